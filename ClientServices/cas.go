@@ -0,0 +1,65 @@
+package clientservices
+
+import (
+	"encoding/json"
+	"errors"
+	msg "kv-store/Messages"
+	node "kv-store/Node"
+	paxos "kv-store/SystemServices/Paxos"
+	"net/http"
+)
+
+// casPath -> endpoint for single key compare-and-set
+const casPath = "cas"
+
+// casHandler -> atomically update a key when the condition holds for its current
+// value, coordinated by this node among the replicas of the key's shard. Responds
+// 200 with whether the update was applied and the current value, and 503 when no
+// round completed before the write deadline.
+func (h *handler) casHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req msg.CompareAndSet
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Key == "" {
+		http.Error(w, "Key can not be empty", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.CompareAndSet(req, h.WriteDeadline())
+	switch {
+	case errors.Is(err, node.ErrInvalidUpdate):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, paxos.ErrTimeout):
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case errors.Is(err, paxos.ErrOutcomeUnknown):
+		// the update may have been applied, retrying it blindly could apply it twice
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	output, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.Write(output)
+}
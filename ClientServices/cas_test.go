@@ -0,0 +1,66 @@
+package clientservices
+
+import (
+	"encoding/json"
+	msg "kv-store/Messages"
+	node "kv-store/Node"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompareAndSet(t *testing.T) {
+	view := []string{"127.0.0.1:13801", "127.0.0.1:13802", "127.0.0.1:13803", "127.0.0.1:13804"}
+	handlers := newTestHandlers(t, node.Config{View: view, ReplFactor: 2})
+
+	increment := `{"Key": "counter", "If": {"Op": "<", "Value": "2"}, "Add": 1}`
+	scenarios := []struct {
+		method  string
+		body    string
+		expect  int
+		applied bool
+		value   string
+	}{
+		{method: http.MethodPost, body: `{"Key": "counter", "If": {"Op": "missing"}, "Value": "0"}`, expect: http.StatusOK, applied: true, value: "0"},
+		{method: http.MethodPost, body: increment, expect: http.StatusOK, applied: true, value: "1"},
+		{method: http.MethodPost, body: increment, expect: http.StatusOK, applied: true, value: "2"},
+		{method: http.MethodPost, body: increment, expect: http.StatusOK, applied: false, value: "2"},
+		{method: http.MethodPost, body: `{"Key": "counter", "If": {"Op": "missing"}, "Value": "0"}`, expect: http.StatusOK, applied: false, value: "2"},
+		{method: http.MethodPost, body: `{"Key": "counter", "If": {"Op": "like"}}`, expect: http.StatusBadRequest},
+		{method: http.MethodPost, body: `{"If": {"Op": "exists"}}`, expect: http.StatusBadRequest},
+		{method: http.MethodGet, expect: http.StatusMethodNotAllowed},
+	}
+
+	// every node coordinates a round, whether or not it holds the key
+	for i, s := range scenarios {
+		h := handlers[i%len(handlers)]
+		w := httptest.NewRecorder()
+		h.casHandler(w, httptest.NewRequest(s.method, "/kv-store/cas", strings.NewReader(s.body)))
+
+		if w.Code != s.expect {
+			t.Fatalf("Scenario %d: expected %d, got %d: %s", i, s.expect, w.Code, w.Body.String())
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+
+		var result msg.CASResult
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatalf("Scenario %d: bad response: %v", i, err)
+		}
+		if result.Applied != s.applied || result.Value != s.value || !result.Exists {
+			t.Errorf("Scenario %d: expected applied %v with %q, got %+v", i, s.applied, s.value, result)
+		}
+	}
+
+	// the decided value is stored by the replicas and seen by plain reads
+	w := httptest.NewRecorder()
+	handlers[0].keyHandler(w, httptest.NewRequest(http.MethodGet, "/kv-store/key/counter", nil))
+
+	var v msg.Value
+	json.NewDecoder(w.Body).Decode(&v)
+	if w.Code != http.StatusOK || v.Value != "2" {
+		t.Errorf("Expected a read of the counter to return 2, got %d %q", w.Code, v.Value)
+	}
+}
@@ -2,11 +2,17 @@ package clientservices
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	msg "kv-store/Messages"
 	node "kv-store/Node"
+	consensus "kv-store/SystemServices/Consensus"
+	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"strings"
+	"time"
 )
 
 /*
@@ -16,6 +22,34 @@ import (
 const (
 	keyPath   = "key"
 	statePath = "snapshot"
+	statsPath = "stats"
+
+	// partialParam -> query parameter allowing a read to return with fewer
+	// replicas than the quorum once its deadline has passed
+	partialParam = "partial"
+
+	// consistency a request asks for, either a level of ONE, QUORUM or ALL or an
+	// explicit count given as r for reads and w for writes
+	consistencyParam  = "consistency"
+	consistencyHeader = "X-Consistency"
+	readParam         = "r"
+	readHeader        = "X-Read-Replicas"
+	writeParam        = "w"
+	writeHeader       = "X-Write-Replicas"
+
+	// achievedHeader -> the consistency level the request reached
+	achievedHeader = "X-Consistency-Achieved"
+
+	// answeredHeader -> the replicas that answered out of those required
+	answeredHeader = "X-Replicas-Answered"
+
+	// causalHeader -> opaque causal context token, returned with every response and
+	// sent back by clients on their next request
+	causalHeader = "X-Causal-Context"
+
+	// forwardedHeader -> names the node that forwarded a request waiting on its
+	// causal context, a request is forwarded at most once
+	forwardedHeader = "X-Causal-Forwarded-By"
 )
 
 // Create a handler type to store the reference to a node
@@ -28,9 +62,25 @@ func (h *handler) stateHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Node id: {%s}\n", h.ID)
 	fmt.Fprintf(w, "Node status: running\n")
 	fmt.Fprintf(w, "shards: {%v}\n", h.ShardGroups)
+	fmt.Fprintf(w, "stats:\n")
+	for _, name := range h.Stats.Names() {
+		fmt.Fprintf(w, "  %s: %d\n", name, h.Stats.Get(name))
+	}
 	fmt.Fprintf(w, "Database state:\n")
 }
 
+// statsHandler -> return the node counters as json
+func (h *handler) statsHandler(w http.ResponseWriter, r *http.Request) {
+	output, err := json.Marshal(h.Stats.Snapshot())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.Write(output)
+}
+
 // handleGet -> Retrieve value from the holding shard and return causaly
 // consistent read
 func (h *handler) handleGet(w http.ResponseWriter, r *http.Request) {
@@ -42,45 +92,226 @@ func (h *handler) handleGet(w http.ResponseWriter, r *http.Request) {
 
 	Key := urlPathSegments[len(urlPathSegments)-1]
 
+	if h.linearizable(r, Key) {
+		h.linearGet(w, r, Key)
+		return
+	}
+
+	required, err := h.consistency(r, readParam, readHeader)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sess, err := h.session(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	known, required := h.sessionReplicas(sess, Key, required)
+
 	// start causal event comparison
-	eventID := h.NewEventStream()
+	eventID := h.NewEventStreamFor(required)
 	thisMsg := msg.Msg{
-		SrcAddr: h.IP,
-		Payload: strings.NewReader(Key),
+		SrcAddr: h.ID,
+		Payload: []byte(Key),
 		ID:      eventID,
 		Action:  "get",
 	}
 
-	// Request this key from each replica in the correct shard
-	ourShard := h.KeyOp(thisMsg)
+	// Request this key from each replica in the correct shard, they have as long to
+	// answer as we wait for them
+	deadline := h.ReadDeadline()
+	ourShard := h.KeyOp(thisMsg, deadline)
 
 	// we are the correct shard, consider our key-val entry
 	if ourShard {
 
-		got, _ := h.Get(Key)
-		strEntry := string(got[:])
-		thisMsg.Payload = strings.NewReader(strEntry)
+		got, _ := h.GetWrite(Key)
+		thisMsg.Payload = got.Value
+		thisMsg.Stamp = got.Stamp
 
 		myCpy := h.Encode(thisMsg)
 		h.Deliver(myCpy)
 	}
 
-	result, notFound := h.OrderEvents(eventID) // blocking call
-	if notFound != nil {
-		panic(notFound)
+	answers, err := h.Collect(eventID, deadline) // blocking call
+	result := h.Latest(answers)
+
+	// bring replicas that answered with an older value up to date
+	if stale := h.Stale(answers, result); len(stale) > 0 {
+		go h.ReadRepair(Key, result, stale)
+	}
+
+	answered := required
+	var quorum *consensus.QuorumError
+	if errors.As(err, &quorum) {
+		h.Stats.Inc("read_quorum_timeouts")
+
+		// answer with the best read we have only if the client will accept it
+		if quorum.Answered == 0 || r.URL.Query().Get(partialParam) != "true" {
+			writeQuorumFailure(w, quorum)
+			return
+		}
+		answered = quorum.Answered
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// within a session only replicas holding the latest value it has seen may answer
+	if known != nil {
+		answers = answeredBy(answers, known)
+		if len(answers) == 0 {
+			h.Stats.Inc("session_unavailable")
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "no replica holding the session's latest value answered in time", http.StatusServiceUnavailable)
+			return
+		}
+		result = h.Latest(answers)
+	}
+	if sess != nil {
+		sess.record(Key, h.holding(answers, result))
+	}
+
+	output, err := json.Marshal(msg.Value{Value: result.PayloadToStr()})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeAchieved(w, answered, required)
+	h.writeContext(w)
+	writeSession(w, sess)
+	w.Header().Set("content-type", "application/json")
+	w.Write(output)
+}
+
+// answeredBy -> the answers sent by the given replicas
+func answeredBy(answers []msg.Msg, replicas []string) []msg.Msg {
+	var kept []msg.Msg
+	for _, answer := range answers {
+		for _, replica := range replicas {
+			if answer.SrcAddr == replica {
+				kept = append(kept, answer)
+				break
+			}
+		}
+	}
+	return kept
+}
+
+// holding -> the replicas that answered with the value of the result
+func (h *handler) holding(answers []msg.Msg, result msg.Msg) []string {
+	var replicas []string
+	for _, answer := range answers {
+		if h.IdenticalValue(answer.Payload, result.Payload) {
+			replicas = append(replicas, answer.SrcAddr)
+		}
+	}
+	return replicas
+}
+
+// consistency -> number of replica answers the request needs. An explicit count in
+// the query parameter or header takes precedence over the level named by the
+// consistency parameter or header. The quorum is used when neither is given.
+func (h *handler) consistency(r *http.Request, param, header string) (int, error) {
+	level := r.URL.Query().Get(param)
+	if level == "" {
+		level = r.Header.Get(header)
+	}
+	if level == "" {
+		level = r.URL.Query().Get(consistencyParam)
+	}
+	if level == "" {
+		level = r.Header.Get(consistencyHeader)
+	}
+	if level == "" {
+		return h.Quorum(), nil
+	}
+
+	return h.Required(level)
+}
+
+// causal -> hold the request until our state covers the causal context sent by the
+// client. If it is still not covered once the wait is over the request is forwarded
+// to the node we are furthest behind. Returns false when the request has already
+// been answered.
+func (h *handler) causal(w http.ResponseWriter, r *http.Request) bool {
+	token := r.Header.Get(causalHeader)
+	if token == "" {
+		return true
+	}
+
+	context, err := consensus.DecodeToken(token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	if h.Covers(context) {
+		return true
+	}
+
+	h.Stats.Inc("causal_waits")
+	if h.WaitCovers(context, h.CausalDeadline()) {
+		return true
+	}
+
+	lagging := h.Lagging(context)
+	if lagging == "" || lagging == h.ID || r.Header.Get(forwardedHeader) != "" {
+		h.Stats.Inc("causal_unavailable")
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "node state does not cover the causal context", http.StatusServiceUnavailable)
+		return false
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
 	}
 
-	output, err := json.Marshal(result.Payload)
+	h.Stats.Inc("causal_forwards")
+	r.Header.Set(forwardedHeader, h.ID)
+	httputil.NewSingleHostReverseProxy(&url.URL{Scheme: scheme, Host: lagging}).ServeHTTP(w, r)
+	return false
+}
+
+// writeContext -> hand the client the causal context of our state
+func (h *handler) writeContext(w http.ResponseWriter) {
+	w.Header().Set(causalHeader, consensus.EncodeToken(h.Clock()))
+}
+
+// writeAchieved -> report the consistency level a request actually reached
+func (h *handler) writeAchieved(w http.ResponseWriter, answered, required int) {
+	w.Header().Set(achievedHeader, h.Achieved(answered))
+	w.Header().Set(answeredHeader, fmt.Sprintf("%d/%d", answered, required))
+}
+
+// writeQuorumFailure -> tell the client how many replicas answered a read that
+// missed its deadline
+func writeQuorumFailure(w http.ResponseWriter, quorum *consensus.QuorumError) {
+	output, err := json.Marshal(msg.QuorumFailure{
+		Error:    quorum.Error(),
+		Answered: quorum.Answered,
+		Required: quorum.Required,
+		Replicas: quorum.Replicas,
+	})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("content-type", "application/json")
+	w.Header().Set("Retry-After", "1")
+	w.WriteHeader(http.StatusServiceUnavailable)
 	w.Write(output)
 }
 
-// hadlePut ->
+// hadlePut -> store the entry on each replica of its shard and wait for the number
+// of replicas required by the write consistency level to acknowledge it. Responds
+// 201 when the key is new, 200 when it was updated and 503 when too few replicas
+// acknowledged the write before its deadline.
 func (h *handler) handlePut(w http.ResponseWriter, r *http.Request) {
 	// cast the request
 	var newEntry msg.Entry
@@ -91,25 +322,102 @@ func (h *handler) handlePut(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if newEntry.Key == "" {
+		http.Error(w, "Key can not be empty", http.StatusBadRequest)
+		return
+	}
+
+	if h.linearizable(r, newEntry.Key) {
+		h.linearPut(w, r, newEntry)
+		return
+	}
+
+	required, err := h.consistency(r, writeParam, writeHeader)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sess, err := h.session(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// replicas acknowledge the write into the event stream, every replica stores
+	// it with the same timestamp
 	thisMsg := msg.Msg{
-		SrcAddr: h.IP,
-		Payload: strings.NewReader(newEntry.Key + ":" + newEntry.Value),
-		ID:      "",
+		SrcAddr: h.ID,
+		Payload: []byte(newEntry.Key + ":" + newEntry.Value),
+		ID:      h.NewEventStreamFor(required),
 		Action:  "put",
+		Stamp:   h.Now().String(),
 	}
 
-	storeLocal := h.KeyOp(thisMsg)
+	deadline := h.WriteDeadline()
+	sent, storeLocal := h.Route(thisMsg, deadline)
 
 	// put key-val in our database
 	if storeLocal {
-		h.Put(newEntry.Key, newEntry.Value)
+		ack, err := h.StoreWrite(newEntry.Key, newEntry.Value, thisMsg.Stamp, sent.Deps)
+		if err != nil {
+			h.Collect(thisMsg.ID, time.Now()) // release the stream
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		thisMsg.Payload = ack
+		h.Deliver(h.Encode(thisMsg))
+	}
+
+	acks, err := h.Collect(thisMsg.ID, deadline) // blocking call
+
+	var quorum *consensus.QuorumError
+	if errors.As(err, &quorum) {
+		h.Stats.Inc("write_quorum_timeouts")
+		writeQuorumFailure(w, quorum)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+
+	result := msg.WriteResult{Replicas: make([]string, len(acks)), Required: required}
+	status := http.StatusOK
+	for i, ack := range acks {
+		result.Replicas[i] = ack.SrcAddr
+		if ack.PayloadToStr() == node.AckCreated {
+			status = http.StatusCreated
+		}
+	}
+
+	output, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// later reads in the session must reach a replica holding this write
+	if sess != nil {
+		sess.record(newEntry.Key, result.Replicas)
+	}
+
+	h.writeAchieved(w, required, required)
+	h.writeContext(w)
+	writeSession(w, sess)
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	w.Write(output)
 }
 
 // Handle request according to request method
 func (h *handler) keyHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
+	if !h.causal(w, r) {
+		return
+	}
+
 	switch r.Method {
 	case http.MethodPost:
 		h.handlePut(w, r)
@@ -126,6 +434,24 @@ func (h *handler) keyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// rateLimit -> reject clients that have used up their request rate with a 429
+func (h *handler) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+
+		if !h.AllowClient(ip) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 // SetupRoutes -> register the api endpoints
 // This function is given a node reference in order to access its fields
 func SetupRoutes(apiBasePath string, node *node.Node) {
@@ -133,12 +459,28 @@ func SetupRoutes(apiBasePath string, node *node.Node) {
 	myHandlerType.Node = *node
 
 	sHandler := http.HandlerFunc(myHandlerType.stateHandler)
-	kHandler := http.HandlerFunc(myHandlerType.keyHandler)
+	kHandler := myHandlerType.rateLimit(http.HandlerFunc(myHandlerType.keyHandler))
+	statsHandler := http.HandlerFunc(myHandlerType.statsHandler)
+	casHandler := myHandlerType.rateLimit(http.HandlerFunc(myHandlerType.casHandler))
+	txnHandler := myHandlerType.rateLimit(http.HandlerFunc(myHandlerType.txnHandler))
+	multiGetHandler := myHandlerType.rateLimit(http.HandlerFunc(myHandlerType.multiGetHandler))
 
 	// API State endpoint
 	http.Handle(fmt.Sprintf("%s/%s", apiBasePath, statePath), sHandler)
 
+	// API stats endpoint
+	http.Handle(fmt.Sprintf("%s/%s", apiBasePath, statsPath), statsHandler)
+
 	// API key endpoint
 	http.Handle(fmt.Sprintf("%s/%s", apiBasePath, keyPath), kHandler)
 	http.Handle(fmt.Sprintf("%s/%s/", apiBasePath, keyPath), kHandler)
+
+	// API compare-and-set endpoint
+	http.Handle(fmt.Sprintf("%s/%s", apiBasePath, casPath), casHandler)
+
+	// API transaction endpoint
+	http.Handle(fmt.Sprintf("%s/%s", apiBasePath, txnPath), txnHandler)
+
+	// API multi-get endpoint
+	http.Handle(fmt.Sprintf("%s/%s", apiBasePath, multiGetPath), multiGetHandler)
 }
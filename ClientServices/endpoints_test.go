@@ -0,0 +1,328 @@
+package clientservices
+
+import (
+	"encoding/json"
+	msg "kv-store/Messages"
+	node "kv-store/Node"
+	consensus "kv-store/SystemServices/Consensus"
+	netutil "kv-store/SystemServices/Network"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestHandler -> handler around a single node cluster on an in memory network
+func newTestHandler(t *testing.T, conf node.Config) *handler {
+	conf.Addr = "127.0.0.1:13801"
+	if conf.View == nil {
+		conf.View = []string{conf.Addr}
+		conf.ReplFactor = 1
+	}
+
+	n, err := node.NewNodeFromConfig(conf, netutil.NewMemNetwork().Join(conf.Addr, 16))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	t.Cleanup(func() { n.Shutdown() })
+
+	h := new(handler)
+	h.Node = *n
+	return h
+}
+
+// newTestHandlers -> handlers around every node in the view, running on a shared
+// in memory network
+func newTestHandlers(t *testing.T, base node.Config) []*handler {
+	mem := netutil.NewMemNetwork()
+	handlers := make([]*handler, len(base.View))
+
+	for i, addr := range base.View {
+		conf := base
+		conf.Addr = addr
+
+		n, err := node.NewNodeFromConfig(conf, mem.Join(addr, 64))
+		if err != nil {
+			t.Fatalf("Failed to create node %v: %v", addr, err)
+		}
+		n.RunBackendSystem()
+		t.Cleanup(func() { n.Shutdown() })
+
+		handlers[i] = new(handler)
+		handlers[i].Node = *n
+	}
+
+	return handlers
+}
+
+func TestRateLimit(t *testing.T) {
+	h := newTestHandler(t, node.Config{ClientRate: 1, ClientBurst: 2})
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	limited := h.rateLimit(ok)
+
+	scenarios := []struct {
+		remote string
+		expect int
+	}{
+		{remote: "10.0.0.1:5000", expect: http.StatusOK},
+		{remote: "10.0.0.1:5001", expect: http.StatusOK},
+		{remote: "10.0.0.1:5002", expect: http.StatusTooManyRequests},
+		{remote: "10.0.0.2:5000", expect: http.StatusOK},
+	}
+
+	for _, s := range scenarios {
+		r := httptest.NewRequest(http.MethodGet, "/kv-store/key/key0", nil)
+		r.RemoteAddr = s.remote
+		w := httptest.NewRecorder()
+
+		limited.ServeHTTP(w, r)
+		if w.Code != s.expect {
+			t.Errorf("Request from %v: expected %d, got %d", s.remote, s.expect, w.Code)
+		}
+	}
+
+	if got := h.Stats.Get("dropped_rate_limited_client"); got != 1 {
+		t.Errorf("Expected 1 rate limited request in stats, got %d", got)
+	}
+}
+
+func TestGetMissedQuorum(t *testing.T) {
+	// the second replica is never started, so only the local replica answers
+	conf := node.Config{
+		View:         []string{"127.0.0.1:13801", "127.0.0.1:13802"},
+		ReplFactor:   2,
+		ReadTimeout:  50 * time.Millisecond,
+		WriteTimeout: 50 * time.Millisecond,
+	}
+	h := newTestHandler(t, conf)
+	h.Put("key0", "value0")
+
+	scenarios := []struct {
+		path     string
+		expect   int
+		value    string
+		answered string
+	}{
+		{path: "/kv-store/key/key0", expect: http.StatusServiceUnavailable},
+		{path: "/kv-store/key/key0?partial=true", expect: http.StatusOK, value: "value0", answered: "1/2"},
+	}
+
+	for _, s := range scenarios {
+		w := httptest.NewRecorder()
+		h.keyHandler(w, httptest.NewRequest(http.MethodGet, s.path, nil))
+
+		if w.Code != s.expect {
+			t.Fatalf("GET %v: expected %d, got %d", s.path, s.expect, w.Code)
+		}
+
+		if s.expect == http.StatusServiceUnavailable {
+			var failure msg.QuorumFailure
+			if err := json.NewDecoder(w.Body).Decode(&failure); err != nil {
+				t.Fatalf("GET %v: bad body: %v", s.path, err)
+			}
+			if failure.Answered != 1 || failure.Required != 2 {
+				t.Errorf("GET %v: expected 1 of 2 answers, got %+v", s.path, failure)
+			}
+			continue
+		}
+
+		var value msg.Value
+		if err := json.NewDecoder(w.Body).Decode(&value); err != nil || value.Value != s.value {
+			t.Errorf("GET %v: expected %q, got %q (%v)", s.path, s.value, value.Value, err)
+		}
+		if got := w.Header().Get(answeredHeader); got != s.answered {
+			t.Errorf("GET %v: expected %v replicas answered, got %q", s.path, s.answered, got)
+		}
+	}
+}
+
+func TestConsistencyLevels(t *testing.T) {
+	// the second replica is never started, so only the local replica answers
+	conf := node.Config{
+		View:         []string{"127.0.0.1:13801", "127.0.0.1:13802"},
+		ReplFactor:   2,
+		ReadTimeout:  50 * time.Millisecond,
+		WriteTimeout: 50 * time.Millisecond,
+	}
+	h := newTestHandler(t, conf)
+	h.Put("key0", "value0")
+
+	scenarios := []struct {
+		method   string
+		path     string
+		header   map[string]string
+		expect   int
+		achieved string
+		answered string
+	}{
+		{method: http.MethodGet, path: "/kv-store/key/key0?consistency=one", expect: http.StatusOK, achieved: "ONE", answered: "1/1"},
+		{method: http.MethodGet, path: "/kv-store/key/key0?r=1", expect: http.StatusOK, achieved: "ONE", answered: "1/1"},
+		{method: http.MethodGet, path: "/kv-store/key/key0", header: map[string]string{"X-Consistency": "ONE"}, expect: http.StatusOK, achieved: "ONE", answered: "1/1"},
+		{method: http.MethodGet, path: "/kv-store/key/key0?consistency=ALL", header: map[string]string{"X-Read-Replicas": "1"}, expect: http.StatusOK, achieved: "ONE", answered: "1/1"},
+		{method: http.MethodGet, path: "/kv-store/key/key0", header: map[string]string{"X-Consistency": "ALL"}, expect: http.StatusServiceUnavailable},
+		{method: http.MethodGet, path: "/kv-store/key/key0?r=3", expect: http.StatusBadRequest},
+		{method: http.MethodPut, path: "/kv-store/key?w=1", expect: http.StatusOK, achieved: "ONE", answered: "1/1"},
+		{method: http.MethodPut, path: "/kv-store/key", header: map[string]string{"X-Write-Replicas": "ONE"}, expect: http.StatusOK, achieved: "ONE", answered: "1/1"},
+		{method: http.MethodPut, path: "/kv-store/key?consistency=QUORUM", expect: http.StatusServiceUnavailable},
+		{method: http.MethodPut, path: "/kv-store/key?w=many", expect: http.StatusBadRequest},
+	}
+
+	for _, s := range scenarios {
+		r := httptest.NewRequest(s.method, s.path, strings.NewReader(`{"Key": "key0", "Value": "value1"}`))
+		for name, val := range s.header {
+			r.Header.Set(name, val)
+		}
+		w := httptest.NewRecorder()
+
+		h.keyHandler(w, r)
+		if w.Code != s.expect {
+			t.Errorf("%v %v: expected %d, got %d", s.method, s.path, s.expect, w.Code)
+			continue
+		}
+		if got := w.Header().Get(achievedHeader); got != s.achieved {
+			t.Errorf("%v %v: expected level %q achieved, got %q", s.method, s.path, s.achieved, got)
+		}
+		if got := w.Header().Get(answeredHeader); got != s.answered {
+			t.Errorf("%v %v: expected %q replicas answered, got %q", s.method, s.path, s.answered, got)
+		}
+	}
+}
+
+func TestPutAcknowledged(t *testing.T) {
+	scenarios := []struct {
+		view     []string
+		key      string
+		expect   int
+		replicas []string
+	}{
+		{view: []string{"127.0.0.1:13801"}, key: "key0", expect: http.StatusCreated, replicas: []string{"127.0.0.1:13801"}},
+		{view: []string{"127.0.0.1:13801"}, key: "key1", expect: http.StatusOK, replicas: []string{"127.0.0.1:13801"}},
+		// the second replica is never started
+		{view: []string{"127.0.0.1:13801", "127.0.0.1:13802"}, key: "key0", expect: http.StatusServiceUnavailable, replicas: []string{"127.0.0.1:13801"}},
+	}
+
+	for _, s := range scenarios {
+		h := newTestHandler(t, node.Config{View: s.view, ReplFactor: len(s.view), WriteTimeout: 50 * time.Millisecond})
+		h.Put("key1", "value0")
+
+		w := httptest.NewRecorder()
+		body := strings.NewReader(`{"Key": "` + s.key + `", "Value": "value1"}`)
+		h.keyHandler(w, httptest.NewRequest(http.MethodPut, "/kv-store/key", body))
+
+		if w.Code != s.expect {
+			t.Fatalf("PUT %v to %v: expected %d, got %d", s.key, s.view, s.expect, w.Code)
+		}
+
+		var replicas []string
+		if s.expect == http.StatusServiceUnavailable {
+			var failure msg.QuorumFailure
+			json.NewDecoder(w.Body).Decode(&failure)
+			replicas = failure.Replicas
+		} else {
+			var result msg.WriteResult
+			json.NewDecoder(w.Body).Decode(&result)
+			replicas = result.Replicas
+		}
+
+		if !reflect.DeepEqual(replicas, s.replicas) {
+			t.Errorf("PUT %v to %v: expected acks from %v, got %v", s.key, s.view, s.replicas, replicas)
+		}
+		if got, _ := h.Get(s.key); string(got) != "value1" {
+			t.Errorf("PUT %v to %v: local replica not written, got %q", s.key, s.view, got)
+		}
+	}
+}
+
+func TestCausalContext(t *testing.T) {
+	h := newTestHandler(t, node.Config{CausalWait: 20 * time.Millisecond})
+
+	w := httptest.NewRecorder()
+	h.keyHandler(w, httptest.NewRequest(http.MethodPut, "/kv-store/key", strings.NewReader(`{"Key": "key0", "Value": "value0"}`)))
+	token := w.Header().Get(causalHeader)
+
+	context, err := consensus.DecodeToken(token)
+	if err != nil || context[h.ID] != 1 {
+		t.Fatalf("Expected the put to return a context including it, got %v (%v)", context, err)
+	}
+
+	scenarios := []struct {
+		token     string
+		forwarded string
+		expect    int
+	}{
+		{expect: http.StatusOK},
+		{token: token, expect: http.StatusOK},
+		// a context from a node outside the view can not be waited on
+		{token: consensus.EncodeToken(map[string]int{"127.0.0.1:13809": 4}), expect: http.StatusOK},
+		// only this node could cover a context ahead of its own writes
+		{token: consensus.EncodeToken(map[string]int{h.ID: 5}), expect: http.StatusServiceUnavailable},
+		{token: consensus.EncodeToken(map[string]int{h.ID: 5}), forwarded: "127.0.0.1:13802", expect: http.StatusServiceUnavailable},
+		{token: "garbage!", expect: http.StatusBadRequest},
+	}
+
+	for _, s := range scenarios {
+		r := httptest.NewRequest(http.MethodGet, "/kv-store/key/key0", nil)
+		if s.token != "" {
+			r.Header.Set(causalHeader, s.token)
+		}
+		if s.forwarded != "" {
+			r.Header.Set(forwardedHeader, s.forwarded)
+		}
+		w := httptest.NewRecorder()
+
+		h.keyHandler(w, r)
+		if w.Code != s.expect {
+			t.Errorf("GET with token %q: expected %d, got %d", s.token, s.expect, w.Code)
+		}
+		if s.expect == http.StatusOK && w.Header().Get(causalHeader) == "" {
+			t.Errorf("GET with token %q: no causal context returned", s.token)
+		}
+	}
+
+	if got := h.Stats.Get("causal_unavailable"); got != 2 {
+		t.Errorf("Expected 2 unavailable requests in stats, got %d", got)
+	}
+}
+
+func TestCausalForward(t *testing.T) {
+	// node b serves its api on a real listener so node a can forward to it
+	srv := httptest.NewUnstartedServer(nil)
+	addrA, addrB := "127.0.0.1:13801", srv.Listener.Addr().String()
+	view := []string{addrA, addrB}
+
+	handlers := newTestHandlers(t, node.Config{View: view, ReplFactor: 2, CausalWait: 20 * time.Millisecond})
+	a, b := handlers[0], handlers[1]
+
+	srv.Config.Handler = http.HandlerFunc(b.keyHandler)
+	srv.Start()
+	defer srv.Close()
+
+	a.Put("key0", "value0")
+	b.Put("key0", "value0")
+
+	// b has coordinated a write that a has not heard of
+	b.Increment(b.ID)
+	token := consensus.EncodeToken(b.Clock())
+
+	r := httptest.NewRequest(http.MethodGet, "/kv-store/key/key0", nil)
+	r.Header.Set(causalHeader, token)
+	w := httptest.NewRecorder()
+	a.keyHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the forwarded read to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var value msg.Value
+	if err := json.NewDecoder(w.Body).Decode(&value); err != nil || value.Value != "value0" {
+		t.Errorf("Expected %q from the forwarded read, got %q (%v)", "value0", value.Value, err)
+	}
+	if got, _ := consensus.DecodeToken(w.Header().Get(causalHeader)); got[b.ID] < 1 {
+		t.Errorf("Forwarded read returned a context behind the client's, got %v", got)
+	}
+	if got := a.Stats.Get("causal_forwards"); got != 1 {
+		t.Errorf("Expected 1 forwarded request in stats, got %d", got)
+	}
+}
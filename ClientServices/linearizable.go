@@ -0,0 +1,127 @@
+package clientservices
+
+import (
+	"encoding/json"
+	"errors"
+	msg "kv-store/Messages"
+	node "kv-store/Node"
+	consensus "kv-store/SystemServices/Consensus"
+	raft "kv-store/SystemServices/Raft"
+	"net/http"
+	"strings"
+)
+
+// leaderHeader -> names the leader of the raft group serving a linearizable request
+const leaderHeader = "X-Raft-Leader"
+
+// linearizable -> whether the request must be served by the raft group of the key's
+// shard, either because the key is in a linearizable namespace or because the
+// request asks for it
+func (h *handler) linearizable(r *http.Request, key string) bool {
+	level := r.URL.Query().Get(consistencyParam)
+	if level == "" {
+		level = r.Header.Get(consistencyHeader)
+	}
+	return h.Linearizable(key) || strings.EqualFold(strings.TrimSpace(level), consensus.LevelLinearizable)
+}
+
+// leading -> whether we lead the raft group of the key's shard. Otherwise the client
+// is redirected to the leader, or asked to retry while one is elected. Returns false
+// when the request has already been answered.
+func (h *handler) leading(w http.ResponseWriter, r *http.Request, key string) bool {
+	leader, err := h.RaftLeader(key, h.RPCDeadline())
+
+	switch {
+	case errors.Is(err, node.ErrLinearizableDisabled):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case err != nil:
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case leader != h.ID:
+		h.redirect(w, r, leader)
+	default:
+		return true
+	}
+	return false
+}
+
+// redirect -> send the client to the leader of the raft group
+func (h *handler) redirect(w http.ResponseWriter, r *http.Request, leader string) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	h.Stats.Inc("raft_redirects")
+	w.Header().Set(leaderHeader, leader)
+	http.Redirect(w, r, scheme+"://"+leader+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+}
+
+// linearFailure -> answer a linearizable request the raft group did not serve
+func (h *handler) linearFailure(w http.ResponseWriter, r *http.Request, err error) {
+	var notLeader *raft.NotLeaderError
+
+	switch {
+	case errors.As(err, &notLeader) && notLeader.Leader != "":
+		h.redirect(w, r, notLeader.Leader)
+	case errors.Is(err, raft.ErrNotLeader), errors.Is(err, raft.ErrTimeout):
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// linearGet -> read the key from the leader of its raft group
+func (h *handler) linearGet(w http.ResponseWriter, r *http.Request, key string) {
+	if !h.leading(w, r, key) {
+		return
+	}
+
+	got, err := h.LinearGet(key, h.ReadDeadline())
+	if err != nil {
+		h.linearFailure(w, r, err)
+		return
+	}
+
+	output, err := json.Marshal(msg.Value{Value: string(got)})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(achievedHeader, consensus.LevelLinearizable)
+	w.Header().Set("content-type", "application/json")
+	w.Write(output)
+}
+
+// linearPut -> commit the entry through the leader of its raft group. Responds 201
+// when the key is new and 200 when it was updated, listing the leader as the replica
+// that acknowledged the write.
+func (h *handler) linearPut(w http.ResponseWriter, r *http.Request, entry msg.Entry) {
+	if !h.leading(w, r, entry.Key) {
+		return
+	}
+
+	ack, err := h.LinearPut(entry.Key, entry.Value, h.WriteDeadline())
+	if err != nil {
+		h.linearFailure(w, r, err)
+		return
+	}
+
+	output, err := json.Marshal(msg.WriteResult{Replicas: []string{h.ID}, Required: h.Quorum()})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	if string(ack) == node.AckCreated {
+		status = http.StatusCreated
+	}
+
+	w.Header().Set(achievedHeader, consensus.LevelLinearizable)
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	w.Write(output)
+}
@@ -0,0 +1,155 @@
+package clientservices
+
+import (
+	"encoding/json"
+	msg "kv-store/Messages"
+	node "kv-store/Node"
+	raft "kv-store/SystemServices/Raft"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLinearizable(t *testing.T) {
+	view := []string{"127.0.0.1:13801", "127.0.0.1:13802", "127.0.0.1:13803"}
+	handlers := newTestHandlers(t, node.Config{
+		View:       view,
+		ReplFactor: 3,
+		Raft:       true,
+		// the race detector slows heartbeats down by an order of magnitude, a
+		// short election timeout keeps the group electing new leaders
+		RaftElectionTimeout: 2 * time.Second,
+		RaftHeartbeat:       100 * time.Millisecond,
+		Linearizable:        []string{"config"},
+		WriteTimeout:        5 * time.Second,
+	})
+
+	byID := make(map[string]*handler)
+	for _, h := range handlers {
+		byID[h.ID] = h
+	}
+
+	serve := func(h *handler, method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.keyHandler(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	// wait for the group to agree on a leader
+	agreed := false
+	for deadline := time.Now().Add(30 * time.Second); !agreed && time.Now().Before(deadline); {
+		leaders := make(map[string]bool)
+		for _, h := range handlers {
+			leader, _ := h.RaftLeader("config/leader", h.RPCDeadline())
+			leaders[leader] = true
+		}
+		agreed = len(leaders) == 1 && !leaders[""]
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !agreed {
+		t.Fatalf("Raft group did not agree on a leader")
+	}
+
+	// linear -> send the request to the cluster, following redirects to the leader
+	// and retrying while one is elected. A write that timed out may still commit
+	// and is not retried.
+	linear := func(method, path, body string) *httptest.ResponseRecorder {
+		h := handlers[0]
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			w := serve(h, method, path, body)
+			switch {
+			case time.Now().After(deadline):
+				return w
+			case w.Code == http.StatusTemporaryRedirect:
+				leader := w.Header().Get(leaderHeader)
+				if w.Header().Get("Location") != "http://"+leader+path || byID[leader] == nil {
+					t.Fatalf("Redirected to an unknown leader %q, location %q", leader, w.Header().Get("Location"))
+				}
+				h = byID[leader]
+			case w.Code == http.StatusServiceUnavailable && !strings.Contains(w.Body.String(), raft.ErrTimeout.Error()):
+				time.Sleep(50 * time.Millisecond)
+			default:
+				return w
+			}
+		}
+	}
+
+	scenarios := []struct {
+		method string
+		path   string
+		body   string
+		expect int
+		value  string
+	}{
+		{method: http.MethodPut, path: "/kv-store/key", body: `{"Key": "config/leader", "Value": "n1"}`, expect: http.StatusCreated},
+		{method: http.MethodPut, path: "/kv-store/key", body: `{"Key": "config/leader", "Value": "n2"}`, expect: http.StatusOK},
+		{method: http.MethodGet, path: "/kv-store/key/config/leader", expect: http.StatusOK, value: "n2"},
+		// keys outside the namespace may ask for it on each request
+		{method: http.MethodPut, path: "/kv-store/key?consistency=linearizable", body: `{"Key": "quota", "Value": "10"}`, expect: http.StatusCreated},
+		{method: http.MethodGet, path: "/kv-store/key/quota?consistency=LINEARIZABLE", expect: http.StatusOK, value: "10"},
+	}
+
+	for i, s := range scenarios {
+		w := linear(s.method, s.path, s.body)
+		if w.Code != s.expect {
+			t.Fatalf("Scenario %d: expected %d, got %d: %s", i, s.expect, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get(achievedHeader); got != "LINEARIZABLE" {
+			t.Errorf("Scenario %d: expected the request to be linearizable, got %q", i, got)
+		}
+
+		if s.value != "" {
+			var v msg.Value
+			json.NewDecoder(w.Body).Decode(&v)
+			if v.Value != s.value {
+				t.Errorf("Scenario %d: expected %q, got %q", i, s.value, v.Value)
+			}
+		}
+	}
+
+	// followers send clients to the leader they know of
+	redirects := 0
+	for _, h := range handlers {
+		w := serve(h, http.MethodGet, "/kv-store/key/config/leader", "")
+		if w.Code != http.StatusTemporaryRedirect {
+			continue
+		}
+		redirects++
+		if got := w.Header().Get(leaderHeader); got == h.ID || byID[got] == nil {
+			t.Errorf("Follower %v redirected to %q", h.ID, got)
+		}
+	}
+	if redirects == 0 {
+		t.Errorf("Expected followers to redirect to the leader")
+	}
+
+	// every replica applies the committed writes
+	for _, h := range handlers {
+		ok := false
+		for deadline := time.Now().Add(5 * time.Second); !ok && time.Now().Before(deadline); {
+			got, _ := h.DB.Get("config/leader")
+			ok = string(got) == "n2"
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !ok {
+			t.Errorf("Replica %v did not apply the committed write", h.ID)
+		}
+	}
+}
+
+func TestLinearizableDisabled(t *testing.T) {
+	h := newTestHandler(t, node.Config{})
+
+	w := httptest.NewRecorder()
+	h.keyHandler(w, httptest.NewRequest(http.MethodGet, "/kv-store/key/key0?consistency=LINEARIZABLE", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without raft, got %d", w.Code)
+	}
+
+	if _, err := node.NewNodeFromConfig(node.Config{Addr: "127.0.0.1:13801", View: []string{"127.0.0.1:13801"}, ReplFactor: 1, Linearizable: []string{"config"}}, nil); err == nil {
+		t.Errorf("Expected linearizable namespaces to require raft")
+	}
+}
@@ -0,0 +1,72 @@
+package clientservices
+
+import (
+	"encoding/json"
+	"errors"
+	msg "kv-store/Messages"
+	node "kv-store/Node"
+	consensus "kv-store/SystemServices/Consensus"
+	"net/http"
+)
+
+// multiGetPath -> endpoint for reading many keys at once
+const multiGetPath = "mget"
+
+// multiGetHandler -> read the keys across the shards holding them, every value
+// returned is consistent with one causal cut, which is handed back as the causal
+// context. Responds 200 with the values, keys that do not exist are marked as such,
+// and 503 when the replicas did not settle on a cut before the read deadline.
+func (h *handler) multiGetHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.causal(w, r) {
+		return
+	}
+
+	var req msg.MultiGet
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the cut covers the causal context of the client, already checked by causal
+	var context map[string]int
+	if token := r.Header.Get(causalHeader); token != "" {
+		context, _ = consensus.DecodeToken(token)
+	}
+
+	snap, cut, err := h.Snapshot(req.Keys, context, h.ReadDeadline())
+	var quorum *consensus.QuorumError
+	switch {
+	case errors.Is(err, node.ErrInvalidSnapshot):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.As(err, &quorum):
+		h.Stats.Inc("read_quorum_timeouts")
+		writeQuorumFailure(w, quorum)
+		return
+	case errors.Is(err, node.ErrNoSnapshot):
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	output, err := json.Marshal(snap)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(causalHeader, consensus.EncodeToken(cut))
+	w.Header().Set("content-type", "application/json")
+	w.Write(output)
+}
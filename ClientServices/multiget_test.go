@@ -0,0 +1,187 @@
+package clientservices
+
+import (
+	"encoding/json"
+	"fmt"
+	msg "kv-store/Messages"
+	node "kv-store/Node"
+	consensus "kv-store/SystemServices/Consensus"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMultiGet(t *testing.T) {
+	view := []string{"127.0.0.1:13801", "127.0.0.1:13802", "127.0.0.1:13803", "127.0.0.1:13804"}
+	handlers := newTestHandlers(t, node.Config{View: view, ReplFactor: 2, ReadTimeout: 200 * time.Millisecond})
+
+	// two keys held by different shards
+	a, b := "", ""
+	for i := 0; b == ""; i++ {
+		key := fmt.Sprintf("key%d", i)
+		switch {
+		case a == "":
+			a = key
+		case handlers[0].GetMatch(key) != handlers[0].GetMatch(a):
+			b = key
+		}
+	}
+
+	w := httptest.NewRecorder()
+	write := fmt.Sprintf(`{"Writes": [{"Key": %q, "Value": "1"}, {"Key": %q, "Value": "2"}]}`, a, b)
+	handlers[0].txnHandler(w, httptest.NewRequest(http.MethodPost, "/kv-store/txn", strings.NewReader(write)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to write the keys: %d %s", w.Code, w.Body.String())
+	}
+
+	// a value of b whose write depends on a write to the shard of a no replica has
+	// applied yet
+	dep := fmt.Sprintf("%s/%d", view[0], handlers[0].GetMatch(a))
+	ahead := map[string]int{dep: 1000}
+	for _, h := range handlers {
+		if h.GetMatch(b) == h.GetShardID(h.ID) {
+			h.DB.PutWrite(b, "3", "", ahead)
+		}
+	}
+
+	tooMany := make([]string, node.MaxSnapshotKeys+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("%q", fmt.Sprintf("key%d", i))
+	}
+
+	scenarios := []struct {
+		method string
+		body   string
+		ahead  bool // every node has applied the writes the value of b depends on
+		expect int
+		values map[string]msg.MultiValue
+	}{
+		{method: http.MethodPost, body: fmt.Sprintf(`{"Keys": [%q, %q]}`, a, b), expect: http.StatusServiceUnavailable},
+		{method: http.MethodPost, body: fmt.Sprintf(`{"Keys": [%q, %q, "missing", %q]}`, a, b, a), ahead: true, expect: http.StatusOK, values: map[string]msg.MultiValue{
+			a:         {Value: "1", Exists: true},
+			b:         {Value: "3", Exists: true},
+			"missing": {},
+		}},
+		{method: http.MethodPost, body: `{"Keys": []}`, expect: http.StatusBadRequest},
+		{method: http.MethodPost, body: `{"Keys": [""]}`, expect: http.StatusBadRequest},
+		{method: http.MethodPost, body: `{"Keys": [` + strings.Join(tooMany, ", ") + `]}`, expect: http.StatusBadRequest},
+		{method: http.MethodPost, body: `{"Keys": [`, expect: http.StatusBadRequest},
+		{method: http.MethodGet, expect: http.StatusMethodNotAllowed},
+	}
+
+	for i, s := range scenarios {
+		if s.ahead {
+			for _, h := range handlers {
+				h.Applied(ahead)
+			}
+		}
+
+		// every node reads the keys, whether or not it holds them
+		for _, h := range handlers {
+			w := httptest.NewRecorder()
+			h.multiGetHandler(w, httptest.NewRequest(s.method, "/kv-store/mget", strings.NewReader(s.body)))
+
+			if w.Code != s.expect {
+				t.Fatalf("Scenario %d: expected %d from %v, got %d: %s", i, s.expect, h.ID, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				continue
+			}
+
+			var snap msg.Snapshot
+			if err := json.NewDecoder(w.Body).Decode(&snap); err != nil {
+				t.Fatalf("Scenario %d: bad response: %v", i, err)
+			}
+			if len(snap.Values) != len(s.values) {
+				t.Errorf("Scenario %d: expected %v from %v, got %v", i, s.values, h.ID, snap.Values)
+			}
+			for key, value := range s.values {
+				if snap.Values[key] != value {
+					t.Errorf("Scenario %d: expected %s=%+v from %v, got %+v", i, key, value, h.ID, snap.Values[key])
+				}
+			}
+
+			// the cut handed back covers the write of every value returned
+			cut, err := consensus.DecodeToken(w.Header().Get(causalHeader))
+			if err != nil || cut[dep] < ahead[dep] {
+				t.Errorf("Scenario %d: expected the cut to cover %v, got %v (%v)", i, ahead, cut, err)
+			}
+		}
+	}
+}
+
+func TestMultiGetMissingWrite(t *testing.T) {
+	view := []string{"127.0.0.1:13801", "127.0.0.1:13802", "127.0.0.1:13803", "127.0.0.1:13804"}
+	handlers := newTestHandlers(t, node.Config{View: view, ReplFactor: 2, ReadTimeout: 200 * time.Millisecond})
+
+	// two keys held by different shards
+	a, b := "", ""
+	for i := 0; b == ""; i++ {
+		key := fmt.Sprintf("key%d", i)
+		switch {
+		case a == "":
+			a = key
+		case handlers[0].GetMatch(key) != handlers[0].GetMatch(a):
+			b = key
+		}
+	}
+
+	// b was written after a write of a that its replicas have not applied. Their
+	// clocks have seen it all the same, as a causal context merged from a client does.
+	write := map[string]int{fmt.Sprintf("%s/%d", view[0], handlers[0].GetMatch(a)): 1}
+	var replicas []*handler
+	for _, h := range handlers {
+		switch h.GetShardID(h.ID) {
+		case h.GetMatch(b):
+			h.StoreWrite(b, "2", "", write)
+		case h.GetMatch(a):
+			h.StoreAt(a, "0", "")
+			h.Merge(map[string]int{view[0]: 1000})
+			replicas = append(replicas, h)
+		}
+	}
+
+	scenarios := []struct {
+		applied int // replicas of a that applied the write
+		expect  int
+		values  map[string]msg.MultiValue
+	}{
+		// the old value of a is never returned along with b
+		{applied: 0, expect: http.StatusServiceUnavailable},
+		{applied: 1, expect: http.StatusOK, values: map[string]msg.MultiValue{
+			a: {Value: "1", Exists: true},
+			b: {Value: "2", Exists: true},
+		}},
+	}
+
+	body := fmt.Sprintf(`{"Keys": [%q, %q]}`, a, b)
+	for i, s := range scenarios {
+		for _, h := range replicas[:s.applied] {
+			h.StoreWrite(a, "1", "", write)
+		}
+
+		for _, h := range handlers {
+			w := httptest.NewRecorder()
+			h.multiGetHandler(w, httptest.NewRequest(http.MethodPost, "/kv-store/mget", strings.NewReader(body)))
+
+			if w.Code != s.expect {
+				t.Fatalf("Scenario %d: expected %d from %v, got %d: %s", i, s.expect, h.ID, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				continue
+			}
+
+			var snap msg.Snapshot
+			if err := json.NewDecoder(w.Body).Decode(&snap); err != nil {
+				t.Fatalf("Scenario %d: bad response: %v", i, err)
+			}
+			for key, value := range s.values {
+				if snap.Values[key] != value {
+					t.Errorf("Scenario %d: expected %s=%+v from %v, got %+v", i, key, value, h.ID, snap.Values[key])
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package clientservices
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+const (
+	// sessionHeader -> opaque session token, clients start a session by sending
+	// newSession and send back the token returned with each response
+	sessionHeader = "X-Session"
+	newSession    = "new"
+
+	// maxSessionKeys -> keys tracked per session, the least recently used key is
+	// forgotten first
+	maxSessionKeys = 128
+)
+
+// errBadSession -> the session token sent by a client could not be decoded
+var errBadSession = errors.New("invalid session token")
+
+// session -> for each key the client has written or read, the replicas known to
+// hold the latest value it has seen. Reads in the session only return answers from
+// those replicas, so they reflect the session's own writes and never go backwards.
+type session struct {
+	Keys []sessionKey `json:"Keys"` // least recently used first
+}
+
+type sessionKey struct {
+	Key      string   `json:"Key"`
+	Replicas []string `json:"Replicas"`
+}
+
+// decodeSession -> the session carried by a client token
+func decodeSession(token string) (*session, error) {
+	sess := new(session)
+	if token == newSession {
+		return sess, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errBadSession
+	}
+	if err := json.Unmarshal(raw, sess); err != nil {
+		return nil, errBadSession
+	}
+	return sess, nil
+}
+
+// encode -> the token handed back to the client
+func (sess *session) encode() string {
+	out, _ := json.Marshal(sess)
+	return base64.RawURLEncoding.EncodeToString(out)
+}
+
+// replicas -> the replicas known to hold the latest value of the key seen by the session
+func (sess *session) replicas(key string) []string {
+	for _, k := range sess.Keys {
+		if k.Key == key {
+			return k.Replicas
+		}
+	}
+	return nil
+}
+
+// record -> remember which replicas hold the value of the key the session has just seen
+func (sess *session) record(key string, replicas []string) {
+	keys := make([]sessionKey, 0, len(sess.Keys)+1)
+	for _, k := range sess.Keys {
+		if k.Key != key {
+			keys = append(keys, k)
+		}
+	}
+
+	keys = append(keys, sessionKey{Key: key, Replicas: replicas})
+	if len(keys) > maxSessionKeys {
+		keys = keys[len(keys)-maxSessionKeys:]
+	}
+	sess.Keys = keys
+}
+
+// session -> the session the request belongs to, nil when it is not part of one
+func (h *handler) session(r *http.Request) (*session, error) {
+	token := r.Header.Get(sessionHeader)
+	if token == "" {
+		return nil, nil
+	}
+	return decodeSession(token)
+}
+
+// sessionReplicas -> the replicas of the key's shard known to hold the latest value
+// the session has seen, along with the number of answers a read needs so at least
+// one of them answers
+func (h *handler) sessionReplicas(sess *session, key string, required int) ([]string, int) {
+	if sess == nil {
+		return nil, required
+	}
+
+	var known []string
+	for _, replica := range sess.replicas(key) {
+		for _, member := range h.ShardGroups[h.GetMatch(key)] {
+			if replica == member {
+				known = append(known, replica)
+				break
+			}
+		}
+	}
+
+	if len(known) == 0 {
+		return nil, required
+	}
+
+	// any set of answers this large overlaps the known replicas
+	if overlap := h.Replicas() - len(known) + 1; overlap > required {
+		required = overlap
+	}
+	return known, required
+}
+
+// writeSession -> hand the client its updated session token
+func writeSession(w http.ResponseWriter, sess *session) {
+	if sess != nil {
+		w.Header().Set(sessionHeader, sess.encode())
+	}
+}
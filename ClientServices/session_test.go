@@ -0,0 +1,146 @@
+package clientservices
+
+import (
+	"encoding/json"
+	"errors"
+	msg "kv-store/Messages"
+	node "kv-store/Node"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSessionToken(t *testing.T) {
+	sess, err := decodeSession(newSession)
+	if err != nil || len(sess.Keys) != 0 {
+		t.Fatalf("Expected an empty session, got %v (%v)", sess, err)
+	}
+
+	sess.record("key0", []string{"127.0.0.1:13801"})
+	sess.record("key1", []string{"127.0.0.1:13802"})
+	sess.record("key0", []string{"127.0.0.1:13803"})
+
+	got, err := decodeSession(sess.encode())
+	if err != nil || !reflect.DeepEqual(got, sess) {
+		t.Fatalf("Session did not round trip, got %v (%v)", got, err)
+	}
+
+	scenarios := []struct {
+		key    string
+		expect []string
+	}{
+		{key: "key0", expect: []string{"127.0.0.1:13803"}},
+		{key: "key1", expect: []string{"127.0.0.1:13802"}},
+		{key: "key2", expect: nil},
+	}
+
+	for _, s := range scenarios {
+		if replicas := got.replicas(s.key); !reflect.DeepEqual(replicas, s.expect) {
+			t.Errorf("Key %v: expected replicas %v, got %v", s.key, s.expect, replicas)
+		}
+	}
+
+	// the least recently used keys are forgotten first
+	for i := 0; i < maxSessionKeys; i++ {
+		sess.record("key"+strconv.Itoa(i+2), nil)
+	}
+	if len(sess.Keys) != maxSessionKeys || sess.replicas("key0") != nil {
+		t.Errorf("Expected the oldest keys to be forgotten, tracking %d keys", len(sess.Keys))
+	}
+
+	if _, err := decodeSession("garbage!"); !errors.Is(err, errBadSession) {
+		t.Errorf("Expected errBadSession, got %v", err)
+	}
+}
+
+func TestSessionGuarantees(t *testing.T) {
+	view := []string{"127.0.0.1:13801", "127.0.0.1:13802", "127.0.0.1:13803"}
+	handlers := newTestHandlers(t, node.Config{View: view, ReplFactor: 3})
+	a, b, c := handlers[0], handlers[1], handlers[2]
+
+	get := func(h *handler, path, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			r.Header.Set(sessionHeader, token)
+		}
+		w := httptest.NewRecorder()
+		h.keyHandler(w, r)
+		return w
+	}
+	value := func(w *httptest.ResponseRecorder) string {
+		var v msg.Value
+		json.NewDecoder(w.Body).Decode(&v)
+		return v.Value
+	}
+
+	// the session wrote key0 through a, the write only reached a so far
+	a.Put("key0", "new")
+	b.Put("key0", "old")
+	c.Put("key0", "old")
+	sess, _ := decodeSession(newSession)
+	sess.record("key0", []string{a.ID})
+
+	if got := value(get(b, "/kv-store/key/key0?r=1", "")); got != "old" {
+		t.Fatalf("Expected a read at ONE outside the session to see the local value, got %q", got)
+	}
+
+	w := get(b, "/kv-store/key/key0?r=1", sess.encode())
+	if w.Code != http.StatusOK {
+		t.Fatalf("Session read failed with %d: %s", w.Code, w.Body.String())
+	}
+	token := w.Header().Get(sessionHeader)
+	if got := value(w); got != "new" {
+		t.Errorf("Session read did not see its own write, got %q", got)
+	}
+
+	// the session has now read the value from a, which then goes down
+	a.Shutdown()
+
+	scenarios := []struct {
+		path   string
+		expect int
+	}{
+		{path: "/kv-store/key/key0?r=1", expect: http.StatusServiceUnavailable},
+		{path: "/kv-store/key/key0?r=1&partial=true", expect: http.StatusServiceUnavailable},
+	}
+	for _, s := range scenarios {
+		w := get(c, s.path, token)
+		if w.Code != s.expect {
+			t.Errorf("GET %v: expected %d, got %d", s.path, s.expect, w.Code)
+		}
+		if got := value(w); got == "old" {
+			t.Errorf("GET %v: session read went backwards", s.path)
+		}
+	}
+
+	if got := c.Stats.Get("session_unavailable"); got != 1 {
+		t.Errorf("Expected 1 unavailable session read in stats, got %d", got)
+	}
+}
+
+func TestSessionWrite(t *testing.T) {
+	h := newTestHandler(t, node.Config{})
+
+	r := httptest.NewRequest(http.MethodPut, "/kv-store/key", strings.NewReader(`{"Key": "key0", "Value": "value0"}`))
+	r.Header.Set(sessionHeader, newSession)
+	w := httptest.NewRecorder()
+	h.keyHandler(w, r)
+
+	sess, err := decodeSession(w.Header().Get(sessionHeader))
+	if err != nil {
+		t.Fatalf("Put did not return a session: %v", err)
+	}
+	if got := sess.replicas("key0"); !reflect.DeepEqual(got, []string{h.ID}) {
+		t.Errorf("Expected the session to track the acknowledging replicas, got %v", got)
+	}
+
+	// requests outside a session are not handed one
+	w = httptest.NewRecorder()
+	h.keyHandler(w, httptest.NewRequest(http.MethodGet, "/kv-store/key/key0", nil))
+	if got := w.Header().Get(sessionHeader); got != "" {
+		t.Errorf("Expected no session outside of one, got %q", got)
+	}
+}
@@ -0,0 +1,64 @@
+package clientservices
+
+import (
+	"encoding/json"
+	"errors"
+	msg "kv-store/Messages"
+	node "kv-store/Node"
+	txn "kv-store/SystemServices/Txn"
+	"net/http"
+)
+
+// txnPath -> endpoint for multi-key transactions
+const txnPath = "txn"
+
+// txnHandler -> atomically apply the writes when every check holds, coordinated by
+// this node across the shards holding the keys. Responds 200 with whether the
+// transaction committed, 409 when another transaction holds one of the keys and 503
+// when a replica did not vote before the write deadline.
+func (h *handler) txnHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req msg.Txn
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.Transact(req, h.WriteDeadline())
+	switch {
+	case errors.Is(err, node.ErrInvalidTxn):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	output, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	switch result.Reason {
+	case txn.ReasonConflict, txn.ReasonDiverged:
+		status = http.StatusConflict
+	case txn.ReasonUnavailable:
+		status = http.StatusServiceUnavailable
+	}
+	if status != http.StatusOK {
+		w.Header().Set("Retry-After", "1")
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	w.Write(output)
+}
@@ -0,0 +1,111 @@
+package clientservices
+
+import (
+	"encoding/json"
+	"fmt"
+	msg "kv-store/Messages"
+	node "kv-store/Node"
+	txn "kv-store/SystemServices/Txn"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTransaction(t *testing.T) {
+	view := []string{"127.0.0.1:13801", "127.0.0.1:13802", "127.0.0.1:13803", "127.0.0.1:13804"}
+	handlers := newTestHandlers(t, node.Config{View: view, ReplFactor: 2})
+
+	// two accounts held by different shards
+	from, to := "", ""
+	for i := 0; to == ""; i++ {
+		key := fmt.Sprintf("account%d", i)
+		switch {
+		case from == "":
+			from = key
+		case handlers[0].GetMatch(key) != handlers[0].GetMatch(from):
+			to = key
+		}
+	}
+
+	transfer := func(amount int) string {
+		return fmt.Sprintf(`{"Checks": [{"Key": %q, "If": {"Op": ">=", "Value": "%d"}}],
+			"Writes": [{"Key": %q, "Add": -%d}, {"Key": %q, "Add": %d}]}`, from, amount, from, amount, to, amount)
+	}
+
+	scenarios := []struct {
+		method    string
+		body      string
+		expect    int
+		committed bool
+		reason    string
+		key       string
+	}{
+		{method: http.MethodPost, body: fmt.Sprintf(`{"Writes": [{"Key": %q, "Value": "100"}, {"Key": %q, "Value": "0"}]}`, from, to), expect: http.StatusOK, committed: true},
+		{method: http.MethodPost, body: transfer(30), expect: http.StatusOK, committed: true},
+		{method: http.MethodPost, body: transfer(100), expect: http.StatusOK, reason: "condition", key: from},
+		{method: http.MethodPost, body: `{"Checks": [{"Key": "a", "If": {"Op": "exists"}}]}`, expect: http.StatusBadRequest},
+		{method: http.MethodPost, body: `{"Writes": [`, expect: http.StatusBadRequest},
+		{method: http.MethodGet, expect: http.StatusMethodNotAllowed},
+	}
+
+	// every node coordinates a transaction, whether or not it holds the keys
+	for i, s := range scenarios {
+		h := handlers[i%len(handlers)]
+		w := httptest.NewRecorder()
+		h.txnHandler(w, httptest.NewRequest(s.method, "/kv-store/txn", strings.NewReader(s.body)))
+
+		if w.Code != s.expect {
+			t.Fatalf("Scenario %d: expected %d, got %d: %s", i, s.expect, w.Code, w.Body.String())
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+
+		var result msg.TxnResult
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatalf("Scenario %d: bad response: %v", i, err)
+		}
+		if result.Committed != s.committed || result.Reason != s.reason || result.Key != s.key || result.ID == "" {
+			t.Errorf("Scenario %d: expected committed %v (%q %q), got %+v", i, s.committed, s.reason, s.key, result)
+		}
+	}
+
+	// every replica of both shards applied the committed transfer
+	byID := make(map[string]*handler)
+	for _, h := range handlers {
+		byID[h.ID] = h
+	}
+
+	// with the same stamp
+	expect := map[string]string{from: "70", to: "30"}
+	for key, value := range expect {
+		stamp := ""
+		for _, replica := range handlers[0].ShardGroups[handlers[0].GetMatch(key)] {
+			got, _ := byID[replica].DB.GetWrite(key)
+			if string(got.Value) != value {
+				t.Errorf("Replica %v holds %s=%q, expected %q", replica, key, got.Value, value)
+			}
+			if stamp == "" {
+				stamp = got.Stamp
+			} else if got.Stamp != stamp {
+				t.Errorf("Replica %v stamped %s %q, expected %q", replica, key, got.Stamp, stamp)
+			}
+		}
+	}
+
+	// a replica that missed a write makes the transfer abort until it is repaired
+	replica := byID[handlers[0].ShardGroups[handlers[0].GetMatch(from)][0]]
+	replica.DB.Put(from, "1000")
+
+	w := httptest.NewRecorder()
+	handlers[0].txnHandler(w, httptest.NewRequest(http.MethodPost, "/kv-store/txn", strings.NewReader(transfer(500))))
+	var result msg.TxnResult
+	json.NewDecoder(w.Body).Decode(&result)
+	if w.Code != http.StatusConflict || result.Committed || result.Reason != txn.ReasonDiverged || result.Key != from {
+		t.Errorf("Expected the replicas of %s to diverge, got %d %+v", from, w.Code, result)
+	}
+	if got, _ := replica.DB.Get(from); string(got) != "1000" {
+		t.Errorf("Expected %s to be left unwritten, got %q", from, got)
+	}
+}
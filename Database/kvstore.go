@@ -3,32 +3,115 @@ package db
 import (
 	"encoding/json"
 	"fmt"
+	"sync"
 
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/ethdb"
 )
 
-// DB -> database type
+// DB -> database type, each key may hold the timestamp and the vector clock of the
+// write that set it. Timestamps are compared as strings and must be encoded to sort
+// in time order.
 type DB struct {
-	id int64
-	kv ethdb.Database
+	id     int64
+	kv     ethdb.Database
+	stamps ethdb.Database
+	clocks ethdb.Database
+	m      *sync.RWMutex // a write, and the check deciding it, is never seen in part
+}
+
+// Entry -> a value along with the timestamp of the write that set it
+type Entry struct {
+	Value string `json:"Value"`
+	Stamp string `json:"Stamp,omitempty"`
+}
+
+// Stored -> a value along with the timestamp and the vector clock of the write that
+// set it
+type Stored struct {
+	Value []byte
+	Stamp string
+	Clock map[string]int
 }
 
 // NewDB -> create a new database instance
 func (db *DB) NewDB() {
 	db.kv = rawdb.NewMemoryDatabase()
+	db.stamps = rawdb.NewMemoryDatabase()
+	db.clocks = rawdb.NewMemoryDatabase()
+	db.m = &sync.RWMutex{}
 	db.id = 0
 }
 
 // Get ->
 func (db *DB) Get(Key string) ([]byte, error) {
+	db.m.RLock()
+	defer db.m.RUnlock()
+
 	got, getErr := db.kv.Get([]byte(Key))
 	return got, getErr
 }
 
-// Put ->
+// GetWrite -> the value of the key along with the timestamp and the clock of the
+// write that set it, all from the same write
+func (db *DB) GetWrite(Key string) (Stored, error) {
+	db.m.RLock()
+	defer db.m.RUnlock()
+
+	return db.get(Key)
+}
+
+// get -> as GetWrite, the caller must hold the lock
+func (db *DB) get(Key string) (Stored, error) {
+	got, err := db.kv.Get([]byte(Key))
+	if err != nil {
+		return Stored{}, err
+	}
+
+	stamp, _ := db.stamps.Get([]byte(Key))
+	return Stored{Value: got, Stamp: string(stamp), Clock: db.clock(Key)}, nil
+}
+
+// Put -> store the value without a timestamp
 func (db *DB) Put(Key, Value string) error {
+	return db.PutStamped(Key, Value, "")
+}
 
+// PutStamped -> store the value along with the timestamp of the write that set it
+func (db *DB) PutStamped(Key, Value, Stamp string) error {
+	return db.PutWrite(Key, Value, Stamp, nil)
+}
+
+// PutWrite -> store the value along with the timestamp and the vector clock of the
+// write that set it, a nil clock leaves the events the value depends on unknown
+func (db *DB) PutWrite(Key, Value, Stamp string, Clock map[string]int) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+
+	return db.put(Key, Value, Stamp, Clock)
+}
+
+// PutWriteIf -> as PutWrite, unless the key holds a value the write does not replace.
+// Replaces is asked with the key locked, so no other write comes between the check
+// and the put. Returns whether the write was stored and whether the key was new.
+func (db *DB) PutWriteIf(Key, Value, Stamp string, Clock map[string]int, replaces func(ours Stored) bool) (bool, bool, error) {
+	db.m.Lock()
+	defer db.m.Unlock()
+
+	ours, err := db.get(Key)
+	created := err != nil
+	if !created && !replaces(ours) {
+		return false, false, nil
+	}
+
+	if err = db.put(Key, Value, Stamp, Clock); err != nil {
+		return false, false, err
+	}
+	return true, created, nil
+}
+
+// put -> as PutWrite, the caller must hold the lock
+func (db *DB) put(Key, Value, Stamp string, Clock map[string]int) error {
 	if Key == "" {
 		return fmt.Errorf("Key can not be empty")
 	}
@@ -38,38 +121,104 @@ func (db *DB) Put(Key, Value string) error {
 		return insertErr
 	}
 
-	return nil
+	if Stamp == "" {
+		insertErr = db.stamps.Delete([]byte(Key))
+	} else {
+		insertErr = db.stamps.Put([]byte(Key), []byte(Stamp))
+	}
+	if insertErr != nil {
+		return insertErr
+	}
+
+	if Clock == nil {
+		return db.clocks.Delete([]byte(Key))
+	}
+	encoded, err := json.Marshal(Clock)
+	if err != nil {
+		return err
+	}
+	return db.clocks.Put([]byte(Key), encoded)
+}
+
+// Stamp -> the timestamp of the write that set the key, empty when it has none
+func (db *DB) Stamp(Key string) string {
+	db.m.RLock()
+	defer db.m.RUnlock()
+
+	got, _ := db.stamps.Get([]byte(Key))
+	return string(got)
 }
 
-// ToByteArray ->
+// WriteClock -> the vector clock of the write that set the key, nil when it is unknown
+func (db *DB) WriteClock(Key string) map[string]int {
+	db.m.RLock()
+	defer db.m.RUnlock()
+
+	return db.clock(Key)
+}
+
+// clock -> as WriteClock, the caller must hold the lock
+func (db *DB) clock(Key string) map[string]int {
+	got, err := db.clocks.Get([]byte(Key))
+	if err != nil {
+		return nil
+	}
+
+	var clock map[string]int
+	if json.Unmarshal(got, &clock) != nil {
+		return nil
+	}
+	return clock
+}
+
+// ToByteArray -> encode every entry of the database
 func (db *DB) ToByteArray() ([]byte, error) {
+	db.m.RLock()
+	defer db.m.RUnlock()
+
 	// Iterate over the database
-	contents := make(map[string]string)
+	contents := make(map[string]Entry)
 	it := db.kv.NewIterator([]byte{}, []byte{})
 
 	for it.Next() {
 		thisKey := string(it.Key()[:])
 		thisVal := string(it.Value()[:])
 
-		contents[thisKey] = thisVal
+		stamp, _ := db.stamps.Get(it.Key())
+		contents[thisKey] = Entry{Value: thisVal, Stamp: string(stamp)}
 	}
 
 	return json.Marshal(contents)
 }
 
-// ByteArrayToMap ->
+// ByteArrayToMap -> decode the values of a database encoded by ToByteArray
 func (db *DB) ByteArrayToMap(contents []byte) (map[string]string, error) {
-	m := make(map[string]string)
+	entries, err := db.ByteArrayToEntries(contents)
+
+	m := make(map[string]string, len(entries))
+	for k, entry := range entries {
+		m[k] = entry.Value
+	}
+	return m, err
+}
+
+// ByteArrayToEntries -> decode a database encoded by ToByteArray
+func (db *DB) ByteArrayToEntries(contents []byte) (map[string]Entry, error) {
+	m := make(map[string]Entry)
 	err := json.Unmarshal(contents, &m)
 
 	return m, err
 }
 
-// MergeDB ->
-func (db *DB) MergeDB(newContents map[string]string) {
-	var err error
-	for k, v := range newContents {
-		err = db.Put(k, v)
+// MergeDB -> store the entries. Whatever the conflict policy, an entry never
+// replaces a value set by a write stamped after it. With last writer wins the
+// greater value breaks ties between writes stamped alike.
+func (db *DB) MergeDB(newContents map[string]Entry, lww bool) {
+	for k, entry := range newContents {
+		entry := entry
+		_, _, err := db.PutWriteIf(k, entry.Value, entry.Stamp, nil, func(ours Stored) bool {
+			return entry.newer(ours, lww)
+		})
 
 		if err != nil {
 			panic(err)
@@ -77,8 +226,19 @@ func (db *DB) MergeDB(newContents map[string]string) {
 	}
 }
 
+// newer -> whether the entry may replace the value we hold
+func (entry Entry) newer(ours Stored, lww bool) bool {
+	if entry.Stamp != ours.Stamp {
+		return entry.Stamp > ours.Stamp
+	}
+	return !lww || entry.Value > string(ours.Value)
+}
+
 // PrintDB ->
 func (db *DB) PrintDB() {
+	db.m.RLock()
+	defer db.m.RUnlock()
+
 	it := db.kv.NewIterator([]byte{}, []byte{})
 
 	for it.Next() {
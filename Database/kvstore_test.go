@@ -1,7 +1,9 @@
 package db
 
 import (
+	"fmt"
 	"strconv"
+	"sync"
 	"testing"
 )
 
@@ -89,3 +91,159 @@ func TestContentConvertion(t *testing.T) {
 		}
 	}
 }
+
+// 04
+func TestMergeDB(t *testing.T) {
+	scenarios := []struct {
+		ours   Entry
+		theirs Entry
+		lww    bool
+		expect Entry
+	}{
+		// an older write never replaces a newer one, whatever the policy
+		{ours: Entry{Value: "a", Stamp: "2"}, theirs: Entry{Value: "b", Stamp: "1"}, expect: Entry{Value: "a", Stamp: "2"}},
+		{ours: Entry{Value: "a", Stamp: "1"}, theirs: Entry{Value: "b", Stamp: "2"}, expect: Entry{Value: "b", Stamp: "2"}},
+		{ours: Entry{Value: "b", Stamp: "1"}, theirs: Entry{Value: "a", Stamp: "1"}, expect: Entry{Value: "a", Stamp: "1"}},
+		{ours: Entry{Value: "a", Stamp: "2"}, theirs: Entry{Value: "b", Stamp: "1"}, lww: true, expect: Entry{Value: "a", Stamp: "2"}},
+		{ours: Entry{Value: "a", Stamp: "1"}, theirs: Entry{Value: "b", Stamp: "2"}, lww: true, expect: Entry{Value: "b", Stamp: "2"}},
+		// an unstamped value is older than any stamped write
+		{ours: Entry{Value: "a"}, theirs: Entry{Value: "b", Stamp: "1"}, lww: true, expect: Entry{Value: "b", Stamp: "1"}},
+		// writes stamped alike settle on the greater value
+		{ours: Entry{Value: "b", Stamp: "1"}, theirs: Entry{Value: "a", Stamp: "1"}, lww: true, expect: Entry{Value: "b", Stamp: "1"}},
+	}
+
+	for i, s := range scenarios {
+		db := new(DB)
+		db.NewDB()
+		db.PutStamped("key0", s.ours.Value, s.ours.Stamp)
+
+		remote := new(DB)
+		remote.NewDB()
+		remote.PutStamped("key0", s.theirs.Value, s.theirs.Stamp)
+		remote.PutStamped("key1", "new", "1")
+
+		contents, _ := remote.ToByteArray()
+		entries, err := db.ByteArrayToEntries(contents)
+		if err != nil {
+			t.Fatalf("Scenario %d: failed to decode %s: %v", i, contents, err)
+		}
+		db.MergeDB(entries, s.lww)
+
+		got, _ := db.Get("key0")
+		if (Entry{Value: string(got), Stamp: db.Stamp("key0")}) != s.expect {
+			t.Errorf("Scenario %d: expected %+v, got %q at %q", i, s.expect, got, db.Stamp("key0"))
+		}
+		if got, _ := db.Get("key1"); string(got) != "new" || db.Stamp("key1") != "1" {
+			t.Errorf("Scenario %d: missing key was not merged, got %q", i, got)
+		}
+	}
+}
+
+// 05
+func TestPutWrite(t *testing.T) {
+	db := new(DB)
+	db.NewDB()
+
+	scenarios := []struct {
+		clock  map[string]int
+		stamp  string
+		expect map[string]int
+	}{
+		{clock: map[string]int{"n1": 2, "n2": 1}, stamp: "1", expect: map[string]int{"n1": 2, "n2": 1}},
+		// a write without a clock forgets the clock of the value it replaced
+		{stamp: "2"},
+		{clock: map[string]int{}, expect: map[string]int{}},
+	}
+
+	for i, s := range scenarios {
+		if err := db.PutWrite("key0", "value"+strconv.Itoa(i), s.stamp, s.clock); err != nil {
+			t.Fatalf("Scenario %d: unexpected error %v", i, err)
+		}
+
+		got := db.WriteClock("key0")
+		if (got == nil) != (s.expect == nil) || len(got) != len(s.expect) {
+			t.Errorf("Scenario %d: expected clock %v, got %v", i, s.expect, got)
+		}
+		for node, count := range s.expect {
+			if got[node] != count {
+				t.Errorf("Scenario %d: expected %v at %d, got %d", i, node, count, got[node])
+			}
+		}
+		if db.Stamp("key0") != s.stamp {
+			t.Errorf("Scenario %d: expected stamp %q, got %q", i, s.stamp, db.Stamp("key0"))
+		}
+	}
+
+	if db.WriteClock("missing") != nil {
+		t.Errorf("Expected no clock for a missing key")
+	}
+}
+
+// 06
+func TestPutWriteIf(t *testing.T) {
+	db := new(DB)
+	db.NewDB()
+
+	later := func(stamp string) func(Stored) bool {
+		return func(ours Stored) bool { return stamp >= ours.Stamp }
+	}
+
+	scenarios := []struct {
+		stamp   string
+		stored  bool
+		created bool
+		expect  string
+	}{
+		{stamp: "2", stored: true, created: true, expect: "2"},
+		{stamp: "1", stored: false, expect: "2"},
+		{stamp: "3", stored: true, expect: "3"},
+	}
+
+	for i, s := range scenarios {
+		stored, created, err := db.PutWriteIf("key0", "value"+s.stamp, s.stamp, nil, later(s.stamp))
+		if err != nil || stored != s.stored || created != s.created {
+			t.Errorf("Scenario %d: expected stored %v created %v, got %v %v (%v)", i, s.stored, s.created, stored, created, err)
+		}
+		if got, _ := db.GetWrite("key0"); got.Stamp != s.expect || string(got.Value) != "value"+s.expect {
+			t.Errorf("Scenario %d: expected the write stamped %v, got %q at %v", i, s.expect, got.Value, got.Stamp)
+		}
+	}
+
+	// racing writes settle on the latest one, readers never see a value along with
+	// the stamp of another write
+	db.NewDB()
+	done := make(chan struct{})
+	torn := make(chan string, 1)
+	go func() {
+		for {
+			select {
+			case <-done:
+				close(torn)
+				return
+			default:
+			}
+			if got, err := db.GetWrite("key0"); err == nil && string(got.Value) != "value"+got.Stamp {
+				torn <- string(got.Value) + " at " + got.Stamp
+				return
+			}
+		}
+	}()
+
+	var writers sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		writers.Add(1)
+		go func(stamp string) {
+			defer writers.Done()
+			db.PutWriteIf("key0", "value"+stamp, stamp, nil, later(stamp))
+		}(fmt.Sprintf("%03d", i))
+	}
+	writers.Wait()
+	close(done)
+
+	if got, ok := <-torn; ok {
+		t.Errorf("Read a torn write, %v", got)
+	}
+	if got, _ := db.GetWrite("key0"); got.Stamp != "199" || string(got.Value) != "value199" {
+		t.Errorf("Expected the latest write to win, got %q at %v", got.Value, got.Stamp)
+	}
+}
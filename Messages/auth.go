@@ -0,0 +1,169 @@
+package messages
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrBadSignature -> the message was not signed with any of the cluster secrets
+	ErrBadSignature = errors.New("message signature does not verify")
+
+	// ErrExpired -> the message was signed outside of the replay window
+	ErrExpired = errors.New("message is outside of the replay window")
+
+	// ErrReplayed -> the message has already been received within the replay window
+	ErrReplayed = errors.New("message has already been received")
+)
+
+// Signer -> signs messages with the cluster shared secret. Several secrets may be
+// accepted at once so the secret can be rotated without dropping traffic: every
+// node first learns the new secret as a second secret, then starts signing with it.
+type Signer struct {
+	secrets [][]byte
+	window  time.Duration
+	now     func() time.Time
+	seen    *seenCache
+}
+
+// seenCache -> signatures of the messages verified within the replay window, with
+// the time each one leaves it. The signature covers the signing time, so a message
+// signed again has a new one while a replayed message does not.
+type seenCache struct {
+	m      *sync.Mutex
+	expiry map[string]time.Time
+	sweep  time.Time // when expired signatures are next removed
+}
+
+// NewSigner -> messages are signed with the first secret and verified against all of
+// them. Messages signed more than window ago, or window into the future, are rejected.
+func NewSigner(window time.Duration, secret []byte, accepted ...[]byte) *Signer {
+	s := &Signer{
+		secrets: [][]byte{secret},
+		window:  window,
+		now:     time.Now,
+		seen:    &seenCache{m: &sync.Mutex{}, expiry: make(map[string]time.Time)},
+	}
+
+	for _, other := range accepted {
+		if len(other) > 0 {
+			s.secrets = append(s.secrets, other)
+		}
+	}
+
+	return s
+}
+
+// Sign -> stamp the message with the current time and our signature
+func (s *Signer) Sign(m Msg) Msg {
+	m.Timestamp = s.now().UnixNano()
+	m.Signature = digest(s.secrets[0], m)
+	return m
+}
+
+// Verify -> check the message was signed by a node holding one of our secrets
+// within the replay window, and that it has not been received before
+func (s *Signer) Verify(m Msg) error {
+	valid := false
+	for _, secret := range s.secrets {
+		if hmac.Equal(m.Signature, digest(secret, m)) {
+			valid = true
+			break
+		}
+	}
+
+	if !valid {
+		return ErrBadSignature
+	}
+
+	age := s.now().Sub(time.Unix(0, m.Timestamp))
+	if age > s.window || age < -s.window {
+		return ErrExpired
+	}
+
+	return s.seen.first(string(m.Signature), time.Unix(0, m.Timestamp).Add(s.window), s.now())
+}
+
+// first -> remember the signature until it leaves the replay window, a signature
+// seen before is a replay
+func (c *seenCache) first(signature string, expiry, now time.Time) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if now.After(c.sweep) {
+		for sig, at := range c.expiry {
+			if now.After(at) {
+				delete(c.expiry, sig)
+			}
+		}
+		c.sweep = now.Add(time.Second)
+	}
+
+	if _, ok := c.expiry[signature]; ok {
+		return ErrReplayed
+	}
+	c.expiry[signature] = expiry
+	return nil
+}
+
+// digest -> hmac over a length prefixed encoding of every signed field
+func digest(secret []byte, m Msg) []byte {
+	mac := hmac.New(sha256.New, secret)
+
+	field := func(b []byte) {
+		var size [8]byte
+		binary.BigEndian.PutUint64(size[:], uint64(len(b)))
+		mac.Write(size[:])
+		mac.Write(b)
+	}
+	number := func(n int64) {
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(n))
+		field(b[:])
+	}
+
+	field([]byte(m.SrcAddr))
+	field([]byte(m.ID))
+	field(m.Payload)
+	field([]byte(m.Action))
+	field([]byte(m.Error))
+	field([]byte(m.Codec))
+	field([]byte(m.Stamp))
+
+	if m.Reply {
+		number(1)
+	} else {
+		number(0)
+	}
+
+	number(int64(len(m.Accept)))
+	for _, codec := range m.Accept {
+		field([]byte(codec))
+	}
+
+	// maps have no order, sign the clocks sorted by node
+	clock := func(c map[string]int) {
+		nodes := make([]string, 0, len(c))
+		for node := range c {
+			nodes = append(nodes, node)
+		}
+		sort.Strings(nodes)
+
+		number(int64(len(nodes)))
+		for _, node := range nodes {
+			field([]byte(node))
+			number(int64(c[node]))
+		}
+	}
+	clock(m.Context)
+	clock(m.Deps)
+
+	number(m.Timestamp)
+
+	return mac.Sum(nil)
+}
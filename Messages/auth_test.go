@@ -0,0 +1,125 @@
+package messages
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	current := []byte("current secret")
+	previous := []byte("previous secret")
+
+	base := Msg{
+		SrcAddr: "127.0.0.1:13801",
+		ID:      "id0",
+		Payload: []byte("key0:value0"),
+		Action:  "put",
+		Context: map[string]int{"127.0.0.1:13801": 1, "127.0.0.1:13802": 4},
+		Deps:    map[string]int{"127.0.0.1:13801/0": 1},
+	}
+
+	scenarios := []struct {
+		name   string
+		signer *Signer
+		mutate func(m Msg) Msg
+		expect error
+	}{
+		{name: "valid", signer: NewSigner(time.Minute, current), expect: nil},
+		{name: "rotated", signer: NewSigner(time.Minute, previous), expect: nil},
+		{name: "unknown secret", signer: NewSigner(time.Minute, []byte("other secret")), expect: ErrBadSignature},
+		{name: "tampered payload", signer: NewSigner(time.Minute, current), expect: ErrBadSignature,
+			mutate: func(m Msg) Msg { m.Payload = []byte("key0:evil"); return m }},
+		{name: "tampered clock", signer: NewSigner(time.Minute, current), expect: ErrBadSignature,
+			mutate: func(m Msg) Msg { m.Context = map[string]int{"127.0.0.1:13801": 9}; return m }},
+		{name: "tampered dependencies", signer: NewSigner(time.Minute, current), expect: ErrBadSignature,
+			mutate: func(m Msg) Msg { m.Deps = nil; return m }},
+		{name: "tampered timestamp", signer: NewSigner(time.Minute, current), expect: ErrBadSignature,
+			mutate: func(m Msg) Msg { m.Timestamp++; return m }},
+		{name: "unsigned", signer: NewSigner(time.Minute, current), expect: ErrBadSignature,
+			mutate: func(m Msg) Msg { m.Signature = nil; return m }},
+	}
+
+	// verify with the current secret while still accepting the previous one
+	verifier := NewSigner(time.Minute, current, previous)
+
+	for _, s := range scenarios {
+		m := s.signer.Sign(base)
+		if s.mutate != nil {
+			m = s.mutate(m)
+		}
+
+		if got := verifier.Verify(m); got != s.expect {
+			t.Errorf("Scenario %v: expected %v, got %v", s.name, s.expect, got)
+		}
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	secret := []byte("current secret")
+	signer := NewSigner(time.Minute, secret)
+	verifier := NewSigner(time.Minute, secret)
+
+	now := time.Now()
+	scenarios := []struct {
+		signedAt time.Time
+		expect   error
+	}{
+		{signedAt: now, expect: nil},
+		{signedAt: now.Add(-30 * time.Second), expect: nil},
+		{signedAt: now.Add(-2 * time.Minute), expect: ErrExpired},
+		{signedAt: now.Add(2 * time.Minute), expect: ErrExpired},
+	}
+
+	for _, s := range scenarios {
+		signedAt := s.signedAt
+		signer.now = func() time.Time { return signedAt }
+		verifier.now = func() time.Time { return now }
+
+		if got := verifier.Verify(signer.Sign(Msg{Action: "put"})); got != s.expect {
+			t.Errorf("Message signed at %v: expected %v, got %v", s.signedAt.Sub(now), s.expect, got)
+		}
+	}
+}
+
+func TestReplayed(t *testing.T) {
+	secret := []byte("current secret")
+	signer := NewSigner(time.Minute, secret)
+	verifier := NewSigner(time.Minute, secret)
+
+	now := time.Now()
+	verifier.now = func() time.Time { return now }
+	put := Msg{SrcAddr: "127.0.0.1:13801", Payload: []byte("key0:value0"), Action: "put"}
+	captured := signer.Sign(put)
+
+	scenarios := []struct {
+		m      Msg
+		later  time.Duration // how long after signing the message is received
+		expect error
+	}{
+		{m: captured, expect: nil},
+		{m: captured, later: time.Second, expect: ErrReplayed},
+		{m: captured, later: 30 * time.Second, expect: ErrReplayed},
+		// the same put signed again is a new message
+		{m: signer.Sign(put), later: 30 * time.Second, expect: nil},
+		{m: captured, later: 2 * time.Minute, expect: ErrExpired},
+	}
+
+	for i, s := range scenarios {
+		now = time.Unix(0, captured.Timestamp).Add(s.later)
+		if got := verifier.Verify(s.m); got != s.expect {
+			t.Errorf("Scenario %d: expected %v, got %v", i, s.expect, got)
+		}
+	}
+
+	// signatures are forgotten once they have left the replay window
+	signer.now = func() time.Time { return now }
+	if err := verifier.Verify(signer.Sign(put)); err != nil {
+		t.Fatalf("Expected a new message to verify, got %v", err)
+	}
+
+	verifier.seen.m.Lock()
+	defer verifier.seen.m.Unlock()
+	if len(verifier.seen.expiry) != 1 {
+		t.Errorf("Expected expired signatures to be removed, %d held", len(verifier.seen.expiry))
+	}
+}
@@ -0,0 +1,99 @@
+package messages
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Payload compression codecs
+const (
+	CodecNone  = "none"
+	CodecGzip  = "gzip"
+	CodecFlate = "flate"
+)
+
+// MaxDecompressedSize -> the largest payload a compressed message may expand to
+const MaxDecompressedSize = 64 << 20
+
+// ErrTooLarge -> a compressed payload expands past MaxDecompressedSize
+var ErrTooLarge = errors.New("decompressed payload is too large")
+
+// Codecs -> every codec this build is able to compress and decompress
+var Codecs = []string{CodecGzip, CodecFlate, CodecNone}
+
+// SupportedCodec -> determine if the codec is known
+func SupportedCodec(codec string) bool {
+	for _, known := range Codecs {
+		if codec == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Compress -> compress the payload with the given codec
+func Compress(codec string, payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+
+	switch codec {
+	case "", CodecNone:
+		return payload, nil
+	case CodecGzip:
+		w = gzip.NewWriter(&buf)
+	case CodecFlate:
+		w, err = flate.NewWriter(&buf, flate.DefaultCompression)
+	default:
+		return nil, fmt.Errorf("unknown codec %q", codec)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(payload); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Decompress -> reverse Compress, failing with ErrTooLarge rather than expanding the
+// payload past MaxDecompressedSize
+func Decompress(codec string, payload []byte) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+
+	switch codec {
+	case "", CodecNone:
+		return payload, nil
+	case CodecGzip:
+		r, err = gzip.NewReader(bytes.NewReader(payload))
+	case CodecFlate:
+		r = flate.NewReader(bytes.NewReader(payload))
+	default:
+		return nil, fmt.Errorf("unknown codec %q", codec)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	out, err := ioutil.ReadAll(io.LimitReader(r, MaxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > MaxDecompressedSize {
+		return nil, ErrTooLarge
+	}
+	return out, nil
+}
@@ -0,0 +1,72 @@
+package messages
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	payload := []byte(strings.Repeat(`{"key":"value"},`, 200))
+
+	for _, codec := range []string{CodecNone, CodecGzip, CodecFlate, ""} {
+		compressed, err := Compress(codec, payload)
+		if err != nil {
+			t.Fatalf("Codec %q: compress failed: %v", codec, err)
+		}
+
+		if codec == CodecGzip || codec == CodecFlate {
+			if len(compressed) >= len(payload) {
+				t.Errorf("Codec %q did not shrink a repetitive payload, %d >= %d", codec, len(compressed), len(payload))
+			}
+		}
+
+		got, err := Decompress(codec, compressed)
+		if err != nil {
+			t.Fatalf("Codec %q: decompress failed: %v", codec, err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Errorf("Codec %q did not round trip", codec)
+		}
+	}
+}
+
+func TestUnknownCodec(t *testing.T) {
+	if _, err := Compress("zstd", []byte("payload")); err == nil {
+		t.Errorf("Expected an error compressing with an unknown codec")
+	}
+	if _, err := Decompress("zstd", []byte("payload")); err == nil {
+		t.Errorf("Expected an error decompressing with an unknown codec")
+	}
+	if SupportedCodec("zstd") || !SupportedCodec(CodecGzip) {
+		t.Errorf("SupportedCodec does not match the known codecs")
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	scenarios := []struct {
+		size   int
+		expect error
+	}{
+		{size: MaxDecompressedSize, expect: nil},
+		// a small payload from a peer may not expand without bound
+		{size: MaxDecompressedSize + 1, expect: ErrTooLarge},
+	}
+
+	for _, codec := range []string{CodecGzip, CodecFlate} {
+		for _, s := range scenarios {
+			compressed, err := Compress(codec, make([]byte, s.size))
+			if err != nil {
+				t.Fatalf("Codec %q: compress failed: %v", codec, err)
+			}
+
+			got, err := Decompress(codec, compressed)
+			if err != s.expect {
+				t.Errorf("Codec %q: expected %v expanding %d bytes, got %v", codec, s.expect, s.size, err)
+			}
+			if err == nil && len(got) != s.size {
+				t.Errorf("Codec %q: expected %d bytes, got %d", codec, s.size, len(got))
+			}
+		}
+	}
+}
@@ -1,28 +1,25 @@
 package messages
 
-import (
-	"fmt"
-	"io"
-	"io/ioutil"
-)
-
 // Msg -> System level message format
 type Msg struct {
-	SrcAddr string
-	ID      string
-	Payload io.Reader
-	Action  string
-	Context map[string]int
+	SrcAddr   string
+	ID        string
+	Payload   []byte
+	Action    string
+	Context   map[string]int
+	Reply     bool           // the message answers the request with the same ID
+	Error     string         // set on replies when the request failed
+	Codec     string         // compression applied to the payload, empty when uncompressed
+	Stamp     string         // hybrid logical clock timestamp of the write carried or read
+	Deps      map[string]int // writes to its shard the carried write depends on
+	Accept    []string       // codecs the sender is able to decompress
+	Timestamp int64          // unix nanoseconds at which the message was signed
+	Signature []byte         // hmac of the fields above, see Signer
 }
 
 // PayloadToStr -> Convert the message payload to a string
 func (m *Msg) PayloadToStr() string {
-	buf, err := ioutil.ReadAll(m.Payload)
-
-	if err != nil {
-		fmt.Printf("error in reading message payload %v", err)
-	}
-	return string(buf)
+	return string(m.Payload)
 }
 
 // Entry -> format key-value user-level entries
@@ -40,3 +37,89 @@ type Key struct {
 type Value struct {
 	Value string `json:"Value"`
 }
+
+// QuorumFailure -> returned to clients when too few replicas answered a request
+type QuorumFailure struct {
+	Error    string   `json:"Error"`
+	Answered int      `json:"Answered"`
+	Required int      `json:"Required"`
+	Replicas []string `json:"Replicas"` // replicas that answered
+}
+
+// WriteResult -> returned to clients once enough replicas acknowledged a write
+type WriteResult struct {
+	Replicas []string `json:"Replicas"` // replicas that acknowledged the write
+	Required int      `json:"Required"`
+}
+
+// Condition -> compared against the current value of a key. Op is one of exists,
+// missing, =, !=, <, <=, > or >=, the comparisons are numeric when both values are
+// numbers. An empty Op always holds.
+type Condition struct {
+	Op    string `json:"Op"`
+	Value string `json:"Value"`
+}
+
+// CompareAndSet -> update a key only while the condition holds for its current
+// value, either setting it to Value or adding Add to its integer value
+type CompareAndSet struct {
+	Key   string    `json:"Key"`
+	If    Condition `json:"If"`
+	Value string    `json:"Value"`
+	Add   *int64    `json:"Add,omitempty"`
+}
+
+// CASResult -> whether the condition held and the update was applied, with the
+// current value of the key
+type CASResult struct {
+	Applied bool   `json:"Applied"`
+	Value   string `json:"Value"`
+	Exists  bool   `json:"Exists"`
+}
+
+// TxnCheck -> a condition that must hold for the current value of a key for the
+// transaction to commit
+type TxnCheck struct {
+	Key string    `json:"Key"`
+	If  Condition `json:"If"`
+}
+
+// TxnWrite -> a write of a transaction, either setting the key to Value or adding
+// Add to its integer value
+type TxnWrite struct {
+	Key   string `json:"Key"`
+	Value string `json:"Value"`
+	Add   *int64 `json:"Add,omitempty"`
+}
+
+// Txn -> writes applied atomically across shards, only when every check holds for
+// the values the keys had before the transaction
+type Txn struct {
+	Checks []TxnCheck `json:"Checks"`
+	Writes []TxnWrite `json:"Writes"`
+}
+
+// TxnResult -> whether the transaction committed. When it aborted, Reason is one of
+// condition, conflict or unavailable and Key the key at fault, if any.
+type TxnResult struct {
+	ID        string `json:"ID"`
+	Committed bool   `json:"Committed"`
+	Reason    string `json:"Reason,omitempty"`
+	Key       string `json:"Key,omitempty"`
+}
+
+// MultiGet -> keys read together, possibly held by different shards
+type MultiGet struct {
+	Keys []string `json:"Keys"`
+}
+
+// MultiValue -> the value of a key read by a multi-get
+type MultiValue struct {
+	Value  string `json:"Value"`
+	Exists bool   `json:"Exists"`
+}
+
+// Snapshot -> the values of a multi-get, all consistent with one causal cut
+type Snapshot struct {
+	Values map[string]MultiValue `json:"Values"`
+}
@@ -0,0 +1,349 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	msg "kv-store/Messages"
+	consensus "kv-store/SystemServices/Consensus"
+	netutil "kv-store/SystemServices/Network"
+	raft "kv-store/SystemServices/Raft"
+	protocols "kv-store/SystemServices/SysProtocols"
+	txn "kv-store/SystemServices/Txn"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultTLSPortOffset -> the tls listener sits this far above the node port
+	defaultTLSPortOffset = 1000
+
+	// defaultReplayWindow -> how old a signed message may be before it is dropped
+	defaultReplayWindow = 30 * time.Second
+
+	// default size of the pool handling messages from other nodes
+	defaultWorkers             = 16
+	defaultClientQueueSize     = 256
+	defaultBackgroundQueueSize = 64
+
+	// defaultHintInterval -> how often replicas holding hints are probed
+	defaultHintInterval = 5 * time.Second
+
+	// default token bucket limits, messages per second per source address and
+	// http requests per second per client ip
+	defaultPeerRate    = 5000
+	defaultPeerBurst   = 10000
+	defaultClientRate  = 200
+	defaultClientBurst = 400
+)
+
+// Config -> settings used to construct a node
+type Config struct {
+	Addr       string
+	View       []string
+	ReplFactor int
+
+	// mutual tls between nodes, enabled when a certificate is provided
+	TLSCert       string
+	TLSKey        string
+	TLSCA         string
+	TLSPortOffset int
+
+	// the client http api is served over https when a certificate is provided
+	HTTPSCert string
+	HTTPSKey  string
+
+	// hmac signing of every message, enabled when a secret is provided. The
+	// previous secret is still accepted while the cluster rotates to a new one.
+	Secret         string
+	PreviousSecret string
+	ReplayWindow   time.Duration
+
+	// payload codecs in order of preference, negotiated with each peer. Payloads
+	// below the threshold are sent uncompressed.
+	Compression       []string
+	CompressThreshold int
+
+	// workers handling received messages, and how many messages may wait in
+	// each priority lane before new ones are dropped
+	Workers             int
+	ClientQueueSize     int
+	BackgroundQueueSize int
+
+	// how long a call to another node waits for its reply, how long a read waits
+	// for a quorum of replicas to answer and how long a write waits for them to
+	// acknowledge it
+	RPCTimeout   time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// how long a client request waits for this node to cover its causal context
+	// before it is forwarded to a node that does
+	CausalWait time.Duration
+
+	// writes received before the writes they depend on are held, at most
+	// DeliveryLimit of them for no longer than DeliveryTimeout, a negative limit
+	// applies every write as it arrives
+	DeliveryLimit   int
+	DeliveryTimeout time.Duration
+
+	// how writes with concurrent vector clocks are resolved, either causal or lww
+	// to keep the write with the latest hybrid logical clock timestamp
+	ConflictPolicy string
+
+	// timestamps from other nodes further ahead of our clock than this are refused
+	MaxClockDrift time.Duration
+
+	// each shard runs a raft group when Raft is set, serving linearizable requests
+	// and every request for keys in the Linearizable namespaces
+	Raft                bool
+	RaftElectionTimeout time.Duration
+	RaftHeartbeat       time.Duration
+	Linearizable        []string
+
+	// how long a participant holds the intents of a prepared transaction before
+	// asking for its decision, it should be well above WriteTimeout
+	TxnTimeout time.Duration
+
+	// writes kept for unreachable replicas, at most HintLimit per replica for no
+	// longer than HintMaxAge, a negative limit disables hinted handoff. Replicas
+	// holding hints are probed every HintInterval.
+	HintLimit    int
+	HintMaxAge   time.Duration
+	HintInterval time.Duration
+
+	// inbound rate limits per source address on the node listener and per client
+	// ip on the http api, a negative rate disables the limit
+	PeerRate    int
+	PeerBurst   int
+	ClientRate  int
+	ClientBurst int
+}
+
+// parseEnv -> exctract the initial view of the system from the os environment
+func parseEnv() (Config, error) {
+	addr := os.Getenv("ADDRESS")
+
+	if addr == "" {
+		err := errors.New("os environment variables not set")
+		panic(err)
+	}
+
+	var view []string
+	for _, member := range strings.Split(os.Getenv("VIEW"), ",") {
+		if strings.TrimSpace(member) != "" {
+			view = append(view, member)
+		}
+	}
+	replFactor, _ := strconv.Atoi(os.Getenv("REPL_FACTOR"))
+
+	conf := Config{
+		Addr:           addr,
+		View:           view,
+		ReplFactor:     replFactor,
+		TLSCert:        os.Getenv("TLS_CERT"),
+		TLSKey:         os.Getenv("TLS_KEY"),
+		TLSCA:          os.Getenv("TLS_CA"),
+		HTTPSCert:      os.Getenv("HTTPS_CERT"),
+		HTTPSKey:       os.Getenv("HTTPS_KEY"),
+		Secret:         os.Getenv("CLUSTER_SECRET"),
+		PreviousSecret: os.Getenv("CLUSTER_SECRET_PREVIOUS"),
+		ConflictPolicy: strings.ToLower(os.Getenv("CONFLICT_POLICY")),
+
+		Compression:       []string{msg.CodecGzip, msg.CodecFlate},
+		CompressThreshold: consensus.DefaultCompressThreshold,
+	}
+
+	if enabled := os.Getenv("RAFT"); enabled != "" {
+		var err error
+		if conf.Raft, err = strconv.ParseBool(enabled); err != nil {
+			return conf, fmt.Errorf("invalid RAFT %q", enabled)
+		}
+	}
+	for _, namespace := range strings.Split(os.Getenv("LINEARIZABLE_NAMESPACES"), ",") {
+		if strings.TrimSpace(namespace) != "" {
+			conf.Linearizable = append(conf.Linearizable, strings.TrimSpace(namespace))
+		}
+	}
+
+	if codecs := os.Getenv("COMPRESSION"); codecs != "" {
+		conf.Compression = strings.Split(codecs, ",")
+		for _, codec := range conf.Compression {
+			if !msg.SupportedCodec(codec) {
+				return conf, fmt.Errorf("invalid COMPRESSION codec %q", codec)
+			}
+		}
+	}
+
+	ints := map[string]*int{
+		"COMPRESS_THRESHOLD":    &conf.CompressThreshold,
+		"TLS_PORT_OFFSET":       &conf.TLSPortOffset,
+		"WORKERS":               &conf.Workers,
+		"CLIENT_QUEUE_SIZE":     &conf.ClientQueueSize,
+		"BACKGROUND_QUEUE_SIZE": &conf.BackgroundQueueSize,
+		"PEER_RATE":             &conf.PeerRate,
+		"PEER_BURST":            &conf.PeerBurst,
+		"CLIENT_RATE":           &conf.ClientRate,
+		"CLIENT_BURST":          &conf.ClientBurst,
+		"HINT_LIMIT":            &conf.HintLimit,
+		"DELIVERY_LIMIT":        &conf.DeliveryLimit,
+	}
+	for name, dest := range ints {
+		if err := envInt(name, dest); err != nil {
+			return conf, err
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"REPLAY_WINDOW":    &conf.ReplayWindow,
+		"RPC_TIMEOUT":      &conf.RPCTimeout,
+		"READ_TIMEOUT":     &conf.ReadTimeout,
+		"WRITE_TIMEOUT":    &conf.WriteTimeout,
+		"HINT_MAX_AGE":     &conf.HintMaxAge,
+		"CAUSAL_WAIT":      &conf.CausalWait,
+		"HINT_INTERVAL":    &conf.HintInterval,
+		"DELIVERY_TIMEOUT": &conf.DeliveryTimeout,
+		"MAX_CLOCK_DRIFT":  &conf.MaxClockDrift,
+
+		"RAFT_ELECTION_TIMEOUT": &conf.RaftElectionTimeout,
+		"RAFT_HEARTBEAT":        &conf.RaftHeartbeat,
+
+		"TXN_TIMEOUT": &conf.TxnTimeout,
+	}
+	for name, dest := range durations {
+		if err := envDuration(name, dest); err != nil {
+			return conf, err
+		}
+	}
+
+	return conf.withDefaults().normalize()
+}
+
+// normalize -> write every address in its canonical form, nodes are identified by
+// these strings in the shard groups and vector clocks. Hostnames and bracketed
+// ipv6 addresses are accepted, e.g. node1:13800 or [fd00::2]:13800.
+func (conf Config) normalize() (Config, error) {
+	addr, err := netutil.NormalizeAddr(conf.Addr)
+	if err != nil {
+		return conf, fmt.Errorf("invalid ADDRESS: %v", err)
+	}
+
+	view := make([]string, len(conf.View))
+	for i, member := range conf.View {
+		if view[i], err = netutil.NormalizeAddr(member); err != nil {
+			return conf, fmt.Errorf("invalid VIEW: %v", err)
+		}
+	}
+
+	switch conf.ConflictPolicy {
+	case "", consensus.PolicyCausal, consensus.PolicyLWW:
+	default:
+		return conf, fmt.Errorf("invalid CONFLICT_POLICY %q", conf.ConflictPolicy)
+	}
+
+	if len(conf.Linearizable) > 0 && !conf.Raft {
+		return conf, errors.New("LINEARIZABLE_NAMESPACES requires RAFT=true")
+	}
+
+	if (conf.HTTPSCert == "") != (conf.HTTPSKey == "") {
+		return conf, errors.New("HTTPS_CERT and HTTPS_KEY must be set together")
+	}
+
+	if conf.TxnTimeout < 0 {
+		return conf, fmt.Errorf("invalid TXN_TIMEOUT %v", conf.TxnTimeout)
+	}
+
+	if conf.MaxClockDrift < 0 {
+		return conf, fmt.Errorf("invalid MAX_CLOCK_DRIFT %v", conf.MaxClockDrift)
+	}
+
+	conf.Addr = addr
+	conf.View = view
+	return conf, nil
+}
+
+// withDefaults -> fill in every setting that was left unset
+func (conf Config) withDefaults() Config {
+	if conf.TLSPortOffset == 0 {
+		conf.TLSPortOffset = defaultTLSPortOffset
+	}
+	if conf.ReplayWindow == 0 {
+		conf.ReplayWindow = defaultReplayWindow
+	}
+	if conf.Workers == 0 {
+		conf.Workers = defaultWorkers
+	}
+	if conf.ClientQueueSize == 0 {
+		conf.ClientQueueSize = defaultClientQueueSize
+	}
+	if conf.BackgroundQueueSize == 0 {
+		conf.BackgroundQueueSize = defaultBackgroundQueueSize
+	}
+	if conf.PeerRate == 0 {
+		conf.PeerRate, conf.PeerBurst = defaultPeerRate, defaultPeerBurst
+	}
+	if conf.ClientRate == 0 {
+		conf.ClientRate, conf.ClientBurst = defaultClientRate, defaultClientBurst
+	}
+	if conf.HintLimit == 0 {
+		conf.HintLimit = protocols.DefaultHintLimit
+	}
+	if conf.HintMaxAge == 0 {
+		conf.HintMaxAge = protocols.DefaultHintMaxAge
+	}
+	if conf.HintInterval == 0 {
+		conf.HintInterval = defaultHintInterval
+	}
+	if conf.RaftElectionTimeout == 0 {
+		conf.RaftElectionTimeout = raft.DefaultElectionTimeout
+	}
+	if conf.RaftHeartbeat == 0 {
+		conf.RaftHeartbeat = raft.DefaultHeartbeat
+	}
+	if conf.DeliveryLimit == 0 {
+		conf.DeliveryLimit = consensus.DefaultDeliveryLimit
+	}
+	if conf.DeliveryTimeout == 0 {
+		conf.DeliveryTimeout = consensus.DefaultDeliveryTimeout
+	}
+	if conf.ConflictPolicy == "" {
+		conf.ConflictPolicy = consensus.PolicyCausal
+	}
+	if conf.TxnTimeout == 0 {
+		conf.TxnTimeout = txn.DefaultTimeout
+	}
+	return conf
+}
+
+// envInt -> overwrite dest with the named integer environment variable, if set
+func envInt(name string, dest *int) error {
+	val := os.Getenv(name)
+	if val == "" {
+		return nil
+	}
+
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q", name, val)
+	}
+
+	*dest = n
+	return nil
+}
+
+// envDuration -> overwrite dest with the named duration environment variable, if set
+func envDuration(name string, dest *time.Duration) error {
+	val := os.Getenv(name)
+	if val == "" {
+		return nil
+	}
+
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q", name, val)
+	}
+
+	*dest = d
+	return nil
+}
@@ -0,0 +1,118 @@
+package node
+
+import (
+	"errors"
+	msg "kv-store/Messages"
+	raft "kv-store/SystemServices/Raft"
+	"strings"
+	"time"
+)
+
+// actionLeader -> asks a member of a shard which member leads its raft group
+const actionLeader = "raft_leader"
+
+var (
+	// ErrLinearizableDisabled -> a linearizable request reached a node not running raft
+	ErrLinearizableDisabled = errors.New("linearizable mode is disabled")
+
+	// ErrNoLeader -> the raft group of the shard is electing a leader
+	ErrNoLeader = errors.New("raft group has no leader")
+)
+
+// useRaft -> run a raft group with the other replicas of our shard. Committed writes
+// are stored in our database.
+func (node *Node) useRaft(group []string) error {
+	call := func(peer, action string, payload []byte, deadline time.Time) ([]byte, error) {
+		reply, err := node.Call(peer, action, payload, deadline)
+		return reply.Payload, err
+	}
+
+	apply := func(command []byte) []byte {
+		entry := strings.SplitN(string(command), ":", 2)
+		if len(entry) != 2 {
+			return nil
+		}
+
+		ack, err := node.Store(entry[0], entry[1])
+		if err != nil {
+			logger.Write("applying raft command failed: " + err.Error())
+		}
+		return ack
+	}
+
+	node.raft = raft.New(node.ID, group, call, apply, node.Stats)
+	node.raft.UseTimeouts(node.conf.RaftElectionTimeout, node.conf.RaftHeartbeat)
+
+	handlers := map[string]Handler{
+		raft.ActionVote:   func(Msg msg.Msg) ([]byte, error) { return node.raft.HandleVote(Msg.Payload) },
+		raft.ActionAppend: func(Msg msg.Msg) ([]byte, error) { return node.raft.HandleAppend(Msg.Payload) },
+		actionLeader:      func(Msg msg.Msg) ([]byte, error) { return []byte(node.raft.Leader()), nil },
+	}
+	for action, h := range handlers {
+		if err := node.Handle(action, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Linearizable -> whether every request for the key must be linearizable, which
+// holds for keys in a linearizable namespace, e.g. config/leader
+func (node *Node) Linearizable(key string) bool {
+	for _, namespace := range node.conf.Linearizable {
+		if strings.HasPrefix(key, namespace+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// RaftLeader -> the leader of the raft group of the shard holding the key. When the
+// key belongs to another shard its members are asked for their leader.
+func (node *Node) RaftLeader(key string, deadline time.Time) (string, error) {
+	if node.raft == nil {
+		return "", ErrLinearizableDisabled
+	}
+
+	members := node.ShardGroups[node.GetMatch(key)]
+	for _, member := range members {
+		if member == node.ID {
+			if leader := node.raft.Leader(); leader != "" {
+				return leader, nil
+			}
+			return "", ErrNoLeader
+		}
+	}
+
+	for _, member := range members {
+		reply, err := node.Call(member, actionLeader, nil, deadline)
+		if err == nil && len(reply.Payload) > 0 {
+			return reply.PayloadToStr(), nil
+		}
+	}
+	return "", ErrNoLeader
+}
+
+// LinearPut -> commit the write through the raft group of our shard, returning
+// whether the key was created or updated. Only the leader accepts writes.
+func (node *Node) LinearPut(key, val string, deadline time.Time) ([]byte, error) {
+	if node.raft == nil {
+		return nil, ErrLinearizableDisabled
+	}
+	return node.raft.Propose([]byte(key+":"+val), deadline)
+}
+
+// LinearGet -> read the key once our lease as leader confirms no other member can
+// have committed a newer write
+func (node *Node) LinearGet(key string, deadline time.Time) ([]byte, error) {
+	if node.raft == nil {
+		return nil, ErrLinearizableDisabled
+	}
+
+	if err := node.raft.Read(deadline); err != nil {
+		return nil, err
+	}
+
+	got, _ := node.DB.Get(key)
+	return got, nil
+}
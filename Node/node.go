@@ -1,22 +1,26 @@
 package node
 
 import (
-	"bytes"
-	"errors"
-	"fmt"
 	database "kv-store/Database"
 	log "kv-store/Logging"
 	msg "kv-store/Messages"
 	consensus "kv-store/SystemServices/Consensus"
+	netutil "kv-store/SystemServices/Network"
+	paxos "kv-store/SystemServices/Paxos"
+	raft "kv-store/SystemServices/Raft"
+	stats "kv-store/SystemServices/Stats"
 	protocols "kv-store/SystemServices/SysProtocols"
+	txn "kv-store/SystemServices/Txn"
 	"net"
-	"os"
 	"strconv"
-	"strings"
+	"sync"
+	"time"
 )
 
 var logger log.AsyncLog
 
+var startLogger sync.Once // every node in the process shares the logger
+
 // Node -> Define node structure in order to provide access to the database and
 // network fucntions wrapper
 type Node struct {
@@ -24,46 +28,92 @@ type Node struct {
 	consensus.ConEngine
 	protocols.Protocol
 	database.DB
-	ID      string
-	Port    int
-	IP      string
-	index   int
-	peers   []string
-	actions map[string]interface{}
-	buffer  string
+	ID       string
+	Port     int
+	IP       string
+	index    int
+	peers    []string
+	handlers *registry
+	buffer   string
+	signer   *msg.Signer
+	queue    *workQueue
+	peerRate *netutil.RateLimiter
+	userRate *netutil.RateLimiter
+	conf     Config
+	Stats    *stats.Counters
+	raft     *raft.Raft    // nil unless linearizable mode is enabled
+	paxos    *paxos.Paxos  // single key compare-and-set
+	txn      *txn.Manager  // cross-shard transactions
+	readers  chan struct{} // one slot for every key being read for a snapshot
+	done     chan struct{} // closed on shutdown to stop background loops
+	stopping *sync.Once
 }
 
-// parseEnv -> exctract the initial view of the system from the os environment
-func parseEnv() (string, []string, string, int, int, error) {
-	addr := os.Getenv("ADDRESS")
+// NewNode -> initialize a node from the os environment, nodes talk to each other over
+// mutual tls when certificates are configured and plain udp otherwise
+func NewNode() (*Node, error) {
+	conf, err := parseEnv()
 
-	if addr == "" {
-		err := errors.New("os environment variables not set")
-		panic(err)
+	if err != nil {
+		return new(Node), err
 	}
 
-	view := strings.Split(os.Getenv("VIEW"), ",")
-	replFactor, _ := strconv.Atoi(os.Getenv("REPL_FACTOR"))
-	ip := strings.Split(addr, ":")[0]
-	port, _ := strconv.Atoi(strings.Split(addr, ":")[1])
+	transport, err := newTransport(conf)
+	if err != nil {
+		return new(Node), err
+	}
 
-	return addr, view, ip, port, replFactor, nil
+	return NewNodeFromConfig(conf, transport)
 }
 
-// NewNode -> initialize a node structure and the dependent protocols
-func NewNode() (*Node, error) {
-	node := new(Node)
+// newTransport -> construct the transport described by the config
+func newTransport(conf Config) (netutil.Transport, error) {
+	if conf.TLSCert == "" {
+		host, portStr, _ := net.SplitHostPort(conf.Addr)
+		port, _ := strconv.Atoi(portStr)
 
-	addr, view, ip, port, replFactor, err := parseEnv()
+		return netutil.NewUDP(host, port, netutil.DefaultUDPBuffer), nil
+	}
 
+	tlsConfig, err := netutil.LoadTLSConfig(conf.TLSCert, conf.TLSKey, conf.TLSCA)
+	if err != nil {
+		return nil, err
+	}
+
+	return netutil.NewTLS(conf.Addr, conf.View, conf.TLSPortOffset, tlsConfig)
+}
+
+// NewNodeFromConfig -> initialize a node structure and the dependent protocols on top
+// of the given transport
+func NewNodeFromConfig(conf Config, transport netutil.Transport) (*Node, error) {
+	node := new(Node)
+
+	conf, err := conf.withDefaults().normalize()
 	if err != nil {
 		return node, err
 	}
+	node.conf = conf
+
+	addr, view, replFactor := conf.Addr, conf.View, conf.ReplFactor
+	ip, portStr, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portStr)
 
 	node.ID = addr
 	node.Port = port
 	node.IP = ip
 	node.peers = view
+	node.Stats = stats.New()
+	node.done = make(chan struct{})
+	node.stopping = &sync.Once{}
+	node.queue = newWorkQueue(conf.ClientQueueSize, conf.BackgroundQueueSize, node.Stats)
+
+	// token buckets guarding the node listener and the client api
+	node.peerRate = netutil.NewRateLimiter(float64(conf.PeerRate), conf.PeerBurst)
+	node.userRate = netutil.NewRateLimiter(float64(conf.ClientRate), conf.ClientBurst)
+	node.Stats.Set("rate_limit_peer_per_sec", int64(conf.PeerRate))
+	node.Stats.Set("rate_limit_peer_burst", int64(conf.PeerBurst))
+	node.Stats.Set("rate_limit_client_per_sec", int64(conf.ClientRate))
+	node.Stats.Set("rate_limit_client_burst", int64(conf.ClientBurst))
 
 	// create database, partitioner and consensus engine
 	node.DB.NewDB()
@@ -71,7 +121,7 @@ func NewNode() (*Node, error) {
 
 	var peerReps []string
 	var ok error
-	peerReps, ok = node.PeerReplicas(node.IP)
+	peerReps, ok = node.PeerReplicas(node.ID)
 	if ok != nil {
 		return node, ok
 	}
@@ -81,21 +131,68 @@ func NewNode() (*Node, error) {
 	if ok != nil {
 		return node, ok
 	}
-	node.ConEngine.NewConEngine(ip, port, numReps, node.peers)
+	node.ConEngine.NewConEngine(node.ID, numReps, node.peers, transport)
+	node.UseStats(node.Stats)
+	node.UseCompression(conf.Compression, conf.CompressThreshold)
+	if conf.ReadTimeout != 0 {
+		node.UseReadTimeout(conf.ReadTimeout)
+	}
+	if conf.WriteTimeout != 0 {
+		node.UseWriteTimeout(conf.WriteTimeout)
+	}
+	if conf.CausalWait != 0 {
+		node.UseCausalWait(conf.CausalWait)
+	}
+	node.UseCausalDelivery(conf.DeliveryLimit, conf.DeliveryTimeout)
+	node.UseShard(node.GetShardID(node.ID))
+	if ok = node.UseConflictPolicy(conf.ConflictPolicy); ok != nil {
+		return node, ok
+	}
+	if conf.MaxClockDrift != 0 {
+		node.UseMaxClockDrift(conf.MaxClockDrift)
+	}
+
+	if conf.Secret != "" {
+		node.signer = msg.NewSigner(conf.ReplayWindow, []byte(conf.Secret), []byte(conf.PreviousSecret))
+		node.UseSigner(node.signer)
+	}
+
 	node.AddConsensusEngine(node.ConEngine)
-	node.Protocol.NewProtocol(node.IP, peerReps, node.DB)
+	node.UseHints(conf.HintLimit, conf.HintMaxAge, node.Stats)
+	node.Protocol.NewProtocol(node.ID, peerReps, node.DB)
 
-	// construct function mapping
-	node.actions = map[string]interface{}{
-		"signal": node.Signal,
-		"read":   "",
-		"put":    node.RemotePut,
-		"get":    node.RemoteGet,
-		"gossip": node.RecvGossip,
+	// register the handlers for each message type
+	node.handlers = newRegistry()
+	if ok = node.registerHandlers(); ok != nil {
+		return node, ok
+	}
+
+	if ok = node.usePaxos(); ok != nil {
+		return node, ok
 	}
 
-	logger = *log.New(nil) // create logger
-	go logger.Start()
+	if ok = node.useTransactions(); ok != nil {
+		return node, ok
+	}
+
+	if ok = node.useSnapshots(); ok != nil {
+		return node, ok
+	}
+
+	if conf.Raft {
+		if ok = node.useRaft(peerReps); ok != nil {
+			return node, ok
+		}
+	}
+
+	if conf.RPCTimeout != 0 {
+		node.UseRPCTimeout(conf.RPCTimeout)
+	}
+
+	startLogger.Do(func() {
+		logger = *log.New(nil) // create logger
+		go logger.Start()
+	})
 
 	return node, nil
 }
@@ -106,104 +203,320 @@ func Info() {
 }
 
 // ServerDaemon -> listens to clients as a go routine and hands off
-// any requests to the request handler.
+// any requests to a bounded pool of workers.
 func (node *Node) ServerDaemon() error {
+	defer node.Transport.Close() // close connection when function returns
+	defer node.queue.close()
 
-	p := make([]byte, 1024)
-	oob := make([]byte, 1024)
-	buffer := bytes.NewBuffer(p)
-
-	// listen to all addresses
-	addr := net.UDPAddr{
-		Port: node.Port,
-		IP:   net.ParseIP("0.0.0.0"),
+	for i := 0; i < node.conf.Workers; i++ {
+		go node.worker(node.queue)
 	}
 
-	conn, err := net.ListenUDP("udp", &addr)
-	defer conn.Close() // close connection when function returns
-
-	if err != nil {
-		return fmt.Errorf("Failed to create socket %g", err)
-	}
-
-	// continuously listen to our connection
+	// continuously listen to our transport
 	for {
-		_, _, _, _, err = conn.ReadMsgUDP(buffer.Bytes(), oob)
+		msgDecode, from, err := node.Recv()
+
+		if err == netutil.ErrClosed {
+			return nil
+		}
 
 		if err != nil {
-			return fmt.Errorf("ReadMsgUDP error %g", err)
+			node.Stats.Inc("dropped_bad_packet")
+			logger.Write("dropping packet from " + from + ": " + err.Error())
+			continue
 		}
 
-		// we got a packet, determine which action to take
-		if len(buffer.Bytes()) > 0 {
-			go node.MessageHandler(*buffer)
+		// we got a packet, queue it for the next free worker unless the sender
+		// has used up its rate limit
+		node.Stats.Inc("messages_received")
+		if !node.peerRate.Allow(netutil.HostOf(from)) {
+			node.Stats.Inc("dropped_rate_limited_peer")
+			continue
 		}
+
+		node.queue.push(msgDecode)
 	}
 }
 
-// MessageHandler -> Handle internal messages between shard replicas
-func (node *Node) MessageHandler(buffer bytes.Buffer) error {
-	msgDecode := node.Decode(buffer)
+// authenticate -> drop messages that were not signed with the cluster secret, that
+// were signed outside of the replay window or that we have already received
+func (node *Node) authenticate(msgDecode msg.Msg) error {
+	if node.signer == nil {
+		return nil
+	}
 
-	action := string(msgDecode.Action)
+	err := node.signer.Verify(msgDecode)
 
-	// loop through actions map
-	for k, v := range node.actions {
-		if k != action {
-			continue
-		}
+	switch err {
+	case msg.ErrBadSignature:
+		node.Stats.Inc("dropped_bad_signature")
+	case msg.ErrExpired:
+		node.Stats.Inc("dropped_expired")
+	case msg.ErrReplayed:
+		node.Stats.Inc("dropped_replayed")
+	}
 
-		switch k {
+	if err != nil {
+		logger.Write("dropping " + msgDecode.Action + " from " + msgDecode.SrcAddr + ": " + err.Error())
+	}
+	return err
+}
 
-		case "signal":
-			v.(func())()
+// MessageHandler -> Handle internal messages between shard replicas
+func (node *Node) MessageHandler(msgDecode msg.Msg) error {
+	if err := node.authenticate(msgDecode); err != nil {
+		return err
+	}
 
-		case "put":
-			key := strings.Split(msgDecode.PayloadToStr(), ":")[0]
-			val := strings.Split(msgDecode.PayloadToStr(), ":")[1]
+	msgDecode, err := node.Decompress(msgDecode)
+	if err != nil {
+		node.Stats.Inc("dropped_bad_payload")
+		logger.Write("dropping " + msgDecode.Action + " from " + msgDecode.SrcAddr + ": " + err.Error())
+		return err
+	}
 
-			// update vector clock
-			node.Increment(msgDecode.SrcAddr)
-			v.(func(string, string))(key, val)
+	// replies are handed to the call waiting for them. What the replica had seen
+	// is not applied here, so its clock is not merged into ours.
+	if msgDecode.Reply {
+		return node.Resolve(msgDecode)
+	}
 
-		case "get":
-			// update vector clock
-			node.Increment(msgDecode.SrcAddr)
-			v.(func(msg.Msg))(msgDecode)
+	// writes wait until the writes they depend on have been applied
+	if causalActions[msgDecode.Action] {
+		for _, ready := range node.Hold(msgDecode) {
+			err = node.apply(ready)
+		}
+		return err
+	}
 
-		case "read":
-			// publish a message to the causal consensus engine
-			node.Deliver(msgDecode)
+	return node.apply(msgDecode)
+}
+
+// apply -> run the handler for the message and answer the caller
+func (node *Node) apply(msgDecode msg.Msg) error {
+	var reply []byte
 
-		case "gossip":
-			v.(func(msg.Msg, consensus.ConEngine, database.DB))(msgDecode, node.ConEngine, node.DB)
+	h, err := node.handlers.lookup(msgDecode.Action)
+	if err != nil {
+		node.Stats.Inc("dropped_unknown_action")
+		logger.Write("dropping message from " + msgDecode.SrcAddr + ": " + err.Error())
+	} else {
+		reply, err = h(msgDecode)
+	}
 
-		default:
-			logger.Write("case_default")
+	// answer the caller if the message was a call, answers to reads carry the
+	// timestamp of the value read, read along with it
+	if msgDecode.ID != "" {
+		stamp := ""
+		if msgDecode.Action == "get" && err == nil {
+			read, _ := node.DB.GetWrite(msgDecode.PayloadToStr())
+			reply, stamp = read.Value, read.Stamp
 		}
+		return node.ReplyAt(msgDecode, reply, stamp, err)
 	}
 
-	return nil
+	return err
 }
 
 // RemoteGet -> This node has a specified key, retreive it and send it back to client node
-func (node *Node) RemoteGet(Msg msg.Msg) {
+func (node *Node) RemoteGet(Msg msg.Msg) ([]byte, error) {
 	got, _ := node.DB.Get(Msg.PayloadToStr())
 
-	src := Msg.SrcAddr
-	Msg.Payload = bytes.NewReader(got)
-	Msg.SrcAddr = node.ID
-	Msg.Action = "read"
-
-	// send value back to source node
-	logger.Write("sending retrieved token: " + Msg.PayloadToStr() + " back to " + src)
-	node.Send(src, Msg)
+	// the value is sent back to the source node as our reply
+	logger.Write("sending retrieved token: " + string(got) + " back to " + Msg.SrcAddr)
+	return got, nil
 }
 
 // RemotePut -> Insert the key, value pair into our local database
-func (node *Node) RemotePut(key string, val string) {
+func (node *Node) RemotePut(key string, val string) error {
+	logger.Write("putting key->val into my database...")
+	return node.DB.Put(key, val)
+}
+
+// Store -> Insert the key, value pair into our local database and return the
+// acknowledgement sent to the coordinating node, telling it whether the key is new.
+// The write is stamped with our clock.
+func (node *Node) Store(key string, val string) ([]byte, error) {
+	return node.StoreAt(key, val, node.Now().String())
+}
+
+// StoreAt -> as Store, for a write stamped by the node that coordinated it. With last
+// writer wins a write older than the value we hold is acknowledged but not applied.
+// The value keeps our clock as the events it depends on.
+func (node *Node) StoreAt(key, val, stamp string) ([]byte, error) {
+	return node.StoreWrite(key, val, stamp, nil)
+}
+
+// StoreWrite -> as StoreAt, for a write carrying the writes it depends on. They are
+// kept as the clock of the value and count as applied here once the write is stored
+// or found to be stale, which releases the writes held until then.
+func (node *Node) StoreWrite(key, val, stamp string, deps map[string]int) ([]byte, error) {
+	lww := node.LastWriterWins()
+	ack, err := node.store(key, val, stamp, deps, "lww_stale_writes", func(ours database.Stored) bool {
+		return !lww || stamp >= ours.Stamp
+	})
+
+	// the client of a write that lost to a later one is told the key was updated
+	if string(ack) == AckStale {
+		ack = []byte(AckUpdated)
+	}
+	return ack, err
+}
+
+// StoreCopy -> as StoreWrite, for a copy of an earlier write such as a read repair.
+// Whatever the conflict policy, the copy is acknowledged as stale and not applied
+// when the value we hold was set by a later write: one depending on it or, when
+// their clocks do not tell, one stamped later.
+func (node *Node) StoreCopy(key, val, stamp string, deps map[string]int) ([]byte, error) {
+	return node.store(key, val, stamp, deps, "stale_repairs", func(ours database.Stored) bool {
+		return !outdated(ours, stamp, deps)
+	})
+}
+
+// store -> put the write unless it does not replace the value we hold, counting the
+// writes dropped under the stale stat. The check and the put are one step, so a
+// write racing ours can not slip between them.
+func (node *Node) store(key, val, stamp string, deps map[string]int, stale string, replaces func(ours database.Stored) bool) ([]byte, error) {
 	logger.Write("putting key->val into my database...")
-	node.DB.Put(key, val)
+	stored, created, err := node.DB.PutWriteIf(key, val, stamp, deps, replaces)
+	if err != nil {
+		return nil, err
+	}
+	node.Applied(deps)
+
+	switch {
+	case !stored:
+		node.Stats.Inc(stale)
+		return []byte(AckStale), nil
+	case created:
+		return []byte(AckCreated), nil
+	}
+	return []byte(AckUpdated), nil
+}
+
+// outdated -> whether the value we hold was set by a write after the one given
+func outdated(ours database.Stored, stamp string, deps map[string]int) bool {
+	if deps != nil && ours.Clock != nil {
+		switch consensus.VectorClock(deps).Compare(ours.Clock) {
+		case consensus.Before:
+			return true
+		case consensus.After:
+			return false
+		}
+	}
+	return stamp < ours.Stamp
+}
+
+// ReadRepair -> send the latest value of a key to every replica that answered a read
+// with a stale one. Divergent replicas are then fixed on the read path instead of
+// waiting for gossip. Only the repairs a replica applied are counted.
+func (node *Node) ReadRepair(key string, latest msg.Msg, stale []string) {
+	// a missing key can not be written back, and a value without a stamp can not be
+	// ordered against the one a replica holds
+	if len(latest.Payload) == 0 || latest.Stamp == "" {
+		return
+	}
+
+	// the repair keeps the timestamp of the write it copies
+	put := msg.Msg{Action: protocols.ActionRepair, Payload: []byte(key + ":" + latest.PayloadToStr()), Stamp: latest.Stamp}
+	for _, replica := range stale {
+		var ack []byte
+		var err error
+		if replica == node.ID {
+			ack, err = node.StoreCopy(key, latest.PayloadToStr(), latest.Stamp, nil)
+		} else {
+			var reply msg.Msg
+			reply, err = node.CallMsg(replica, put, node.RPCDeadline())
+			ack = reply.Payload
+		}
+
+		switch {
+		case err != nil:
+			node.Stats.Inc("read_repair_failures")
+			logger.Write("read repair of " + key + " on " + replica + " failed: " + err.Error())
+		case string(ack) != AckStale:
+			node.Stats.Inc("read_repairs")
+		}
+	}
+}
+
+// ClientCert -> the certificate and key the client api is served with over https,
+// both empty when it is served over plain http
+func (node *Node) ClientCert() (string, string) {
+	return node.conf.HTTPSCert, node.conf.HTTPSKey
+}
+
+// AllowClient -> take a token from the rate limit of a client ip, returns false if
+// the client has sent too many requests
+func (node *Node) AllowClient(ip string) bool {
+	if node.userRate.Allow(ip) {
+		return true
+	}
+
+	node.Stats.Inc("dropped_rate_limited_client")
+	return false
+}
+
+// Shutdown -> stop listening for messages from other nodes
+func (node *Node) Shutdown() error {
+	node.stopping.Do(func() {
+		close(node.done)
+	})
+	return node.Transport.Close()
+}
+
+// hintedHandoff -> periodically probe the replicas holding hints, so writes they
+// missed are handed off even when no new write reaches them
+func (node *Node) hintedHandoff(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			node.ReplayAllHints()
+		case <-node.done:
+			return
+		}
+	}
+}
+
+// resolveTransactions -> periodically ask for the decision of the transactions whose
+// intents we have held for too long
+func (node *Node) resolveTransactions(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			node.ResolveTransactions()
+		case <-node.done:
+			return
+		}
+	}
+}
+
+// causalDelivery -> apply held writes once the writes they depend on have been
+// applied, or once they have waited for too long
+func (node *Node) causalDelivery() {
+	for {
+		// watch the clock before releasing so no advance is missed
+		changed := node.ClockChanged()
+		for _, ready := range node.Release() {
+			node.apply(ready)
+		}
+
+		timer := time.NewTimer(node.NextRelease())
+		select {
+		case <-changed:
+		case <-timer.C:
+		case <-node.done:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
 }
 
 // RunBackendSystem -> run all system level protocols needed to initiate the key value store
@@ -211,6 +524,20 @@ func (node *Node) RunBackendSystem() {
 	// run the server daemon in the background
 	go node.ServerDaemon()
 
+	// apply writes that arrived before the writes they depend on
+	go node.causalDelivery()
+
+	// elect a leader for the raft group of our shard
+	if node.raft != nil {
+		go node.raft.Run(node.done)
+	}
+
+	// hand off writes missed by replicas that were unreachable
+	go node.hintedHandoff(node.conf.HintInterval)
+
+	// settle transactions whose coordinator did not tell us the decision
+	go node.resolveTransactions(node.conf.TxnTimeout)
+
 	// use the peer to peer connectivity protocol to ensure all nodes up
 	//go node.InitGossipProtocol(node.ConEngine)
 }
@@ -0,0 +1,704 @@
+package node
+
+import (
+	msg "kv-store/Messages"
+	netutil "kv-store/SystemServices/Network"
+	protocols "kv-store/SystemServices/SysProtocols"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestCluster -> start every node in the view on a shared in memory network
+func newTestCluster(t *testing.T, base Config) ([]*Node, *netutil.MemNetwork) {
+	mem := netutil.NewMemNetwork()
+	nodes := make([]*Node, len(base.View))
+
+	for i, addr := range base.View {
+		conf := base
+		conf.Addr = addr
+
+		n, err := NewNodeFromConfig(conf, mem.Join(addr, 64))
+		if err != nil {
+			t.Fatalf("Failed to create node %v: %v", addr, err)
+		}
+		n.RunBackendSystem()
+		nodes[i] = n
+	}
+
+	return nodes, mem
+}
+
+func shutdownCluster(nodes []*Node) {
+	for _, n := range nodes {
+		n.Shutdown()
+	}
+}
+
+// waitFor -> poll cond until it holds or the timeout expires
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestReplicatedPut(t *testing.T) {
+	view := []string{"127.0.0.1:13801", "127.0.0.1:13802"}
+	nodes, _ := newTestCluster(t, Config{View: view, ReplFactor: 2})
+	defer shutdownCluster(nodes)
+
+	local := nodes[0].KeyOp(msg.Msg{SrcAddr: nodes[0].ID, Payload: []byte("key0:value0"), Action: "put"}, nodes[0].RPCDeadline())
+	if !local {
+		t.Fatalf("Single shard cluster should store every key locally")
+	}
+
+	ok := waitFor(time.Second, func() bool {
+		got, _ := nodes[1].DB.Get("key0")
+		return string(got) == "value0"
+	})
+	if !ok {
+		t.Errorf("Put was not replicated to %v", nodes[1].ID)
+	}
+}
+
+func TestReplicatedGet(t *testing.T) {
+	view := []string{"127.0.0.1:13801", "127.0.0.1:13802"}
+	nodes, _ := newTestCluster(t, Config{View: view, ReplFactor: 2})
+	defer shutdownCluster(nodes)
+
+	for _, n := range nodes {
+		n.DB.Put("key0", "value0")
+	}
+
+	// a quorum of two requires the remote replica to answer
+	id := nodes[0].NewEventStream()
+	getMsg := msg.Msg{SrcAddr: nodes[0].ID, Payload: []byte("key0"), ID: id, Action: "get"}
+	if nodes[0].KeyOp(getMsg, nodes[0].RPCDeadline()) {
+		got, _ := nodes[0].DB.Get("key0")
+		getMsg.Payload = got
+		nodes[0].Deliver(nodes[0].Encode(getMsg))
+	}
+
+	done := make(chan msg.Msg)
+	go func() {
+		result, _ := nodes[0].OrderEvents(id, nodes[0].ReadDeadline())
+		done <- result
+	}()
+
+	select {
+	case result := <-done:
+		if result.PayloadToStr() != "value0" {
+			t.Errorf("Did not read the remote value. Expected %q, got %q", "value0", result.PayloadToStr())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Get never received a reply from the remote replica")
+	}
+}
+
+func TestSignedMessages(t *testing.T) {
+	view := []string{"127.0.0.1:13801", "127.0.0.1:13802"}
+	nodes, mem := newTestCluster(t, Config{View: view, ReplFactor: 2, Secret: "secret", ReplayWindow: 200 * time.Millisecond})
+	defer shutdownCluster(nodes)
+
+	// signed messages between members are accepted
+	nodes[0].KeyOp(msg.Msg{SrcAddr: nodes[0].ID, Payload: []byte("key0:value0"), Action: "put"}, nodes[0].RPCDeadline())
+	ok := waitFor(time.Second, func() bool {
+		got, _ := nodes[1].DB.Get("key0")
+		return string(got) == "value0"
+	})
+	if !ok {
+		t.Fatalf("Signed put was not applied on %v", nodes[1].ID)
+	}
+
+	intruder := mem.Join("127.0.0.1:13899", 8)
+	forged := msg.NewSigner(time.Minute, []byte("guess"))
+	captured := msg.NewSigner(time.Minute, []byte("secret")).Sign(msg.Msg{SrcAddr: view[0], Payload: []byte("key1:evil"), Action: "put"})
+
+	scenarios := []struct {
+		name    string
+		message msg.Msg
+		counter string
+	}{
+		{name: "unsigned", message: msg.Msg{SrcAddr: view[0], Payload: []byte("key1:evil"), Action: "put"}, counter: "dropped_bad_signature"},
+		{name: "wrong secret", message: forged.Sign(msg.Msg{SrcAddr: view[0], Payload: []byte("key1:evil"), Action: "put"}), counter: "dropped_bad_signature"},
+		{name: "replayed", message: captured, counter: "dropped_expired"},
+	}
+
+	for _, s := range scenarios {
+		before := nodes[1].Stats.Get(s.counter)
+		if s.name == "replayed" {
+			time.Sleep(300 * time.Millisecond) // let the captured message fall out of the window
+		}
+		intruder.Send(view[1], s.message)
+
+		if !waitFor(time.Second, func() bool { return nodes[1].Stats.Get(s.counter) == before+1 }) {
+			t.Errorf("Scenario %v: message was not counted as %v", s.name, s.counter)
+		}
+	}
+
+	if got, _ := nodes[1].DB.Get("key1"); len(got) != 0 {
+		t.Errorf("Rejected put was applied, got %q", got)
+	}
+}
+
+func TestCompressedSignedReplies(t *testing.T) {
+	view := []string{"127.0.0.1:13801", "127.0.0.1:13802"}
+	nodes, _ := newTestCluster(t, Config{
+		View:              view,
+		ReplFactor:        2,
+		Secret:            "secret",
+		ReplayWindow:      time.Minute,
+		Compression:       []string{msg.CodecGzip},
+		CompressThreshold: 64,
+	})
+	defer shutdownCluster(nodes)
+
+	value := strings.Repeat("value", 50)
+
+	// the put tells the replica which codecs we accept
+	nodes[0].KeyOp(msg.Msg{SrcAddr: nodes[0].ID, Payload: []byte("key0:" + value), Action: "put"}, nodes[0].RPCDeadline())
+	nodes[0].DB.Put("key0", value)
+	if !waitFor(time.Second, func() bool { got, _ := nodes[1].DB.Get("key0"); return string(got) == value }) {
+		t.Fatalf("Put was not applied on %v", nodes[1].ID)
+	}
+
+	// the replica answers our read with a compressed payload
+	id := nodes[0].NewEventStream()
+	getMsg := msg.Msg{SrcAddr: nodes[0].ID, Payload: []byte("key0"), ID: id, Action: "get"}
+	nodes[0].KeyOp(getMsg, nodes[0].RPCDeadline())
+	getMsg.Payload = []byte(value)
+	nodes[0].Deliver(nodes[0].Encode(getMsg))
+
+	done := make(chan msg.Msg)
+	go func() {
+		result, _ := nodes[0].OrderEvents(id, nodes[0].ReadDeadline())
+		done <- result
+	}()
+
+	select {
+	case result := <-done:
+		if result.PayloadToStr() != value {
+			t.Errorf("Did not read the remote value, got %q", result.PayloadToStr())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Get never received a reply from the remote replica")
+	}
+
+	if nodes[1].Stats.Get("compression_bytes_saved") <= 0 {
+		t.Errorf("Replica did not compress its reply")
+	}
+}
+
+func TestGossipExchange(t *testing.T) {
+	view := []string{"127.0.0.1:13801", "127.0.0.1:13802"}
+	nodes, _ := newTestCluster(t, Config{View: view, ReplFactor: 2})
+	defer shutdownCluster(nodes)
+
+	nodes[0].DB.Put("key0", "value0")
+	nodes[1].DB.Put("key1", "value1")
+
+	p, _ := nodes[0].DB.ToByteArray()
+	reply, err := nodes[0].Call(nodes[1].ID, "gossip", p, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("Gossip call failed: %v", err)
+	}
+
+	// the replica merged our database and answered with its own
+	if got, _ := nodes[1].DB.Get("key0"); string(got) != "value0" {
+		t.Errorf("Replica did not merge the gossiped database, got %q", got)
+	}
+
+	contents, err := nodes[0].DB.ByteArrayToMap(reply.Payload)
+	if err != nil {
+		t.Fatalf("Gossip reply is not a database: %v", err)
+	}
+	if contents["key1"] != "value1" || contents["key0"] != "value0" {
+		t.Errorf("Gossip reply does not hold the replica database, got %v", contents)
+	}
+}
+
+func TestPutCallReply(t *testing.T) {
+	view := []string{"127.0.0.1:13801", "127.0.0.1:13802"}
+	nodes, _ := newTestCluster(t, Config{View: view, ReplFactor: 2})
+	defer shutdownCluster(nodes)
+
+	scenarios := []struct {
+		payload string
+		ack     string
+	}{
+		{payload: "key0:a:b", ack: AckCreated},
+		{payload: "key0:a:b", ack: AckUpdated},
+	}
+
+	for _, s := range scenarios {
+		reply, err := nodes[0].Call(nodes[1].ID, "put", []byte(s.payload), time.Now().Add(time.Second))
+		if err != nil {
+			t.Fatalf("Put call failed: %v", err)
+		}
+		if reply.PayloadToStr() != s.ack {
+			t.Errorf("Expected the put to be acknowledged as %q, got %q", s.ack, reply.PayloadToStr())
+		}
+		if got, _ := nodes[1].DB.Get("key0"); string(got) != "a:b" {
+			t.Errorf("Put was not applied before the reply, got %q", got)
+		}
+	}
+
+	if _, err := nodes[0].Call(nodes[1].ID, "put", []byte("malformed"), time.Now().Add(time.Second)); err == nil {
+		t.Errorf("Expected the replica to reject a malformed put")
+	}
+}
+
+func TestMergeAppliedWrites(t *testing.T) {
+	view := []string{"127.0.0.1:13801", "127.0.0.1:13802"}
+	nodes, _ := newTestCluster(t, Config{View: view, ReplFactor: 2})
+	defer shutdownCluster(nodes)
+	a, b := nodes[0], nodes[1]
+
+	// each node has coordinated writes the other has not applied
+	for i := 0; i < 3; i++ {
+		a.Increment(a.ID)
+		b.Increment(b.ID)
+	}
+
+	scenarios := []struct {
+		action  string
+		payload string
+		merged  bool
+	}{
+		{action: "get", payload: "key0"},
+		{action: "missing_action", payload: "key0"},
+		{action: "put", payload: "malformed"},
+		{action: "put", payload: "key0:value0", merged: true},
+	}
+
+	for i, s := range scenarios {
+		a.Call(b.ID, s.action, []byte(s.payload), time.Now().Add(time.Second))
+
+		expect := 0
+		if s.merged {
+			expect = 3
+		}
+		if got := b.Clock()[a.ID]; got != expect {
+			t.Errorf("Scenario %d: expected the replica to have seen %d writes of the coordinator, got %d", i, expect, got)
+		}
+
+		// the reply tells the coordinator nothing it has applied
+		if got := a.Clock()[b.ID]; got != 0 {
+			t.Errorf("Scenario %d: reply merged the replica's clock into the coordinator's, got %d", i, got)
+		}
+	}
+}
+
+func TestLastWriterWins(t *testing.T) {
+	view := []string{"127.0.0.1:13801", "127.0.0.1:13802"}
+	nodes, _ := newTestCluster(t, Config{View: view, ReplFactor: 2, ConflictPolicy: "lww"})
+	defer shutdownCluster(nodes)
+
+	earlier := nodes[0].Now().String()
+	later := nodes[0].Now().String()
+
+	scenarios := []struct {
+		payload string
+		stamp   string
+		ack     string
+		expect  string
+	}{
+		{payload: "key0:b", stamp: later, ack: AckCreated, expect: "b"},
+		// an older write reaching the replica late is acknowledged and dropped
+		{payload: "key0:a", stamp: earlier, ack: AckUpdated, expect: "b"},
+		{payload: "key0:c", stamp: later, ack: AckUpdated, expect: "c"},
+	}
+
+	for i, s := range scenarios {
+		put := msg.Msg{Action: "put", Payload: []byte(s.payload), Stamp: s.stamp}
+		reply, err := nodes[0].CallMsg(nodes[1].ID, put, time.Now().Add(time.Second))
+		if err != nil {
+			t.Fatalf("Scenario %d: put call failed: %v", i, err)
+		}
+		if reply.PayloadToStr() != s.ack {
+			t.Errorf("Scenario %d: expected the put to be acknowledged as %q, got %q", i, s.ack, reply.PayloadToStr())
+		}
+		if got, _ := nodes[1].DB.Get("key0"); string(got) != s.expect {
+			t.Errorf("Scenario %d: expected %q, got %q", i, s.expect, got)
+		}
+	}
+	if got := nodes[1].Stats.Get("lww_stale_writes"); got != 1 {
+		t.Errorf("Expected 1 stale write in stats, got %d", got)
+	}
+
+	// reads answer with the timestamp of the value
+	reply, err := nodes[0].Call(nodes[1].ID, "get", []byte("key0"), time.Now().Add(time.Second))
+	if err != nil || reply.Stamp != later {
+		t.Errorf("Expected the read to carry %q, got %q (%v)", later, reply.Stamp, err)
+	}
+
+	// the replica stamps its own writes after those it has received
+	if got := nodes[1].Now().String(); got <= later {
+		t.Errorf("Expected %q to come after %q", got, later)
+	}
+}
+
+func TestPeerRateLimit(t *testing.T) {
+	view := []string{"127.0.0.1:13801", "127.0.0.1:13802"}
+	nodes, mem := newTestCluster(t, Config{View: view, ReplFactor: 2, PeerRate: 1, PeerBurst: 2})
+	defer shutdownCluster(nodes)
+
+	// a flooding sender is limited without affecting other senders
+	flood := mem.Join("127.0.0.9:13800", 8)
+	for i := 0; i < 5; i++ {
+		flood.Send(view[1], msg.Msg{SrcAddr: "127.0.0.9:13800", Action: "signal"})
+	}
+
+	if !waitFor(time.Second, func() bool { return nodes[1].Stats.Get("dropped_rate_limited_peer") == 3 }) {
+		t.Errorf("Expected 3 rate limited messages, got %d", nodes[1].Stats.Get("dropped_rate_limited_peer"))
+	}
+
+	if _, err := nodes[0].Call(view[1], "get", []byte("key0"), time.Now().Add(time.Second)); err != nil {
+		t.Errorf("Member was limited by another sender's flood: %v", err)
+	}
+}
+
+func TestConfigNormalize(t *testing.T) {
+	scenarios := []struct {
+		conf Config
+		addr string
+		view []string
+		err  bool
+	}{
+		{
+			conf: Config{Addr: "Node1:13800", View: []string{"Node1:13800", "node2:13800"}},
+			addr: "node1:13800",
+			view: []string{"node1:13800", "node2:13800"},
+		},
+		{
+			conf: Config{Addr: "[0:0::1]:13801", View: []string{"[::1]:13801", "[0::1]:13802"}},
+			addr: "[::1]:13801",
+			view: []string{"[::1]:13801", "[::1]:13802"},
+		},
+		{conf: Config{Addr: "node1", View: []string{"node1:13800"}}, err: true},
+		{conf: Config{Addr: "node1:13800", View: []string{"fd00::2:13800"}}, err: true},
+		{conf: Config{Addr: "node1:13800", View: []string{"node1:13800"}, ConflictPolicy: "newest"}, err: true},
+		{conf: Config{Addr: "node1:13800", View: []string{"node1:13800"}, TxnTimeout: -time.Second}, err: true},
+		{conf: Config{Addr: "node1:13800", View: []string{"node1:13800"}, MaxClockDrift: -time.Second}, err: true},
+		{conf: Config{Addr: "node1:13800", View: []string{"node1:13800"}, HTTPSCert: "api.crt"}, err: true},
+	}
+
+	for _, s := range scenarios {
+		conf, err := s.conf.normalize()
+		if s.err {
+			if err == nil {
+				t.Errorf("Expected an error normalizing %v", s.conf)
+			}
+			continue
+		}
+
+		if err != nil || conf.Addr != s.addr || !reflect.DeepEqual(conf.View, s.view) {
+			t.Errorf("Expected %v %v, got %v %v (%v)", s.addr, s.view, conf.Addr, conf.View, err)
+		}
+	}
+}
+
+func TestReadRepair(t *testing.T) {
+	view := []string{"127.0.0.1:13801", "127.0.0.1:13802", "127.0.0.1:13803"}
+	nodes, _ := newTestCluster(t, Config{View: view, ReplFactor: 3})
+	defer shutdownCluster(nodes)
+
+	stamps := make([]string, 3)
+	for i := range stamps {
+		stamps[i] = nodes[1].Now().String()
+	}
+
+	// the third replica took a write after the read
+	nodes[0].StoreAt("key0", "value0", stamps[0])
+	nodes[1].StoreAt("key0", "value1", stamps[1])
+	nodes[2].StoreAt("key0", "value2", stamps[2])
+
+	latest := msg.Msg{SrcAddr: nodes[1].ID, Payload: []byte("value1"), Stamp: stamps[1]}
+	nodes[1].ReadRepair("key0", latest, []string{nodes[0].ID, nodes[2].ID})
+
+	for i, expect := range []string{"value1", "value1", "value2"} {
+		if got, _ := nodes[i].DB.Get("key0"); string(got) != expect {
+			t.Errorf("Replica %v: expected %q, got %q", nodes[i].ID, expect, got)
+		}
+	}
+	// the repair the third replica refused is not counted
+	if got := nodes[1].Stats.Get("read_repairs"); got != 1 {
+		t.Errorf("Expected 1 repair in stats, got %d", got)
+	}
+
+	// a missing key is never written back
+	nodes[1].ReadRepair("key1", msg.Msg{SrcAddr: nodes[1].ID}, []string{nodes[0].ID})
+	if _, err := nodes[0].DB.Get("key1"); err == nil {
+		t.Errorf("Repair wrote a missing key")
+	}
+
+	// nor is a value without a stamp
+	nodes[1].ReadRepair("key0", msg.Msg{SrcAddr: nodes[1].ID, Payload: []byte("value3")}, []string{nodes[0].ID})
+	if got, _ := nodes[0].DB.Get("key0"); string(got) != "value1" {
+		t.Errorf("Repair wrote a value without a stamp, got %q", got)
+	}
+	if got := nodes[1].Stats.Get("read_repairs"); got != 1 {
+		t.Errorf("Expected 1 repair in stats, got %d", got)
+	}
+}
+
+func TestStaleRepair(t *testing.T) {
+	view := []string{"127.0.0.1:13801", "127.0.0.1:13802"}
+	nodes, _ := newTestCluster(t, Config{View: view, ReplFactor: 2})
+	defer shutdownCluster(nodes)
+
+	stamps := make([]string, 4)
+	for i := range stamps {
+		stamps[i] = nodes[0].Now().String()
+	}
+	dep := nodes[0].ID + "/0"
+	nodes[1].StoreWrite("key0", "b", stamps[1], map[string]int{dep: 2})
+
+	scenarios := []struct {
+		payload string
+		stamp   string
+		deps    map[string]int
+		ack     string
+		expect  string
+	}{
+		// a repair racing a newer write never rolls the replica back
+		{payload: "key0:a", stamp: stamps[0], ack: AckStale, expect: "b"},
+		// the clocks order the writes before their stamps do
+		{payload: "key0:c", stamp: stamps[2], deps: map[string]int{dep: 1}, ack: AckStale, expect: "b"},
+		{payload: "key0:d", stamp: stamps[3], ack: AckUpdated, expect: "d"},
+	}
+
+	for i, s := range scenarios {
+		repair := msg.Msg{Action: protocols.ActionRepair, Payload: []byte(s.payload), Stamp: s.stamp, Deps: s.deps}
+		reply, err := nodes[0].CallMsg(nodes[1].ID, repair, time.Now().Add(time.Second))
+		if err != nil || reply.PayloadToStr() != s.ack {
+			t.Fatalf("Scenario %d: expected the repair to be acknowledged %q, got %q (%v)", i, s.ack, reply.PayloadToStr(), err)
+		}
+		if got, _ := nodes[1].DB.Get("key0"); string(got) != s.expect {
+			t.Errorf("Scenario %d: expected %q, got %q", i, s.expect, got)
+		}
+	}
+
+	// nor does a repair of our own replica
+	nodes[1].ReadRepair("key0", msg.Msg{SrcAddr: nodes[0].ID, Payload: []byte("a"), Stamp: stamps[0]}, []string{nodes[1].ID})
+	if got, _ := nodes[1].DB.Get("key0"); string(got) != "d" {
+		t.Errorf("Expected the repair to be dropped, got %q", got)
+	}
+	if got := nodes[1].Stats.Get("stale_repairs"); got != 3 {
+		t.Errorf("Expected 3 stale repairs in stats, got %d", got)
+	}
+	if got := nodes[1].Stats.Get("read_repairs"); got != 0 {
+		t.Errorf("Expected no repairs in stats, got %d", got)
+	}
+}
+
+func TestHintedHandoff(t *testing.T) {
+	view := []string{"127.0.0.1:13801", "127.0.0.1:13802"}
+	// a restarted replica has an empty clock and would hold the replayed writes,
+	// see TestCausalDelivery
+	base := Config{View: view, ReplFactor: 2, HintInterval: time.Hour, DeliveryLimit: -1}
+	nodes, mem := newTestCluster(t, base)
+	defer shutdownCluster(nodes)
+
+	put := func(payload string) {
+		nodes[0].KeyOp(msg.Msg{SrcAddr: nodes[0].ID, Payload: []byte(payload), Action: "put"}, nodes[0].RPCDeadline())
+	}
+
+	// the replica misses writes while it is down
+	nodes[1].Shutdown()
+	put("key0:value0")
+	put("key1:value0")
+	if !waitFor(time.Second, func() bool { return nodes[0].Stats.Get("hints_pending") == 2 }) {
+		t.Fatalf("Expected 2 hints, got %d", nodes[0].Stats.Get("hints_pending"))
+	}
+
+	conf := base
+	conf.Addr = view[1]
+	restarted, err := NewNodeFromConfig(conf, mem.Join(conf.Addr, 64))
+	if err != nil {
+		t.Fatalf("Failed to restart node: %v", err)
+	}
+	restarted.RunBackendSystem()
+	defer restarted.Shutdown()
+
+	// a later successful write hands the missed ones off, without replaying the
+	// older hint for the key it writes
+	put("key1:value1")
+
+	expect := map[string]string{"key0": "value0", "key1": "value1"}
+	ok := waitFor(time.Second, func() bool {
+		for key, val := range expect {
+			if got, _ := restarted.DB.Get(key); string(got) != val {
+				return false
+			}
+		}
+		return true
+	})
+	if !ok {
+		t.Errorf("Missed writes were not handed off")
+	}
+	if got := nodes[0].Stats.Get("hints_replayed"); got != 1 {
+		t.Errorf("Expected 1 hint replayed, got %d", got)
+	}
+
+	// the probe hands off writes when nothing else reaches the replica
+	restarted.Shutdown()
+	put("key2:value2")
+	waitFor(time.Second, func() bool { return nodes[0].Stats.Get("hints_pending") == 1 })
+
+	restarted, _ = NewNodeFromConfig(conf, mem.Join(conf.Addr, 64))
+	restarted.RunBackendSystem()
+	defer restarted.Shutdown()
+
+	nodes[0].ReplayAllHints()
+	if got, _ := restarted.DB.Get("key2"); string(got) != "value2" {
+		t.Errorf("Probe did not hand off the missed write, got %q", got)
+	}
+
+	// a hint never replaces a newer write the replica received since
+	restarted.Shutdown()
+	put("key3:value3")
+	waitFor(time.Second, func() bool { return nodes[0].Stats.Get("hints_pending") == 1 })
+
+	restarted, _ = NewNodeFromConfig(conf, mem.Join(conf.Addr, 64))
+	restarted.RunBackendSystem()
+	defer restarted.Shutdown()
+	restarted.StoreAt("key3", "newer", nodes[0].Now().String())
+
+	nodes[0].ReplayAllHints()
+	if got, _ := restarted.DB.Get("key3"); string(got) != "newer" {
+		t.Errorf("Replayed hint replaced a newer write, got %q", got)
+	}
+	if got := restarted.Stats.Get("stale_repairs"); got != 1 {
+		t.Errorf("Expected 1 stale repair in stats, got %d", got)
+	}
+}
+
+func TestCausalDelivery(t *testing.T) {
+	view := []string{"127.0.0.1:13801", "127.0.0.1:13802", "127.0.0.1:13803"}
+	nodes, _ := newTestCluster(t, Config{View: view, ReplFactor: 3, DeliveryTimeout: time.Minute})
+	defer shutdownCluster(nodes)
+	a, b, c := nodes[0], nodes[1], nodes[2]
+	shard := a.GetMatch("key0")
+
+	// a has applied a write by b that has not reached c yet
+	before := b.Written(shard)
+	a.Applied(before)
+	after := a.Written(shard)
+
+	done := make(chan error, 1)
+	go func() {
+		put := msg.Msg{Action: "put", Payload: []byte("key0:after"), Deps: after}
+		_, err := a.CallMsg(c.ID, put, time.Now().Add(10*time.Second))
+		done <- err
+	}()
+
+	if !waitFor(2*time.Second, func() bool { return c.Stats.Get("causal_pending") == 1 }) {
+		t.Fatalf("Expected the write to be held, %d pending", c.Stats.Get("causal_pending"))
+	}
+	if got, _ := c.DB.Get("key0"); len(got) != 0 {
+		t.Errorf("Held write was applied before its predecessor, got %q", got)
+	}
+
+	// the write it depends on arrives and both are applied in order
+	put := msg.Msg{Action: "put", Payload: []byte("key1:before"), Deps: before}
+	if _, err := b.CallMsg(c.ID, put, time.Now().Add(10*time.Second)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Held put failed: %v", err)
+	}
+
+	if got, _ := c.DB.Get("key0"); string(got) != "after" {
+		t.Errorf("Held write was not applied, got %q", got)
+	}
+	if c.Stats.Get("causal_released") != 1 || c.Stats.Get("causal_pending") != 0 {
+		t.Errorf("Expected 1 released write and none pending, got %d and %d",
+			c.Stats.Get("causal_released"), c.Stats.Get("causal_pending"))
+	}
+}
+
+func TestCausalDeliveryAcrossShards(t *testing.T) {
+	view := []string{"127.0.0.1:13801", "127.0.0.1:13802", "127.0.0.1:13803", "127.0.0.1:13804"}
+	nodes, _ := newTestCluster(t, Config{View: view, ReplFactor: 2, DeliveryTimeout: time.Minute})
+	defer shutdownCluster(nodes)
+	a := nodes[0]
+
+	byID := make(map[string]*Node)
+	for _, n := range nodes {
+		byID[n.ID] = n
+	}
+
+	// one key in the shard of a and one in the other shard
+	keys := make(map[bool]string)
+	for i := 0; len(keys) < 2; i++ {
+		key := "key" + strconv.Itoa(i)
+		own := false
+		for _, member := range a.ShardGroups[a.GetMatch(key)] {
+			own = own || member == a.ID
+		}
+		if _, ok := keys[own]; !ok {
+			keys[own] = key
+		}
+	}
+	other := a.GetMatch(keys[false])
+	replica := byID[a.ShardGroups[other][0]]
+
+	// a write to the shard of a is not a dependency of the writes to the other shard
+	put := msg.Msg{SrcAddr: a.ID, Payload: []byte(keys[true] + ":own"), Action: "put", Stamp: a.Now().String()}
+	if sent, local := a.Route(put, a.RPCDeadline()); local {
+		if _, err := a.StoreWrite(keys[true], "own", put.Stamp, sent.Deps); err != nil {
+			t.Fatalf("Local write failed: %v", err)
+		}
+	}
+
+	// two writes to the other shard arrive out of order, the second is released as
+	// soon as the first is applied
+	first, second := a.Written(other), a.Written(other)
+	done := make(chan error, 1)
+	go func() {
+		put := msg.Msg{Action: "put", Payload: []byte(keys[false] + ":second"), Deps: second}
+		_, err := a.CallMsg(replica.ID, put, time.Now().Add(10*time.Second))
+		done <- err
+	}()
+
+	if !waitFor(2*time.Second, func() bool { return replica.Stats.Get("causal_pending") == 1 }) {
+		t.Fatalf("Expected the second write to be held, %d pending", replica.Stats.Get("causal_pending"))
+	}
+
+	put = msg.Msg{Action: "put", Payload: []byte(keys[false] + ":first"), Deps: first}
+	if _, err := a.CallMsg(replica.ID, put, time.Now().Add(10*time.Second)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Held put failed: %v", err)
+	}
+
+	if got, _ := replica.DB.Get(keys[false]); string(got) != "second" {
+		t.Errorf("Writes were not applied in order, got %q", got)
+	}
+
+	// no write waited for the timeout, and the write to the shard of a reached its
+	// replicas without being held
+	for _, n := range nodes {
+		if forced := n.Stats.Get("causal_forced_timeout") + n.Stats.Get("causal_forced_full"); forced != 0 {
+			t.Errorf("Expected no forced writes on %v, got %d", n.ID, forced)
+		}
+	}
+	if got := replica.Stats.Get("causal_released"); got != 1 {
+		t.Errorf("Expected the held write to be released, got %d", got)
+	}
+	for _, member := range a.ShardGroups[a.GetMatch(keys[true])] {
+		n := byID[member]
+		if !waitFor(2*time.Second, func() bool { got, _ := n.DB.Get(keys[true]); return string(got) == "own" }) {
+			t.Errorf("Write to the shard of the coordinator did not reach %v", member)
+		}
+	}
+}
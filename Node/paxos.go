@@ -0,0 +1,151 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	msg "kv-store/Messages"
+	paxos "kv-store/SystemServices/Paxos"
+	"strconv"
+	"time"
+)
+
+// ErrInvalidUpdate -> a compare-and-set with an unknown condition or a bad increment
+var ErrInvalidUpdate = errors.New("invalid compare-and-set")
+
+// usePaxos -> take part in the paxos rounds on the keys of our shard and coordinate
+// the rounds on keys written through us. Decided values are stored in our database.
+func (node *Node) usePaxos() error {
+	call := func(peer, action string, payload []byte, deadline time.Time) ([]byte, error) {
+		reply, err := node.Call(peer, action, payload, deadline)
+		return reply.Payload, err
+	}
+
+	load := func(key string) ([]byte, bool) {
+		got, err := node.DB.Get(key)
+		return got, err == nil
+	}
+
+	store := func(key string, value []byte) error {
+		_, err := node.Store(key, string(value))
+		return err
+	}
+
+	node.paxos = paxos.New(node.ID, call, load, store, node.Stats)
+
+	for _, action := range []string{paxos.ActionPrepare, paxos.ActionAccept, paxos.ActionCommit} {
+		action := action
+		h := func(Msg msg.Msg) ([]byte, error) { return node.paxos.Handle(action, Msg.Payload) }
+		if err := node.Handle(action, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CompareAndSet -> atomically update the key among the replicas of its shard when
+// the condition holds for its current value. Plain writes to the same key are not
+// ordered with compare-and-set and may be lost.
+func (node *Node) CompareAndSet(req msg.CompareAndSet, deadline time.Time) (msg.CASResult, error) {
+	update, err := casUpdate(req)
+	if err != nil {
+		return msg.CASResult{}, err
+	}
+
+	replicas := node.ShardGroups[node.GetMatch(req.Key)]
+	result, err := node.paxos.Propose(req.Key, replicas, update, deadline)
+	if err != nil {
+		return msg.CASResult{}, err
+	}
+
+	return msg.CASResult{Applied: result.Applied, Value: string(result.Value), Exists: result.Exists}, nil
+}
+
+// casUpdate -> the update applied by a round, a key whose value is not an integer
+// can not be incremented and is left as it is
+func casUpdate(req msg.CompareAndSet) (paxos.Update, error) {
+	cond := req.If
+	if !knownCondition(cond.Op) {
+		return nil, fmt.Errorf("%w: unknown condition %q", ErrInvalidUpdate, cond.Op)
+	}
+
+	return func(current []byte, exists bool) ([]byte, bool) {
+		if !holds(cond, string(current), exists) {
+			return nil, false
+		}
+		if req.Add == nil {
+			return []byte(req.Value), true
+		}
+
+		n := int64(0)
+		if exists {
+			var err error
+			if n, err = strconv.ParseInt(string(current), 10, 64); err != nil {
+				return nil, false
+			}
+		}
+		return []byte(strconv.FormatInt(n+*req.Add, 10)), true
+	}, nil
+}
+
+// knownCondition -> whether the condition op is one we can evaluate
+func knownCondition(op string) bool {
+	switch op {
+	case "", "exists", "missing", "=", "!=", "<", "<=", ">", ">=":
+		return true
+	}
+	return false
+}
+
+// holds -> whether the condition holds for the current value, comparisons fail
+// on a missing key
+func holds(cond msg.Condition, current string, exists bool) bool {
+	switch cond.Op {
+	case "":
+		return true
+	case "exists":
+		return exists
+	case "missing":
+		return !exists
+	}
+	if !exists {
+		return false
+	}
+
+	order := compareValues(current, cond.Value)
+	switch cond.Op {
+	case "=":
+		return order == 0
+	case "!=":
+		return order != 0
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	}
+	return order >= 0
+}
+
+// compareValues -> order two values as numbers when both are, otherwise as strings
+func compareValues(a, b string) int {
+	x, errA := strconv.ParseFloat(a, 64)
+	y, errB := strconv.ParseFloat(b, 64)
+	if errA != nil || errB != nil {
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	}
+
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
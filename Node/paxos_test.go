@@ -0,0 +1,51 @@
+package node
+
+import (
+	"errors"
+	msg "kv-store/Messages"
+	"testing"
+)
+
+func TestCasUpdate(t *testing.T) {
+	one, minusTen := int64(1), int64(-10)
+
+	scenarios := []struct {
+		req     msg.CompareAndSet
+		current string
+		exists  bool
+		apply   bool
+		next    string
+	}{
+		{req: msg.CompareAndSet{Value: "a"}, apply: true, next: "a"},
+		{req: msg.CompareAndSet{If: msg.Condition{Op: "missing"}, Value: "a"}, apply: true, next: "a"},
+		{req: msg.CompareAndSet{If: msg.Condition{Op: "missing"}, Value: "a"}, current: "b", exists: true},
+		{req: msg.CompareAndSet{If: msg.Condition{Op: "exists"}, Value: "a"}, current: "b", exists: true, apply: true, next: "a"},
+		{req: msg.CompareAndSet{If: msg.Condition{Op: "=", Value: "b"}, Value: "c"}, current: "b", exists: true, apply: true, next: "c"},
+		{req: msg.CompareAndSet{If: msg.Condition{Op: "!=", Value: "b"}, Value: "c"}, current: "b", exists: true},
+		// numbers compare as numbers, anything else as strings
+		{req: msg.CompareAndSet{If: msg.Condition{Op: "<", Value: "100"}, Add: &one}, current: "99", exists: true, apply: true, next: "100"},
+		{req: msg.CompareAndSet{If: msg.Condition{Op: "<", Value: "100"}, Add: &one}, current: "100", exists: true},
+		{req: msg.CompareAndSet{If: msg.Condition{Op: ">=", Value: "10"}, Add: &minusTen}, current: "9.5", exists: true},
+		{req: msg.CompareAndSet{If: msg.Condition{Op: "<=", Value: "b"}, Value: "c"}, current: "abc", exists: true, apply: true, next: "c"},
+		{req: msg.CompareAndSet{If: msg.Condition{Op: ">", Value: "1"}, Value: "c"}, current: "", exists: false},
+		// a missing key counts from zero, a non integer value can not be incremented
+		{req: msg.CompareAndSet{Add: &one}, apply: true, next: "1"},
+		{req: msg.CompareAndSet{Add: &one}, current: "one", exists: true},
+	}
+
+	for i, s := range scenarios {
+		update, err := casUpdate(s.req)
+		if err != nil {
+			t.Fatalf("Scenario %d: unexpected error %v", i, err)
+		}
+
+		next, apply := update([]byte(s.current), s.exists)
+		if apply != s.apply || string(next) != s.next {
+			t.Errorf("Scenario %d: expected %v %q, got %v %q", i, s.apply, s.next, apply, next)
+		}
+	}
+
+	if _, err := casUpdate(msg.CompareAndSet{If: msg.Condition{Op: "like"}}); !errors.Is(err, ErrInvalidUpdate) {
+		t.Errorf("Expected an unknown condition to be refused, got %v", err)
+	}
+}
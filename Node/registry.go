@@ -0,0 +1,150 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	msg "kv-store/Messages"
+	protocols "kv-store/SystemServices/SysProtocols"
+	"strings"
+	"sync"
+)
+
+// Handler -> handles one type of inter-node message. The returned payload, or
+// error, is sent back to the caller when the message was a call.
+type Handler func(Msg msg.Msg) ([]byte, error)
+
+// ErrUnknownAction -> no handler is registered for the message action
+var ErrUnknownAction = errors.New("unknown action")
+
+// Put acknowledgements, tell the coordinating node whether the key was new. A
+// repair is acknowledged as stale when the replica holds a later value.
+const (
+	AckCreated = "created"
+	AckUpdated = "updated"
+	AckStale   = "stale"
+)
+
+// registry -> handlers keyed by the message action they handle
+type registry struct {
+	m        *sync.RWMutex
+	handlers map[string]Handler
+}
+
+func newRegistry() *registry {
+	return &registry{
+		m:        &sync.RWMutex{},
+		handlers: make(map[string]Handler),
+	}
+}
+
+// register -> add the handler for an action, every action has a single handler
+func (r *registry) register(action string, h Handler) error {
+	if action == "" || h == nil {
+		return errors.New("a handler needs an action and a function")
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if _, ok := r.handlers[action]; ok {
+		return fmt.Errorf("a handler for %q is already registered", action)
+	}
+
+	r.handlers[action] = h
+	return nil
+}
+
+// lookup -> return the handler for an action
+func (r *registry) lookup(action string) (Handler, error) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	h, ok := r.handlers[action]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownAction, action)
+	}
+	return h, nil
+}
+
+// Handle -> register the handler for messages with the given action. Subsystems,
+// including ones outside this package, register their actions at startup before
+// RunBackendSystem is called.
+func (node *Node) Handle(action string, h Handler) error {
+	return node.handlers.register(action, h)
+}
+
+// registerHandlers -> register the actions every node understands
+func (node *Node) registerHandlers() error {
+	builtin := map[string]Handler{
+		"signal":               node.handleSignal,
+		"put":                  node.handlePut,
+		protocols.ActionRepair: node.handleRepair,
+		"get":                  node.handleGet,
+		"gossip":               node.handleGossip,
+	}
+
+	for action, h := range builtin {
+		if err := node.Handle(action, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleSignal -> release anything waiting for this node to be signaled
+func (node *Node) handleSignal(Msg msg.Msg) ([]byte, error) {
+	node.Signal()
+	return nil, nil
+}
+
+// handlePut -> store a key:value pair sent by the coordinating node and acknowledge it
+func (node *Node) handlePut(Msg msg.Msg) ([]byte, error) {
+	entry := strings.SplitN(Msg.PayloadToStr(), ":", 2)
+	if len(entry) != 2 {
+		return nil, errors.New("malformed put " + Msg.PayloadToStr())
+	}
+
+	// writes from nodes that do not stamp them are stamped on arrival
+	stamp := Msg.Stamp
+	if stamp == "" {
+		stamp = node.Now().String()
+	} else if err := node.Observe(stamp); err != nil {
+		return nil, err
+	}
+
+	ack, err := node.StoreWrite(entry[0], entry[1], stamp, Msg.Deps)
+	if err != nil {
+		return nil, err
+	}
+
+	// the write has been applied, our state now covers what the coordinator had
+	// seen when it wrote it
+	node.Merge(Msg.Context)
+	return ack, nil
+}
+
+// handleRepair -> store a copy of an earlier write unless we hold a newer value. The
+// sender's context is not merged, it covers far more than the one write.
+func (node *Node) handleRepair(Msg msg.Msg) ([]byte, error) {
+	entry := strings.SplitN(Msg.PayloadToStr(), ":", 2)
+	if len(entry) != 2 {
+		return nil, errors.New("malformed repair " + Msg.PayloadToStr())
+	}
+
+	if Msg.Stamp != "" {
+		if err := node.Observe(Msg.Stamp); err != nil {
+			return nil, err
+		}
+	}
+	return node.StoreCopy(entry[0], entry[1], Msg.Stamp, Msg.Deps)
+}
+
+// handleGet -> answer with our value for the requested key
+func (node *Node) handleGet(Msg msg.Msg) ([]byte, error) {
+	return node.RemoteGet(Msg)
+}
+
+// handleGossip -> merge a gossiped database and answer with ours
+func (node *Node) handleGossip(Msg msg.Msg) ([]byte, error) {
+	return node.RecvGossip(Msg, node.ConEngine)
+}
@@ -0,0 +1,83 @@
+package node
+
+import (
+	"errors"
+	msg "kv-store/Messages"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegister(t *testing.T) {
+	r := newRegistry()
+	echo := func(Msg msg.Msg) ([]byte, error) { return Msg.Payload, nil }
+
+	scenarios := []struct {
+		action string
+		h      Handler
+		fails  bool
+	}{
+		{action: "echo", h: echo, fails: false},
+		{action: "echo", h: echo, fails: true},
+		{action: "", h: echo, fails: true},
+		{action: "nil", h: nil, fails: true},
+	}
+
+	for _, s := range scenarios {
+		if err := r.register(s.action, s.h); (err != nil) != s.fails {
+			t.Errorf("Register %q: expected failure %v, got %v", s.action, s.fails, err)
+		}
+	}
+
+	if _, err := r.lookup("missing"); !errors.Is(err, ErrUnknownAction) {
+		t.Errorf("Expected ErrUnknownAction, got %v", err)
+	}
+}
+
+func TestExternalHandler(t *testing.T) {
+	view := []string{"127.0.0.1:13801", "127.0.0.1:13802"}
+	nodes, _ := newTestCluster(t, Config{View: view, ReplFactor: 2})
+	defer shutdownCluster(nodes)
+
+	err := nodes[1].Handle("upper", func(Msg msg.Msg) ([]byte, error) {
+		return []byte(strings.ToUpper(Msg.PayloadToStr())), nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to register handler: %v", err)
+	}
+
+	if err := nodes[1].Handle("put", nodes[1].handlePut); err == nil {
+		t.Errorf("Expected an error when replacing a builtin handler")
+	}
+
+	reply, err := nodes[0].Call(nodes[1].ID, "upper", []byte("value0"), time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("Call to registered action failed: %v", err)
+	}
+	if reply.PayloadToStr() != "VALUE0" {
+		t.Errorf("Expected %q, got %q", "VALUE0", reply.PayloadToStr())
+	}
+}
+
+func TestUnknownAction(t *testing.T) {
+	view := []string{"127.0.0.1:13801", "127.0.0.1:13802"}
+	nodes, _ := newTestCluster(t, Config{View: view, ReplFactor: 2})
+	defer shutdownCluster(nodes)
+
+	// calls fail fast instead of waiting for the deadline
+	start := time.Now()
+	_, err := nodes[0].Call(nodes[1].ID, "broadcast", []byte("Broadcasting"), time.Now().Add(time.Second))
+	if err == nil || !strings.Contains(err.Error(), ErrUnknownAction.Error()) {
+		t.Errorf("Expected an unknown action error, got %v", err)
+	}
+	if time.Since(start) >= time.Second {
+		t.Errorf("Unknown action was not answered")
+	}
+
+	// messages that are not calls are dropped and counted
+	nodes[0].SendWithoutEvent(nodes[1].ID, msg.Msg{SrcAddr: nodes[0].ID, Action: "broadcast"})
+
+	if !waitFor(time.Second, func() bool { return nodes[1].Stats.Get("dropped_unknown_action") == 2 }) {
+		t.Errorf("Expected 2 unknown actions, got %d", nodes[1].Stats.Get("dropped_unknown_action"))
+	}
+}
@@ -0,0 +1,229 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	msg "kv-store/Messages"
+	consensus "kv-store/SystemServices/Consensus"
+	"sort"
+	"time"
+)
+
+// actionSnapshotRead -> read of one key taking part in a multi-key snapshot
+const actionSnapshotRead = "snapshot_read"
+
+// snapshotRetry -> pause before the keys read from replicas behind the cut are read
+// again
+const snapshotRetry = 10 * time.Millisecond
+
+// MaxSnapshotKeys -> the most keys a multi-get may read
+const MaxSnapshotKeys = 100
+
+// snapshotReaders -> how many keys this node reads for snapshots at once, across
+// every multi-get it serves. Each key read is a call to a quorum of its replicas.
+const snapshotReaders = 32
+
+// ErrInvalidSnapshot -> a multi-get without keys, with an empty key or with more than
+// MaxSnapshotKeys keys
+var ErrInvalidSnapshot = errors.New("invalid multi-get")
+
+// ErrNoSnapshot -> the replicas did not settle on a consistent cut before the deadline
+var ErrNoSnapshot = errors.New("no consistent snapshot before the deadline")
+
+// version -> a value read for a snapshot. Clock holds the writes the write that set
+// the value depends on, Seen the writes to the shard of the key the replica had
+// applied when it read it.
+type version struct {
+	Value  []byte
+	Exists bool
+	Stamp  string
+	Clock  map[string]int
+	Seen   map[string]int
+}
+
+// useSnapshots -> answer the snapshot reads of the keys of our shard
+func (node *Node) useSnapshots() error {
+	node.readers = make(chan struct{}, snapshotReaders)
+	return node.Handle(actionSnapshotRead, func(Msg msg.Msg) ([]byte, error) {
+		return json.Marshal(node.version(Msg.PayloadToStr()))
+	})
+}
+
+// version -> our value of the key. A value written without a clock depends on every
+// write we had applied when it was read.
+func (node *Node) version(key string) version {
+	v := version{Seen: consensus.ShardClock(node.AppliedClock(), node.GetMatch(key))}
+
+	got, err := node.DB.GetWrite(key)
+	v.Value, v.Exists = got.Value, err == nil
+	v.Stamp, v.Clock = got.Stamp, got.Clock
+
+	if v.Clock == nil {
+		v.Clock = v.Seen
+	}
+	return v
+}
+
+// Snapshot -> read the keys from the replicas of their shards consistently with one
+// causal cut: the cut covers the context given and the write of every value returned,
+// and every value was read from a replica that had applied the writes of the cut to
+// the shard of its key. Keys read from a
+// replica behind the cut are read again until the values settle or the deadline
+// passes. Returns the values along with the cut.
+func (node *Node) Snapshot(keys []string, context map[string]int, deadline time.Time) (msg.Snapshot, map[string]int, error) {
+	if len(keys) == 0 {
+		return msg.Snapshot{}, nil, fmt.Errorf("%w: no keys", ErrInvalidSnapshot)
+	}
+	if len(keys) > MaxSnapshotKeys {
+		return msg.Snapshot{}, nil, fmt.Errorf("%w: at most %d keys", ErrInvalidSnapshot, MaxSnapshotKeys)
+	}
+
+	unique := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if key == "" {
+			return msg.Snapshot{}, nil, fmt.Errorf("%w: key can not be empty", ErrInvalidSnapshot)
+		}
+		unique[key] = true
+	}
+
+	pending := make([]string, 0, len(unique))
+	for key := range unique {
+		pending = append(pending, key)
+	}
+	sort.Strings(pending)
+
+	node.Stats.Inc("snapshot_reads")
+	read := make(map[string]version, len(pending))
+	for {
+		if err := node.readVersions(pending, read, deadline); err != nil {
+			return msg.Snapshot{}, nil, err
+		}
+
+		cut := consensus.VectorClock(context).Copy()
+		for _, v := range read {
+			cut.Merge(v.Clock)
+		}
+
+		pending = pending[:0]
+		for key, v := range read {
+			shard := consensus.ShardClock(cut, node.GetMatch(key))
+			if order := consensus.VectorClock(v.Seen).Compare(shard); order != consensus.Equal && order != consensus.After {
+				pending = append(pending, key)
+			}
+		}
+
+		if len(pending) == 0 {
+			snap := msg.Snapshot{Values: make(map[string]msg.MultiValue, len(read))}
+			for key, v := range read {
+				snap.Values[key] = msg.MultiValue{Value: string(v.Value), Exists: v.Exists}
+			}
+			return snap, cut, nil
+		}
+		sort.Strings(pending)
+
+		if time.Until(deadline) < snapshotRetry {
+			node.Stats.Inc("snapshot_unavailable")
+			return msg.Snapshot{}, nil, ErrNoSnapshot
+		}
+		node.Stats.Inc("snapshot_retries")
+		time.Sleep(snapshotRetry)
+	}
+}
+
+// readVersions -> read the keys, as many at once as the node has snapshot readers
+// free, storing the version of each in read. Fails with ErrNoSnapshot when no
+// reader frees up before the deadline.
+func (node *Node) readVersions(keys []string, read map[string]version, deadline time.Time) error {
+	type result struct {
+		key string
+		v   version
+		err error
+	}
+	results := make(chan result, len(keys))
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	var err error
+	started := 0
+	for _, key := range keys {
+		select {
+		case node.readers <- struct{}{}:
+		case <-timer.C:
+			node.Stats.Inc("snapshot_unavailable")
+			err = ErrNoSnapshot
+		}
+		if err != nil {
+			break
+		}
+
+		started++
+		go func(key string) {
+			v, err := node.readVersion(key, deadline)
+			<-node.readers
+			results <- result{key: key, v: v, err: err}
+		}(key)
+	}
+
+	for i := 0; i < started; i++ {
+		r := <-results
+		if r.err != nil {
+			err = r.err
+			continue
+		}
+		read[r.key] = r.v
+	}
+	return err
+}
+
+// readVersion -> the latest version of the key among a quorum of the replicas of its
+// shard, compared as a read of the key would
+func (node *Node) readVersion(key string, deadline time.Time) (version, error) {
+	type answer struct {
+		from string
+		v    version
+		err  error
+	}
+
+	replicas := node.ShardGroups[node.GetMatch(key)]
+	answers := make(chan answer, len(replicas))
+	for _, replica := range replicas {
+		go func(replica string) {
+			if replica == node.ID {
+				answers <- answer{from: replica, v: node.version(key)}
+				return
+			}
+
+			var v version
+			reply, err := node.Call(replica, actionSnapshotRead, []byte(key), deadline)
+			if err == nil {
+				err = json.Unmarshal(reply.Payload, &v)
+			}
+			answers <- answer{from: replica, v: v, err: err}
+		}(replica)
+	}
+
+	required := node.Quorum()
+	versions := make(map[string]version, len(replicas))
+	var got []msg.Msg
+	var answered []string
+	for range replicas {
+		a := <-answers
+		if a.err != nil {
+			continue
+		}
+
+		versions[a.from] = a.v
+		answered = append(answered, a.from)
+		got = append(got, msg.Msg{SrcAddr: a.from, Payload: a.v.Value, Stamp: a.v.Stamp, Context: a.v.Seen})
+		if len(got) == required {
+			break
+		}
+	}
+
+	if len(got) < required {
+		return version{}, &consensus.QuorumError{Answered: len(got), Required: required, Replicas: answered}
+	}
+	return versions[node.Latest(got).SrcAddr], nil
+}
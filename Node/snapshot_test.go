@@ -0,0 +1,44 @@
+package node
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSnapshotLimits(t *testing.T) {
+	view := []string{"127.0.0.1:13801", "127.0.0.1:13802"}
+	nodes, _ := newTestCluster(t, Config{View: view, ReplFactor: 2})
+	defer shutdownCluster(nodes)
+
+	keys := make([]string, MaxSnapshotKeys+1)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+	}
+	for _, n := range nodes {
+		n.StoreAt(keys[0], "value0", nodes[0].Now().String())
+	}
+
+	if _, _, err := nodes[0].Snapshot(keys, nil, time.Now().Add(time.Second)); !errors.Is(err, ErrInvalidSnapshot) {
+		t.Errorf("Expected a multi-get of %d keys to be refused, got %v", len(keys), err)
+	}
+
+	// every reader is busy with other multi-gets
+	for i := 0; i < cap(nodes[0].readers); i++ {
+		nodes[0].readers <- struct{}{}
+	}
+	if _, _, err := nodes[0].Snapshot(keys[:3], nil, time.Now().Add(50*time.Millisecond)); !errors.Is(err, ErrNoSnapshot) {
+		t.Errorf("Expected no snapshot while every reader is busy, got %v", err)
+	}
+
+	// a single free reader reads the keys one after the other
+	<-nodes[0].readers
+	snap, _, err := nodes[0].Snapshot(keys[:3], nil, time.Now().Add(time.Second))
+	if err != nil || len(snap.Values) != 3 || snap.Values[keys[0]].Value != "value0" {
+		t.Errorf("Expected the keys to be read, got %+v (%v)", snap, err)
+	}
+	if len(nodes[0].readers) != cap(nodes[0].readers)-1 {
+		t.Errorf("Expected the reader to be released, %d busy", len(nodes[0].readers))
+	}
+}
@@ -0,0 +1,171 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	msg "kv-store/Messages"
+	txn "kv-store/SystemServices/Txn"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ErrInvalidTxn -> a transaction without writes, or with an empty key, a key written
+// twice or an unknown condition
+var ErrInvalidTxn = errors.New("invalid transaction")
+
+// txnOp -> what a transaction does to one key: every condition must hold for the
+// value the key had before it, then the key is written when Write is set
+type txnOp struct {
+	If    []msg.Condition
+	Write bool
+	Value string
+	Add   *int64
+}
+
+// useTransactions -> coordinate the transactions received by this node and take part
+// in the transactions on keys of our shard. Committed writes are stored in our
+// database.
+func (node *Node) useTransactions() error {
+	call := func(peer, action string, payload []byte, deadline time.Time) ([]byte, error) {
+		reply, err := node.Call(peer, action, payload, deadline)
+		return reply.Payload, err
+	}
+
+	load := func(key string) ([]byte, bool) {
+		got, err := node.DB.Get(key)
+		return got, err == nil
+	}
+
+	store := func(key string, value []byte, stamp string) error {
+		_, err := node.StoreAt(key, string(value), stamp)
+		return err
+	}
+
+	node.txn = txn.New(node.ID, call, load, store, evalTxnOp, node.Stats)
+	node.txn.UseTimeout(node.conf.TxnTimeout)
+	if node.conf.RPCTimeout != 0 {
+		node.txn.UseDecideTimeout(node.conf.RPCTimeout)
+	}
+
+	for _, action := range []string{txn.ActionPrepare, txn.ActionDecide, txn.ActionStatus} {
+		action := action
+		h := func(Msg msg.Msg) ([]byte, error) { return node.txn.Handle(action, Msg.Payload) }
+		if err := node.Handle(action, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Transact -> atomically apply the writes across the shards holding their keys when
+// every check holds, coordinated by this node with two-phase commit among every
+// replica of those shards. Plain writes are not blocked by the intents of a
+// transaction and may be overwritten when it commits.
+func (node *Node) Transact(req msg.Txn, deadline time.Time) (msg.TxnResult, error) {
+	ops, err := txnOps(req)
+	if err != nil {
+		return msg.TxnResult{}, err
+	}
+
+	keys := make([]string, 0, len(ops))
+	for key := range ops {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	participants := make(map[string][]txn.Op)
+	for _, key := range keys {
+		spec, err := json.Marshal(ops[key])
+		if err != nil {
+			return msg.TxnResult{}, err
+		}
+
+		for _, replica := range node.ShardGroups[node.GetMatch(key)] {
+			participants[replica] = append(participants[replica], txn.Op{Key: key, Spec: spec})
+		}
+	}
+
+	// every replica stores the writes with the same stamp
+	result := node.txn.Run(participants, node.Now().String(), deadline)
+	return msg.TxnResult{ID: result.ID, Committed: result.Committed, Reason: result.Reason, Key: result.Key}, nil
+}
+
+// ResolveTransactions -> settle the transactions we prepared whose decision has not
+// reached us in time
+func (node *Node) ResolveTransactions() {
+	node.txn.Resolve(node.RPCDeadline())
+}
+
+// txnOps -> the operation of the transaction on each key it checks or writes
+func txnOps(req msg.Txn) (map[string]*txnOp, error) {
+	if len(req.Writes) == 0 {
+		return nil, fmt.Errorf("%w: no writes", ErrInvalidTxn)
+	}
+
+	ops := make(map[string]*txnOp)
+	op := func(key string) (*txnOp, error) {
+		if key == "" {
+			return nil, fmt.Errorf("%w: key can not be empty", ErrInvalidTxn)
+		}
+		if ops[key] == nil {
+			ops[key] = &txnOp{}
+		}
+		return ops[key], nil
+	}
+
+	for _, check := range req.Checks {
+		if !knownCondition(check.If.Op) {
+			return nil, fmt.Errorf("%w: unknown condition %q", ErrInvalidTxn, check.If.Op)
+		}
+
+		o, err := op(check.Key)
+		if err != nil {
+			return nil, err
+		}
+		o.If = append(o.If, check.If)
+	}
+
+	for _, write := range req.Writes {
+		o, err := op(write.Key)
+		if err != nil {
+			return nil, err
+		}
+		if o.Write {
+			return nil, fmt.Errorf("%w: %q is written twice", ErrInvalidTxn, write.Key)
+		}
+		o.Write, o.Value, o.Add = true, write.Value, write.Add
+	}
+	return ops, nil
+}
+
+// evalTxnOp -> the value a participant writes for the operation, a check that does not
+// hold or a non integer value that can not be incremented aborts the transaction
+func evalTxnOp(spec []byte, current []byte, exists bool) ([]byte, bool, bool) {
+	var op txnOp
+	if err := json.Unmarshal(spec, &op); err != nil {
+		return nil, false, false
+	}
+
+	for _, cond := range op.If {
+		if !holds(cond, string(current), exists) {
+			return nil, false, false
+		}
+	}
+	if !op.Write {
+		return nil, false, true
+	}
+	if op.Add == nil {
+		return []byte(op.Value), true, true
+	}
+
+	n := int64(0)
+	if exists {
+		var err error
+		if n, err = strconv.ParseInt(string(current), 10, 64); err != nil {
+			return nil, false, false
+		}
+	}
+	return []byte(strconv.FormatInt(n+*op.Add, 10)), true, true
+}
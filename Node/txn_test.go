@@ -0,0 +1,92 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	msg "kv-store/Messages"
+	"testing"
+)
+
+func TestTxnOps(t *testing.T) {
+	ten, minusTen := int64(10), int64(-10)
+
+	scenarios := []struct {
+		req     msg.Txn
+		current map[string]string
+		ok      bool
+		written map[string]string
+		invalid bool
+	}{
+		// move ten from a to b while a holds at least ten
+		{
+			req: msg.Txn{
+				Checks: []msg.TxnCheck{{Key: "a", If: msg.Condition{Op: ">=", Value: "10"}}},
+				Writes: []msg.TxnWrite{{Key: "a", Add: &minusTen}, {Key: "b", Add: &ten}},
+			},
+			current: map[string]string{"a": "25"},
+			ok:      true,
+			written: map[string]string{"a": "15", "b": "10"},
+		},
+		{
+			req: msg.Txn{
+				Checks: []msg.TxnCheck{{Key: "a", If: msg.Condition{Op: ">=", Value: "10"}}},
+				Writes: []msg.TxnWrite{{Key: "b", Add: &ten}},
+			},
+			current: map[string]string{"a": "5"},
+		},
+		// a checked key is not written, a key that is not an integer can not be incremented
+		{
+			req: msg.Txn{
+				Checks: []msg.TxnCheck{{Key: "c", If: msg.Condition{Op: "exists"}}},
+				Writes: []msg.TxnWrite{{Key: "d", Value: "x"}},
+			},
+			current: map[string]string{"c": "1"},
+			ok:      true,
+			written: map[string]string{"d": "x"},
+		},
+		{req: msg.Txn{Writes: []msg.TxnWrite{{Key: "a", Add: &ten}}}, current: map[string]string{"a": "ten"}},
+		{req: msg.Txn{Checks: []msg.TxnCheck{{Key: "a", If: msg.Condition{Op: "exists"}}}}, invalid: true},
+		{req: msg.Txn{Writes: []msg.TxnWrite{{Key: "", Value: "x"}}}, invalid: true},
+		{req: msg.Txn{Writes: []msg.TxnWrite{{Key: "a", Value: "x"}, {Key: "a", Value: "y"}}}, invalid: true},
+		{req: msg.Txn{Checks: []msg.TxnCheck{{Key: "a", If: msg.Condition{Op: "like"}}}, Writes: []msg.TxnWrite{{Key: "a"}}}, invalid: true},
+	}
+
+	for i, s := range scenarios {
+		ops, err := txnOps(s.req)
+		if s.invalid {
+			if !errors.Is(err, ErrInvalidTxn) {
+				t.Errorf("Scenario %d: expected the transaction to be refused, got %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Scenario %d: unexpected error %v", i, err)
+		}
+
+		// every participant must vote yes for the writes to be applied
+		ok := true
+		written := make(map[string]string)
+		for key, op := range ops {
+			spec, _ := json.Marshal(op)
+			current, exists := s.current[key]
+			next, write, yes := evalTxnOp(spec, []byte(current), exists)
+			ok = ok && yes
+			if write {
+				written[key] = string(next)
+			}
+		}
+
+		if ok != s.ok {
+			t.Errorf("Scenario %d: expected the vote %v, got %v", i, s.ok, ok)
+			continue
+		}
+		if ok && len(written) != len(s.written) {
+			t.Errorf("Scenario %d: expected %v written, got %v", i, s.written, written)
+		}
+		for key, value := range s.written {
+			if written[key] != value {
+				t.Errorf("Scenario %d: expected %s=%q, got %q", i, key, value, written[key])
+			}
+		}
+	}
+}
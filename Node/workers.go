@@ -0,0 +1,137 @@
+package node
+
+import (
+	msg "kv-store/Messages"
+	paxos "kv-store/SystemServices/Paxos"
+	raft "kv-store/SystemServices/Raft"
+	stats "kv-store/SystemServices/Stats"
+	protocols "kv-store/SystemServices/SysProtocols"
+	txn "kv-store/SystemServices/Txn"
+	"sync"
+)
+
+// Message priority lanes, client lanes are always served before background lanes
+const (
+	laneClient     = "client"
+	laneBackground = "background"
+)
+
+// clientActions -> messages on the path of a client request, along with their
+// replies. Raft heartbeats share the lane so leaders are not deposed by a backlog,
+// as do repairs and handed off hints, which carry writes a replica missed.
+var clientActions = map[string]bool{
+	"get":                  true,
+	"put":                  true,
+	protocols.ActionRepair: true,
+	raft.ActionVote:        true,
+	raft.ActionAppend:      true,
+	actionLeader:           true,
+	paxos.ActionPrepare:    true,
+	paxos.ActionAccept:     true,
+	paxos.ActionCommit:     true,
+	txn.ActionPrepare:      true,
+	txn.ActionDecide:       true,
+	actionSnapshotRead:     true,
+}
+
+// causalActions -> messages applying writes, held until the writes they depend on
+// have been applied
+var causalActions = map[string]bool{
+	"put":                  true,
+	protocols.ActionRepair: true,
+}
+
+// lane -> determine which lane a message is queued on
+func lane(Msg msg.Msg) string {
+	if clientActions[Msg.Action] {
+		return laneClient
+	}
+	return laneBackground
+}
+
+// workQueue -> bounded queue of received messages split into priority lanes.
+// Messages arriving while a lane is full are dropped instead of blocking the
+// receiving socket.
+type workQueue struct {
+	lanes   map[string]chan msg.Msg
+	done    chan struct{}
+	closing *sync.Once
+	stats   *stats.Counters
+}
+
+// newWorkQueue -> construct a queue holding at most the given number of messages per lane
+func newWorkQueue(clientSize, backgroundSize int, s *stats.Counters) *workQueue {
+	return &workQueue{
+		lanes: map[string]chan msg.Msg{
+			laneClient:     make(chan msg.Msg, clientSize),
+			laneBackground: make(chan msg.Msg, backgroundSize),
+		},
+		done:    make(chan struct{}),
+		closing: &sync.Once{},
+		stats:   s,
+	}
+}
+
+// push -> queue the message without blocking, returns false if it was dropped
+func (q *workQueue) push(Msg msg.Msg) bool {
+	name := lane(Msg)
+	ch := q.lanes[name]
+
+	select {
+	case <-q.done:
+		return false
+	default:
+	}
+
+	select {
+	case ch <- Msg:
+		q.stats.Set("queue_depth_"+name, int64(len(ch)))
+		return true
+	default:
+		q.stats.Inc("dropped_queue_full_" + name)
+		return false
+	}
+}
+
+// pop -> blocking call, return the next message preferring the client lane.
+// Returns false once the queue has been closed.
+func (q *workQueue) pop() (msg.Msg, bool) {
+	client, background := q.lanes[laneClient], q.lanes[laneBackground]
+
+	select {
+	case Msg := <-client:
+		q.stats.Set("queue_depth_"+laneClient, int64(len(client)))
+		return Msg, true
+	default:
+	}
+
+	select {
+	case Msg := <-client:
+		q.stats.Set("queue_depth_"+laneClient, int64(len(client)))
+		return Msg, true
+	case Msg := <-background:
+		q.stats.Set("queue_depth_"+laneBackground, int64(len(background)))
+		return Msg, true
+	case <-q.done:
+		return msg.Msg{}, false
+	}
+}
+
+// close -> release every worker waiting on the queue
+func (q *workQueue) close() {
+	q.closing.Do(func() {
+		close(q.done)
+	})
+}
+
+// worker -> handle queued messages until the queue is closed
+func (node *Node) worker(q *workQueue) {
+	for {
+		Msg, ok := q.pop()
+		if !ok {
+			return
+		}
+
+		node.MessageHandler(Msg)
+	}
+}
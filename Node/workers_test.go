@@ -0,0 +1,104 @@
+package node
+
+import (
+	msg "kv-store/Messages"
+	stats "kv-store/SystemServices/Stats"
+	protocols "kv-store/SystemServices/SysProtocols"
+	"testing"
+	"time"
+)
+
+func TestWorkQueuePriority(t *testing.T) {
+	q := newWorkQueue(4, 4, stats.New())
+
+	queued := []msg.Msg{
+		{Action: "gossip"},
+		{Action: "put"},
+		{Action: "gossip", Reply: true},
+		{Action: "get"},
+		{Action: "get", Reply: true},
+		{Action: protocols.ActionRepair},
+	}
+	for _, m := range queued {
+		if !q.push(m) {
+			t.Fatalf("Queue rejected %v before it was full", m.Action)
+		}
+	}
+
+	// client path messages and their replies are handled before any background message
+	expect := []msg.Msg{
+		{Action: "put"},
+		{Action: "get"},
+		{Action: "get", Reply: true},
+		{Action: protocols.ActionRepair},
+		{Action: "gossip"},
+		{Action: "gossip", Reply: true},
+	}
+	for _, m := range expect {
+		got, ok := q.pop()
+		if !ok {
+			t.Fatalf("Queue closed early")
+		}
+		if got.Action != m.Action || got.Reply != m.Reply {
+			t.Errorf("Expected %v (reply %v), got %v (reply %v)", m.Action, m.Reply, got.Action, got.Reply)
+		}
+	}
+}
+
+func TestWorkQueueBackpressure(t *testing.T) {
+	counters := stats.New()
+	q := newWorkQueue(2, 1, counters)
+
+	scenarios := []struct {
+		action string
+		expect bool
+	}{
+		{action: "put", expect: true},
+		{action: "get", expect: true},
+		{action: "put", expect: false},
+		{action: "gossip", expect: true},
+		{action: "gossip", expect: false},
+		{action: "gossip", expect: false},
+	}
+
+	for _, s := range scenarios {
+		if got := q.push(msg.Msg{Action: s.action}); got != s.expect {
+			t.Errorf("Push %v: expected %v, got %v", s.action, s.expect, got)
+		}
+	}
+
+	if got := counters.Get("dropped_queue_full_client"); got != 1 {
+		t.Errorf("Expected 1 dropped client message, got %d", got)
+	}
+	if got := counters.Get("dropped_queue_full_background"); got != 2 {
+		t.Errorf("Expected 2 dropped background messages, got %d", got)
+	}
+	if got := counters.Get("queue_depth_client"); got != 2 {
+		t.Errorf("Expected a client queue depth of 2, got %d", got)
+	}
+}
+
+func TestWorkQueueClose(t *testing.T) {
+	q := newWorkQueue(1, 1, nil)
+
+	done := make(chan bool)
+	go func() {
+		_, ok := q.pop()
+		done <- ok
+	}()
+
+	q.close()
+
+	select {
+	case ok := <-done:
+		if ok {
+			t.Errorf("Pop returned a message from an empty closed queue")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Worker still blocked after the queue was closed")
+	}
+
+	if q.push(msg.Msg{Action: "put"}) {
+		t.Errorf("Closed queue accepted a message")
+	}
+}
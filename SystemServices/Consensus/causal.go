@@ -0,0 +1,159 @@
+package consensus
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultCausalWait -> how long a request waits for our clock to cover its causal
+// context unless told otherwise
+const DefaultCausalWait = time.Second
+
+// ErrBadToken -> the causal context token sent by a client could not be decoded
+var ErrBadToken = errors.New("invalid causal context token")
+
+// clockSync -> guards the vector clock and wakes requests waiting for it to advance
+type clockSync struct {
+	m       *sync.Mutex
+	changed chan struct{} // closed and replaced whenever the clock advances
+}
+
+func newClockSync() *clockSync {
+	return &clockSync{
+		m:       &sync.Mutex{},
+		changed: make(chan struct{}),
+	}
+}
+
+// advanced -> wake everything waiting on the clock, the caller must hold the lock
+func (s *clockSync) advanced() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Clock -> a copy of our vector clock
+func (c *ConEngine) Clock() map[string]int {
+	c.clockSync.m.Lock()
+	defer c.clockSync.m.Unlock()
+
+	return c.vectorClock.Copy()
+}
+
+// Merge -> advance our clock to include every event in the given context. Nodes
+// outside our view are ignored.
+func (c *ConEngine) Merge(context map[string]int) {
+	c.clockSync.m.Lock()
+	defer c.clockSync.m.Unlock()
+
+	known := make(VectorClock, len(context))
+	for node, count := range context {
+		node = clockKey(node)
+		if _, ok := c.vectorClock[node]; ok {
+			known[node] = count
+		}
+	}
+
+	if c.vectorClock.Merge(known) {
+		c.clockSync.advanced()
+	}
+}
+
+// member -> whether the node belongs to our view
+func (c *ConEngine) member(node string) bool {
+	c.clockSync.m.Lock()
+	defer c.clockSync.m.Unlock()
+
+	_, ok := c.vectorClock[clockKey(node)]
+	return ok
+}
+
+// Covers -> whether our clock includes every event in the given context. Nodes
+// outside our view are ignored.
+func (c *ConEngine) Covers(context map[string]int) bool {
+	return c.Lagging(context) == ""
+}
+
+// Lagging -> the node whose events we are furthest behind on, empty when our
+// clock covers the context
+func (c *ConEngine) Lagging(context map[string]int) string {
+	c.clockSync.m.Lock()
+	defer c.clockSync.m.Unlock()
+
+	lagging, gap := "", 0
+	for node, count := range context {
+		node = clockKey(node)
+		ours, ok := c.vectorClock[node]
+		if ok && count-ours > gap {
+			lagging, gap = node, count-ours
+		}
+	}
+	return lagging
+}
+
+// UseCausalWait -> set how long a request waits for our clock to cover the
+// causal context of the client
+func (c *ConEngine) UseCausalWait(wait time.Duration) {
+	c.configure(func(s *settings) { s.causalWait = wait })
+}
+
+// CausalDeadline -> deadline for a request waiting on its causal context
+func (c *ConEngine) CausalDeadline() time.Time {
+	return time.Now().Add(c.settings().causalWait)
+}
+
+// ClockChanged -> a channel closed the next time our clock advances
+func (c *ConEngine) ClockChanged() <-chan struct{} {
+	c.clockSync.m.Lock()
+	defer c.clockSync.m.Unlock()
+
+	return c.clockSync.changed
+}
+
+// WaitCovers -> block until our clock covers the context or the deadline passes,
+// returns whether the context is covered
+func (c *ConEngine) WaitCovers(context map[string]int, deadline time.Time) bool {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	for {
+		changed := c.ClockChanged()
+		if c.Covers(context) {
+			return true
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return c.Covers(context)
+		}
+	}
+}
+
+// EncodeToken -> the opaque causal context token handed to clients
+func EncodeToken(context map[string]int) string {
+	out, _ := json.Marshal(context)
+	return base64.RawURLEncoding.EncodeToString(out)
+}
+
+// DecodeToken -> the causal context carried by a client token
+func DecodeToken(token string) (map[string]int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrBadToken
+	}
+
+	var context map[string]int
+	if err := json.Unmarshal(raw, &context); err != nil {
+		return nil, ErrBadToken
+	}
+
+	for _, count := range context {
+		if count < 0 {
+			return nil, ErrBadToken
+		}
+	}
+	return context, nil
+}
@@ -0,0 +1,101 @@
+package consensus
+
+import (
+	"errors"
+	netutil "kv-store/SystemServices/Network"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestToken(t *testing.T) {
+	scenarios := []struct {
+		token string
+		err   bool
+	}{
+		{token: EncodeToken(map[string]int{"127.0.0.1:13801": 2, "[::1]:13802": 0})},
+		{token: EncodeToken(map[string]int{})},
+		{token: "not base64!", err: true},
+		{token: "bm90IGpzb24", err: true}, // "not json"
+		{token: EncodeToken(map[string]int{"127.0.0.1:13801": -1}), err: true},
+	}
+
+	for _, s := range scenarios {
+		context, err := DecodeToken(s.token)
+		if s.err {
+			if !errors.Is(err, ErrBadToken) {
+				t.Errorf("Token %q: expected ErrBadToken, got %v", s.token, err)
+			}
+			continue
+		}
+
+		if err != nil || EncodeToken(context) != s.token {
+			t.Errorf("Token %q did not round trip, got %v (%v)", s.token, context, err)
+		}
+	}
+}
+
+func TestMergeCovers(t *testing.T) {
+	a := newTestEngine(netutil.NewMemNetwork(), "127.0.0.1:13801")
+	a.Increment("127.0.0.1:13801")
+
+	scenarios := []struct {
+		merge   map[string]int
+		context map[string]int
+		lagging string
+		clock   map[string]int
+	}{
+		{
+			context: map[string]int{"127.0.0.1:13801": 1},
+			clock:   map[string]int{"127.0.0.1:13801": 1, "127.0.0.1:13802": 0, "127.0.0.1:13803": 0},
+		},
+		{
+			context: map[string]int{"127.0.0.1:13801": 1, "127.0.0.1:13802": 1, "127.0.0.1:13803": 3},
+			lagging: "127.0.0.1:13803",
+			clock:   map[string]int{"127.0.0.1:13801": 1, "127.0.0.1:13802": 0, "127.0.0.1:13803": 0},
+		},
+		{
+			// merging never moves an entry backwards and ignores nodes outside the view
+			merge:   map[string]int{"127.0.0.1:13801": 0, "127.0.0.1:13803": 3, "127.0.0.1:13809": 7},
+			context: map[string]int{"127.0.0.1:13801": 1, "127.0.0.1:13802": 1, "127.0.0.1:13803": 3, "127.0.0.1:13809": 7},
+			lagging: "127.0.0.1:13802",
+			clock:   map[string]int{"127.0.0.1:13801": 1, "127.0.0.1:13802": 0, "127.0.0.1:13803": 3},
+		},
+	}
+
+	for i, s := range scenarios {
+		a.Merge(s.merge)
+
+		if got := a.Lagging(s.context); got != s.lagging {
+			t.Errorf("Scenario %d: expected to lag %q, got %q", i, s.lagging, got)
+		}
+		if a.Covers(s.context) != (s.lagging == "") {
+			t.Errorf("Scenario %d: Covers disagrees with Lagging", i)
+		}
+		if got := a.Clock(); !reflect.DeepEqual(got, s.clock) {
+			t.Errorf("Scenario %d: expected clock %v, got %v", i, s.clock, got)
+		}
+	}
+}
+
+func TestWaitCovers(t *testing.T) {
+	a := newTestEngine(netutil.NewMemNetwork(), "127.0.0.1:13801")
+	context := map[string]int{"127.0.0.1:13802": 1}
+
+	if a.WaitCovers(context, time.Now().Add(20*time.Millisecond)) {
+		t.Fatalf("Context covered before the clock advanced")
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		a.Merge(context)
+	}()
+
+	start := time.Now()
+	if !a.WaitCovers(context, time.Now().Add(time.Second)) {
+		t.Fatalf("Context not covered after the clock advanced")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Waiting request was not woken when the clock advanced, took %v", elapsed)
+	}
+}
@@ -0,0 +1,114 @@
+package consensus
+
+import (
+	msg "kv-store/Messages"
+	stats "kv-store/SystemServices/Stats"
+	"sync"
+)
+
+// DefaultCompressThreshold -> payloads smaller than this are always sent uncompressed
+const DefaultCompressThreshold = 256
+
+// compression -> negotiates a payload codec with each peer. Every message we send
+// advertises the codecs we accept, a payload is only compressed once the peer has
+// told us it can decompress it.
+type compression struct {
+	m         *sync.RWMutex
+	preferred []string            // our codecs in order of preference
+	peers     map[string][]string // codecs each member of the view has advertised
+	threshold int
+}
+
+// UseCompression -> compress payloads of at least threshold bytes with the first of
+// the preferred codecs that the destination also accepts
+func (c *ConEngine) UseCompression(preferred []string, threshold int) {
+	codecs := []string{}
+	for _, codec := range preferred {
+		if codec != msg.CodecNone && msg.SupportedCodec(codec) {
+			codecs = append(codecs, codec)
+		}
+	}
+
+	cmp := &compression{
+		m:         &sync.RWMutex{},
+		preferred: codecs,
+		peers:     make(map[string][]string),
+		threshold: threshold,
+	}
+	c.configure(func(s *settings) { s.compression = cmp })
+}
+
+// UseStats -> record counters for the consensus engine in the given stats
+func (c *ConEngine) UseStats(s *stats.Counters) {
+	c.configure(func(conf *settings) { conf.stats = s })
+}
+
+// compress -> advertise our codecs and compress the payload if the peer accepts it
+func (c *ConEngine) compress(addr string, Msg msg.Msg) msg.Msg {
+	s := c.settings()
+	cmp := s.compression
+	if cmp == nil {
+		return Msg
+	}
+
+	Msg.Accept = cmp.preferred
+	if len(Msg.Payload) < cmp.threshold {
+		return Msg
+	}
+
+	codec := cmp.negotiate(addr)
+	if codec == "" {
+		return Msg
+	}
+
+	compressed, err := msg.Compress(codec, Msg.Payload)
+	if err != nil || len(compressed) >= len(Msg.Payload) {
+		return Msg
+	}
+
+	s.stats.Add("compression_bytes_saved", int64(len(Msg.Payload)-len(compressed)))
+	s.stats.Inc("compression_messages")
+
+	Msg.Payload = compressed
+	Msg.Codec = codec
+	return Msg
+}
+
+// negotiate -> our most preferred codec the peer has advertised
+func (cmp *compression) negotiate(addr string) string {
+	cmp.m.RLock()
+	defer cmp.m.RUnlock()
+
+	for _, codec := range cmp.preferred {
+		for _, accepted := range cmp.peers[clockKey(addr)] {
+			if codec == accepted {
+				return codec
+			}
+		}
+	}
+	return ""
+}
+
+// Decompress -> restore the payload of a received message and remember which codecs
+// the sender accepts. Only the codecs of members of the view are kept, so senders
+// naming any address they like can not grow them.
+func (c *ConEngine) Decompress(Msg msg.Msg) (msg.Msg, error) {
+	if cmp := c.settings().compression; cmp != nil && c.member(Msg.SrcAddr) {
+		cmp.m.Lock()
+		cmp.peers[clockKey(Msg.SrcAddr)] = Msg.Accept
+		cmp.m.Unlock()
+	}
+
+	if Msg.Codec == "" || Msg.Codec == msg.CodecNone {
+		return Msg, nil
+	}
+
+	payload, err := msg.Decompress(Msg.Codec, Msg.Payload)
+	if err != nil {
+		return Msg, err
+	}
+
+	Msg.Payload = payload
+	Msg.Codec = ""
+	return Msg, nil
+}
@@ -0,0 +1,193 @@
+package consensus
+
+import (
+	msg "kv-store/Messages"
+	netutil "kv-store/SystemServices/Network"
+	stats "kv-store/SystemServices/Stats"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompressionNegotiation(t *testing.T) {
+	mem := netutil.NewMemNetwork()
+	a := newTestEngine(mem, "127.0.0.1:13801")
+	b := newTestEngine(mem, "127.0.0.1:13802")
+	c := newTestEngine(mem, "127.0.0.1:13803")
+
+	aStats := stats.New()
+	a.UseStats(aStats)
+	a.UseCompression([]string{msg.CodecFlate, msg.CodecGzip}, 64)
+	b.UseCompression([]string{msg.CodecGzip}, 64)
+	c.UseCompression([]string{msg.CodecNone}, 64)
+
+	large := []byte(strings.Repeat(`{"key":"value"},`, 100))
+	small := []byte("key0:value0")
+
+	// exchange sends src -> dest and returns the message as it travelled
+	exchange := func(src, dest *ConEngine, destAddr string, payload []byte) msg.Msg {
+		if err := src.SendWithoutEvent(destAddr, msg.Msg{SrcAddr: src.addr, Payload: payload, Action: "gossip"}); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		wire, _, err := dest.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		got, err := dest.Decompress(wire)
+		if err != nil {
+			t.Fatalf("Decompress failed: %v", err)
+		}
+		if string(got.Payload) != string(payload) {
+			t.Fatalf("Payload did not survive the exchange")
+		}
+		return wire
+	}
+
+	scenarios := []struct {
+		name    string
+		src     *ConEngine
+		dest    *ConEngine
+		addr    string
+		payload []byte
+		expect  string
+	}{
+		{name: "peer not yet negotiated", src: a, dest: b, addr: b.addr, payload: large, expect: ""},
+		{name: "peer advertised gzip", src: b, dest: a, addr: a.addr, payload: large, expect: msg.CodecGzip},
+		{name: "common codec", src: a, dest: b, addr: b.addr, payload: large, expect: msg.CodecGzip},
+		{name: "below threshold", src: a, dest: b, addr: b.addr, payload: small, expect: ""},
+		{name: "peer without codecs", src: c, dest: a, addr: a.addr, payload: large, expect: ""},
+		{name: "never compress for peer without codecs", src: a, dest: c, addr: c.addr, payload: large, expect: ""},
+	}
+
+	for _, s := range scenarios {
+		wire := exchange(s.src, s.dest, s.addr, s.payload)
+		if wire.Codec != s.expect {
+			t.Errorf("Scenario %v: expected codec %q, got %q", s.name, s.expect, wire.Codec)
+		}
+	}
+
+	if aStats.Get("compression_bytes_saved") <= 0 {
+		t.Errorf("Bytes saved by compression were not counted")
+	}
+}
+
+func TestCompressionOnlyMembers(t *testing.T) {
+	a := newTestEngine(netutil.NewMemNetwork(), "127.0.0.1:13801")
+	a.UseCompression([]string{msg.CodecGzip}, 64)
+	cmp := a.settings().compression
+
+	// senders outside the view are not remembered, whatever address they claim
+	for i := 0; i < 100; i++ {
+		a.Decompress(msg.Msg{SrcAddr: "10.0.0.1:" + strconv.Itoa(20000+i), Accept: []string{msg.CodecGzip}})
+	}
+	a.Decompress(msg.Msg{SrcAddr: "127.0.0.1:13802", Accept: []string{msg.CodecGzip}})
+
+	if len(cmp.peers) != 1 || cmp.negotiate("127.0.0.1:13802") != msg.CodecGzip {
+		t.Errorf("Expected only the member to be remembered, got %v", cmp.peers)
+	}
+}
+
+func TestCompressionOverUDP(t *testing.T) {
+	ports := []int{}
+	for i := 0; i < 2; i++ {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		if err != nil {
+			t.Fatalf("Failed to find a free port: %v", err)
+		}
+		ports = append(ports, conn.LocalAddr().(*net.UDPAddr).Port)
+		conn.Close()
+	}
+
+	addrs := []string{"127.0.0.1:" + strconv.Itoa(ports[0]), "127.0.0.1:" + strconv.Itoa(ports[1])}
+	engines := []*ConEngine{}
+	inboxes := []chan msg.Msg{}
+	for i, addr := range addrs {
+		transport := netutil.NewUDP("127.0.0.1", ports[i], netutil.DefaultUDPBuffer)
+		defer transport.Close()
+
+		c := new(ConEngine)
+		c.NewConEngine(addr, len(addrs), addrs, transport)
+		c.UseCompression([]string{msg.CodecGzip}, DefaultCompressThreshold)
+		engines = append(engines, c)
+
+		inbox := make(chan msg.Msg, 16)
+		inboxes = append(inboxes, inbox)
+		go func() {
+			for {
+				wire, _, err := c.Recv()
+				if err != nil {
+					return
+				}
+				inbox <- wire
+			}
+		}()
+	}
+
+	// larger than the old 1024 byte read buffer, both before and after the peers
+	// have negotiated a codec
+	payload := []byte(strings.Repeat(`{"key":"value"},`, 1024))
+
+	// the sockets are only bound once Recv is called, ping each engine until it
+	// answers so every scenario below is sent exactly once
+	for dest := range engines {
+		bound := false
+		for attempt := 0; attempt < 100 && !bound; attempt++ {
+			if err := engines[1-dest].SendWithoutEvent(addrs[dest], msg.Msg{Action: "ping"}); err != nil {
+				t.Fatalf("Send failed: %v", err)
+			}
+			select {
+			case <-inboxes[dest]:
+				bound = true
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+		if !bound {
+			t.Fatalf("%v never bound its socket", addrs[dest])
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	for _, inbox := range inboxes {
+		for len(inbox) > 0 {
+			<-inbox
+		}
+	}
+
+	exchange := func(src, dest int) msg.Msg {
+		if err := engines[src].SendWithoutEvent(addrs[dest], msg.Msg{SrcAddr: addrs[src], Payload: payload, Action: "gossip"}); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		select {
+		case wire := <-inboxes[dest]:
+			return wire
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Payload from %v never reached %v", addrs[src], addrs[dest])
+		}
+		return msg.Msg{}
+	}
+
+	scenarios := []struct {
+		src, dest int
+		expect    string
+	}{
+		{src: 0, dest: 1, expect: ""},
+		{src: 1, dest: 0, expect: msg.CodecGzip},
+		{src: 0, dest: 1, expect: msg.CodecGzip},
+	}
+
+	for i, s := range scenarios {
+		wire := exchange(s.src, s.dest)
+		if wire.Codec != s.expect {
+			t.Errorf("Scenario %d: expected codec %q, got %q", i, s.expect, wire.Codec)
+		}
+
+		got, err := engines[s.dest].Decompress(wire)
+		if err != nil {
+			t.Fatalf("Scenario %d: decompress failed: %v", i, err)
+		}
+		if string(got.Payload) != string(payload) {
+			t.Errorf("Scenario %d: payload of %d bytes was not received intact", i, len(payload))
+		}
+	}
+}
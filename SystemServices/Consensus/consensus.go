@@ -2,119 +2,214 @@ package consensus
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
-	"io"
 	log "kv-store/Logging"
 	msg "kv-store/Messages"
 	netutil "kv-store/SystemServices/Network"
 	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var logger log.AsyncLog // define our logging suite
 
-// ConEngine -> Provides an interface to contstruct causaly consistent reads and writes.
-type ConEngine struct {
-	vectorClock map[string]int
-	streams     map[string]chan msg.Msg
-	quorumReq   int
-	addr        string
-	netutil.UDP
+var startLogger sync.Once // every engine in the process shares the logger
+
+// DefaultReadTimeout -> how long a read waits for a quorum of replicas unless told otherwise
+const DefaultReadTimeout = DefaultRPCTimeout
+
+// DefaultWriteTimeout -> how long a write waits for replicas to acknowledge it
+const DefaultWriteTimeout = DefaultRPCTimeout
+
+// ErrNoQuorum -> fewer replicas than the quorum answered before the read deadline
+var ErrNoQuorum = errors.New("read quorum not reached")
+
+// QuorumError -> which replicas answered a request that missed its deadline
+type QuorumError struct {
+	Answered int
+	Required int
+	Replicas []string
 }
 
-// NewConEngine -> Construct a new consensus manager
-func (c *ConEngine) NewConEngine(ip string, port int, replicas int, view []string) {
-	c.vectorClock = make(map[string]int)
-	c.streams = make(map[string]chan msg.Msg)
-	c.addr = ip
+func (e *QuorumError) Error() string {
+	return fmt.Sprintf("%v, %d of %d replicas answered", ErrNoQuorum, e.Answered, e.Required)
+}
 
-	logger = *log.New(nil) // create logger
-	go logger.Start()
+// Unwrap -> lets errors.Is match ErrNoQuorum
+func (e *QuorumError) Unwrap() error {
+	return ErrNoQuorum
+}
 
-	// initialize vector clock
+// eventStream -> replica answers to a single client request
+type eventStream struct {
+	messages chan msg.Msg
+	required int // answers needed before the request completes
+}
+
+// ConEngine -> Provides an interface to contstruct causaly consistent reads and writes.
+// The engine is copied by value, so every piece of state that changes after
+// construction sits behind a pointer and is guarded by the lock noted beside it.
+// Requests may use the engine, and any copy of it, from many goroutines at once.
+type ConEngine struct {
+	vectorClock VectorClock             // guarded by clockSync.m
+	applied     VectorClock             // writes applied here by coordinator and shard, guarded by clockSync.m
+	written     map[int]int             // writes coordinated here by shard, guarded by clockSync.m
+	clockSync   *clockSync              // also wakes requests waiting on the clock
+	streams     map[string]*eventStream // guarded by streamsMu
+	streamsMu   *sync.Mutex             // guards streams
+	ids         *uint64                 // sequence of generated ids, updated atomically
+	quorumReq   int                     // fixed at construction
+	replicas    int                     // fixed at construction
+	addr        string                  // fixed at construction
+	config      *config                 // settings, read as a snapshot
+	hlc         *hybridClock            // guarded by its own lock
+	signal      chan struct{}           // closed once by Signal
+	signalOnce  *sync.Once              // guards closing signal
+	rpc         *rpc                    // calls waiting for a reply, guarded by rpc.m
+	netutil.Transport
+}
+
+// NewConEngine -> Construct a new consensus manager on top of the given transport.
+// Nodes are identified by their host:port address.
+func (c *ConEngine) NewConEngine(addr string, replicas int, view []string, transport netutil.Transport) {
+	c.vectorClock = make(VectorClock)
+	c.applied = make(VectorClock)
+	c.written = make(map[int]int)
+	c.clockSync = newClockSync()
+	c.streams = make(map[string]*eventStream)
+	c.streamsMu = &sync.Mutex{}
+	c.ids = new(uint64)
+	c.config = newConfig()
+	c.signal = make(chan struct{})
+	c.signalOnce = &sync.Once{}
+	c.rpc = newRPC()
+	c.hlc = newHybridClock()
+	c.addr = clockKey(addr)
+	c.Transport = transport
+
+	startLogger.Do(func() {
+		logger = *log.New(nil) // create logger
+		go logger.Start()
+	})
+
+	// initialize vector clock, keyed by the canonical address of each node
 	for _, node := range view {
-		key := strings.Split(node, ":")[0]
-		c.vectorClock[key] = 0
+		c.vectorClock[clockKey(node)] = 0
 	}
 
-	// we require a majority of replicas to respond
+	// unless a request asks otherwise we require a majority of replicas to respond
+	c.replicas = replicas
 	c.quorumReq = int(replicas/2) + 1
 	fmt.Printf("Using quorum requirement of %d replicas with a view of %d replicas\n", c.quorumReq, replicas)
-
-	// create a udp utility
-	c.UDP.Init(ip, port, 1024)
 }
 
 // Send -> Provide a wrapper for any networking functions needed to send and recv messages.
 // This enables vector clocks to be appended to the payload.
-func (c *ConEngine) Send(addr string, Msg msg.Msg) {
+func (c *ConEngine) Send(addr string, Msg msg.Msg) error {
 	Msg = c.Encode(Msg)
 
 	// update my clock
 	c.Increment(c.addr)
-	c.Send(addr, Msg)
+	return c.transmit(addr, Msg)
 }
 
 // SendWithoutEvent -> Dont update the vector clock
-func (c *ConEngine) SendWithoutEvent(addr string, Msg msg.Msg) {
-	c.Send(addr, Msg)
+func (c *ConEngine) SendWithoutEvent(addr string, Msg msg.Msg) error {
+	return c.transmit(addr, Msg)
+}
+
+// UseReadTimeout -> set how long reads wait for a quorum of replicas
+func (c *ConEngine) UseReadTimeout(timeout time.Duration) {
+	c.configure(func(s *settings) { s.readTimeout = timeout })
+}
+
+// ReadDeadline -> deadline for a read started now
+func (c *ConEngine) ReadDeadline() time.Time {
+	return time.Now().Add(c.settings().readTimeout)
+}
+
+// UseWriteTimeout -> set how long writes wait for replicas to acknowledge them
+func (c *ConEngine) UseWriteTimeout(timeout time.Duration) {
+	c.configure(func(s *settings) { s.writeTimeout = timeout })
 }
 
-// RecvFrom -> wraper for the netutil function, is a blocking call
+// WriteDeadline -> deadline for a write started now
+func (c *ConEngine) WriteDeadline() time.Time {
+	return time.Now().Add(c.settings().writeTimeout)
+}
+
+// UseSigner -> sign every outgoing message with the cluster secret
+func (c *ConEngine) UseSigner(signer *msg.Signer) {
+	c.configure(func(s *settings) { s.signer = signer })
+}
+
+// transmit -> hand the message to the transport, compressing and signing it if required
+func (c *ConEngine) transmit(addr string, Msg msg.Msg) error {
+	Msg = c.compress(addr, Msg)
+
+	if signer := c.settings().signer; signer != nil {
+		Msg = signer.Sign(Msg)
+	}
+	return c.Transport.Send(addr, Msg)
+}
+
+// RecvFrom -> blocking call, wait until this node has been signaled
 func (c *ConEngine) RecvFrom() {
-	c.RecvFrom()
+	<-c.signal
 }
 
-// Signal -> wrapper for the netutil function
+// Signal -> release any functions waiting in RecvFrom, safe to call more than once
 func (c *ConEngine) Signal() {
-	c.Signal()
+	c.signalOnce.Do(func() {
+		fmt.Println("closing channel")
+		close(c.signal)
+	})
 }
 
-// Encode -> Add our vector clock to the message
+// Encode -> Add a copy of our vector clock to the message
 func (c *ConEngine) Encode(Msg msg.Msg) msg.Msg {
-	Msg.Context = c.vectorClock
+	Msg.Context = c.Clock()
 	return Msg
 }
 
 // PrintVC ->
 func (c *ConEngine) PrintVC() {
-	fmt.Println(c.vectorClock)
+	fmt.Println(c.Clock())
 }
 
-// generateID -> return a unique id for this node at this time
+// generateID -> return a unique id for this node at this time, ids generated by
+// concurrent requests in the same nanosecond differ by their sequence number
 func (c *ConEngine) generateID() string {
 	t := strconv.FormatInt(time.Now().UnixNano(), 10)
-	id := (t + c.addr)
+	seq := strconv.FormatUint(atomic.AddUint64(c.ids, 1), 10)
+	id := (t + c.addr + "-" + seq)
 	return id
 }
 
-/*
-	The following functions implement causal broadcast by utilizing vector clocks.
-
-	Causal broadcast algorithm: delivery valid iff
-		1. message from nodeA: c.vectorClock[nodeA] == remote_vc[nodeA] + 1
-
-		2. for each element c.vecor_clock <= remote_vc
-
-*/
-
 // NewEventStream -> Given a key get request, contact the correct replicas for the
 // value associated to that key. We can define how relationship between availability
 // and consistency by determining how many replicas we need to hear from before we
 // return to the client with the retrived value.
 func (c *ConEngine) NewEventStream() string {
+	return c.NewEventStreamFor(c.quorumReq)
+}
+
+// NewEventStreamFor -> create an event stream that is complete once the given
+// number of replicas have answered, see Required
+func (c *ConEngine) NewEventStreamFor(required int) string {
 
 	id := c.generateID()
-	message := make(chan msg.Msg, c.quorumReq)
+	stream := &eventStream{
+		messages: make(chan msg.Msg, required),
+		required: required,
+	}
 
-	// generate a unique channel id
 	// gain exclusive access before we add to map of channels
-	m := &sync.Mutex{}
-	m.Lock()
-	defer m.Unlock()
-	c.streams[id] = message
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	c.streams[id] = stream
 
 	return id
 }
@@ -123,14 +218,17 @@ func (c *ConEngine) NewEventStream() string {
 // a get request. Send a message into the channel associated with this get request.
 func (c *ConEngine) Deliver(newMsg msg.Msg) error {
 
-	thisChan, ok := c.streams[newMsg.ID]
+	c.streamsMu.Lock()
+	stream, ok := c.streams[newMsg.ID]
+	c.streamsMu.Unlock()
 
 	if !ok {
+		c.settings().stats.Inc("stream_late_answers")
 		return fmt.Errorf("ID provided in message does not exist in map of channels %s", newMsg.ID)
 	}
 
 	select {
-	case thisChan <- newMsg:
+	case stream.messages <- newMsg:
 		logger.Write("Message from " + newMsg.SrcAddr + " was accepted")
 	default:
 		logger.Write("Channel capacity is full")
@@ -139,128 +237,138 @@ func (c *ConEngine) Deliver(newMsg msg.Msg) error {
 	return nil
 }
 
-// OrderEvents -> Consume all messages in channel and compare causal context
-// before returning the most up to date read. Each message in this channel
-// is from a separate shard replica.
-func (c *ConEngine) OrderEvents(id string) (msg.Msg, error) {
-
-	var Nil map[string]int
-	var p io.Reader
-	var highestPriorityMsg = msg.Msg{SrcAddr: "", Payload: p, ID: "", Action: "", Context: Nil}
-
-	messages, ok := c.streams[id]
+// Collect -> Consume messages in the channel until the replicas required by the
+// stream have answered or the deadline passes, returning every answer received.
+// When the deadline is missed the answers are returned with a *QuorumError.
+// The stream is removed in every case.
+func (c *ConEngine) Collect(id string, deadline time.Time) ([]msg.Msg, error) {
+	c.streamsMu.Lock()
+	stream, ok := c.streams[id]
+	c.streamsMu.Unlock()
 	if !ok {
-		return highestPriorityMsg, fmt.Errorf("Stream id %s not in map of streams", id)
+		return nil, fmt.Errorf("Stream id %s not in map of streams", id)
 	}
 
-	// read all responses from the specified number of replicas
-	seen := 0
-	for thisMsg := range messages {
-
-		logger.Write("Consuming message and comparing clocks, msg src: " + thisMsg.SrcAddr)
-
-		// if the value of the two messages are the same, dont check vectors
-		if !c.IdenticalValue(highestPriorityMsg.Payload, thisMsg.Payload) {
-			if c.ValidDelivery(thisMsg.SrcAddr, thisMsg.Context, highestPriorityMsg.SrcAddr, highestPriorityMsg.Context) {
-				// update which read we should return
-				highestPriorityMsg = thisMsg
+	// replicas answering after we return are told the stream no longer exists
+	defer func() {
+		c.streamsMu.Lock()
+		delete(c.streams, id)
+		c.streamsMu.Unlock()
+	}()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	answers := make([]msg.Msg, 0, stream.required)
+	for len(answers) < stream.required {
+		select {
+		case thisMsg := <-stream.messages:
+			answers = append(answers, thisMsg)
+		case <-timer.C:
+			replicas := make([]string, len(answers))
+			for i, answer := range answers {
+				replicas[i] = answer.SrcAddr
 			}
-		}
-
-		seen++
-		if seen >= c.quorumReq {
-			close(messages)
-			break
+			return answers, &QuorumError{Answered: len(answers), Required: stream.required, Replicas: replicas}
 		}
 	}
 
-	// gain exclusive access to our map of channels before we delete this read stream id
-	m := &sync.Mutex{}
-	m.Lock()
-	defer m.Unlock()
-	delete(c.streams, id)
-
-	return highestPriorityMsg, nil
+	return answers, nil
 }
 
-// IdenticalValue -> if the message value is the same we dont need to
-// check vector clocks
-func (c *ConEngine) IdenticalValue(m1, m2 io.Reader) bool {
-	buf1 := new(bytes.Buffer)
-	buf2 := new(bytes.Buffer)
-	buf1.ReadFrom(m1)
-	buf2.ReadFrom(m2)
-
-	if buf1.String() != buf2.String() {
-		return false
+// OrderEvents -> Consume the answers of the replicas required by the stream and
+// return the most up to date read. When the deadline is missed the best read seen
+// so far is returned with a *QuorumError.
+func (c *ConEngine) OrderEvents(id string, deadline time.Time) (msg.Msg, error) {
+	answers, err := c.Collect(id, deadline)
+	if errors.Is(err, ErrNoQuorum) {
+		c.settings().stats.Inc("read_quorum_timeouts")
 	}
-	return true
-}
-
-// Increment -> Update the vector clock for this node
-func (c *ConEngine) Increment(srcNode string) error {
-	_, ok := c.vectorClock[srcNode]
 
-	if ok {
-		c.vectorClock[srcNode]++
-	} else {
-		//c.vectorClock[node] = 0
-		return fmt.Errorf("Cant Increment index of node not in view %q, %q", srcNode, c.vectorClock)
-	}
-
-	return nil
+	return c.Latest(answers), err
 }
 
-// CheckIndices -> Determine if the first vector clock causaly happened before the second vector clock
-func (c *ConEngine) CheckIndices(newVC map[string]int, prevVC map[string]int) (bool, bool) {
-
-	// check each key, val to compare the greater history
-	nul := true
-	for index, value := range prevVC {
+// Latest -> compare the causal context of replica answers and return the most up
+// to date read. Each answer is from a separate shard replica. When the clocks of two
+// answers are concurrent or equal the answer with the later timestamp wins under the
+// last writer wins policy, otherwise the answer whose replica has seen more events,
+// then the greater value, so every coordinator settles on the same read.
+func (c *ConEngine) Latest(answers []msg.Msg) msg.Msg {
+	var latest msg.Msg
+	lww := c.settings().lww
 
-		if value != 0 {
-			nul = false
-		}
-
-		val, ok := newVC[index]
-
-		if ok == false && value != 0 {
-			return false, nul
-		}
+	for i, thisMsg := range answers {
+		logger.Write("Consuming message and comparing clocks, msg src: " + thisMsg.SrcAddr)
 
-		if ok && val < value {
-			return false, nul
+		// if the value of the two messages are the same, dont check vectors
+		if i == 0 || (!c.IdenticalValue(latest.Payload, thisMsg.Payload) && newer(thisMsg, latest, lww)) {
+			latest = thisMsg
 		}
 	}
 
-	return true, nul
+	return latest
 }
 
-// ValidDelivery -> compare two vector clocks and determine if the new clock -> old clock
-func (c *ConEngine) ValidDelivery(newNode string, newVC map[string]int, pevNode string, prevVC map[string]int) bool {
+// newer -> whether the answer is more up to date than the current read
+func newer(answer, current msg.Msg, lww bool) bool {
+	theirs, ours := VectorClock(answer.Context), VectorClock(current.Context)
 
-	if len(newVC) < len(prevVC) {
+	switch theirs.Compare(ours) {
+	case After:
+		return true
+	case Before:
 		return false
 	}
 
-	valid, empty := c.CheckIndices(newVC, prevVC) // compare element wise
-
-	if valid && empty { // check if our vector clock is empty
-		return true
+	// encoded timestamps sort in timestamp order, an unstamped answer is the oldest
+	if lww && answer.Stamp != current.Stamp {
+		return answer.Stamp > current.Stamp
 	}
 
-	val, ok := prevVC[newNode]
+	if theirs.Sum() != ours.Sum() {
+		return theirs.Sum() > ours.Sum()
+	}
+	return bytes.Compare(answer.Payload, current.Payload) > 0
+}
 
-	if ok {
-		if val != (newVC[newNode] + 1) { // compare first condition of causal broadcast
-			return false
+// Stale -> replicas whose answer differs from the latest read
+func (c *ConEngine) Stale(answers []msg.Msg, latest msg.Msg) []string {
+	var stale []string
+	for _, answer := range answers {
+		if !c.IdenticalValue(answer.Payload, latest.Payload) {
+			stale = append(stale, answer.SrcAddr)
 		}
 	}
+	return stale
+}
+
+// IdenticalValue -> if the message value is the same we dont need to
+// check vector clocks
+func (c *ConEngine) IdenticalValue(m1, m2 []byte) bool {
+	return bytes.Equal(m1, m2)
+}
 
-	return valid
+// clockKey -> nodes are keyed by their canonical address, names that are not
+// host:port addresses are used as is
+func clockKey(node string) string {
+	if addr, err := netutil.NormalizeAddr(node); err == nil {
+		return addr
+	}
+	return node
 }
 
-// ValidDeliveryLocal ->
-func (c *ConEngine) ValidDeliveryLocal(newNode string, newVC map[string]int) bool {
-	return c.ValidDelivery(newNode, newVC, c.addr, c.vectorClock)
+// Increment -> Update the vector clock for this node
+func (c *ConEngine) Increment(srcNode string) error {
+	srcNode = clockKey(srcNode)
+
+	c.clockSync.m.Lock()
+	defer c.clockSync.m.Unlock()
+
+	if _, ok := c.vectorClock[srcNode]; !ok {
+		return fmt.Errorf("Cant Increment index of node not in view %q, %q", srcNode, c.vectorClock)
+	}
+
+	c.vectorClock.Increment(srcNode)
+	c.clockSync.advanced()
+	return nil
 }
@@ -0,0 +1,378 @@
+package consensus
+
+import (
+	"errors"
+	"fmt"
+	msg "kv-store/Messages"
+	netutil "kv-store/SystemServices/Network"
+	stats "kv-store/SystemServices/Stats"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testView = []string{"127.0.0.1:13801", "127.0.0.1:13802", "127.0.0.1:13803"}
+
+func newTestEngine(mem *netutil.MemNetwork, addr string) *ConEngine {
+	c := new(ConEngine)
+	c.NewConEngine(addr, len(testView), testView, mem.Join(addr, 16))
+	return c
+}
+
+func TestSendAttachesClock(t *testing.T) {
+	mem := netutil.NewMemNetwork()
+	a := newTestEngine(mem, "127.0.0.1:13801")
+	b := newTestEngine(mem, "127.0.0.1:13802")
+
+	for i := 1; i <= 2; i++ {
+		if err := a.Send("127.0.0.1:13802", msg.Msg{SrcAddr: "127.0.0.1:13801", Action: "put"}); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+
+		got, _, err := b.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+
+		// the clock is attached before the send event is counted
+		if got.Context["127.0.0.1:13801"] != i-1 {
+			t.Errorf("Expected clock entry %d for the sender, got %v", i-1, got.Context)
+		}
+	}
+
+	if a.vectorClock["127.0.0.1:13801"] != 2 {
+		t.Errorf("Sender clock not incremented, got %v", a.vectorClock)
+	}
+}
+
+func TestSendWithoutEvent(t *testing.T) {
+	mem := netutil.NewMemNetwork()
+	a := newTestEngine(mem, "127.0.0.1:13801")
+	b := newTestEngine(mem, "127.0.0.1:13802")
+
+	a.SendWithoutEvent("127.0.0.1:13802", msg.Msg{SrcAddr: "127.0.0.1:13801", Action: "gossip"})
+
+	if _, _, err := b.Recv(); err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if a.vectorClock["127.0.0.1:13801"] != 0 {
+		t.Errorf("Clock should not change without an event, got %v", a.vectorClock)
+	}
+}
+
+func TestOrderEvents(t *testing.T) {
+	mem := netutil.NewMemNetwork()
+	a := newTestEngine(mem, "127.0.0.1:13801")
+
+	stamp := func(wall int64, node string) string {
+		return Timestamp{Wall: wall, Node: node}.String()
+	}
+
+	scenarios := []struct {
+		replies []msg.Msg
+		policy  string
+		expect  string
+	}{
+		{
+			replies: []msg.Msg{
+				{SrcAddr: "127.0.0.1:13801", Payload: []byte("value0"), Context: map[string]int{"127.0.0.1:13801": 0, "127.0.0.1:13802": 0}},
+				{SrcAddr: "127.0.0.1:13802", Payload: []byte("value0"), Context: map[string]int{"127.0.0.1:13801": 0, "127.0.0.1:13802": 0}},
+			},
+			expect: "value0",
+		},
+		{
+			replies: []msg.Msg{
+				{SrcAddr: "127.0.0.1:13802", Payload: []byte("value1"), Context: map[string]int{"127.0.0.1:13801": 0, "127.0.0.1:13802": 0}},
+				{SrcAddr: "127.0.0.1:13803", Payload: []byte("value1"), Context: map[string]int{"127.0.0.1:13801": 0, "127.0.0.1:13803": 0}},
+			},
+			expect: "value1",
+		},
+		{
+			// a replica that has seen more events than the other wins
+			replies: []msg.Msg{
+				{SrcAddr: "127.0.0.1:13802", Payload: []byte("value3"), Context: map[string]int{"127.0.0.1:13801": 2, "127.0.0.1:13802": 1}},
+				{SrcAddr: "127.0.0.1:13801", Payload: []byte("value2"), Context: map[string]int{"127.0.0.1:13801": 1, "127.0.0.1:13802": 0}},
+			},
+			expect: "value3",
+		},
+		{
+			// concurrent answers settle on the replica that has seen more events
+			replies: []msg.Msg{
+				{SrcAddr: "127.0.0.1:13801", Payload: []byte("value4"), Context: map[string]int{"127.0.0.1:13801": 3, "127.0.0.1:13802": 0}},
+				{SrcAddr: "127.0.0.1:13802", Payload: []byte("value5"), Context: map[string]int{"127.0.0.1:13801": 1, "127.0.0.1:13802": 1}},
+			},
+			expect: "value4",
+		},
+		{
+			// and then on the greater value, whichever answer arrives first
+			replies: []msg.Msg{
+				{SrcAddr: "127.0.0.1:13802", Payload: []byte("value7"), Context: map[string]int{"127.0.0.1:13801": 0, "127.0.0.1:13802": 1}},
+				{SrcAddr: "127.0.0.1:13801", Payload: []byte("value6"), Context: map[string]int{"127.0.0.1:13801": 1, "127.0.0.1:13802": 0}},
+			},
+			expect: "value7",
+		},
+		{
+			// with last writer wins concurrent answers settle on the later write
+			replies: []msg.Msg{
+				{SrcAddr: "127.0.0.1:13801", Payload: []byte("value8"), Context: map[string]int{"127.0.0.1:13801": 3, "127.0.0.1:13802": 0}, Stamp: stamp(1, "127.0.0.1:13801")},
+				{SrcAddr: "127.0.0.1:13802", Payload: []byte("value9"), Context: map[string]int{"127.0.0.1:13801": 1, "127.0.0.1:13802": 1}, Stamp: stamp(2, "127.0.0.1:13802")},
+			},
+			policy: PolicyLWW,
+			expect: "value9",
+		},
+		{
+			// writes stamped at the same time settle on the node id
+			replies: []msg.Msg{
+				{SrcAddr: "127.0.0.1:13802", Payload: []byte("value11"), Context: map[string]int{"127.0.0.1:13801": 0, "127.0.0.1:13802": 1}, Stamp: stamp(1, "127.0.0.1:13802")},
+				{SrcAddr: "127.0.0.1:13801", Payload: []byte("value10"), Context: map[string]int{"127.0.0.1:13801": 1, "127.0.0.1:13802": 0}, Stamp: stamp(1, "127.0.0.1:13801")},
+			},
+			policy: PolicyLWW,
+			expect: "value11",
+		},
+		{
+			// an answer the other has seen is older whatever its timestamp
+			replies: []msg.Msg{
+				{SrcAddr: "127.0.0.1:13802", Payload: []byte("value12"), Context: map[string]int{"127.0.0.1:13801": 1, "127.0.0.1:13802": 0}, Stamp: stamp(5, "127.0.0.1:13802")},
+				{SrcAddr: "127.0.0.1:13801", Payload: []byte("value13"), Context: map[string]int{"127.0.0.1:13801": 2, "127.0.0.1:13802": 0}, Stamp: stamp(1, "127.0.0.1:13801")},
+			},
+			policy: PolicyLWW,
+			expect: "value13",
+		},
+	}
+
+	for _, s := range scenarios {
+		policy := PolicyCausal
+		if s.policy != "" {
+			policy = s.policy
+		}
+		if err := a.UseConflictPolicy(policy); err != nil {
+			t.Fatalf("UseConflictPolicy failed: %v", err)
+		}
+
+		id := a.NewEventStream()
+
+		for _, reply := range s.replies {
+			reply.ID = id
+			if err := a.Deliver(reply); err != nil {
+				t.Fatalf("Deliver failed: %v", err)
+			}
+		}
+
+		got, err := a.OrderEvents(id, a.ReadDeadline())
+		if err != nil {
+			t.Fatalf("OrderEvents failed: %v", err)
+		}
+		if got.PayloadToStr() != s.expect {
+			t.Errorf("Did not get expected read. Expected %q, got %q", s.expect, got.PayloadToStr())
+		}
+		if _, ok := a.streams[id]; ok {
+			t.Errorf("Stream %s was not removed", id)
+		}
+	}
+}
+
+func TestOrderEventsDeadline(t *testing.T) {
+	mem := netutil.NewMemNetwork()
+	a := newTestEngine(mem, "127.0.0.1:13801")
+	a.UseStats(stats.New())
+	a.UseReadTimeout(50 * time.Millisecond)
+
+	context := map[string]int{"127.0.0.1:13801": 0, "127.0.0.1:13802": 0}
+	scenarios := []struct {
+		replies  []msg.Msg
+		answered int
+		expect   string
+	}{
+		{answered: 0, expect: ""},
+		{
+			replies:  []msg.Msg{{SrcAddr: "127.0.0.1:13802", Payload: []byte("value0"), Context: context}},
+			answered: 1,
+			expect:   "value0",
+		},
+	}
+
+	for _, s := range scenarios {
+		id := a.NewEventStream()
+		for _, reply := range s.replies {
+			reply.ID = id
+			a.Deliver(reply)
+		}
+
+		start := time.Now()
+		got, err := a.OrderEvents(id, a.ReadDeadline())
+
+		var quorum *QuorumError
+		if !errors.As(err, &quorum) || !errors.Is(err, ErrNoQuorum) {
+			t.Fatalf("Expected a quorum error, got %v", err)
+		}
+		if quorum.Answered != s.answered || quorum.Required != a.quorumReq {
+			t.Errorf("Expected %d of %d answers, got %d of %d", s.answered, a.quorumReq, quorum.Answered, quorum.Required)
+		}
+		if got.PayloadToStr() != s.expect {
+			t.Errorf("Expected the partial read %q, got %q", s.expect, got.PayloadToStr())
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Read returned %v after its deadline", elapsed)
+		}
+
+		// replicas answering late find the stream removed
+		if err := a.Deliver(msg.Msg{ID: id, SrcAddr: "127.0.0.1:13803"}); err == nil {
+			t.Errorf("Stream %s was not removed", id)
+		}
+	}
+
+	if got := a.settings().stats.Get("read_quorum_timeouts"); got != 2 {
+		t.Errorf("Expected 2 read timeouts in stats, got %d", got)
+	}
+}
+
+func TestStale(t *testing.T) {
+	a := newTestEngine(netutil.NewMemNetwork(), "127.0.0.1:13801")
+
+	older := map[string]int{"127.0.0.1:13801": 0, "127.0.0.1:13802": 0}
+	newer := map[string]int{"127.0.0.1:13801": 1, "127.0.0.1:13802": 0}
+
+	scenarios := []struct {
+		answers []msg.Msg
+		expect  []string
+	}{
+		{
+			answers: []msg.Msg{
+				{SrcAddr: "127.0.0.1:13801", Payload: []byte("value0"), Context: older},
+				{SrcAddr: "127.0.0.1:13802", Payload: []byte("value0"), Context: older},
+			},
+		},
+		{
+			answers: []msg.Msg{
+				{SrcAddr: "127.0.0.1:13801", Payload: []byte("value1"), Context: newer},
+				{SrcAddr: "127.0.0.1:13802", Payload: []byte("value0"), Context: older},
+			},
+			expect: []string{"127.0.0.1:13802"},
+		},
+		{
+			answers: []msg.Msg{
+				{SrcAddr: "127.0.0.1:13801", Payload: []byte("value1"), Context: newer},
+				{SrcAddr: "127.0.0.1:13802", Context: older},
+				{SrcAddr: "127.0.0.1:13803", Payload: []byte("value0"), Context: older},
+			},
+			expect: []string{"127.0.0.1:13802", "127.0.0.1:13803"},
+		},
+	}
+
+	for i, s := range scenarios {
+		latest := a.Latest(s.answers)
+		if got := a.Stale(s.answers, latest); !reflect.DeepEqual(got, s.expect) {
+			t.Errorf("Scenario %d: expected %v to be stale, got %v", i, s.expect, got)
+		}
+	}
+}
+
+func TestDeliverUnknownStream(t *testing.T) {
+	mem := netutil.NewMemNetwork()
+	a := newTestEngine(mem, "127.0.0.1:13801")
+
+	if err := a.Deliver(msg.Msg{ID: "missing"}); err == nil {
+		t.Errorf("Expected an error when delivering to an unknown stream")
+	}
+}
+
+// TestConcurrentEngine -> requests served at once share the engine and its copies,
+// run with -race to check every piece of state is synchronized
+func TestConcurrentEngine(t *testing.T) {
+	const workers, rounds = 8, 50
+
+	mem := netutil.NewMemNetwork()
+	a := newTestEngine(mem, "127.0.0.1:13801")
+	b := newTestEngine(mem, "127.0.0.1:13802")
+	defer a.Close()
+	defer b.Close()
+
+	a.UseStats(stats.New())
+	a.UseCompression([]string{msg.CodecGzip}, 64)
+	a.UseCausalDelivery(4, time.Millisecond)
+	b.UseCompression([]string{msg.CodecGzip}, 64)
+
+	go serve(a)
+	go serve(b)
+
+	// the node embeds a copy of the engine, it must share state with the original
+	copied := *a
+
+	errs := make(chan error, workers)
+	stamps := make(chan []Timestamp, workers)
+	for w := 0; w < workers; w++ {
+		go func(w int) {
+			var err error
+			var taken []Timestamp
+			defer func() { errs <- err; stamps <- taken }()
+
+			for i := 0; i < rounds; i++ {
+				engine := a
+				if i%2 == 1 {
+					engine = &copied
+				}
+
+				// a read answered by two replicas at once
+				id := engine.NewEventStreamFor(2)
+				go engine.Deliver(msg.Msg{ID: id, SrcAddr: testView[1], Payload: []byte("new"), Context: map[string]int{testView[1]: i + 1}})
+				go engine.Deliver(msg.Msg{ID: id, SrcAddr: testView[2], Payload: []byte("old")})
+				latest, rerr := engine.OrderEvents(id, time.Now().Add(5*time.Second))
+				if rerr != nil || latest.PayloadToStr() != "new" {
+					err = fmt.Errorf("worker %d: read %q, %v", w, latest.PayloadToStr(), rerr)
+					return
+				}
+
+				// a call whose payload is large enough to be compressed
+				payload := strings.Repeat(strconv.Itoa(w), 128)
+				reply, cerr := engine.Call(b.addr, "get", []byte(payload), time.Now().Add(5*time.Second))
+				if cerr != nil || reply.PayloadToStr() != strings.ToUpper(payload) {
+					err = fmt.Errorf("worker %d: call answered %q, %v", w, reply.PayloadToStr(), cerr)
+					return
+				}
+
+				engine.Increment(engine.addr)
+				engine.Merge(map[string]int{testView[2]: i})
+				engine.Covers(engine.Clock())
+				engine.Hold(msg.Msg{SrcAddr: testView[2], Context: map[string]int{testView[2]: rounds + 2}})
+				engine.Release()
+
+				taken = append(taken, engine.Now())
+				engine.Observe(Timestamp{Wall: time.Now().UnixNano(), Node: testView[1]}.String())
+
+				// settings change while requests are served
+				engine.UseReadTimeout(time.Second)
+				engine.UseRPCTimeout(5 * time.Second)
+				engine.UseConflictPolicy([]string{PolicyCausal, PolicyLWW}[i%2])
+				engine.ReadDeadline()
+				engine.LastWriterWins()
+			}
+			a.Signal()
+		}(w)
+	}
+
+	seen := make(map[Timestamp]bool)
+	for w := 0; w < workers; w++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+		for _, stamp := range <-stamps {
+			if seen[stamp] {
+				t.Errorf("Timestamp %v taken twice", stamp)
+			}
+			seen[stamp] = true
+		}
+	}
+
+	// every increment is counted once, whichever copy of the engine made it
+	if got := a.Clock()[a.addr]; got != workers*rounds {
+		t.Errorf("Expected %d events on our clock, got %d", workers*rounds, got)
+	}
+	if got := copied.Clock()[testView[2]]; got != rounds-1 {
+		t.Errorf("Expected the merged clock entry %d, got %d", rounds-1, got)
+	}
+
+	// every worker signaled, waiting returns
+	copied.RecvFrom()
+}
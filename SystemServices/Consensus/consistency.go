@@ -0,0 +1,65 @@
+package consensus
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Consistency levels a client may ask for on each request
+const (
+	LevelOne    = "ONE"
+	LevelQuorum = "QUORUM"
+	LevelAll    = "ALL"
+
+	// LevelLinearizable -> served by the raft group of the shard instead of by
+	// counting replica answers, see Required for the other levels
+	LevelLinearizable = "LINEARIZABLE"
+)
+
+// ErrBadLevel -> the requested consistency level can not be met by the shard
+var ErrBadLevel = errors.New("invalid consistency level")
+
+// Replicas -> number of replicas holding each key
+func (c *ConEngine) Replicas() int {
+	return c.replicas
+}
+
+// Quorum -> number of replicas making up a majority
+func (c *ConEngine) Quorum() int {
+	return c.quorumReq
+}
+
+// Required -> number of replica answers needed to satisfy the level, which is ONE,
+// QUORUM, ALL or an explicit count between one and the number of replicas
+func (c *ConEngine) Required(level string) (int, error) {
+	switch strings.ToUpper(strings.TrimSpace(level)) {
+	case LevelOne:
+		return 1, nil
+	case LevelQuorum:
+		return c.quorumReq, nil
+	case LevelAll:
+		return c.replicas, nil
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(level))
+	if err != nil || n < 1 || n > c.replicas {
+		return 0, fmt.Errorf("%w %q, expected ONE, QUORUM, ALL or 1 to %d", ErrBadLevel, level, c.replicas)
+	}
+	return n, nil
+}
+
+// Achieved -> the strongest level met by the given number of replica answers,
+// empty when no replica answered
+func (c *ConEngine) Achieved(answered int) string {
+	switch {
+	case answered >= c.replicas:
+		return LevelAll
+	case answered >= c.quorumReq:
+		return LevelQuorum
+	case answered >= 1:
+		return LevelOne
+	}
+	return ""
+}
@@ -0,0 +1,60 @@
+package consensus
+
+import (
+	"errors"
+	netutil "kv-store/SystemServices/Network"
+	"testing"
+)
+
+func TestRequired(t *testing.T) {
+	a := newTestEngine(netutil.NewMemNetwork(), "127.0.0.1:13801")
+
+	scenarios := []struct {
+		level  string
+		expect int
+		err    bool
+	}{
+		{level: "ONE", expect: 1},
+		{level: "quorum", expect: 2},
+		{level: "ALL", expect: 3},
+		{level: " 2 ", expect: 2},
+		{level: "3", expect: 3},
+		{level: "0", err: true},
+		{level: "4", err: true},
+		{level: "SOME", err: true},
+	}
+
+	for _, s := range scenarios {
+		got, err := a.Required(s.level)
+		if s.err {
+			if !errors.Is(err, ErrBadLevel) {
+				t.Errorf("Level %q: expected ErrBadLevel, got %d (%v)", s.level, got, err)
+			}
+			continue
+		}
+
+		if err != nil || got != s.expect {
+			t.Errorf("Level %q: expected %d replicas, got %d (%v)", s.level, s.expect, got, err)
+		}
+	}
+}
+
+func TestAchieved(t *testing.T) {
+	a := newTestEngine(netutil.NewMemNetwork(), "127.0.0.1:13801")
+
+	scenarios := []struct {
+		answered int
+		expect   string
+	}{
+		{answered: 0, expect: ""},
+		{answered: 1, expect: LevelOne},
+		{answered: 2, expect: LevelQuorum},
+		{answered: 3, expect: LevelAll},
+	}
+
+	for _, s := range scenarios {
+		if got := a.Achieved(s.answered); got != s.expect {
+			t.Errorf("%d answers: expected %q, got %q", s.answered, s.expect, got)
+		}
+	}
+}
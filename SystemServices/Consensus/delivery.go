@@ -0,0 +1,240 @@
+package consensus
+
+import (
+	msg "kv-store/Messages"
+	stats "kv-store/SystemServices/Stats"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default bounds on the messages held until their causal predecessors arrive
+const (
+	DefaultDeliveryLimit   = 1024
+	DefaultDeliveryTimeout = 250 * time.Millisecond
+)
+
+// held -> a message waiting for its causal predecessors
+type held struct {
+	Msg   msg.Msg
+	since time.Time
+}
+
+// deliveryBuffer -> messages received before their causal predecessors, oldest
+// first. At most limit messages are held and none for longer than timeout.
+type deliveryBuffer struct {
+	m       *sync.Mutex
+	held    []held
+	limit   int
+	timeout time.Duration
+	maxWait time.Duration
+	now     func() time.Time
+}
+
+func newDeliveryBuffer(limit int, timeout time.Duration) *deliveryBuffer {
+	return &deliveryBuffer{
+		m:       &sync.Mutex{},
+		limit:   limit,
+		timeout: timeout,
+		now:     time.Now,
+	}
+}
+
+// UseCausalDelivery -> hold messages that arrive before their causal predecessors
+// until those have been applied. At most limit messages are held for no longer than
+// timeout, a limit below one delivers every message as it arrives.
+func (c *ConEngine) UseCausalDelivery(limit int, timeout time.Duration) {
+	var d *deliveryBuffer
+	if limit >= 1 {
+		d = newDeliveryBuffer(limit, timeout)
+	}
+	c.configure(func(s *settings) { s.delivery = d })
+}
+
+// shardKey -> the dependency entry counting the writes a node coordinated to a shard
+func shardKey(addr string, shard int) string {
+	return clockKey(addr) + "/" + strconv.Itoa(shard)
+}
+
+// coordinator -> the node of a dependency entry
+func coordinator(key string) string {
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+// UseShard -> the shard whose writes are applied here. Delivery then waits only on
+// the writes to that shard a message depends on, a negative shard waits on all of them.
+func (c *ConEngine) UseShard(shard int) {
+	c.configure(func(s *settings) { s.shard = shard })
+}
+
+// ShardClock -> the entries of a dependency clock counting writes to the shard
+func ShardClock(clock map[string]int, shard int) map[string]int {
+	suffix := "/" + strconv.Itoa(shard)
+	entries := make(map[string]int)
+	for key, count := range clock {
+		if strings.HasSuffix(key, suffix) {
+			entries[key] = count
+		}
+	}
+	return entries
+}
+
+// Written -> count a write coordinated here to the shard and return the writes it
+// depends on, those to every shard applied here or coordinated here before it.
+// Replicas of the shard wait only on the writes to it, the rest orders the write
+// against other shards for snapshots.
+func (c *ConEngine) Written(shard int) map[string]int {
+	c.clockSync.m.Lock()
+	defer c.clockSync.m.Unlock()
+
+	c.written[shard]++
+	deps := map[string]int(c.applied.Copy())
+	for other, count := range c.written {
+		if key := shardKey(c.addr, other); count > deps[key] {
+			deps[key] = count
+		}
+	}
+	return deps
+}
+
+// AppliedClock -> the writes applied here and those they depend on
+func (c *ConEngine) AppliedClock() map[string]int {
+	c.clockSync.m.Lock()
+	defer c.clockSync.m.Unlock()
+
+	return c.applied.Copy()
+}
+
+// Applied -> record that a write and the writes it depends on have been applied
+// here, releasing the held writes waiting for them
+func (c *ConEngine) Applied(deps map[string]int) {
+	c.clockSync.m.Lock()
+	defer c.clockSync.m.Unlock()
+
+	if c.applied.Merge(deps) {
+		c.clockSync.advanced()
+	}
+}
+
+// Deliverable -> whether every write to our shard the message depends on has been
+// applied here. The sender may be one write ahead of us, the message itself.
+// Messages carrying no dependencies, e.g. read repairs, are delivered as they arrive.
+func (c *ConEngine) Deliverable(Msg msg.Msg) bool {
+	sender := clockKey(Msg.SrcAddr)
+	deps := Msg.Deps
+	if shard := c.settings().shard; shard >= 0 {
+		deps = ShardClock(deps, shard)
+	}
+
+	c.clockSync.m.Lock()
+	defer c.clockSync.m.Unlock()
+
+	for key, count := range deps {
+		ours := c.applied[key]
+		if coordinator(key) == sender {
+			ours++
+		}
+		if count > ours {
+			return false
+		}
+	}
+	return true
+}
+
+// Hold -> keep the message until its causal predecessors have been applied. Returns
+// the messages to handle now: the message itself when nothing is missing, or the
+// oldest held message when the buffer is full.
+func (c *ConEngine) Hold(Msg msg.Msg) []msg.Msg {
+	s := c.settings()
+	d := s.delivery
+	if d == nil {
+		return []msg.Msg{Msg}
+	}
+
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if c.Deliverable(Msg) {
+		return []msg.Msg{Msg}
+	}
+
+	var ready []msg.Msg
+	if len(d.held) >= d.limit {
+		oldest := d.held[0]
+		d.held = d.held[1:]
+		d.released(oldest, "causal_forced_full", s.stats)
+		ready = append(ready, oldest.Msg)
+	}
+
+	logger.Write("holding " + Msg.Action + " from " + Msg.SrcAddr + " until its causal predecessors arrive")
+	d.held = append(d.held, held{Msg: Msg, since: d.now()})
+	s.stats.Inc("causal_held")
+	s.stats.Set("causal_pending", int64(len(d.held)))
+	return ready
+}
+
+// Release -> remove and return, oldest first, the held messages whose causal
+// predecessors have been applied along with those held for longer than the timeout
+func (c *ConEngine) Release() []msg.Msg {
+	s := c.settings()
+	d := s.delivery
+	if d == nil {
+		return nil
+	}
+
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	var ready []msg.Msg
+	kept := d.held[:0]
+	for _, h := range d.held {
+		switch {
+		case c.Deliverable(h.Msg):
+			d.released(h, "causal_released", s.stats)
+		case d.now().Sub(h.since) >= d.timeout:
+			d.released(h, "causal_forced_timeout", s.stats)
+		default:
+			kept = append(kept, h)
+			continue
+		}
+		ready = append(ready, h.Msg)
+	}
+
+	d.held = kept
+	s.stats.Set("causal_pending", int64(len(d.held)))
+	return ready
+}
+
+// NextRelease -> how long until the oldest held message times out, the timeout
+// when nothing is held
+func (c *ConEngine) NextRelease() time.Duration {
+	d := c.settings().delivery
+	if d == nil {
+		return DefaultDeliveryTimeout
+	}
+
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if len(d.held) == 0 {
+		return d.timeout
+	}
+	return d.held[0].since.Add(d.timeout).Sub(d.now())
+}
+
+// released -> count a message leaving the buffer and how long it waited, the
+// caller must hold the buffer lock
+func (d *deliveryBuffer) released(h held, reason string, counters *stats.Counters) {
+	wait := d.now().Sub(h.since)
+	if wait > d.maxWait {
+		d.maxWait = wait
+		counters.Set("causal_wait_ms_max", wait.Milliseconds())
+	}
+
+	counters.Inc(reason)
+	counters.Add("causal_wait_ms_total", wait.Milliseconds())
+}
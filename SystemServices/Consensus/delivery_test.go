@@ -0,0 +1,132 @@
+package consensus
+
+import (
+	msg "kv-store/Messages"
+	netutil "kv-store/SystemServices/Network"
+	stats "kv-store/SystemServices/Stats"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDeliverable(t *testing.T) {
+	a := newTestEngine(netutil.NewMemNetwork(), "127.0.0.1:13801")
+	a.Applied(map[string]int{"127.0.0.1:13802/0": 1, "127.0.0.1:13803/0": 2})
+	a.UseShard(0)
+
+	scenarios := []struct {
+		src    string
+		deps   map[string]int
+		expect bool
+	}{
+		{src: "127.0.0.1:13802", deps: map[string]int{"127.0.0.1:13802/0": 2, "127.0.0.1:13803/0": 2}, expect: true},
+		{src: "127.0.0.1:13802", deps: map[string]int{"127.0.0.1:13802/0": 1, "127.0.0.1:13803/0": 0}, expect: true},
+		// a write by the sender is missing
+		{src: "127.0.0.1:13802", deps: map[string]int{"127.0.0.1:13802/0": 3}, expect: false},
+		// a write by another node is missing
+		{src: "127.0.0.1:13802", deps: map[string]int{"127.0.0.1:13802/0": 2, "127.0.0.1:13803/0": 3}, expect: false},
+		// writes to other shards are applied by their replicas
+		{src: "127.0.0.1:13802", deps: map[string]int{"127.0.0.1:13802/0": 2, "127.0.0.1:13802/1": 7, "127.0.0.1:13803/1": 9}, expect: true},
+		// only the sender may be one write ahead
+		{src: "127.0.0.1:13803", deps: map[string]int{"127.0.0.1:13802/0": 2}, expect: false},
+		// messages without dependencies, e.g. read repairs
+		{src: "127.0.0.1:13803", deps: nil, expect: true},
+	}
+
+	for _, s := range scenarios {
+		if got := a.Deliverable(msg.Msg{SrcAddr: s.src, Deps: s.deps}); got != s.expect {
+			t.Errorf("Message from %v with %v: expected deliverable %v, got %v", s.src, s.deps, s.expect, got)
+		}
+	}
+}
+
+func TestWritten(t *testing.T) {
+	a := newTestEngine(netutil.NewMemNetwork(), "127.0.0.1:13801")
+	a.Applied(map[string]int{"127.0.0.1:13802/0": 2, "127.0.0.1:13802/1": 5})
+
+	scenarios := []struct {
+		shard  int
+		expect map[string]int
+	}{
+		{shard: 0, expect: map[string]int{"127.0.0.1:13802/0": 2, "127.0.0.1:13802/1": 5, "127.0.0.1:13801/0": 1}},
+		{shard: 0, expect: map[string]int{"127.0.0.1:13802/0": 2, "127.0.0.1:13802/1": 5, "127.0.0.1:13801/0": 2}},
+		// a write depends on those we coordinated to other shards before it
+		{shard: 1, expect: map[string]int{"127.0.0.1:13802/0": 2, "127.0.0.1:13802/1": 5, "127.0.0.1:13801/0": 2, "127.0.0.1:13801/1": 1}},
+	}
+
+	for i, s := range scenarios {
+		if got := a.Written(s.shard); !reflect.DeepEqual(got, s.expect) {
+			t.Errorf("Scenario %d: expected %v, got %v", i, s.expect, got)
+		}
+	}
+}
+
+func TestHoldRelease(t *testing.T) {
+	now := time.Now()
+	a := newTestEngine(netutil.NewMemNetwork(), "127.0.0.1:13801")
+	a.UseStats(stats.New())
+	a.UseCausalDelivery(2, time.Second)
+	a.settings().delivery.now = func() time.Time { return now }
+
+	ready := msg.Msg{SrcAddr: "127.0.0.1:13802", Payload: []byte("0"), Deps: map[string]int{"127.0.0.1:13802/0": 1}}
+	waiting := func(payload string, count int) msg.Msg {
+		return msg.Msg{SrcAddr: "127.0.0.1:13802", Payload: []byte(payload), Deps: map[string]int{"127.0.0.1:13803/0": count}}
+	}
+
+	payloads := func(msgs []msg.Msg) string {
+		var out string
+		for _, m := range msgs {
+			out += m.PayloadToStr()
+		}
+		return out
+	}
+
+	scenarios := []struct {
+		applied map[string]int
+		advance time.Duration
+		release string // released before the message is held
+		hold    msg.Msg
+		handled string // handled as the message is held
+		pending int64
+	}{
+		// nothing is missing, the message is handled right away
+		{hold: ready, handled: "0", pending: 0},
+		{hold: waiting("1", 1), pending: 1},
+		{hold: waiting("2", 2), pending: 2},
+		// the buffer is full, the oldest message is handed over
+		{hold: waiting("3", 2), handled: "1", pending: 2},
+		// their predecessor arrives
+		{applied: map[string]int{"127.0.0.1:13803/0": 2}, release: "23", hold: waiting("4", 5), pending: 1},
+		// it waited too long
+		{advance: 2 * time.Second, release: "4", hold: ready, handled: "0", pending: 0},
+	}
+
+	for i, s := range scenarios {
+		a.Applied(s.applied)
+		now = now.Add(s.advance)
+
+		if got := payloads(a.Release()); got != s.release {
+			t.Errorf("Scenario %d: expected %q to be released, got %q", i, s.release, got)
+		}
+		if got := payloads(a.Hold(s.hold)); got != s.handled {
+			t.Errorf("Scenario %d: expected %q to be handled, got %q", i, s.handled, got)
+		}
+		if got := a.settings().stats.Get("causal_pending"); got != s.pending {
+			t.Errorf("Scenario %d: expected %d pending, got %d", i, s.pending, got)
+		}
+	}
+
+	expect := map[string]int64{
+		"causal_held":           4,
+		"causal_forced_full":    1,
+		"causal_released":       2,
+		"causal_forced_timeout": 1,
+		"causal_wait_ms_max":    2000,
+		"causal_wait_ms_total":  2000,
+	}
+	for name, count := range expect {
+		if got := a.settings().stats.Get(name); got != count {
+			t.Errorf("Expected %v to be %d, got %d", name, count, got)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package consensus
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Conflict resolution policies, deciding between writes whose vector clocks are
+// concurrent
+const (
+	// PolicyCausal -> keep the write whose replica has seen more events
+	PolicyCausal = "causal"
+
+	// PolicyLWW -> keep the write with the latest hybrid logical clock timestamp,
+	// the node that took it breaks ties
+	PolicyLWW = "lww"
+)
+
+// DefaultMaxClockDrift -> how far ahead of our physical clock a timestamp received
+// from another node may be
+const DefaultMaxClockDrift = 5 * time.Second
+
+// ErrClockDrift -> a timestamp is further ahead of our physical clock than allowed
+var ErrClockDrift = errors.New("timestamp is too far ahead of our clock")
+
+// Timestamp -> reading of a hybrid logical clock. Wall follows the physical clock in
+// unix nanoseconds, Logical orders events sharing a wall time and Node names the
+// node that took the reading.
+type Timestamp struct {
+	Wall    int64
+	Logical uint32
+	Node    string
+}
+
+// Less -> whether the timestamp comes before the other
+func (t Timestamp) Less(other Timestamp) bool {
+	if t.Wall != other.Wall {
+		return t.Wall < other.Wall
+	}
+	if t.Logical != other.Logical {
+		return t.Logical < other.Logical
+	}
+	return t.Node < other.Node
+}
+
+// String -> encode the timestamp so encoded timestamps sort as strings in the same
+// order as Less, e.g. 1600000000000000000.0000000001@10.10.0.2:13800
+func (t Timestamp) String() string {
+	return fmt.Sprintf("%019d.%010d@%s", t.Wall, t.Logical, t.Node)
+}
+
+// ParseTimestamp -> decode a timestamp encoded by String
+func ParseTimestamp(s string) (Timestamp, error) {
+	var t Timestamp
+
+	at := strings.Index(s, "@")
+	dot := strings.Index(s, ".")
+	if at < 0 || dot < 0 || dot > at {
+		return t, fmt.Errorf("malformed timestamp %q", s)
+	}
+
+	wall, err := strconv.ParseInt(s[:dot], 10, 64)
+	if err != nil {
+		return t, fmt.Errorf("malformed timestamp %q", s)
+	}
+	logical, err := strconv.ParseUint(s[dot+1:at], 10, 32)
+	if err != nil {
+		return t, fmt.Errorf("malformed timestamp %q", s)
+	}
+
+	return Timestamp{Wall: wall, Logical: uint32(logical), Node: s[at+1:]}, nil
+}
+
+// hybridClock -> the latest timestamp taken or observed by this node
+type hybridClock struct {
+	m    *sync.Mutex
+	last Timestamp
+	now  func() time.Time
+}
+
+func newHybridClock() *hybridClock {
+	return &hybridClock{
+		m:   &sync.Mutex{},
+		now: time.Now,
+	}
+}
+
+// UseConflictPolicy -> choose how writes with concurrent vector clocks are resolved
+func (c *ConEngine) UseConflictPolicy(policy string) error {
+	switch policy {
+	case PolicyCausal, PolicyLWW:
+	default:
+		return fmt.Errorf("unknown conflict policy %q", policy)
+	}
+
+	c.configure(func(s *settings) { s.lww = policy == PolicyLWW })
+	return nil
+}
+
+// UseMaxClockDrift -> refuse timestamps more than drift ahead of our physical clock
+func (c *ConEngine) UseMaxClockDrift(drift time.Duration) {
+	c.configure(func(s *settings) { s.maxDrift = drift })
+}
+
+// LastWriterWins -> whether concurrent writes are resolved by their timestamps
+func (c *ConEngine) LastWriterWins() bool {
+	return c.settings().lww
+}
+
+// Now -> take a timestamp for a write coordinated by this node, later than every
+// timestamp taken or observed so far
+func (c *ConEngine) Now() Timestamp {
+	h := c.hlc
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	wall := h.now().UnixNano()
+	if wall > h.last.Wall {
+		h.last = Timestamp{Wall: wall}
+	} else {
+		h.last.Logical++
+	}
+
+	h.last.Node = c.addr
+	return h.last
+}
+
+// Observe -> move the clock past the encoded timestamp of a write received from
+// another node, so writes coordinated here after it are stamped later. A timestamp
+// further ahead of our physical clock than the maximum drift fails with
+// ErrClockDrift and leaves the clock alone, so one node with a clock far in the
+// future can not drag every later timestamp along with it.
+func (c *ConEngine) Observe(stamp string) error {
+	t, err := ParseTimestamp(stamp)
+	if err != nil {
+		return err
+	}
+
+	s := c.settings()
+	h := c.hlc
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if ahead := time.Duration(t.Wall - h.now().UnixNano()); ahead > s.maxDrift {
+		s.stats.Inc("clock_drift_rejected")
+		return fmt.Errorf("%w: %v from %s", ErrClockDrift, ahead, t.Node)
+	}
+
+	if h.last.Less(t) {
+		h.last = Timestamp{Wall: t.Wall, Logical: t.Logical, Node: c.addr}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package consensus
+
+import (
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	stats "kv-store/SystemServices/Stats"
+)
+
+func TestTimestamp(t *testing.T) {
+	ordered := []Timestamp{
+		{Wall: 0, Logical: 0, Node: "127.0.0.1:13801"},
+		{Wall: 1, Logical: 0, Node: "127.0.0.1:13801"},
+		{Wall: 1, Logical: 0, Node: "127.0.0.1:13802"},
+		{Wall: 1, Logical: 9, Node: "127.0.0.1:13801"},
+		{Wall: 1, Logical: 10, Node: "127.0.0.1:13801"},
+		{Wall: 2, Logical: 0, Node: "127.0.0.1:13800"},
+		{Wall: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano(), Logical: 0, Node: "a"},
+	}
+
+	encoded := make([]string, len(ordered))
+	for i, ts := range ordered {
+		encoded[i] = ts.String()
+
+		parsed, err := ParseTimestamp(encoded[i])
+		if err != nil || parsed != ts {
+			t.Errorf("Expected %q to decode to %+v, got %+v %v", encoded[i], ts, parsed, err)
+		}
+		if i > 0 && !ordered[i-1].Less(ts) {
+			t.Errorf("Expected %+v to come before %+v", ordered[i-1], ts)
+		}
+	}
+
+	// encoded timestamps sort in the same order
+	if !sort.StringsAreSorted(encoded) {
+		t.Errorf("Encoded timestamps do not sort in order: %v", encoded)
+	}
+
+	for _, bad := range []string{"", "1@a", "a.1@b", "1.a@b", "1@a.b"} {
+		if _, err := ParseTimestamp(bad); err == nil {
+			t.Errorf("Expected %q to be refused", bad)
+		}
+	}
+}
+
+func TestHybridClock(t *testing.T) {
+	var c ConEngine
+	c.addr = "127.0.0.1:13801"
+	c.hlc = newHybridClock()
+	c.config = newConfig()
+	c.UseStats(stats.New())
+
+	wall := time.Unix(100, 0)
+	c.hlc.now = func() time.Time { return wall }
+
+	scenarios := []struct {
+		advance time.Duration
+		observe Timestamp
+		refused bool
+		expect  Timestamp
+	}{
+		{expect: Timestamp{Wall: wall.UnixNano()}},
+		// the physical clock has not moved, the logical counter orders the writes
+		{expect: Timestamp{Wall: wall.UnixNano(), Logical: 1}},
+		// the physical clock moved on
+		{advance: time.Second, expect: Timestamp{Wall: wall.UnixNano() + int64(time.Second)}},
+		// a write from a node whose clock is ahead pulls ours forward
+		{observe: Timestamp{Wall: wall.UnixNano() + int64(5*time.Second), Logical: 3, Node: "127.0.0.1:13802"}, expect: Timestamp{Wall: wall.UnixNano() + int64(5*time.Second), Logical: 4}},
+		// and one from a node behind does not move it back
+		{observe: Timestamp{Wall: 1, Node: "127.0.0.1:13802"}, expect: Timestamp{Wall: wall.UnixNano() + int64(5*time.Second), Logical: 5}},
+		// one from a node whose clock is further ahead than the allowed drift is refused
+		{observe: Timestamp{Wall: wall.UnixNano() + int64(time.Hour), Node: "127.0.0.1:13802"}, refused: true, expect: Timestamp{Wall: wall.UnixNano() + int64(5*time.Second), Logical: 6}},
+	}
+
+	for i, s := range scenarios {
+		wall = wall.Add(s.advance)
+		if s.observe.Node != "" {
+			err := c.Observe(s.observe.String())
+			if s.refused != errors.Is(err, ErrClockDrift) || (!s.refused && err != nil) {
+				t.Fatalf("Scenario %d: expected refused %v, got %v", i, s.refused, err)
+			}
+		}
+
+		s.expect.Node = c.addr
+		if got := c.Now(); got != s.expect {
+			t.Errorf("Scenario %d: expected %+v, got %+v", i, s.expect, got)
+		}
+	}
+
+	if got := c.settings().stats.Get("clock_drift_rejected"); got != 1 {
+		t.Errorf("Expected 1 rejected timestamp, got %d", got)
+	}
+
+	if err := c.UseConflictPolicy("newest"); err == nil {
+		t.Errorf("Expected an unknown policy to be refused")
+	}
+}
@@ -0,0 +1,130 @@
+package consensus
+
+import (
+	"errors"
+	"fmt"
+	msg "kv-store/Messages"
+	"sync"
+	"time"
+)
+
+// DefaultRPCTimeout -> how long a call waits for its reply unless told otherwise
+const DefaultRPCTimeout = 2 * time.Second
+
+// ErrTimeout -> the peer did not answer before the deadline
+var ErrTimeout = errors.New("rpc deadline exceeded")
+
+// rpc -> calls waiting for their reply, keyed by the message id of the request
+type rpc struct {
+	m       *sync.Mutex
+	pending map[string]chan msg.Msg
+}
+
+func newRPC() *rpc {
+	return &rpc{
+		m:       &sync.Mutex{},
+		pending: make(map[string]chan msg.Msg),
+	}
+}
+
+// UseRPCTimeout -> set how long calls made through the engine wait for a reply
+func (c *ConEngine) UseRPCTimeout(timeout time.Duration) {
+	c.configure(func(s *settings) { s.rpcTimeout = timeout })
+}
+
+// RPCDeadline -> deadline for a call started now
+func (c *ConEngine) RPCDeadline() time.Time {
+	return time.Now().Add(c.settings().rpcTimeout)
+}
+
+// Call -> send a request to peer and block until its reply arrives or the deadline
+// passes. Replies are matched to their request by the message id. The request
+// carries our clock but is not an event of its own, the operation it is part of
+// decides whether to count one.
+func (c *ConEngine) Call(peer, action string, payload []byte, deadline time.Time) (msg.Msg, error) {
+	return c.CallMsg(peer, msg.Msg{Action: action, Payload: payload}, deadline)
+}
+
+// CallMsg -> as Call, sending the action, payload, timestamp and dependencies of
+// the request
+func (c *ConEngine) CallMsg(peer string, request msg.Msg, deadline time.Time) (msg.Msg, error) {
+	action := request.Action
+	id := c.generateID()
+	reply := make(chan msg.Msg, 1)
+
+	c.rpc.m.Lock()
+	c.rpc.pending[id] = reply
+	c.rpc.m.Unlock()
+
+	defer func() {
+		c.rpc.m.Lock()
+		delete(c.rpc.pending, id)
+		c.rpc.m.Unlock()
+	}()
+
+	request = msg.Msg{
+		SrcAddr: c.addr,
+		ID:      id,
+		Payload: request.Payload,
+		Action:  action,
+		Stamp:   request.Stamp,
+		Deps:    request.Deps,
+	}
+
+	if err := c.SendWithoutEvent(peer, c.Encode(request)); err != nil {
+		return msg.Msg{}, err
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case response := <-reply:
+		if response.Error != "" {
+			return response, fmt.Errorf("%s failed on %s: %s", action, peer, response.Error)
+		}
+		return response, nil
+	case <-timer.C:
+		c.settings().stats.Inc("rpc_timeouts")
+		return msg.Msg{}, ErrTimeout
+	}
+}
+
+// Reply -> answer a request received from another node, the reply carries our clock
+func (c *ConEngine) Reply(request msg.Msg, payload []byte, err error) error {
+	return c.ReplyAt(request, payload, "", err)
+}
+
+// ReplyAt -> as Reply, along with the timestamp of the value answered
+func (c *ConEngine) ReplyAt(request msg.Msg, payload []byte, stamp string, err error) error {
+	response := msg.Msg{
+		SrcAddr: c.addr,
+		ID:      request.ID,
+		Payload: payload,
+		Action:  request.Action,
+		Reply:   true,
+		Stamp:   stamp,
+	}
+
+	if err != nil {
+		response.Error = err.Error()
+	}
+
+	return c.SendWithoutEvent(request.SrcAddr, c.Encode(response))
+}
+
+// Resolve -> hand a received reply to the call waiting for it
+func (c *ConEngine) Resolve(response msg.Msg) error {
+	c.rpc.m.Lock()
+	reply, ok := c.rpc.pending[response.ID]
+	delete(c.rpc.pending, response.ID)
+	c.rpc.m.Unlock()
+
+	if !ok {
+		c.settings().stats.Inc("rpc_late_replies")
+		return fmt.Errorf("no call waiting for reply %s from %s", response.ID, response.SrcAddr)
+	}
+
+	reply <- response
+	return nil
+}
@@ -0,0 +1,144 @@
+package consensus
+
+import (
+	"errors"
+	msg "kv-store/Messages"
+	netutil "kv-store/SystemServices/Network"
+	stats "kv-store/SystemServices/Stats"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serve -> answer every call with the upper cased payload, "fail" calls return an error
+// and "ignore" calls are never answered
+func serve(c *ConEngine) {
+	for {
+		request, _, err := c.Recv()
+		if err != nil {
+			return
+		}
+
+		if request.Reply {
+			c.Resolve(request)
+			continue
+		}
+
+		switch request.Action {
+		case "fail":
+			c.Reply(request, nil, errors.New("no such key"))
+		case "ignore":
+		default:
+			c.Reply(request, []byte(strings.ToUpper(request.PayloadToStr())), nil)
+		}
+	}
+}
+
+func TestCall(t *testing.T) {
+	mem := netutil.NewMemNetwork()
+	a := newTestEngine(mem, "127.0.0.1:13801")
+	b := newTestEngine(mem, "127.0.0.1:13802")
+	defer a.Close()
+	defer b.Close()
+
+	go serve(a)
+	go serve(b)
+
+	scenarios := []struct {
+		action  string
+		payload string
+		expect  string
+		err     bool
+	}{
+		{action: "get", payload: "value0", expect: "VALUE0"},
+		{action: "put", payload: "key0:value0", expect: "KEY0:VALUE0"},
+		{action: "fail", payload: "key0", err: true},
+	}
+
+	for _, s := range scenarios {
+		reply, err := a.Call(b.addr, s.action, []byte(s.payload), time.Now().Add(time.Second))
+		if s.err {
+			if err == nil || err == ErrTimeout {
+				t.Errorf("Call %v: expected a remote error, got %v", s.action, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("Call %v failed: %v", s.action, err)
+		}
+		if reply.PayloadToStr() != s.expect || reply.SrcAddr != b.addr || !reply.Reply {
+			t.Errorf("Call %v: unexpected reply '%v'", s.action, reply)
+		}
+		if reply.Context == nil {
+			t.Errorf("Call %v: reply does not carry the replica clock", s.action)
+		}
+	}
+
+	if len(a.rpc.pending) != 0 {
+		t.Errorf("Calls were not cleaned up, %d pending", len(a.rpc.pending))
+	}
+}
+
+func TestCallConcurrent(t *testing.T) {
+	mem := netutil.NewMemNetwork()
+	a := newTestEngine(mem, "127.0.0.1:13801")
+	b := newTestEngine(mem, "127.0.0.1:13802")
+	defer a.Close()
+	defer b.Close()
+
+	go serve(a)
+	go serve(b)
+
+	// every caller must receive the reply to its own request
+	errs := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func(payload string) {
+			reply, err := a.Call(b.addr, "get", []byte(payload), time.Now().Add(time.Second))
+			if err == nil && reply.PayloadToStr() != strings.ToUpper(payload) {
+				err = errors.New("reply " + reply.PayloadToStr() + " for request " + payload)
+			}
+			errs <- err
+		}(strings.Repeat("v", i+1))
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	mem := netutil.NewMemNetwork()
+	a := newTestEngine(mem, "127.0.0.1:13801")
+	b := newTestEngine(mem, "127.0.0.1:13802")
+	defer a.Close()
+	defer b.Close()
+
+	counters := stats.New()
+	a.UseStats(counters)
+
+	go serve(a)
+	go serve(b)
+
+	start := time.Now()
+	_, err := a.Call(b.addr, "ignore", nil, time.Now().Add(50*time.Millisecond))
+	if err != ErrTimeout {
+		t.Errorf("Expected ErrTimeout, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Call did not respect its deadline")
+	}
+	if counters.Get("rpc_timeouts") != 1 {
+		t.Errorf("Timeout was not counted")
+	}
+
+	// a reply arriving after the deadline is discarded
+	if err := a.Resolve(msg.Msg{ID: "gone", Reply: true}); err == nil {
+		t.Errorf("Expected an error for a reply nobody is waiting for")
+	}
+	if counters.Get("rpc_late_replies") != 1 {
+		t.Errorf("Late reply was not counted")
+	}
+}
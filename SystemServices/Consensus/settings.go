@@ -0,0 +1,61 @@
+package consensus
+
+import (
+	msg "kv-store/Messages"
+	stats "kv-store/SystemServices/Stats"
+	"sync"
+	"time"
+)
+
+// settings -> the tunables of the engine, read by every request it serves
+type settings struct {
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	causalWait   time.Duration
+	rpcTimeout   time.Duration
+	lww          bool
+	maxDrift     time.Duration
+	signer       *msg.Signer
+	compression  *compression
+	delivery     *deliveryBuffer
+	shard        int
+	stats        *stats.Counters
+}
+
+// config -> settings shared by every copy of the engine. Requests read a snapshot
+// of them, so the UseXxx setters are safe to call while requests are served and
+// take effect on every copy.
+type config struct {
+	m *sync.RWMutex
+	settings
+}
+
+func newConfig() *config {
+	return &config{
+		m: &sync.RWMutex{},
+		settings: settings{
+			readTimeout:  DefaultReadTimeout,
+			writeTimeout: DefaultWriteTimeout,
+			causalWait:   DefaultCausalWait,
+			rpcTimeout:   DefaultRPCTimeout,
+			maxDrift:     DefaultMaxClockDrift,
+			shard:        -1,
+		},
+	}
+}
+
+// settings -> a snapshot of the current settings
+func (c *ConEngine) settings() settings {
+	c.config.m.RLock()
+	defer c.config.m.RUnlock()
+
+	return c.config.settings
+}
+
+// configure -> change the settings of the engine
+func (c *ConEngine) configure(change func(s *settings)) {
+	c.config.m.Lock()
+	defer c.config.m.Unlock()
+
+	change(&c.config.settings)
+}
@@ -0,0 +1,94 @@
+package consensus
+
+// Ordering -> how two vector clocks relate
+type Ordering int
+
+// Possible orderings of one vector clock against another
+const (
+	Equal      Ordering = iota // both clocks have seen the same events
+	Before                     // every event seen by the first clock was seen by the second
+	After                      // every event seen by the second clock was seen by the first
+	Concurrent                 // each clock has seen events the other has not
+)
+
+func (o Ordering) String() string {
+	switch o {
+	case Equal:
+		return "equal"
+	case Before:
+		return "before"
+	case After:
+		return "after"
+	default:
+		return "concurrent"
+	}
+}
+
+// VectorClock -> number of events seen from each node, a node missing from the
+// clock has no events
+type VectorClock map[string]int
+
+// Compare -> order this clock against another
+func (vc VectorClock) Compare(other VectorClock) Ordering {
+	behind, ahead := false, false
+
+	for node, count := range vc {
+		if count > other[node] {
+			ahead = true
+		} else if count < other[node] {
+			behind = true
+		}
+	}
+	for node, count := range other {
+		if _, ok := vc[node]; !ok && count > 0 {
+			behind = true
+		}
+	}
+
+	switch {
+	case ahead && behind:
+		return Concurrent
+	case ahead:
+		return After
+	case behind:
+		return Before
+	default:
+		return Equal
+	}
+}
+
+// Merge -> advance every entry to include the events of the other clock,
+// returns whether any entry changed
+func (vc VectorClock) Merge(other VectorClock) bool {
+	changed := false
+	for node, count := range other {
+		if count > vc[node] {
+			vc[node] = count
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Increment -> record a new event on the node
+func (vc VectorClock) Increment(node string) {
+	vc[node]++
+}
+
+// Copy -> a clock that can be changed without affecting this one
+func (vc VectorClock) Copy() VectorClock {
+	cpy := make(VectorClock, len(vc))
+	for node, count := range vc {
+		cpy[node] = count
+	}
+	return cpy
+}
+
+// Sum -> total events seen by the clock
+func (vc VectorClock) Sum() int {
+	total := 0
+	for _, count := range vc {
+		total += count
+	}
+	return total
+}
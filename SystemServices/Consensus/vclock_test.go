@@ -0,0 +1,89 @@
+package consensus
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestVectorClockCompare(t *testing.T) {
+	scenarios := []struct {
+		a, b   VectorClock
+		expect Ordering
+	}{
+		{a: VectorClock{}, b: VectorClock{}, expect: Equal},
+		{a: VectorClock{"n1": 1, "n2": 0}, b: VectorClock{"n1": 1}, expect: Equal},
+		{a: VectorClock{"n1": 1, "n2": 2}, b: VectorClock{"n1": 1, "n2": 3}, expect: Before},
+		{a: VectorClock{"n1": 1}, b: VectorClock{"n1": 1, "n2": 1}, expect: Before},
+		{a: VectorClock{"n1": 2, "n2": 3}, b: VectorClock{"n1": 1, "n2": 3}, expect: After},
+		{a: VectorClock{"n1": 1, "n3": 1}, b: VectorClock{"n1": 1}, expect: After},
+		{a: VectorClock{"n1": 2, "n2": 0}, b: VectorClock{"n1": 1, "n2": 1}, expect: Concurrent},
+		{a: VectorClock{"n1": 1}, b: VectorClock{"n2": 1}, expect: Concurrent},
+		{a: nil, b: VectorClock{"n1": 1}, expect: Before},
+	}
+
+	for _, s := range scenarios {
+		if got := s.a.Compare(s.b); got != s.expect {
+			t.Errorf("%v compared to %v: expected %v, got %v", s.a, s.b, s.expect, got)
+		}
+
+		// the ordering seen from the other clock is the mirror image
+		mirror := map[Ordering]Ordering{Equal: Equal, Before: After, After: Before, Concurrent: Concurrent}
+		if got := s.b.Compare(s.a); got != mirror[s.expect] {
+			t.Errorf("%v compared to %v: expected %v, got %v", s.b, s.a, mirror[s.expect], got)
+		}
+	}
+}
+
+func TestVectorClockMerge(t *testing.T) {
+	scenarios := []struct {
+		vc, other VectorClock
+		expect    VectorClock
+		changed   bool
+	}{
+		{vc: VectorClock{"n1": 1}, other: VectorClock{"n1": 1}, expect: VectorClock{"n1": 1}},
+		{vc: VectorClock{"n1": 3}, other: VectorClock{"n1": 1}, expect: VectorClock{"n1": 3}},
+		{vc: VectorClock{"n1": 1, "n2": 4}, other: VectorClock{"n1": 2, "n2": 1}, expect: VectorClock{"n1": 2, "n2": 4}, changed: true},
+		{vc: VectorClock{"n1": 1}, other: VectorClock{"n2": 2}, expect: VectorClock{"n1": 1, "n2": 2}, changed: true},
+	}
+
+	for _, s := range scenarios {
+		merged := s.vc.Copy()
+		changed := merged.Merge(s.other)
+
+		if !reflect.DeepEqual(merged, s.expect) || changed != s.changed {
+			t.Errorf("Merging %v into %v: expected %v (changed %v), got %v (changed %v)", s.other, s.vc, s.expect, s.changed, merged, changed)
+		}
+
+		// the merged clock has seen every event of both clocks
+		if o := merged.Compare(s.vc); o != After && o != Equal {
+			t.Errorf("Merged clock %v does not include %v", merged, s.vc)
+		}
+		if o := merged.Compare(s.other); o != After && o != Equal {
+			t.Errorf("Merged clock %v does not include %v", merged, s.other)
+		}
+	}
+}
+
+func TestVectorClockIncrement(t *testing.T) {
+	scenarios := []struct {
+		vc     VectorClock
+		node   string
+		expect VectorClock
+	}{
+		{vc: VectorClock{"n1": 0}, node: "n1", expect: VectorClock{"n1": 1}},
+		{vc: VectorClock{"n1": 2, "n2": 1}, node: "n2", expect: VectorClock{"n1": 2, "n2": 2}},
+		{vc: VectorClock{"n1": 2}, node: "n2", expect: VectorClock{"n1": 2, "n2": 1}},
+	}
+
+	for _, s := range scenarios {
+		before := s.vc.Copy()
+		s.vc.Increment(s.node)
+
+		if !reflect.DeepEqual(s.vc, s.expect) {
+			t.Errorf("Incrementing %v on %v: expected %v, got %v", s.node, before, s.expect, s.vc)
+		}
+		if got := s.vc.Compare(before); got != After {
+			t.Errorf("Expected the incremented clock to be after %v, got %v", before, got)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package network
+
+import (
+	"fmt"
+	msg "kv-store/Messages"
+	"sync"
+)
+
+// MemNetwork -> an in memory network that lets several nodes run inside a single
+// process. Messages are passed directly between the transports joined to it.
+type MemNetwork struct {
+	m     *sync.RWMutex
+	nodes map[string]*MemTransport
+}
+
+// MemTransport -> channel based transport attached to a MemNetwork
+type MemTransport struct {
+	addr    string
+	net     *MemNetwork
+	inbox   chan memPacket
+	closed  chan struct{}
+	closing *sync.Once
+}
+
+type memPacket struct {
+	Msg  msg.Msg
+	from string
+}
+
+// NewMemNetwork -> construct an empty in memory network
+func NewMemNetwork() *MemNetwork {
+	return &MemNetwork{
+		m:     &sync.RWMutex{},
+		nodes: make(map[string]*MemTransport),
+	}
+}
+
+// Join -> attach a new transport listening on the given host:port address
+func (mem *MemNetwork) Join(addr string, buffer int) *MemTransport {
+	t := &MemTransport{
+		addr:    addr,
+		net:     mem,
+		inbox:   make(chan memPacket, buffer),
+		closed:  make(chan struct{}),
+		closing: &sync.Once{},
+	}
+
+	mem.m.Lock()
+	defer mem.m.Unlock()
+	mem.nodes[addr] = t
+
+	return t
+}
+
+// lookup -> find the transport listening on an address
+func (mem *MemNetwork) lookup(addr string) (*MemTransport, bool) {
+	mem.m.RLock()
+	defer mem.m.RUnlock()
+
+	t, ok := mem.nodes[addr]
+	return t, ok
+}
+
+// leave -> detach a transport from the network
+func (mem *MemNetwork) leave(t *MemTransport) {
+	mem.m.Lock()
+	defer mem.m.Unlock()
+
+	if mem.nodes[t.addr] == t {
+		delete(mem.nodes, t.addr)
+	}
+}
+
+// Send -> place the message in the destination inbox. Like udp, the message is
+// dropped if the destination is unknown or can not keep up.
+func (t *MemTransport) Send(addr string, Msg msg.Msg) error {
+	dest, ok := t.net.lookup(addr)
+	if !ok {
+		return fmt.Errorf("no node listening on %s", addr)
+	}
+
+	select {
+	case <-dest.closed:
+		return fmt.Errorf("node %s is closed", addr)
+	case dest.inbox <- memPacket{Msg: copyMsg(Msg), from: t.addr}:
+		return nil
+	default:
+		return fmt.Errorf("inbox of %s is full, dropping message", addr)
+	}
+}
+
+// Recv -> blocking call, return the next message sent to this transport
+func (t *MemTransport) Recv() (msg.Msg, string, error) {
+	select {
+	case p := <-t.inbox:
+		return p.Msg, p.from, nil
+	case <-t.closed:
+		return msg.Msg{}, "", ErrClosed
+	}
+}
+
+// Close -> detach from the network and release any blocked receivers
+func (t *MemTransport) Close() error {
+	t.closing.Do(func() {
+		t.net.leave(t)
+		close(t.closed)
+	})
+	return nil
+}
+
+// copyMsg -> the sender and receiver must not share payload or clock memory
+func copyMsg(Msg msg.Msg) msg.Msg {
+	cpy := Msg
+
+	if Msg.Payload != nil {
+		cpy.Payload = make([]byte, len(Msg.Payload))
+		copy(cpy.Payload, Msg.Payload)
+	}
+
+	if Msg.Context != nil {
+		cpy.Context = make(map[string]int, len(Msg.Context))
+		for k, v := range Msg.Context {
+			cpy.Context[k] = v
+		}
+	}
+
+	return cpy
+}
@@ -0,0 +1,107 @@
+package network
+
+import (
+	msg "kv-store/Messages"
+	"testing"
+	"time"
+)
+
+func TestMemSendRecv(t *testing.T) {
+	mem := NewMemNetwork()
+	a := mem.Join("10.0.0.1:13800", 8)
+	b := mem.Join("10.0.0.2:13800", 8)
+
+	sent := msg.Msg{SrcAddr: "10.0.0.1", Payload: []byte("key0:value0"), Action: "put", Context: map[string]int{"10.0.0.1": 1}}
+	if err := a.Send("10.0.0.2:13800", sent); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	// mutating the sent message must not change what the receiver sees
+	sent.Payload[0] = 'X'
+	sent.Context["10.0.0.1"] = 5
+
+	got, from, err := b.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if from != "10.0.0.1:13800" {
+		t.Errorf("Expected message from %q, got %q", "10.0.0.1:13800", from)
+	}
+	if got.PayloadToStr() != "key0:value0" || got.Action != "put" {
+		t.Errorf("Did not receive the sent message, got '%v'", got)
+	}
+	if got.Context["10.0.0.1"] != 1 {
+		t.Errorf("Vector clock shared between sender and receiver, got %v", got.Context)
+	}
+}
+
+func TestMemSendUnknown(t *testing.T) {
+	mem := NewMemNetwork()
+	a := mem.Join("10.0.0.1:13800", 8)
+
+	if err := a.Send("10.0.0.9:13800", msg.Msg{}); err == nil {
+		t.Errorf("Expected an error when sending to a node that is not on the network")
+	}
+}
+
+func TestMemInboxFull(t *testing.T) {
+	mem := NewMemNetwork()
+	a := mem.Join("10.0.0.1:13800", 1)
+	mem.Join("10.0.0.2:13800", 1)
+
+	if err := a.Send("10.0.0.2:13800", msg.Msg{}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if err := a.Send("10.0.0.2:13800", msg.Msg{}); err == nil {
+		t.Errorf("Expected an error when the destination inbox is full")
+	}
+}
+
+func TestMemClose(t *testing.T) {
+	mem := NewMemNetwork()
+	a := mem.Join("10.0.0.1:13800", 8)
+	b := mem.Join("10.0.0.2:13800", 8)
+
+	done := make(chan error)
+	go func() {
+		_, _, err := b.Recv()
+		done <- err
+	}()
+
+	b.Close()
+
+	select {
+	case err := <-done:
+		if err != ErrClosed {
+			t.Errorf("Expected ErrClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Recv still blocked after Close")
+	}
+
+	if err := a.Send("10.0.0.2:13800", msg.Msg{}); err == nil {
+		t.Errorf("Expected an error when sending to a closed node")
+	}
+}
+
+func TestMemSameHost(t *testing.T) {
+	mem := NewMemNetwork()
+	a := mem.Join("127.0.0.1:13801", 8)
+	b := mem.Join("127.0.0.1:13802", 8)
+	c := mem.Join("127.0.0.1:13803", 8)
+
+	if err := a.Send("127.0.0.1:13803", msg.Msg{Action: "put"}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	got, from, _ := c.Recv()
+	if got.Action != "put" || from != "127.0.0.1:13801" {
+		t.Errorf("Message not routed by port, got '%v' from %q", got, from)
+	}
+
+	select {
+	case p := <-b.inbox:
+		t.Errorf("Node on another port of the same host received '%v'", p.Msg)
+	default:
+	}
+}
@@ -7,23 +7,35 @@ import (
 	"fmt"
 	msg "kv-store/Messages"
 	"net"
+	"strconv"
 	"strings"
 )
 
-// Network -> create a network interface that defines general networking functions
-type Network interface {
-	Send()
-	Recv()
-	formatAddr()
-	ServerDaemon()
+// Transport -> create a network interface that defines how system level messages
+// move between nodes. The consensus engine only depends on this interface so the
+// underlying network can be swapped out, e.g. for an in memory network in tests.
+type Transport interface {
+	Send(addr string, Msg msg.Msg) error
+	Recv() (msg.Msg, string, error)
+	Close() error
 }
 
+// DefaultUDPBuffer -> the largest payload a udp datagram can carry, reading into a
+// smaller buffer silently truncates larger packets
+const DefaultUDPBuffer = 65507
+
+// ErrClosed -> returned by a transport once it has been closed
+var ErrClosed = errors.New("transport is closed")
+
 // UDP ->
 type UDP struct {
-	Addr    string
-	Port    int
-	Buffer  int
-	timeout int
+	Addr     string
+	Port     int
+	Buffer   int
+	timeout  int
+	conn     *net.UDPConn
+	readBuf  []byte
+	resolver *Resolver
 }
 
 // TCP ->
@@ -33,14 +45,19 @@ type TCP struct {
 	Timeout int
 }
 
-// used to implement a recv from blocking call
-var wait chan struct{}
+// NewUDP -> construct a udp transport, the socket is bound on the first call to Recv
+func NewUDP(sAddr string, port int, buffer int) *UDP {
+	udp := new(UDP)
+	udp.Init(sAddr, port, buffer)
+	return udp
+}
 
 // Init ->
 func (udp *UDP) Init(sAddr string, port int, buffer int) {
 	udp.Addr = sAddr
 	udp.Port = port
 	udp.Buffer = buffer
+	udp.resolver = NewResolver(DefaultResolveInterval)
 }
 
 // Decode ->
@@ -56,11 +73,11 @@ func (udp *UDP) Decode(buffer bytes.Buffer) msg.Msg {
 	return msgDecode
 }
 
+// formatAddr -> peers are identified by host:port, addresses without a port
+// are assumed to listen on the same port as this node
 func (udp *UDP) formatAddr(addr string) string {
-	if strings.Contains(addr, ":") {
-		host := strings.Split(addr, ":")[0]
-
-		return host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(strings.Trim(addr, "[]"), strconv.Itoa(udp.Port))
 	}
 	return addr
 }
@@ -78,32 +95,81 @@ func (udp *UDP) Encode(Msg msg.Msg) []byte {
 	return buffer.Bytes()
 }
 
-// RecvFrom ->
-func (udp *UDP) RecvFrom() {
-	wait = make(chan struct{})
+// listen -> bind our socket on all ipv4 and ipv6 addresses
+func (udp *UDP) listen() error {
+	addr := net.UDPAddr{
+		Port: udp.Port,
+	}
+
+	conn, err := net.ListenUDP("udp", &addr)
+	if err != nil {
+		return fmt.Errorf("Failed to create socket %v", err)
+	}
+
+	udp.conn = conn
+	return nil
+}
+
+// Recv -> blocking call, read the next packet from our socket and decode it.
+// Returns the message and the address it was received from. Recv must only be
+// called from a single go routine.
+func (udp *UDP) Recv() (msg.Msg, string, error) {
+	var Msg msg.Msg
+
+	if udp.conn == nil {
+		if err := udp.listen(); err != nil {
+			return Msg, "", err
+		}
+	}
+
+	if len(udp.readBuf) != udp.Buffer {
+		udp.readBuf = make([]byte, udp.Buffer)
+	}
+
+	n, from, err := udp.conn.ReadFromUDP(udp.readBuf)
+
+	if err != nil {
+		return Msg, "", fmt.Errorf("ReadFromUDP error %v", err)
+	}
+
+	// copy the packet out of the shared read buffer before decoding it
+	packet := make([]byte, n)
+	copy(packet, udp.readBuf[:n])
+
+	d := gob.NewDecoder(bytes.NewReader(packet))
+	if err = d.Decode(&Msg); err != nil {
+		return Msg, from.String(), fmt.Errorf("failed to decode packet from %s: %v", from, err)
+	}
+
+	return Msg, from.String(), nil
+}
 
-	// wait until we have been signaled
-	<-wait
+// Close -> release our socket
+func (udp *UDP) Close() error {
+	if udp.conn == nil {
+		return nil
+	}
+	return udp.conn.Close()
 }
 
 // Send ->
 func (udp *UDP) Send(Addr string, Msg msg.Msg) error {
 
-	host := udp.formatAddr(Addr)
 	payload := udp.Encode(Msg)
 
-	addr := net.UDPAddr{
-		Port: udp.Port,
-		IP:   net.ParseIP(host),
+	dest, err := udp.resolver.Resolve(udp.formatAddr(Addr))
+	if err != nil {
+		fmt.Printf("failed to resolve %s: %v\n", Addr, err)
+		return err
 	}
 
-	conn, err := net.DialUDP("udp", nil, &addr) // bind udp socket
+	addr, err := net.ResolveUDPAddr("udp", dest)
+	if err != nil {
+		fmt.Printf("failed to resolve %s: %v\n", Addr, err)
+		return err
+	}
 
-	defer func() {
-		if err := conn.Close(); err != nil {
-			fmt.Println("failed while closing connection:", err)
-		}
-	}()
+	conn, err := net.DialUDP("udp", nil, addr) // bind udp socket
 
 	if err != nil {
 		fmt.Printf("failed to connect: %v\n", err)
@@ -111,13 +177,13 @@ func (udp *UDP) Send(Addr string, Msg msg.Msg) error {
 		return errN
 	}
 
+	defer func() {
+		if err := conn.Close(); err != nil {
+			fmt.Println("failed while closing connection:", err)
+		}
+	}()
+
 	// send time request
 	_, err = conn.Write(payload)
 	return err
 }
-
-// Signal -> Will raise the signal chan releasing any functions waiting for the signal
-func (udp *UDP) Signal() {
-	fmt.Println("closing channel")
-	close(wait)
-}
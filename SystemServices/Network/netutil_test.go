@@ -0,0 +1,92 @@
+package network
+
+import (
+	"bytes"
+	msg "kv-store/Messages"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// freePort -> ask the os for an unused udp port on the loopback interface
+func freePort(t *testing.T) int {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestUDPSameHost(t *testing.T) {
+	portA, portB := freePort(t), freePort(t)
+	a := NewUDP("127.0.0.1", portA, 1024)
+	b := NewUDP("127.0.0.1", portB, 1024)
+	defer a.Close()
+	defer b.Close()
+
+	if err := b.listen(); err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	dest := "127.0.0.1:" + strconv.Itoa(portB)
+	if err := a.Send(dest, msg.Msg{SrcAddr: "127.0.0.1:" + strconv.Itoa(portA), Payload: []byte("key0:value0"), Action: "put"}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	got, _, err := b.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if got.PayloadToStr() != "key0:value0" || got.SrcAddr != "127.0.0.1:"+strconv.Itoa(portA) {
+		t.Errorf("Did not receive the sent message, got '%v'", got)
+	}
+}
+
+func TestUDPLargePayload(t *testing.T) {
+	portA, portB := freePort(t), freePort(t)
+	a := NewUDP("127.0.0.1", portA, DefaultUDPBuffer)
+	b := NewUDP("127.0.0.1", portB, DefaultUDPBuffer)
+	defer a.Close()
+	defer b.Close()
+
+	if err := b.listen(); err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	payload := make([]byte, 16*1024)
+	for i := range payload {
+		payload[i] = byte(i * 31)
+	}
+
+	if err := a.Send("127.0.0.1:"+strconv.Itoa(portB), msg.Msg{Payload: payload, Action: "gossip"}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	got, _, err := b.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if !bytes.Equal(got.Payload, payload) {
+		t.Errorf("Payload of %d bytes was not received intact, got %d bytes", len(payload), len(got.Payload))
+	}
+}
+
+func TestFormatAddr(t *testing.T) {
+	udp := NewUDP("127.0.0.1", 13800, 1024)
+
+	scenarios := []struct {
+		addr   string
+		expect string
+	}{
+		{addr: "127.0.0.1:13801", expect: "127.0.0.1:13801"},
+		{addr: "10.0.4.2", expect: "10.0.4.2:13800"},
+	}
+
+	for _, s := range scenarios {
+		if got := udp.formatAddr(s.addr); got != s.expect {
+			t.Errorf("Did not get expected address for input '%v'. Expected %q, got %q", s.addr, s.expect, got)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package network
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultMaxBuckets -> the most keys a limiter tracks, the least recently seen key
+// is forgotten to make room for a new one
+const DefaultMaxBuckets = 4096
+
+// RateLimiter -> token bucket per key, e.g. per source address. Each key may send a
+// burst of messages, after which it is limited to rate messages per second. A nil
+// RateLimiter allows everything.
+type RateLimiter struct {
+	m       *sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*list.Element // of *bucket, in recent tracks most recent first
+	recent  *list.List
+	limit   int
+	now     func() time.Time
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter -> construct a limiter, a rate of zero or less disables limiting
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &RateLimiter{
+		m:       &sync.Mutex{},
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*list.Element),
+		recent:  list.New(),
+		limit:   DefaultMaxBuckets,
+		now:     time.Now,
+	}
+}
+
+// Allow -> take a token from the key's bucket, returns false if it is empty
+func (l *RateLimiter) Allow(key string) bool {
+	if l == nil {
+		return true
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	now := l.now()
+	b := l.bucket(key, now)
+
+	// refill for the time since the last message
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// Tracked -> number of keys currently holding a bucket
+func (l *RateLimiter) Tracked() int {
+	if l == nil {
+		return 0
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+	return len(l.buckets)
+}
+
+// bucket -> the bucket of the key, a new full one when the key is not tracked. At
+// the limit the least recently seen key is forgotten, so a flood of new keys costs
+// the same for each and never grows the limiter. The caller must hold the lock.
+func (l *RateLimiter) bucket(key string, now time.Time) *bucket {
+	if e, ok := l.buckets[key]; ok {
+		l.recent.MoveToFront(e)
+		return e.Value.(*bucket)
+	}
+
+	if l.recent.Len() >= l.limit {
+		oldest := l.recent.Back()
+		l.recent.Remove(oldest)
+		delete(l.buckets, oldest.Value.(*bucket).key)
+	}
+
+	b := &bucket{key: key, tokens: l.burst, last: now}
+	l.buckets[key] = l.recent.PushFront(b)
+	return b
+}
+
+// HostOf -> the host part of an address, or the address itself if it has no port
+func HostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
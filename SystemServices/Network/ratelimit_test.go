@@ -0,0 +1,106 @@
+package network
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := NewRateLimiter(10, 3)
+	l.now = func() time.Time { return now }
+
+	scenarios := []struct {
+		key     string
+		advance time.Duration
+		expect  bool
+	}{
+		{key: "10.0.0.1", expect: true},
+		{key: "10.0.0.1", expect: true},
+		{key: "10.0.0.1", expect: true},
+		{key: "10.0.0.1", expect: false}, // burst used up
+		{key: "10.0.0.2", expect: true},  // every key has its own bucket
+		{key: "10.0.0.1", advance: 50 * time.Millisecond, expect: false},
+		{key: "10.0.0.1", advance: 50 * time.Millisecond, expect: true}, // refilled one token
+		{key: "10.0.0.1", expect: false},
+		{key: "10.0.0.1", advance: time.Hour, expect: true}, // never more than the burst
+		{key: "10.0.0.1", expect: true},
+		{key: "10.0.0.1", expect: true},
+		{key: "10.0.0.1", expect: false},
+	}
+
+	for i, s := range scenarios {
+		now = now.Add(s.advance)
+		if got := l.Allow(s.key); got != s.expect {
+			t.Errorf("Step %d, key %v: expected %v, got %v", i, s.key, s.expect, got)
+		}
+	}
+
+	if l.Tracked() != 2 {
+		t.Errorf("Expected 2 tracked keys, got %d", l.Tracked())
+	}
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	l := NewRateLimiter(0.001, 1)
+	l.limit = 2
+
+	scenarios := []struct {
+		key    string
+		expect bool
+	}{
+		{key: "10.0.0.1", expect: true},
+		{key: "10.0.0.2", expect: true},
+		{key: "10.0.0.1", expect: false},
+		// the least recently seen key makes room for a new one
+		{key: "10.0.0.3", expect: true},
+		{key: "10.0.0.1", expect: false},
+		{key: "10.0.0.2", expect: true},
+		{key: "10.0.0.1", expect: false},
+	}
+
+	for i, s := range scenarios {
+		if got := l.Allow(s.key); got != s.expect {
+			t.Errorf("Step %d, key %v: expected %v, got %v", i, s.key, s.expect, got)
+		}
+		if l.Tracked() > l.limit {
+			t.Errorf("Step %d: tracking %d keys, more than the limit", i, l.Tracked())
+		}
+	}
+
+	// a flood of new keys never grows the limiter
+	for i := 0; i < 1000; i++ {
+		l.Allow("10.1." + strconv.Itoa(i/256) + "." + strconv.Itoa(i%256))
+	}
+	if l.Tracked() != l.limit {
+		t.Errorf("Expected %d tracked keys, got %d", l.limit, l.Tracked())
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	l := NewRateLimiter(0, 10)
+
+	for i := 0; i < 100; i++ {
+		if !l.Allow("10.0.0.1") {
+			t.Fatalf("A disabled limiter rejected a message")
+		}
+	}
+}
+
+func TestHostOf(t *testing.T) {
+	scenarios := []struct {
+		addr   string
+		expect string
+	}{
+		{addr: "10.0.0.1:13800", expect: "10.0.0.1"},
+		{addr: "[::1]:13800", expect: "::1"},
+		{addr: "10.0.0.1", expect: "10.0.0.1"},
+	}
+
+	for _, s := range scenarios {
+		if got := HostOf(s.addr); got != s.expect {
+			t.Errorf("HostOf(%v): expected %q, got %q", s.addr, s.expect, got)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultResolveInterval -> how long a resolved hostname is used before it is looked up again
+const DefaultResolveInterval = 30 * time.Second
+
+// NormalizeAddr -> canonical form of a host:port address so the same node is always
+// identified by the same string. Hostnames are lower cased, ip addresses are written
+// in their shortest form and ipv6 addresses are bracketed, e.g. [::1]:13800.
+func NormalizeAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(strings.TrimSpace(addr))
+	if err != nil {
+		return "", fmt.Errorf("invalid address %q: %v", addr, err)
+	}
+
+	if host == "" {
+		return "", fmt.Errorf("invalid address %q: missing host", addr)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid address %q: bad port", addr)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	} else {
+		host = strings.ToLower(host)
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// Resolver -> resolves the hostnames of peers, e.g. docker service names, and caches
+// the answer. A hostname is looked up again once its answer is older than the
+// interval so peers that move to a new ip are found again.
+type Resolver struct {
+	m        *sync.Mutex
+	interval time.Duration
+	cache    map[string]resolved
+	lookup   func(host string) ([]string, error)
+	now      func() time.Time
+}
+
+type resolved struct {
+	ip string
+	at time.Time
+}
+
+// NewResolver -> construct a resolver that refreshes hostnames every interval
+func NewResolver(interval time.Duration) *Resolver {
+	return &Resolver{
+		m:        &sync.Mutex{},
+		interval: interval,
+		cache:    make(map[string]resolved),
+		lookup:   net.LookupHost,
+		now:      time.Now,
+	}
+}
+
+// Resolve -> translate a host:port address into an ip:port address. If a hostname
+// can not be looked up again its previous answer is used.
+func (r *Resolver) Resolve(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return net.JoinHostPort(ip.String(), port), nil
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	entry, cached := r.cache[host]
+	if !cached || r.now().Sub(entry.at) >= r.interval {
+		ips, err := r.lookup(host)
+
+		switch {
+		case err == nil && len(ips) > 0:
+			entry = resolved{ip: ips[0], at: r.now()}
+			r.cache[host] = entry
+		case cached:
+			// keep using the stale answer until the lookup succeeds again
+		case err != nil:
+			return "", fmt.Errorf("failed to resolve %s: %v", host, err)
+		default:
+			return "", fmt.Errorf("failed to resolve %s: no addresses", host)
+		}
+	}
+
+	return net.JoinHostPort(entry.ip, port), nil
+}
@@ -0,0 +1,129 @@
+package network
+
+import (
+	"errors"
+	msg "kv-store/Messages"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNormalizeAddr(t *testing.T) {
+	scenarios := []struct {
+		addr   string
+		expect string
+		err    bool
+	}{
+		{addr: "10.0.4.2:13800", expect: "10.0.4.2:13800"},
+		{addr: " Node1:13800 ", expect: "node1:13800"},
+		{addr: "[::1]:13800", expect: "[::1]:13800"},
+		{addr: "[0:0:0:0:0:0:0:1]:13800", expect: "[::1]:13800"},
+		{addr: "[FD00::2]:13800", expect: "[fd00::2]:13800"},
+		{addr: "::1:13800", err: true},
+		{addr: "10.0.4.2", err: true},
+		{addr: ":13800", err: true},
+		{addr: "node1:http", err: true},
+		{addr: "node1:70000", err: true},
+	}
+
+	for _, s := range scenarios {
+		got, err := NormalizeAddr(s.addr)
+		if s.err {
+			if err == nil {
+				t.Errorf("NormalizeAddr(%q): expected an error, got %q", s.addr, got)
+			}
+			continue
+		}
+
+		if err != nil || got != s.expect {
+			t.Errorf("NormalizeAddr(%q): expected %q, got %q (%v)", s.addr, s.expect, got, err)
+		}
+	}
+}
+
+func TestResolverRefresh(t *testing.T) {
+	now := time.Now()
+	answers := map[string][]string{"node1": {"10.0.4.2"}}
+	lookups := 0
+
+	r := NewResolver(time.Minute)
+	r.now = func() time.Time { return now }
+	r.lookup = func(host string) ([]string, error) {
+		lookups++
+		ips, ok := answers[host]
+		if !ok {
+			return nil, errors.New("no such host")
+		}
+		return ips, nil
+	}
+
+	scenarios := []struct {
+		addr    string
+		advance time.Duration
+		change  []string
+		expect  string
+		lookups int
+		err     bool
+	}{
+		{addr: "node1:13800", expect: "10.0.4.2:13800", lookups: 1},
+		{addr: "node1:13801", expect: "10.0.4.2:13801", lookups: 1}, // cached
+		{addr: "node1:13800", advance: time.Minute, change: []string{"10.0.4.9"}, expect: "10.0.4.9:13800", lookups: 2},
+		{addr: "node1:13800", advance: time.Minute, change: []string{}, expect: "10.0.4.9:13800", lookups: 3}, // stale answer kept
+		{addr: "[::1]:13800", expect: "[::1]:13800", lookups: 3},                                              // ip literals are never looked up
+		{addr: "node2:13800", lookups: 4, err: true},
+	}
+
+	for i, s := range scenarios {
+		now = now.Add(s.advance)
+		if s.change != nil {
+			answers["node1"] = s.change
+		}
+
+		got, err := r.Resolve(s.addr)
+		if s.err != (err != nil) || (!s.err && got != s.expect) {
+			t.Errorf("Step %d, %v: expected %q (error %v), got %q (%v)", i, s.addr, s.expect, s.err, got, err)
+		}
+		if lookups != s.lookups {
+			t.Errorf("Step %d, %v: expected %d lookups, got %d", i, s.addr, s.lookups, lookups)
+		}
+	}
+}
+
+func TestUDPHostnameAndIPv6(t *testing.T) {
+	scenarios := []struct {
+		host string
+		ip   string
+	}{
+		{host: "localhost", ip: "127.0.0.1"},
+		{host: "[::1]", ip: "::1"},
+	}
+
+	for _, s := range scenarios {
+		port := freePort(t)
+		b := NewUDP(s.host, port, 1024)
+		if err := b.listen(); err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+
+		// not every machine has an ipv6 loopback
+		if conn, err := net.Dial("udp", net.JoinHostPort(s.ip, "9")); err != nil {
+			b.Close()
+			t.Logf("Skipping %v, loopback not available: %v", s.host, err)
+			continue
+		} else {
+			conn.Close()
+		}
+
+		a := NewUDP("localhost", freePort(t), 1024)
+		a.resolver.lookup = func(host string) ([]string, error) { return []string{"127.0.0.1"}, nil }
+
+		if err := a.Send(s.host+":"+strconv.Itoa(port), msg.Msg{Action: "put"}); err != nil {
+			t.Errorf("Send to %v failed: %v", s.host, err)
+		} else if got, ok := recvWithin(b, time.Second); !ok || got.Action != "put" {
+			t.Errorf("Message to %v was not received", s.host)
+		}
+
+		b.Close()
+	}
+}
@@ -0,0 +1,332 @@
+package network
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	msg "kv-store/Messages"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultDialTimeout -> how long connecting to a peer, handshake included, may take
+// before the send fails
+const DefaultDialTimeout = 2 * time.Second
+
+// DefaultWriteTimeout -> how long writing one message to a peer may take before the
+// send fails, so a peer that stops reading does not hold up its senders
+const DefaultWriteTimeout = 2 * time.Second
+
+// TLS -> transport that sends messages over mutually authenticated tls connections.
+// Peers are identified by their host:port in the view, the tls listener is bound to
+// that port plus a fixed offset so it does not collide with the client http api.
+type TLS struct {
+	Addr         string
+	offset       int
+	config       *tls.Config
+	view         map[string]bool
+	listener     net.Listener
+	dialTimeout  time.Duration
+	writeTimeout time.Duration
+	m            *sync.Mutex // guards peers, not the connections in it
+	peers        map[string]*tlsPeer
+	inbox        chan memPacket
+	closed       chan struct{}
+	closing      *sync.Once
+}
+
+// tlsPeer -> our outgoing connection to a peer, dialed on first use. Messages are gob
+// encoded back to back, sends to one peer are serialized while sends to different
+// peers are not.
+type tlsPeer struct {
+	m    *sync.Mutex
+	conn *tls.Conn
+	en   *gob.Encoder
+}
+
+// LoadTLSConfig -> build a mutual tls configuration from a certificate, its private
+// key and the certificate authority every node in the cluster is signed by
+func LoadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load node certificate: %v", err)
+	}
+
+	caPEM, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate authority: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("no certificates found in " + caFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// NewTLS -> construct a tls transport for the node at addr and start listening.
+// Only members of the view may connect to us or be sent messages.
+func NewTLS(addr string, view []string, offset int, config *tls.Config) (*TLS, error) {
+	t := &TLS{
+		Addr:         addr,
+		offset:       offset,
+		view:         make(map[string]bool),
+		dialTimeout:  DefaultDialTimeout,
+		writeTimeout: DefaultWriteTimeout,
+		m:            &sync.Mutex{},
+		peers:        make(map[string]*tlsPeer),
+		inbox:        make(chan memPacket, 1024),
+		closed:       make(chan struct{}),
+		closing:      &sync.Once{},
+	}
+
+	for _, node := range view {
+		t.view[node] = true
+	}
+
+	// reject any peer whose certificate does not belong to a member of the view
+	t.config = config.Clone()
+	t.config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("peer did not present a certificate")
+		}
+		if _, ok := t.member(cs.PeerCertificates[0]); !ok {
+			return errors.New("peer certificate does not match a member of the view")
+		}
+		return nil
+	}
+
+	listenAddr, err := t.dialAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	_, port, _ := net.SplitHostPort(listenAddr)
+
+	t.listener, err = tls.Listen("tcp", ":"+port, t.config)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create socket %v", err)
+	}
+
+	go t.accept()
+
+	return t, nil
+}
+
+// dialAddr -> translate a node address into the address its tls listener is bound to
+func (t *TLS) dialAddr(addr string) (string, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", fmt.Errorf("invalid port in address %s", addr)
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(port+t.offset)), nil
+}
+
+// member -> return the first view member the certificate was issued for
+func (t *TLS) member(cert *x509.Certificate) (string, bool) {
+	for node := range t.view {
+		if t.certifies(cert, node) {
+			return node, true
+		}
+	}
+	return "", false
+}
+
+// certifies -> determine if the certificate was issued for the host of this node
+func (t *TLS) certifies(cert *x509.Certificate, node string) bool {
+	host, _, err := net.SplitHostPort(node)
+	if err != nil {
+		return false
+	}
+	return cert.VerifyHostname(host) == nil
+}
+
+// accept -> hand every incoming connection to its own reader
+func (t *TLS) accept() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			select {
+			case <-t.closed:
+				return
+			default:
+				fmt.Println("failed to accept tls connection:", err)
+				continue
+			}
+		}
+
+		go t.read(conn.(*tls.Conn))
+	}
+}
+
+// read -> decode messages from a peer until the connection fails. A peer may only
+// send messages in the name of a node its certificate was issued for.
+func (t *TLS) read(conn *tls.Conn) {
+	defer conn.Close()
+
+	if err := conn.Handshake(); err != nil {
+		fmt.Println("rejected tls peer", conn.RemoteAddr(), err)
+		return
+	}
+	cert := conn.ConnectionState().PeerCertificates[0]
+	from := conn.RemoteAddr().String()
+
+	d := gob.NewDecoder(conn)
+	for {
+		var Msg msg.Msg
+		if err := d.Decode(&Msg); err != nil {
+			return
+		}
+
+		if !t.view[Msg.SrcAddr] || !t.certifies(cert, Msg.SrcAddr) {
+			fmt.Printf("rejected message from %s claiming to be %s\n", from, Msg.SrcAddr)
+			return
+		}
+
+		select {
+		case t.inbox <- memPacket{Msg: Msg, from: from}:
+		case <-t.closed:
+			return
+		}
+	}
+}
+
+// peer -> the connection state of the peer, created on first use
+func (t *TLS) peer(addr string) *tlsPeer {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	p, ok := t.peers[addr]
+	if !ok {
+		p = &tlsPeer{m: &sync.Mutex{}}
+		t.peers[addr] = p
+	}
+	return p
+}
+
+// connect -> dial the peer unless we are already connected, the caller must hold the
+// lock of the peer
+func (t *TLS) connect(addr string, p *tlsPeer) error {
+	if p.conn != nil {
+		return nil
+	}
+
+	dest, err := t.dialAddr(addr)
+	if err != nil {
+		return err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+
+	config := t.config.Clone()
+	config.ServerName = host
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: t.dialTimeout}, "tcp", dest, config)
+	if err != nil {
+		return err
+	}
+
+	// the transport was closed while we were dialing
+	select {
+	case <-t.closed:
+		conn.Close()
+		return ErrClosed
+	default:
+	}
+
+	p.conn, p.en = conn, gob.NewEncoder(conn)
+	return nil
+}
+
+// Send -> encode the message onto our connection with the peer, a broken
+// connection is dialed again once. A peer that can not be reached or stops reading
+// only delays the messages sent to it, a write that times out drops the connection
+// without dialing again.
+func (t *TLS) Send(addr string, Msg msg.Msg) error {
+	if !t.view[addr] {
+		return fmt.Errorf("refusing to send to %s, not a member of the view", addr)
+	}
+
+	select {
+	case <-t.closed:
+		return ErrClosed
+	default:
+	}
+
+	p := t.peer(addr)
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if err = t.connect(addr, p); err != nil {
+			continue
+		}
+
+		p.conn.SetWriteDeadline(time.Now().Add(t.writeTimeout))
+		if err = p.en.Encode(Msg); err == nil {
+			return nil
+		}
+
+		p.conn.Close()
+		p.conn, p.en = nil, nil
+
+		var timeout net.Error
+		if errors.As(err, &timeout) && timeout.Timeout() {
+			break
+		}
+	}
+
+	fmt.Printf("failed to send to %s: %v\n", addr, err)
+	return err
+}
+
+// Recv -> blocking call, return the next message received from a peer
+func (t *TLS) Recv() (msg.Msg, string, error) {
+	select {
+	case p := <-t.inbox:
+		return p.Msg, p.from, nil
+	case <-t.closed:
+		return msg.Msg{}, "", ErrClosed
+	}
+}
+
+// Close -> stop listening and close every connection to our peers
+func (t *TLS) Close() error {
+	var err error
+	t.closing.Do(func() {
+		close(t.closed)
+		err = t.listener.Close()
+
+		t.m.Lock()
+		peers := t.peers
+		t.peers = make(map[string]*tlsPeer)
+		t.m.Unlock()
+
+		for _, p := range peers {
+			p.m.Lock()
+			if p.conn != nil {
+				p.conn.Close()
+				p.conn, p.en = nil, nil
+			}
+			p.m.Unlock()
+		}
+	})
+	return err
+}
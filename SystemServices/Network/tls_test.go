@@ -0,0 +1,307 @@
+package network
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	msg "kv-store/Messages"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kv-store test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create ca: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue -> write a certificate for the given ip along with the ca to dir and load them
+func (ca *testCA) issue(t *testing.T, dir string, name string, ip string) *tls.Config {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP(ip)},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Failed to issue certificate: %v", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	caFile := filepath.Join(dir, name+"-ca.crt")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	ioutil.WriteFile(caFile, ca.pem, 0600)
+
+	config, err := LoadTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatalf("Failed to load tls config: %v", err)
+	}
+	return config
+}
+
+func freeTCPPort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// recvWithin -> wait a short time for a message on the transport
+func recvWithin(tr Transport, d time.Duration) (msg.Msg, bool) {
+	got := make(chan msg.Msg, 1)
+	go func() {
+		m, _, err := tr.Recv()
+		if err == nil {
+			got <- m
+		}
+	}()
+
+	select {
+	case m := <-got:
+		return m, true
+	case <-time.After(d):
+		return msg.Msg{}, false
+	}
+}
+
+func TestTLSMembers(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+
+	addrA := "127.0.0.1:" + strconv.Itoa(freeTCPPort(t))
+	addrB := "127.0.0.1:" + strconv.Itoa(freeTCPPort(t))
+	view := []string{addrA, addrB}
+
+	a, err := NewTLS(addrA, view, 0, ca.issue(t, dir, "a", "127.0.0.1"))
+	if err != nil {
+		t.Fatalf("Failed to start transport: %v", err)
+	}
+	defer a.Close()
+
+	b, err := NewTLS(addrB, view, 0, ca.issue(t, dir, "b", "127.0.0.1"))
+	if err != nil {
+		t.Fatalf("Failed to start transport: %v", err)
+	}
+	defer b.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := a.Send(addrB, msg.Msg{SrcAddr: addrA, Payload: []byte("key0:value0"), Action: "put"}); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+
+		got, ok := recvWithin(b, time.Second)
+		if !ok {
+			t.Fatalf("Message %d was not received", i)
+		}
+		if got.PayloadToStr() != "key0:value0" {
+			t.Errorf("Did not receive the sent message, got '%v'", got)
+		}
+	}
+
+	if err := a.Send("127.0.0.1:1", msg.Msg{SrcAddr: addrA}); err == nil {
+		t.Errorf("Expected an error when sending to a node outside the view")
+	}
+}
+
+func TestTLSRejectsUnknownPeers(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	otherCA := newTestCA(t)
+
+	addrA := "127.0.0.1:" + strconv.Itoa(freeTCPPort(t))
+	addrB := "127.0.0.2:" + strconv.Itoa(freeTCPPort(t))
+	addrC := "127.0.0.3:" + strconv.Itoa(freeTCPPort(t))
+
+	a, err := NewTLS(addrA, []string{addrA, addrB}, 0, ca.issue(t, dir, "a", "127.0.0.1"))
+	if err != nil {
+		t.Fatalf("Failed to start transport: %v", err)
+	}
+	defer a.Close()
+
+	scenarios := []struct {
+		name   string
+		addr   string
+		src    string
+		config *tls.Config
+	}{
+		// signed by the cluster ca but issued for a host outside the view
+		{name: "outsider", addr: addrC, src: addrC, config: ca.issue(t, dir, "c", "127.0.0.3")},
+		// a member of the view signed by a different ca
+		{name: "forged", addr: addrB, src: addrB, config: otherCA.issue(t, dir, "b-forged", "127.0.0.2")},
+		// a member of the view sending in the name of another member
+		{name: "spoofed", addr: addrB, src: addrA, config: ca.issue(t, dir, "b", "127.0.0.2")},
+	}
+
+	for _, s := range scenarios {
+		peer, err := NewTLS(s.addr, []string{addrA, addrB, addrC}, 0, s.config)
+		if err != nil {
+			t.Fatalf("Failed to start transport: %v", err)
+		}
+
+		peer.Send(addrA, msg.Msg{SrcAddr: s.src, Payload: []byte("key0:evil"), Action: "put"})
+
+		if got, ok := recvWithin(a, 200*time.Millisecond); ok {
+			t.Errorf("Scenario %v: message from rejected peer was accepted '%v'", s.name, got)
+		}
+		peer.Close()
+	}
+}
+
+func TestTLSUnreachablePeer(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+
+	addrA := "127.0.0.1:" + strconv.Itoa(freeTCPPort(t))
+	addrB := "127.0.0.1:" + strconv.Itoa(freeTCPPort(t))
+
+	// c accepts connections but never completes a handshake
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	addrC := silent.Addr().String()
+	view := []string{addrA, addrB, addrC}
+
+	a, err := NewTLS(addrA, view, 0, ca.issue(t, dir, "a", "127.0.0.1"))
+	if err != nil {
+		t.Fatalf("Failed to start transport: %v", err)
+	}
+	defer a.Close()
+	a.dialTimeout = 300 * time.Millisecond
+
+	b, err := NewTLS(addrB, view, 0, ca.issue(t, dir, "b", "127.0.0.1"))
+	if err != nil {
+		t.Fatalf("Failed to start transport: %v", err)
+	}
+	defer b.Close()
+
+	failed := make(chan error, 1)
+	go func() { failed <- a.Send(addrC, msg.Msg{SrcAddr: addrA, Action: "put"}) }()
+
+	// messages to b are not held up by the dial to c
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	if err := a.Send(addrB, msg.Msg{SrcAddr: addrA, Payload: []byte("key0:value0"), Action: "put"}); err != nil {
+		t.Fatalf("Send to b failed: %v", err)
+	}
+	if _, ok := recvWithin(b, time.Second); !ok {
+		t.Fatalf("Message to b was not received")
+	}
+	if waited := time.Since(start); waited > 200*time.Millisecond {
+		t.Errorf("Send to b waited %v for the dial to c", waited)
+	}
+
+	select {
+	case err := <-failed:
+		if err == nil {
+			t.Errorf("Expected the send to c to fail")
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("Send to c did not give up after the dial timeout")
+	}
+}
+
+func TestTLSStalledPeer(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+
+	addrA := "127.0.0.1:" + strconv.Itoa(freeTCPPort(t))
+
+	// c completes the handshake but never reads
+	silent, err := tls.Listen("tcp", "127.0.0.1:0", ca.issue(t, dir, "c", "127.0.0.1"))
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.(*tls.Conn).Handshake()
+		}
+	}()
+	addrC := silent.Addr().String()
+
+	a, err := NewTLS(addrA, []string{addrA, addrC}, 0, ca.issue(t, dir, "a", "127.0.0.1"))
+	if err != nil {
+		t.Fatalf("Failed to start transport: %v", err)
+	}
+	defer a.Close()
+	a.writeTimeout = 300 * time.Millisecond
+
+	// large enough to fill the socket buffers of both ends
+	big := msg.Msg{SrcAddr: addrA, Action: "put", Payload: make([]byte, 32<<20)}
+	failed := make(chan error, 1)
+	go func() { failed <- a.Send(addrC, big) }()
+
+	select {
+	case err := <-failed:
+		if err == nil {
+			t.Fatalf("Expected the send to c to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Send to c did not give up after the write timeout")
+	}
+
+	p := a.peer(addrC)
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.conn != nil {
+		t.Errorf("Expected the stalled connection to be dropped")
+	}
+}
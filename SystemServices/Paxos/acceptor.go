@@ -0,0 +1,188 @@
+package paxos
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// maxDecided -> proposals each replica remembers having committed for a key
+const maxDecided = 64
+
+// acceptor -> the state of a replica for one key: the newest round it promised to
+// take part in, the value it last accepted and the proposals it last committed
+type acceptor struct {
+	promised      Ballot
+	accepted      Ballot
+	acceptedID    string
+	acceptedValue []byte
+	committed     Ballot
+	decided       []decision // oldest first, at most maxDecided
+	forgot        bool       // older decisions were dropped from decided
+}
+
+// decision -> a proposal committed by a round
+type decision struct {
+	ID     string
+	Ballot Ballot
+}
+
+// prepareRequest -> start a round on the key. A coordinator that does not know
+// whether its proposal ID was decided asks about it, Since is the ballot it was
+// first sent with.
+type prepareRequest struct {
+	Key    string
+	Ballot Ballot
+	ID     string
+	Since  Ballot
+}
+
+// promise -> a replica's answer to a prepare. Once promised it holds the value the
+// replica accepted after its last commit, if any, the stored value of the key and
+// whether it committed the proposal asked about. Otherwise Ballot is the newer round
+// the replica promised.
+type promise struct {
+	Promised      bool
+	Ballot        Ballot
+	Accepted      Ballot
+	AcceptedID    string
+	AcceptedValue []byte
+	Committed     Ballot
+	Value         []byte
+	Exists        bool
+	Decided       bool // the replica committed the proposal asked about
+	Forgotten     bool // the replica may have committed it and no longer remembers
+}
+
+// proposal -> the value of a round, sent to be accepted and then committed. The ID
+// stays with the value when another round finishes it.
+type proposal struct {
+	Key    string
+	Ballot Ballot
+	ID     string
+	Value  []byte
+}
+
+type acceptReply struct {
+	Accepted bool
+	Ballot   Ballot
+}
+
+// Handle -> answer a message sent by a coordinator
+func (p *Paxos) Handle(action string, payload []byte) ([]byte, error) {
+	switch action {
+	case ActionPrepare:
+		return p.HandlePrepare(payload)
+	case ActionAccept:
+		return p.HandleAccept(payload)
+	case ActionCommit:
+		return p.HandleCommit(payload)
+	}
+	return nil, fmt.Errorf("unknown paxos action %q", action)
+}
+
+// HandlePrepare -> promise to ignore rounds older than the one asked for
+func (p *Paxos) HandlePrepare(payload []byte) ([]byte, error) {
+	var req prepareRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	a := p.acceptor(req.Key, req.Ballot)
+	if !a.promised.Less(req.Ballot) {
+		return json.Marshal(promise{Ballot: a.promised})
+	}
+	a.promised = req.Ballot
+
+	reply := promise{Promised: true, Ballot: a.promised, Committed: a.committed}
+	if a.committed.Less(a.accepted) {
+		reply.Accepted, reply.AcceptedID, reply.AcceptedValue = a.accepted, a.acceptedID, a.acceptedValue
+	}
+	if req.ID != "" {
+		reply.Decided, reply.Forgotten = a.outcome(req.ID, req.Since)
+	}
+	reply.Value, reply.Exists = p.load(req.Key)
+	return json.Marshal(reply)
+}
+
+// HandleAccept -> accept the value of a round unless a newer one has been promised
+func (p *Paxos) HandleAccept(payload []byte) ([]byte, error) {
+	var req proposal
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	a := p.acceptor(req.Key, req.Ballot)
+	if req.Ballot.Less(a.promised) {
+		return json.Marshal(acceptReply{Ballot: a.promised})
+	}
+
+	a.promised = req.Ballot
+	a.accepted, a.acceptedID, a.acceptedValue = req.Ballot, req.ID, req.Value
+	return json.Marshal(acceptReply{Accepted: true, Ballot: req.Ballot})
+}
+
+// HandleCommit -> store the value decided by a round, unless a newer round has
+// already been committed
+func (p *Paxos) HandleCommit(payload []byte) ([]byte, error) {
+	var req proposal
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	a := p.acceptor(req.Key, req.Ballot)
+	if !a.committed.Less(req.Ballot) {
+		return nil, nil
+	}
+
+	if err := p.store(req.Key, req.Value); err != nil {
+		return nil, err
+	}
+	a.committed = req.Ballot
+	if !req.Ballot.Less(a.accepted) {
+		a.accepted, a.acceptedID, a.acceptedValue = Ballot{}, "", nil
+	}
+
+	a.decided = append(a.decided, decision{ID: req.ID, Ballot: req.Ballot})
+	if len(a.decided) > maxDecided {
+		a.decided = a.decided[len(a.decided)-maxDecided:]
+		a.forgot = true
+	}
+	return nil, nil
+}
+
+// outcome -> whether the proposal first sent at the since ballot was committed
+// here, or may have been and was dropped from the decisions we remember
+func (a *acceptor) outcome(id string, since Ballot) (decided, forgotten bool) {
+	for _, d := range a.decided {
+		if d.ID == id {
+			return true, false
+		}
+	}
+
+	// every commit made after the oldest decision we remember is still known
+	return false, a.forgot && len(a.decided) > 0 && since.Less(a.decided[0].Ballot)
+}
+
+// acceptor -> the state of the key, remembering the ballot seen. The caller must
+// hold the lock.
+func (p *Paxos) acceptor(key string, seen Ballot) *acceptor {
+	if seen.Counter > p.highest {
+		p.highest = seen.Counter
+	}
+
+	a, ok := p.keys[key]
+	if !ok {
+		a = &acceptor{}
+		p.keys[key] = a
+	}
+	return a
+}
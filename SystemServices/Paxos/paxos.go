@@ -0,0 +1,323 @@
+package paxos
+
+import (
+	"encoding/json"
+	"errors"
+	stats "kv-store/SystemServices/Stats"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Message actions exchanged between the coordinator and the replicas of a key
+const (
+	ActionPrepare = "paxos_prepare"
+	ActionAccept  = "paxos_accept"
+	ActionCommit  = "paxos_commit"
+)
+
+// maxBackoff -> longest wait before retrying a round that lost to another coordinator
+const maxBackoff = 50 * time.Millisecond
+
+// ErrTimeout -> no round completed before the deadline, either because too few
+// replicas answered or because other coordinators kept winning the key
+var ErrTimeout = errors.New("paxos deadline exceeded")
+
+// ErrOutcomeUnknown -> the new value was sent to the replicas but whether it was
+// decided could not be learned, the update may or may not have been applied
+var ErrOutcomeUnknown = errors.New("paxos outcome unknown")
+
+// Caller -> send an action to a replica and return its reply
+type Caller func(peer, action string, payload []byte, deadline time.Time) ([]byte, error)
+
+// Loader -> read the stored value of a key, returning false when it is missing
+type Loader func(key string) ([]byte, bool)
+
+// Storer -> store the value of a key decided by a round
+type Storer func(key string, value []byte) error
+
+// Update -> compute the new value of a key from its current value, returning false
+// to leave the key as it is
+type Update func(current []byte, exists bool) ([]byte, bool)
+
+// Result -> whether the update was applied and the value of the key afterwards
+type Result struct {
+	Applied bool
+	Value   []byte
+	Exists  bool
+}
+
+// Ballot -> orders the rounds run on a key, ties between coordinators are broken
+// by their id
+type Ballot struct {
+	Counter int64
+	Node    string
+}
+
+// String -> the ballot as an identifier, unique to the coordinator that made it
+func (b Ballot) String() string {
+	return b.Node + "/" + strconv.FormatInt(b.Counter, 10)
+}
+
+// Less -> whether the ballot comes before the other
+func (b Ballot) Less(other Ballot) bool {
+	if b.Counter != other.Counter {
+		return b.Counter < other.Counter
+	}
+	return b.Node < other.Node
+}
+
+// Paxos -> coordinates rounds on the keys written through this node and accepts the
+// rounds run by other coordinators on the keys it holds
+type Paxos struct {
+	m       *sync.Mutex
+	id      string
+	call    Caller
+	load    Loader
+	store   Storer
+	stats   *stats.Counters
+	keys    map[string]*acceptor
+	highest int64 // highest ballot counter seen
+}
+
+// New -> construct the paxos participant of the node id
+func New(id string, call Caller, load Loader, store Storer, s *stats.Counters) *Paxos {
+	return &Paxos{
+		m:     &sync.Mutex{},
+		id:    id,
+		call:  call,
+		load:  load,
+		store: store,
+		stats: s,
+		keys:  make(map[string]*acceptor),
+	}
+}
+
+// Propose -> atomically apply the update to the key among its replicas. A round
+// first reads the key from a majority of the replicas, finishing any round that
+// may have been decided without being committed, and then has a majority accept
+// the new value. Rounds lost to another coordinator are retried until the deadline.
+// A value that may have been accepted is never computed again until the replicas
+// show it was not decided, so the update is applied at most once.
+func (p *Paxos) Propose(key string, replicas []string, update Update, deadline time.Time) (Result, error) {
+	p.stats.Inc("paxos_proposals")
+
+	var sent *proposal // our value, sent without learning whether it was decided
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			backoff := time.Duration(rand.Int63n(int64(maxBackoff)))
+			if time.Now().Add(backoff).After(deadline) {
+				if sent != nil {
+					p.stats.Inc("paxos_outcome_unknown")
+					return Result{}, ErrOutcomeUnknown
+				}
+				p.stats.Inc("paxos_timeouts")
+				return Result{}, ErrTimeout
+			}
+			time.Sleep(backoff)
+		}
+
+		ballot := p.nextBallot()
+		req := prepareRequest{Key: key, Ballot: ballot}
+		if sent != nil {
+			req.ID, req.Since = sent.ID, sent.Ballot
+		}
+		promises, ok := p.prepare(req, replicas, deadline)
+		if !ok {
+			p.stats.Inc("paxos_contention")
+			continue
+		}
+
+		// a majority may have accepted a value without it being committed, the
+		// value must be decided before the key is read
+		latest, pending := current(promises)
+		if sent != nil {
+			decided, known := outcome(promises, sent.ID)
+			switch {
+			case decided:
+				p.stats.Inc("paxos_applied")
+				return Result{Applied: true, Value: sent.Value, Exists: true}, nil
+			case pending != nil && pending.AcceptedID == sent.ID:
+				// finished below like any other pending value
+			case !known:
+				p.stats.Inc("paxos_outcome_unknown")
+				return Result{}, ErrOutcomeUnknown
+			default:
+				// the majority neither committed nor holds our value, it can no
+				// longer be decided and the update is computed again
+				sent = nil
+			}
+		}
+
+		if pending != nil {
+			p.stats.Inc("paxos_repairs")
+			repaired := p.decide(proposal{Key: key, Ballot: ballot, ID: pending.AcceptedID, Value: pending.AcceptedValue}, replicas, deadline)
+			if repaired && sent != nil {
+				p.stats.Inc("paxos_applied")
+				return Result{Applied: true, Value: sent.Value, Exists: true}, nil
+			}
+			continue
+		}
+
+		next, apply := update(latest.Value, latest.Exists)
+		if !apply {
+			p.stats.Inc("paxos_not_applied")
+			return Result{Value: latest.Value, Exists: latest.Exists}, nil
+		}
+
+		ours := proposal{Key: key, Ballot: ballot, ID: ballot.String(), Value: next}
+		if !p.decide(ours, replicas, deadline) {
+			p.stats.Inc("paxos_contention")
+			sent = &ours
+			continue
+		}
+
+		p.stats.Inc("paxos_applied")
+		return Result{Applied: true, Value: next, Exists: true}, nil
+	}
+}
+
+// prepare -> have a majority of the replicas promise to ignore older rounds on the
+// key, returning their promises
+func (p *Paxos) prepare(req prepareRequest, replicas []string, deadline time.Time) ([]promise, bool) {
+	var promises []promise
+	promised := p.broadcast(replicas, ActionPrepare, req, deadline, func(out []byte) bool {
+		var reply promise
+		if json.Unmarshal(out, &reply) != nil {
+			return false
+		}
+
+		p.observe(reply.Ballot)
+		if reply.Promised {
+			promises = append(promises, reply)
+		}
+		return reply.Promised
+	})
+
+	return promises, promised >= quorum(replicas)
+}
+
+// decide -> have a majority of the replicas accept the value and then tell them it
+// was decided. Returns false when a newer round took over the key.
+func (p *Paxos) decide(proposal proposal, replicas []string, deadline time.Time) bool {
+	accepted := p.broadcast(replicas, ActionAccept, proposal, deadline, func(out []byte) bool {
+		var reply acceptReply
+		if json.Unmarshal(out, &reply) != nil {
+			return false
+		}
+
+		p.observe(reply.Ballot)
+		return reply.Accepted
+	})
+	if accepted < quorum(replicas) {
+		return false
+	}
+
+	// the value is decided, replicas that miss the commit learn it from the next round
+	p.broadcast(replicas, ActionCommit, proposal, deadline, func(out []byte) bool { return true })
+	return true
+}
+
+// current -> the latest committed value among the promises, along with the promise
+// holding a value accepted after it when there is one
+func current(promises []promise) (latest promise, pending *promise) {
+	for i, reply := range promises {
+		if i == 0 || latest.Committed.Less(reply.Committed) {
+			latest = reply
+		}
+	}
+
+	for i, reply := range promises {
+		if !latest.Committed.Less(reply.Accepted) {
+			continue
+		}
+		if pending == nil || pending.Accepted.Less(reply.Accepted) {
+			pending = &promises[i]
+		}
+	}
+	return latest, pending
+}
+
+// outcome -> whether a replica of the majority committed the proposal, and whether
+// that is known. A decided proposal is either committed by a majority, so one of
+// ours remembers it, or still accepted by one of ours and pending.
+func outcome(promises []promise, id string) (decided, known bool) {
+	known = true
+	for _, reply := range promises {
+		if reply.Decided {
+			return true, true
+		}
+		if reply.Forgotten {
+			known = false
+		}
+	}
+	return false, known
+}
+
+// broadcast -> send the request to every replica and hand each reply to answer,
+// until a majority has answered true or every replica has replied. Returns the
+// number of replicas that answered true.
+func (p *Paxos) broadcast(replicas []string, action string, req interface{}, deadline time.Time, answer func(out []byte) bool) int {
+	payload, _ := json.Marshal(req)
+
+	type reply struct {
+		out []byte
+		err error
+	}
+	replies := make(chan reply, len(replicas))
+
+	for _, replica := range replicas {
+		go func(replica string) {
+			var r reply
+			if replica == p.id {
+				r.out, r.err = p.Handle(action, payload)
+			} else {
+				r.out, r.err = p.call(replica, action, payload, deadline)
+			}
+			replies <- r
+		}(replica)
+	}
+
+	count := 0
+	for range replicas {
+		r := <-replies
+		if r.err == nil && answer(r.out) {
+			count++
+		}
+		if count >= quorum(replicas) {
+			break
+		}
+	}
+	return count
+}
+
+// nextBallot -> a ballot newer than any seen so far, following the clock so that
+// coordinators that have not heard of each other still order their rounds
+func (p *Paxos) nextBallot() Ballot {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	counter := time.Now().UnixNano() / int64(time.Microsecond)
+	if counter <= p.highest {
+		counter = p.highest + 1
+	}
+	p.highest = counter
+
+	return Ballot{Counter: counter, Node: p.id}
+}
+
+// observe -> remember a ballot so our next round starts above it
+func (p *Paxos) observe(b Ballot) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if b.Counter > p.highest {
+		p.highest = b.Counter
+	}
+}
+
+// quorum -> replicas that make a majority
+func quorum(replicas []string) int {
+	return len(replicas)/2 + 1
+}
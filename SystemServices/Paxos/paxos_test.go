@@ -0,0 +1,273 @@
+package paxos
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	stats "kv-store/SystemServices/Stats"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testGroup -> replicas calling each other directly, each storing into its own map.
+// Replicas may be cut off from the rest of the group, and a hook may step in on
+// every call.
+type testGroup struct {
+	m       *sync.Mutex
+	ids     []string
+	members map[string]*Paxos
+	stored  map[string]map[string]string
+	cut     map[string]bool
+	hook    func(from, peer, action string, deliver func() ([]byte, error)) ([]byte, error)
+}
+
+func newTestGroup(ids ...string) *testGroup {
+	g := &testGroup{
+		m:       &sync.Mutex{},
+		ids:     ids,
+		members: make(map[string]*Paxos),
+		stored:  make(map[string]map[string]string),
+		cut:     make(map[string]bool),
+	}
+
+	for _, id := range ids {
+		id := id
+		g.stored[id] = make(map[string]string)
+
+		load := func(key string) ([]byte, bool) {
+			g.m.Lock()
+			defer g.m.Unlock()
+			val, ok := g.stored[id][key]
+			return []byte(val), ok
+		}
+		store := func(key string, value []byte) error {
+			g.m.Lock()
+			defer g.m.Unlock()
+			g.stored[id][key] = string(value)
+			return nil
+		}
+
+		g.members[id] = New(id, g.caller(id), load, store, stats.New())
+	}
+	return g
+}
+
+func (g *testGroup) caller(from string) Caller {
+	return func(peer, action string, payload []byte, deadline time.Time) ([]byte, error) {
+		g.m.Lock()
+		cut := g.cut[from] || g.cut[peer]
+		p := g.members[peer]
+		hook := g.hook
+		g.m.Unlock()
+
+		if cut {
+			return nil, fmt.Errorf("%v can not reach %v", from, peer)
+		}
+
+		deliver := func() ([]byte, error) { return p.Handle(action, payload) }
+		if hook != nil {
+			return hook(from, peer, action, deliver)
+		}
+		return deliver()
+	}
+}
+
+func (g *testGroup) setCut(id string, cut bool) {
+	g.m.Lock()
+	defer g.m.Unlock()
+	g.cut[id] = cut
+}
+
+// increment -> add one to an integer value while it is below the limit
+func increment(limit int) Update {
+	return func(current []byte, exists bool) ([]byte, bool) {
+		n, _ := strconv.Atoi(string(current))
+		if n >= limit {
+			return nil, false
+		}
+		return []byte(strconv.Itoa(n + 1)), true
+	}
+}
+
+func TestPropose(t *testing.T) {
+	g := newTestGroup("n1", "n2", "n3")
+	deadline := time.Now().Add(time.Second)
+
+	scenarios := []struct {
+		coordinator string
+		limit       int
+		applied     bool
+		value       string
+	}{
+		{coordinator: "n1", limit: 2, applied: true, value: "1"},
+		{coordinator: "n2", limit: 2, applied: true, value: "2"},
+		{coordinator: "n3", limit: 2, applied: false, value: "2"},
+		// the coordinator does not need to hold the key
+		{coordinator: "n4", limit: 3, applied: true, value: "3"},
+	}
+
+	g.members["n4"] = New("n4", g.caller("n4"), nil, nil, stats.New())
+	for i, s := range scenarios {
+		result, err := g.members[s.coordinator].Propose("counter", g.ids, increment(s.limit), deadline)
+		if err != nil {
+			t.Fatalf("Scenario %d: propose failed: %v", i, err)
+		}
+		if result.Applied != s.applied || string(result.Value) != s.value || !result.Exists {
+			t.Errorf("Scenario %d: expected applied %v with %q, got %+v", i, s.applied, s.value, result)
+		}
+	}
+}
+
+func TestConcurrentPropose(t *testing.T) {
+	g := newTestGroup("n1", "n2", "n3")
+	deadline := time.Now().Add(10 * time.Second)
+
+	// every coordinator increments the counter until the limit, each increment must
+	// be applied exactly once
+	const limit = 30
+	var wg sync.WaitGroup
+	applied := make(chan int, 3*limit)
+	for _, id := range g.ids {
+		wg.Add(1)
+		go func(p *Paxos) {
+			defer wg.Done()
+			for {
+				result, err := p.Propose("counter", g.ids, increment(limit), deadline)
+				if err != nil {
+					t.Errorf("Propose failed: %v", err)
+					return
+				}
+				if !result.Applied {
+					return
+				}
+				n, _ := strconv.Atoi(string(result.Value))
+				applied <- n
+			}
+		}(g.members[id])
+	}
+	wg.Wait()
+	close(applied)
+
+	seen := make(map[int]bool)
+	for n := range applied {
+		if seen[n] {
+			t.Errorf("Value %d was set by two rounds", n)
+		}
+		seen[n] = true
+	}
+	if len(seen) != limit {
+		t.Errorf("Expected %d applied increments, got %d", limit, len(seen))
+	}
+}
+
+func TestUnreachable(t *testing.T) {
+	g := newTestGroup("n1", "n2", "n3")
+
+	// a majority is enough
+	g.setCut("n3", true)
+	if _, err := g.members["n1"].Propose("counter", g.ids, increment(10), time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("Expected a majority to decide, got %v", err)
+	}
+
+	// a minority is not
+	g.setCut("n2", true)
+	_, err := g.members["n1"].Propose("counter", g.ids, increment(10), time.Now().Add(200*time.Millisecond))
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected a minority to time out, got %v", err)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	g := newTestGroup("n1", "n2", "n3")
+
+	// n1 had n1 and n2 accept a value and failed before committing it
+	ballot := g.members["n1"].nextBallot()
+	payload, _ := json.Marshal(proposal{Key: "counter", Ballot: ballot, Value: []byte("1")})
+	for _, id := range []string{"n1", "n2"} {
+		if out, err := g.members[id].HandleAccept(payload); err != nil || !json.Valid(out) {
+			t.Fatalf("Accept on %v failed: %v", id, err)
+		}
+	}
+
+	// the next round decides that value before reading the key
+	result, err := g.members["n3"].Propose("counter", g.ids, increment(10), time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("Propose failed: %v", err)
+	}
+	if !result.Applied || string(result.Value) != "2" {
+		t.Errorf("Expected the pending value to be decided first, got %+v", result)
+	}
+	if got := g.members["n3"].stats.Get("paxos_repairs"); got != 1 {
+		t.Errorf("Expected 1 repair, got %d", got)
+	}
+}
+
+func TestProposeDecidedElsewhere(t *testing.T) {
+	g := newTestGroup("n1", "n2", "n3")
+	deadline := time.Now().Add(time.Second)
+
+	// the first value of n1 is accepted by n2 but the answer is lost, n3 never gets
+	// it. Before the next round of n1 reaches the replicas, n3 finishes that value
+	// and applies its own increment.
+	var m sync.Mutex
+	accepts, repaired := 0, false
+	g.hook = func(from, peer, action string, deliver func() ([]byte, error)) ([]byte, error) {
+		if from != "n1" {
+			return deliver()
+		}
+
+		m.Lock()
+		defer m.Unlock()
+		switch {
+		case action == ActionAccept && accepts < 2:
+			accepts++
+			if peer == "n2" {
+				deliver()
+			}
+			return nil, fmt.Errorf("%v lost the answer of %v", from, peer)
+		case action == ActionPrepare && accepts == 2 && !repaired:
+			repaired = true
+			if _, err := g.members["n3"].Propose("counter", g.ids, increment(10), deadline); err != nil {
+				t.Errorf("Propose on n3 failed: %v", err)
+			}
+		}
+		return deliver()
+	}
+
+	result, err := g.members["n1"].Propose("counter", g.ids, increment(10), deadline)
+	if err != nil {
+		t.Fatalf("Propose failed: %v", err)
+	}
+	if !result.Applied || string(result.Value) != "1" {
+		t.Errorf("Expected n1 to learn its value was decided, got %+v", result)
+	}
+
+	g.m.Lock()
+	defer g.m.Unlock()
+	for _, id := range g.ids {
+		if got := g.stored[id]["counter"]; got != "2" {
+			t.Errorf("Expected each increment to be applied once on %v, got %q", id, got)
+		}
+	}
+}
+
+func TestProposeOutcomeUnknown(t *testing.T) {
+	g := newTestGroup("n1", "n2", "n3")
+
+	// the replicas accept the value of n1 and become unreachable before answering
+	g.hook = func(from, peer, action string, deliver func() ([]byte, error)) ([]byte, error) {
+		if from != "n1" || action != ActionAccept {
+			return deliver()
+		}
+		deliver()
+		g.setCut(peer, true)
+		return nil, fmt.Errorf("%v lost the answer of %v", from, peer)
+	}
+
+	_, err := g.members["n1"].Propose("counter", g.ids, increment(10), time.Now().Add(200*time.Millisecond))
+	if !errors.Is(err, ErrOutcomeUnknown) {
+		t.Errorf("Expected the outcome to be unknown, got %v", err)
+	}
+}
@@ -0,0 +1,400 @@
+package raft
+
+import (
+	"errors"
+	stats "kv-store/SystemServices/Stats"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Default timing of a group. A member that hears nothing from a leader for the
+// election timeout, plus a random delay of up to as long again, starts an election.
+// The leader sends heartbeats every heartbeat interval.
+const (
+	DefaultElectionTimeout = time.Second
+	DefaultHeartbeat       = 100 * time.Millisecond
+)
+
+// Message actions exchanged between the members of a group
+const (
+	ActionVote   = "raft_vote"
+	ActionAppend = "raft_append"
+)
+
+// maxBatch -> most entries sent to a member in one append
+const maxBatch = 256
+
+var (
+	// ErrNotLeader -> the request reached a member that is not the leader
+	ErrNotLeader = errors.New("not the raft leader")
+
+	// ErrTimeout -> the request was not committed, or the read not confirmed,
+	// before its deadline. A write may still commit later.
+	ErrTimeout = errors.New("raft deadline exceeded")
+)
+
+// NotLeaderError -> names the leader known to the member, empty while an election
+// is in progress
+type NotLeaderError struct {
+	Leader string
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.Leader == "" {
+		return ErrNotLeader.Error() + ", no leader elected"
+	}
+	return ErrNotLeader.Error() + ", leader is " + e.Leader
+}
+
+// Unwrap -> lets errors.Is match ErrNotLeader
+func (e *NotLeaderError) Unwrap() error {
+	return ErrNotLeader
+}
+
+// Caller -> send an action to another member of the group and return its reply
+type Caller func(peer, action string, payload []byte, deadline time.Time) ([]byte, error)
+
+// Applier -> apply a committed command to the state machine and return its result
+type Applier func(command []byte) []byte
+
+// Entry -> a command in the replicated log, leaders start their term with an empty one
+type Entry struct {
+	Term    int
+	Command []byte
+}
+
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+// Raft -> a member of the raft group replicating the commands of one shard. Every
+// member applies the committed commands in the same order.
+type Raft struct {
+	m       *sync.Mutex
+	changed chan struct{} // closed and replaced whenever the state advances
+	kick    chan struct{} // wakes the leader to replicate new entries
+	id      string
+	peers   []string // the other members of the group
+	call    Caller
+	apply   Applier
+	stats   *stats.Counters
+
+	electionTimeout time.Duration
+	heartbeat       time.Duration
+
+	role     role
+	term     int
+	votedFor string
+	leader   string
+	votes    int
+	heard    time.Time // last heard from a leader or granted a vote
+	deadline time.Time // an election starts once this passes
+
+	log     []Entry // log[0] is a sentinel, entries are indexed from 1
+	commit  int
+	applied int
+	waiting map[int]bool   // entries a proposal is waiting on
+	results map[int][]byte // results of applied entries a proposal is waiting on
+
+	// leader state for each peer: the next entry to send, the last entry known to
+	// match ours and the send time of the latest append it answered
+	next     map[string]int
+	match    map[string]int
+	acked    map[string]time.Time
+	inflight map[string]bool
+}
+
+// New -> construct a member of the group made of id and peers
+func New(id string, peers []string, call Caller, apply Applier, s *stats.Counters) *Raft {
+	r := &Raft{
+		m:               &sync.Mutex{},
+		changed:         make(chan struct{}),
+		kick:            make(chan struct{}, 1),
+		id:              id,
+		call:            call,
+		apply:           apply,
+		stats:           s,
+		electionTimeout: DefaultElectionTimeout,
+		heartbeat:       DefaultHeartbeat,
+		log:             []Entry{{}},
+		waiting:         make(map[int]bool),
+		results:         make(map[int][]byte),
+		next:            make(map[string]int),
+		match:           make(map[string]int),
+		acked:           make(map[string]time.Time),
+		inflight:        make(map[string]bool),
+	}
+
+	for _, peer := range peers {
+		if peer != id {
+			r.peers = append(r.peers, peer)
+		}
+	}
+	r.resetDeadline()
+	return r
+}
+
+// UseTimeouts -> set the election timeout and heartbeat interval, the heartbeat
+// must be well below the election timeout
+func (r *Raft) UseTimeouts(election, heartbeat time.Duration) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.electionTimeout = election
+	r.heartbeat = heartbeat
+	r.resetDeadline()
+}
+
+// Run -> blocking call, hold elections and send heartbeats until done is closed
+func (r *Raft) Run(done <-chan struct{}) {
+	ticker := time.NewTicker(r.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.tick()
+		case <-r.kick:
+			r.broadcast()
+		case <-done:
+			return
+		}
+	}
+}
+
+// Leader -> the leader known to this member, empty while an election is in progress
+func (r *Raft) Leader() string {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	return r.leader
+}
+
+// Propose -> append the command to the log and wait until it has been committed and
+// applied, returning the result of applying it. Only the leader accepts proposals.
+func (r *Raft) Propose(command []byte, deadline time.Time) ([]byte, error) {
+	r.m.Lock()
+	if r.role != leader {
+		defer r.m.Unlock()
+		return nil, &NotLeaderError{Leader: r.leader}
+	}
+
+	r.log = append(r.log, Entry{Term: r.term, Command: command})
+	index, term := len(r.log)-1, r.term
+	r.waiting[index] = true
+	r.stats.Inc("raft_proposals")
+	r.advanceCommit()
+	r.m.Unlock()
+	r.wake()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	for {
+		r.m.Lock()
+
+		// a new leader replaced the entry before it was committed, a result at the
+		// index belongs to the entry that replaced it
+		if len(r.log) <= index || r.log[index].Term != term {
+			delete(r.results, index)
+			delete(r.waiting, index)
+			defer r.m.Unlock()
+			return nil, &NotLeaderError{Leader: r.leader}
+		}
+
+		if result, ok := r.results[index]; ok {
+			delete(r.results, index)
+			delete(r.waiting, index)
+			r.m.Unlock()
+			return result, nil
+		}
+		changed := r.changed
+		r.m.Unlock()
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			r.m.Lock()
+			delete(r.waiting, index)
+			r.m.Unlock()
+			return nil, ErrTimeout
+		}
+	}
+}
+
+// Read -> wait until a read of the state machine is linearizable, which holds while
+// this member is the leader and a majority of the group answered it within the last
+// lease. Followers do not vote for another leader while that lease runs.
+func (r *Raft) Read(deadline time.Time) error {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	waited := false
+	for {
+		r.m.Lock()
+		if r.role != leader {
+			defer r.m.Unlock()
+			return &NotLeaderError{Leader: r.leader}
+		}
+
+		// a new leader knows which entries are committed once one of its own is
+		if r.log[r.commit].Term == r.term && r.applied == r.commit && r.leaseValid(time.Now()) {
+			r.m.Unlock()
+			if waited {
+				r.stats.Inc("raft_read_waits")
+			}
+			r.stats.Inc("raft_lease_reads")
+			return nil
+		}
+		changed := r.changed
+		r.m.Unlock()
+
+		waited = true
+		r.wake()
+		select {
+		case <-changed:
+		case <-timer.C:
+			return ErrTimeout
+		}
+	}
+}
+
+// tick -> send heartbeats as the leader, otherwise start an election once we have
+// not heard from a leader for too long
+func (r *Raft) tick() {
+	r.m.Lock()
+	if r.role == leader {
+		r.m.Unlock()
+		r.broadcast()
+		return
+	}
+
+	if time.Now().After(r.deadline) {
+		r.startElection()
+	}
+	r.m.Unlock()
+}
+
+// wake -> have the leader replicate without waiting for the next heartbeat
+func (r *Raft) wake() {
+	select {
+	case r.kick <- struct{}{}:
+	default:
+	}
+}
+
+// advanced -> wake everything waiting on the state, the caller must hold the lock
+func (r *Raft) advanced() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// quorum -> members that make a majority of the group
+func (r *Raft) quorum() int {
+	return (len(r.peers)+1)/2 + 1
+}
+
+// resetDeadline -> push the next election back by a randomized election timeout,
+// the caller must hold the lock
+func (r *Raft) resetDeadline() {
+	jitter := time.Duration(rand.Int63n(int64(r.electionTimeout) + 1))
+	r.deadline = time.Now().Add(r.electionTimeout + jitter)
+}
+
+// lease -> how long after a majority answered the leader reads may be served,
+// short of the election timeout to allow for clock drift
+func (r *Raft) lease() time.Duration {
+	return r.electionTimeout * 9 / 10
+}
+
+// leaseValid -> whether a majority of the group answered an append sent within the
+// lease, the caller must hold the lock
+func (r *Raft) leaseValid(now time.Time) bool {
+	times := []time.Time{now}
+	for _, peer := range r.peers {
+		times = append(times, r.acked[peer])
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].After(times[j]) })
+
+	return now.Before(times[r.quorum()-1].Add(r.lease()))
+}
+
+// becomeFollower -> follow the given leader, moving to a newer term if needed. The
+// caller must hold the lock.
+func (r *Raft) becomeFollower(term int, leaderID string) {
+	if term > r.term {
+		r.term = term
+		r.votedFor = ""
+	}
+	if r.role == leader {
+		r.stats.Set("raft_is_leader", 0)
+	}
+
+	r.role = follower
+	r.leader = leaderID
+	r.resetDeadline()
+	r.stats.Set("raft_term", int64(r.term))
+	r.advanced()
+}
+
+// becomeLeader -> take over the group, starting the term with an empty entry. The
+// caller must hold the lock.
+func (r *Raft) becomeLeader() {
+	r.role = leader
+	r.leader = r.id
+	r.log = append(r.log, Entry{Term: r.term})
+
+	for _, peer := range r.peers {
+		r.next[peer] = len(r.log) - 1
+		r.match[peer] = 0
+		r.acked[peer] = time.Time{}
+	}
+
+	r.stats.Set("raft_is_leader", 1)
+	r.advanceCommit()
+	r.advanced()
+	r.wake()
+}
+
+// advanceCommit -> commit the latest entry of our term stored by a majority of the
+// group, the caller must hold the lock
+func (r *Raft) advanceCommit() {
+	for n := len(r.log) - 1; n > r.commit && r.log[n].Term == r.term; n-- {
+		stored := 1
+		for _, peer := range r.peers {
+			if r.match[peer] >= n {
+				stored++
+			}
+		}
+
+		if stored >= r.quorum() {
+			r.commit = n
+			r.applyCommitted()
+			return
+		}
+	}
+}
+
+// applyCommitted -> apply every committed entry not applied yet, in log order. The
+// caller must hold the lock.
+func (r *Raft) applyCommitted() {
+	for r.applied < r.commit {
+		r.applied++
+		entry := r.log[r.applied]
+
+		var result []byte
+		if len(entry.Command) > 0 {
+			result = r.apply(entry.Command)
+		}
+		if r.waiting[r.applied] {
+			r.results[r.applied] = result
+		}
+	}
+	r.advanced()
+}
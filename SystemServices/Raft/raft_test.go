@@ -0,0 +1,248 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	stats "kv-store/SystemServices/Stats"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testGroup -> members of a group calling each other directly, members may be
+// cut off from the rest of the group
+type testGroup struct {
+	m       *sync.Mutex
+	members map[string]*Raft
+	applied map[string][]string
+	cut     map[string]bool
+	done    chan struct{}
+}
+
+func newTestGroup(t *testing.T, ids ...string) *testGroup {
+	g := &testGroup{
+		m:       &sync.Mutex{},
+		members: make(map[string]*Raft),
+		applied: make(map[string][]string),
+		cut:     make(map[string]bool),
+		done:    make(chan struct{}),
+	}
+
+	for _, id := range ids {
+		id := id
+		apply := func(command []byte) []byte {
+			g.m.Lock()
+			defer g.m.Unlock()
+			g.applied[id] = append(g.applied[id], string(command))
+			return []byte(strings.ToUpper(string(command)))
+		}
+
+		r := New(id, ids, g.caller(id), apply, stats.New())
+		r.UseTimeouts(100*time.Millisecond, 10*time.Millisecond)
+		g.members[id] = r
+	}
+	for _, r := range g.members {
+		go r.Run(g.done)
+	}
+
+	t.Cleanup(func() { close(g.done) })
+	return g
+}
+
+func (g *testGroup) caller(from string) Caller {
+	return func(peer, action string, payload []byte, deadline time.Time) ([]byte, error) {
+		g.m.Lock()
+		cut := g.cut[from] || g.cut[peer]
+		r := g.members[peer]
+		g.m.Unlock()
+
+		if cut {
+			return nil, fmt.Errorf("%v can not reach %v", from, peer)
+		}
+		if action == ActionVote {
+			return r.HandleVote(payload)
+		}
+		return r.HandleAppend(payload)
+	}
+}
+
+func (g *testGroup) setCut(id string, cut bool) {
+	g.m.Lock()
+	defer g.m.Unlock()
+	g.cut[id] = cut
+}
+
+func (g *testGroup) appliedBy(id string) []string {
+	g.m.Lock()
+	defer g.m.Unlock()
+	return append([]string(nil), g.applied[id]...)
+}
+
+// waitLeader -> the leader agreed on by every member that is not cut off
+func (g *testGroup) waitLeader(t *testing.T, exclude string) string {
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		leaders := make(map[string]bool)
+		for id, r := range g.members {
+			if id != exclude {
+				leaders[r.Leader()] = true
+			}
+		}
+		for l := range leaders {
+			if len(leaders) == 1 && l != "" && l != exclude {
+				return l
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Group did not agree on a leader")
+	return ""
+}
+
+func TestElection(t *testing.T) {
+	scenarios := []struct {
+		members []string
+	}{
+		{members: []string{"n1"}},
+		{members: []string{"n1", "n2", "n3"}},
+		{members: []string{"n1", "n2", "n3", "n4", "n5"}},
+	}
+
+	for _, s := range scenarios {
+		g := newTestGroup(t, s.members...)
+		l := g.waitLeader(t, "")
+
+		leaders := 0
+		for _, r := range g.members {
+			r.m.Lock()
+			if r.role == leader {
+				leaders++
+			}
+			r.m.Unlock()
+		}
+		if leaders != 1 {
+			t.Errorf("%d members: expected 1 leader, got %d", len(s.members), leaders)
+		}
+
+		if err := g.members[l].Read(time.Now().Add(time.Second)); err != nil {
+			t.Errorf("%d members: leader read failed: %v", len(s.members), err)
+		}
+	}
+}
+
+func TestPropose(t *testing.T) {
+	g := newTestGroup(t, "n1", "n2", "n3")
+	l := g.waitLeader(t, "")
+
+	for _, command := range []string{"a", "b", "c"} {
+		result, err := g.members[l].Propose([]byte(command), time.Now().Add(time.Second))
+		if err != nil {
+			t.Fatalf("Propose failed: %v", err)
+		}
+		if string(result) != strings.ToUpper(command) {
+			t.Errorf("Expected result %q, got %q", strings.ToUpper(command), result)
+		}
+	}
+
+	// followers apply the same commands in the same order and refuse proposals
+	for id, r := range g.members {
+		if id == l {
+			continue
+		}
+
+		var notLeader *NotLeaderError
+		if _, err := r.Propose([]byte("d"), time.Now().Add(time.Second)); !errors.As(err, &notLeader) || notLeader.Leader != l {
+			t.Errorf("Expected %v to redirect to %v, got %v", id, l, err)
+		}
+		if err := r.Read(time.Now().Add(time.Second)); !errors.Is(err, ErrNotLeader) {
+			t.Errorf("Expected %v to refuse reads, got %v", id, err)
+		}
+	}
+
+	expect := []string{"a", "b", "c"}
+	deadline := time.Now().Add(time.Second)
+	for id := range g.members {
+		for !reflect.DeepEqual(g.appliedBy(id), expect) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := g.appliedBy(id); !reflect.DeepEqual(got, expect) {
+			t.Errorf("Member %v applied %v, expected %v", id, got, expect)
+		}
+	}
+}
+
+func TestLeaderFailover(t *testing.T) {
+	g := newTestGroup(t, "n1", "n2", "n3")
+	old := g.waitLeader(t, "")
+
+	if _, err := g.members[old].Propose([]byte("a"), time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("Propose failed: %v", err)
+	}
+
+	// the leader is cut off, it can neither commit nor serve reads once its lease ends
+	g.setCut(old, true)
+	if _, err := g.members[old].Propose([]byte("lost"), time.Now().Add(300*time.Millisecond)); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected the cut off leader to time out, got %v", err)
+	}
+	if err := g.members[old].Read(time.Now().Add(100 * time.Millisecond)); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected the cut off leader to refuse reads, got %v", err)
+	}
+
+	// the rest of the group elects a new leader that keeps the committed entry
+	l := g.waitLeader(t, old)
+	if _, err := g.members[l].Propose([]byte("b"), time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("Propose on the new leader failed: %v", err)
+	}
+
+	// the old leader steps down and drops the entry it could not commit
+	g.setCut(old, false)
+	expect := []string{"a", "b"}
+	deadline := time.Now().Add(2 * time.Second)
+	for !reflect.DeepEqual(g.appliedBy(old), expect) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := g.appliedBy(old); !reflect.DeepEqual(got, expect) {
+		t.Errorf("Old leader applied %v, expected %v", got, expect)
+	}
+	if got := g.members[old].Leader(); got != l {
+		t.Errorf("Old leader follows %q, expected %q", got, l)
+	}
+}
+
+func TestProposeReplaced(t *testing.T) {
+	unreachable := func(peer, action string, payload []byte, deadline time.Time) ([]byte, error) {
+		return nil, errors.New("unreachable")
+	}
+	r := New("n1", []string{"n1", "n2", "n3"}, unreachable, func(command []byte) []byte { return command }, stats.New())
+
+	r.m.Lock()
+	r.term = 1
+	r.becomeLeader()
+	r.m.Unlock()
+
+	errs := make(chan error)
+	go func() {
+		_, err := r.Propose([]byte("a"), time.Now().Add(time.Second))
+		errs <- err
+	}()
+
+	for appended := false; !appended; time.Sleep(time.Millisecond) {
+		r.m.Lock()
+		appended = len(r.log) == 3
+		r.m.Unlock()
+	}
+
+	// a new leader replaces the entry with its own and commits it
+	payload, _ := json.Marshal(appendRequest{Term: 2, Leader: "n2", PrevIndex: 1, PrevTerm: 1, Entries: []Entry{{Term: 2}}, Commit: 2})
+	if _, err := r.HandleAppend(payload); err != nil {
+		t.Fatalf("HandleAppend failed: %v", err)
+	}
+
+	var notLeader *NotLeaderError
+	if err := <-errs; !errors.As(err, &notLeader) || notLeader.Leader != "n2" {
+		t.Errorf("Expected the replaced proposal to redirect to n2, got %v", err)
+	}
+}
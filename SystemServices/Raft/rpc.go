@@ -0,0 +1,282 @@
+package raft
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// voteRequest -> a candidate asking for the vote of a member
+type voteRequest struct {
+	Term      int
+	Candidate string
+	LastIndex int
+	LastTerm  int
+}
+
+type voteReply struct {
+	Term    int
+	Granted bool
+}
+
+// appendRequest -> the leader replicating entries following PrevIndex, an append
+// without entries is a heartbeat
+type appendRequest struct {
+	Term      int
+	Leader    string
+	PrevIndex int
+	PrevTerm  int
+	Entries   []Entry
+	Commit    int
+}
+
+// appendReply -> whether the member's log matched at PrevIndex. When it did not,
+// Conflict is the entry the leader should retry from.
+type appendReply struct {
+	Term     int
+	Success  bool
+	Conflict int
+}
+
+// startElection -> become a candidate for the next term and ask every member for
+// its vote, the caller must hold the lock
+func (r *Raft) startElection() {
+	r.role = candidate
+	r.term++
+	r.votedFor = r.id
+	r.votes = 1
+	r.leader = ""
+	r.resetDeadline()
+	r.stats.Inc("raft_elections")
+	r.stats.Set("raft_term", int64(r.term))
+
+	if r.votes >= r.quorum() {
+		r.becomeLeader()
+		return
+	}
+
+	last := len(r.log) - 1
+	req := voteRequest{Term: r.term, Candidate: r.id, LastIndex: last, LastTerm: r.log[last].Term}
+	for _, peer := range r.peers {
+		go r.requestVote(peer, req)
+	}
+}
+
+// requestVote -> ask a member for its vote, winning the election once a majority
+// of the group has voted for us
+func (r *Raft) requestVote(peer string, req voteRequest) {
+	payload, _ := json.Marshal(req)
+	out, err := r.call(peer, ActionVote, payload, time.Now().Add(r.electionTimeout))
+	if err != nil {
+		return
+	}
+
+	var reply voteReply
+	if err := json.Unmarshal(out, &reply); err != nil {
+		return
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if reply.Term > r.term {
+		r.becomeFollower(reply.Term, "")
+		return
+	}
+
+	if r.role == candidate && r.term == req.Term && reply.Granted {
+		r.votes++
+		if r.votes >= r.quorum() {
+			r.becomeLeader()
+		}
+	}
+}
+
+// HandleVote -> answer a candidate asking for our vote. The vote is granted once per
+// term to a candidate whose log is at least as up to date as ours.
+func (r *Raft) HandleVote(payload []byte) ([]byte, error) {
+	var req voteRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	reply := voteReply{Term: r.term}
+
+	// a member still hearing from its leader keeps following it, which is what
+	// makes the leader lease safe
+	now := time.Now()
+	following := r.role == follower && r.leader != "" && now.Sub(r.heard) < r.electionTimeout
+	leading := r.role == leader && r.leaseValid(now)
+	if req.Term < r.term || following || leading {
+		return json.Marshal(reply)
+	}
+
+	if req.Term > r.term {
+		r.becomeFollower(req.Term, "")
+		reply.Term = r.term
+	}
+
+	last := len(r.log) - 1
+	upToDate := req.LastTerm > r.log[last].Term || (req.LastTerm == r.log[last].Term && req.LastIndex >= last)
+
+	if (r.votedFor == "" || r.votedFor == req.Candidate) && upToDate {
+		r.votedFor = req.Candidate
+		r.heard = now
+		r.resetDeadline()
+		reply.Granted = true
+	}
+
+	return json.Marshal(reply)
+}
+
+// broadcast -> as the leader, send every member the entries it is missing or a
+// heartbeat when it has them all
+func (r *Raft) broadcast() {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.role != leader {
+		return
+	}
+
+	for _, peer := range r.peers {
+		if !r.inflight[peer] {
+			r.inflight[peer] = true
+			go r.replicate(peer)
+		}
+	}
+}
+
+// replicate -> send a member the entries following the last one it is known to hold
+func (r *Raft) replicate(peer string) {
+	r.m.Lock()
+	if r.role != leader {
+		r.inflight[peer] = false
+		r.m.Unlock()
+		return
+	}
+
+	prev := r.next[peer] - 1
+	end := len(r.log)
+	if end-prev-1 > maxBatch {
+		end = prev + 1 + maxBatch
+	}
+
+	req := appendRequest{
+		Term:      r.term,
+		Leader:    r.id,
+		PrevIndex: prev,
+		PrevTerm:  r.log[prev].Term,
+		Entries:   append([]Entry(nil), r.log[prev+1:end]...),
+		Commit:    r.commit,
+	}
+	r.m.Unlock()
+
+	sent := time.Now()
+	payload, _ := json.Marshal(req)
+	out, err := r.call(peer, ActionAppend, payload, sent.Add(r.electionTimeout))
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.inflight[peer] = false
+
+	var reply appendReply
+	if err != nil || json.Unmarshal(out, &reply) != nil {
+		return
+	}
+
+	if reply.Term > r.term {
+		r.becomeFollower(reply.Term, "")
+		return
+	}
+	if r.role != leader || r.term != req.Term {
+		return
+	}
+
+	// any answer in our term confirms our leadership for the lease
+	if sent.After(r.acked[peer]) {
+		r.acked[peer] = sent
+	}
+
+	if reply.Success {
+		if match := prev + len(req.Entries); match > r.match[peer] {
+			r.match[peer] = match
+		}
+		r.next[peer] = r.match[peer] + 1
+		r.advanceCommit()
+	} else if reply.Conflict < r.next[peer] {
+		r.next[peer] = reply.Conflict
+		if r.next[peer] < 1 {
+			r.next[peer] = 1
+		}
+	}
+	r.advanced()
+
+	// keep going while the member is behind
+	if r.next[peer] < len(r.log) {
+		r.wake()
+	}
+}
+
+// HandleAppend -> store the entries sent by the leader, replacing any of ours that
+// conflict with them, and apply those it has committed
+func (r *Raft) HandleAppend(payload []byte) ([]byte, error) {
+	var req appendRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	reply := appendReply{Term: r.term}
+	if req.Term < r.term {
+		return json.Marshal(reply)
+	}
+
+	if r.role != follower || r.leader != req.Leader || req.Term > r.term {
+		r.becomeFollower(req.Term, req.Leader)
+	} else {
+		r.resetDeadline()
+	}
+	r.heard = time.Now()
+	reply.Term = r.term
+
+	// our log must hold the entry preceding those sent
+	if req.PrevIndex >= len(r.log) {
+		reply.Conflict = len(r.log)
+		return json.Marshal(reply)
+	}
+	if term := r.log[req.PrevIndex].Term; term != req.PrevTerm {
+		conflict := req.PrevIndex
+		for conflict > r.commit+1 && r.log[conflict-1].Term == term {
+			conflict--
+		}
+		reply.Conflict = conflict
+		return json.Marshal(reply)
+	}
+
+	for i, entry := range req.Entries {
+		index := req.PrevIndex + 1 + i
+		if index < len(r.log) {
+			if r.log[index].Term == entry.Term {
+				continue
+			}
+			r.log = r.log[:index]
+		}
+		r.log = append(r.log, entry)
+	}
+
+	if last := req.PrevIndex + len(req.Entries); req.Commit > r.commit && last > r.commit {
+		r.commit = req.Commit
+		if r.commit > last {
+			r.commit = last
+		}
+		r.applyCommitted()
+	}
+
+	reply.Success = true
+	return json.Marshal(reply)
+}
@@ -0,0 +1,105 @@
+package stats
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Counters -> named counters shared between the subsystems of a node. A nil
+// Counters is valid and discards every update.
+type Counters struct {
+	m      *sync.RWMutex
+	counts map[string]*int64
+}
+
+// New -> construct an empty set of counters
+func New() *Counters {
+	return &Counters{
+		m:      &sync.RWMutex{},
+		counts: make(map[string]*int64),
+	}
+}
+
+// counter -> return the counter with this name, creating it if needed
+func (c *Counters) counter(name string) *int64 {
+	c.m.RLock()
+	count, ok := c.counts[name]
+	c.m.RUnlock()
+
+	if ok {
+		return count
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if count, ok = c.counts[name]; !ok {
+		count = new(int64)
+		c.counts[name] = count
+	}
+	return count
+}
+
+// Add -> add delta to the named counter
+func (c *Counters) Add(name string, delta int64) {
+	if c == nil {
+		return
+	}
+	atomic.AddInt64(c.counter(name), delta)
+}
+
+// Inc -> add one to the named counter
+func (c *Counters) Inc(name string) {
+	c.Add(name, 1)
+}
+
+// Set -> overwrite the named counter, used for gauges such as queue lengths
+func (c *Counters) Set(name string, value int64) {
+	if c == nil {
+		return
+	}
+	atomic.StoreInt64(c.counter(name), value)
+}
+
+// Get -> current value of the named counter
+func (c *Counters) Get(name string) int64 {
+	if c == nil {
+		return 0
+	}
+
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	count, ok := c.counts[name]
+	if !ok {
+		return 0
+	}
+	return atomic.LoadInt64(count)
+}
+
+// Snapshot -> copy of every counter
+func (c *Counters) Snapshot() map[string]int64 {
+	snap := make(map[string]int64)
+	if c == nil {
+		return snap
+	}
+
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	for name, count := range c.counts {
+		snap[name] = atomic.LoadInt64(count)
+	}
+	return snap
+}
+
+// Names -> sorted names of every counter
+func (c *Counters) Names() []string {
+	var names []string
+	for name := range c.Snapshot() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
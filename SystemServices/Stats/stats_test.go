@@ -0,0 +1,55 @@
+package stats
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestCounters(t *testing.T) {
+	c := New()
+	wg := &sync.WaitGroup{}
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.Inc("messages")
+			}
+		}()
+	}
+	wg.Wait()
+
+	c.Add("bytes", 42)
+	c.Set("queue", 3)
+	c.Set("queue", 2)
+
+	scenarios := []struct {
+		name   string
+		expect int64
+	}{
+		{name: "messages", expect: 1000},
+		{name: "bytes", expect: 42},
+		{name: "queue", expect: 2},
+		{name: "missing", expect: 0},
+	}
+
+	for _, s := range scenarios {
+		if got := c.Get(s.name); got != s.expect {
+			t.Errorf("Counter %v: expected %d, got %d", s.name, s.expect, got)
+		}
+	}
+
+	if names := c.Names(); len(names) != 3 || names[0] != "bytes" {
+		t.Errorf("Unexpected counter names %v", names)
+	}
+}
+
+func TestNilCounters(t *testing.T) {
+	var c *Counters
+	c.Inc("messages")
+
+	if c.Get("messages") != 0 || len(c.Snapshot()) != 0 {
+		t.Errorf("A nil set of counters should discard updates")
+	}
+}
@@ -0,0 +1,223 @@
+package protocols
+
+import (
+	msg "kv-store/Messages"
+	stats "kv-store/SystemServices/Stats"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default bounds on the writes kept for replicas that could not be reached
+const (
+	DefaultHintLimit  = 1000
+	DefaultHintMaxAge = 10 * time.Minute
+)
+
+// hint -> a write that failed to reach a replica
+type hint struct {
+	key     string
+	payload []byte
+	stamp   string
+	deps    map[string]int
+	stored  time.Time
+}
+
+// hintStore -> writes waiting to be handed off to each replica, oldest first. Only
+// the latest write to a key is kept, a replica holds at most limit hints and hints
+// older than maxAge are dropped.
+type hintStore struct {
+	m       *sync.Mutex
+	pending map[string][]hint
+	limit   int
+	maxAge  time.Duration
+	now     func() time.Time
+	stats   *stats.Counters
+}
+
+func newHintStore(limit int, maxAge time.Duration, s *stats.Counters) *hintStore {
+	return &hintStore{
+		m:       &sync.Mutex{},
+		pending: make(map[string][]hint),
+		limit:   limit,
+		maxAge:  maxAge,
+		now:     time.Now,
+		stats:   s,
+	}
+}
+
+// add -> keep a write for the replica, replacing an older write to the same key
+func (h *hintStore) add(replica string, payload []byte, stamp string, deps map[string]int) {
+	key := strings.SplitN(string(payload), ":", 2)[0]
+
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	hints := without(h.pending[replica], key)
+	if len(hints) >= h.limit {
+		hints = hints[len(hints)-h.limit+1:]
+		h.stats.Inc("hints_dropped_full")
+	}
+
+	h.pending[replica] = append(hints, hint{key: key, payload: payload, stamp: stamp, deps: deps, stored: h.now()})
+	h.stats.Inc("hints_stored")
+	h.stats.Set("hints_pending", h.count())
+}
+
+// delivered -> the replica received a newer write to the key, drop its hint
+func (h *hintStore) delivered(replica string, payload []byte) {
+	key := strings.SplitN(string(payload), ":", 2)[0]
+
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if hints, ok := h.pending[replica]; ok {
+		h.pending[replica] = without(hints, key)
+		if len(h.pending[replica]) == 0 {
+			delete(h.pending, replica)
+		}
+		h.stats.Set("hints_pending", h.count())
+	}
+}
+
+// take -> remove and return the hints for the replica that have not expired
+func (h *hintStore) take(replica string) []hint {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	var live []hint
+	for _, hint := range h.pending[replica] {
+		if h.now().Sub(hint.stored) > h.maxAge {
+			h.stats.Inc("hints_expired")
+			continue
+		}
+		live = append(live, hint)
+	}
+
+	delete(h.pending, replica)
+	h.stats.Set("hints_pending", h.count())
+	return live
+}
+
+// restore -> put back hints that could not be replayed, ahead of any newer
+// hints stored in the meantime
+func (h *hintStore) restore(replica string, hints []hint) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	newer := h.pending[replica]
+	for _, n := range newer {
+		hints = without(hints, n.key)
+	}
+
+	hints = append(hints, newer...)
+	if len(hints) > h.limit {
+		h.stats.Add("hints_dropped_full", int64(len(hints)-h.limit))
+		hints = hints[len(hints)-h.limit:]
+	}
+
+	if len(hints) == 0 {
+		delete(h.pending, replica)
+	} else {
+		h.pending[replica] = hints
+	}
+	h.stats.Set("hints_pending", h.count())
+}
+
+// replicas -> the replicas with hints waiting for them
+func (h *hintStore) replicas() []string {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	replicas := make([]string, 0, len(h.pending))
+	for replica := range h.pending {
+		replicas = append(replicas, replica)
+	}
+	return replicas
+}
+
+// count -> total hints held, the caller must hold the lock
+func (h *hintStore) count() int64 {
+	total := 0
+	for _, hints := range h.pending {
+		total += len(hints)
+	}
+	return int64(total)
+}
+
+// without -> the hints not writing to key
+func without(hints []hint, key string) []hint {
+	kept := make([]hint, 0, len(hints))
+	for _, hint := range hints {
+		if hint.key != key {
+			kept = append(kept, hint)
+		}
+	}
+	return kept
+}
+
+// UseHints -> keep writes that could not reach a replica and hand them off once it
+// is reachable again. A replica holds at most limit hints for no longer than maxAge,
+// a limit below one disables hinted handoff.
+func (oracle *Orchestrator) UseHints(limit int, maxAge time.Duration, s *stats.Counters) {
+	if limit < 1 {
+		oracle.hints = nil
+		return
+	}
+	oracle.hints = newHintStore(limit, maxAge, s)
+}
+
+// hint -> keep a write the replica did not receive
+func (oracle *Orchestrator) hint(replica string, Msg msg.Msg) {
+	if oracle.hints == nil || Msg.Action != "put" {
+		return
+	}
+
+	logger.Write("storing hint for " + replica)
+	oracle.hints.add(replica, Msg.Payload, Msg.Stamp, Msg.Deps)
+}
+
+// handedOff -> the replica answered, replay any writes it missed. A hint for the
+// key just written is older than that write and is dropped instead.
+func (oracle *Orchestrator) handedOff(replica string, Msg msg.Msg) {
+	if oracle.hints == nil {
+		return
+	}
+
+	if Msg.Action == "put" {
+		oracle.hints.delivered(replica, Msg.Payload)
+	}
+	oracle.ReplayHints(replica)
+}
+
+// ReplayHints -> hand the writes held for a replica off to it as repairs, which it
+// drops when it holds a newer value. Replay stops at the first write the replica
+// does not acknowledge, the rest are kept for a later try.
+func (oracle *Orchestrator) ReplayHints(replica string) {
+	if oracle.hints == nil {
+		return
+	}
+
+	hints := oracle.hints.take(replica)
+	for i, hint := range hints {
+		put := msg.Msg{Action: ActionRepair, Payload: hint.payload, Stamp: hint.stamp, Deps: hint.deps}
+		if _, err := oracle.CallMsg(replica, put, oracle.RPCDeadline()); err != nil {
+			logger.Write("hint replay to " + replica + " failed: " + err.Error())
+			oracle.hints.restore(replica, hints[i:])
+			return
+		}
+		oracle.hints.stats.Inc("hints_replayed")
+	}
+}
+
+// ReplayAllHints -> probe every replica with hints waiting for it, replaying them
+// to the replicas that answer
+func (oracle *Orchestrator) ReplayAllHints() {
+	if oracle.hints == nil {
+		return
+	}
+
+	for _, replica := range oracle.hints.replicas() {
+		oracle.ReplayHints(replica)
+	}
+}
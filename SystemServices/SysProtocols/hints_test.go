@@ -0,0 +1,81 @@
+package protocols
+
+import (
+	stats "kv-store/SystemServices/Stats"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHintStore(t *testing.T) {
+	now := time.Now()
+	h := newHintStore(2, time.Minute, stats.New())
+	h.now = func() time.Time { return now }
+
+	scenarios := []struct {
+		add     []string
+		advance time.Duration
+		expect  []string
+	}{
+		// only the latest write to a key is kept
+		{add: []string{"key0:a", "key1:b", "key0:c"}, expect: []string{"key1:b", "key0:c"}},
+		// the oldest hint is dropped once the replica holds the limit
+		{add: []string{"key0:a", "key1:b", "key2:c"}, expect: []string{"key1:b", "key2:c"}},
+		// hints older than the max age are never replayed
+		{add: []string{"key0:a"}, advance: 2 * time.Minute, expect: nil},
+	}
+
+	for i, s := range scenarios {
+		for _, payload := range s.add {
+			h.add("127.0.0.1:13802", []byte(payload), "", nil)
+		}
+		now = now.Add(s.advance)
+
+		var got []string
+		for _, hint := range h.take("127.0.0.1:13802") {
+			got = append(got, string(hint.payload))
+		}
+		if !reflect.DeepEqual(got, s.expect) {
+			t.Errorf("Scenario %d: expected hints %v, got %v", i, s.expect, got)
+		}
+		if len(h.replicas()) != 0 {
+			t.Errorf("Scenario %d: hints were not removed once taken", i)
+		}
+	}
+
+	if got := h.stats.Get("hints_dropped_full"); got != 1 {
+		t.Errorf("Expected 1 hint dropped in stats, got %d", got)
+	}
+	if got := h.stats.Get("hints_expired"); got != 1 {
+		t.Errorf("Expected 1 hint expired in stats, got %d", got)
+	}
+}
+
+func TestHintRestore(t *testing.T) {
+	h := newHintStore(3, time.Minute, stats.New())
+
+	h.add("127.0.0.1:13802", []byte("key0:a"), "", nil)
+	h.add("127.0.0.1:13802", []byte("key1:b"), "", nil)
+	failed := h.take("127.0.0.1:13802")
+
+	// writes stored while the replay was running are newer than the failed hints
+	h.add("127.0.0.1:13802", []byte("key1:c"), "", nil)
+	h.add("127.0.0.1:13802", []byte("key2:d"), "", nil)
+	h.restore("127.0.0.1:13802", failed)
+
+	var got []string
+	for _, hint := range h.take("127.0.0.1:13802") {
+		got = append(got, string(hint.payload))
+	}
+
+	expect := []string{"key0:a", "key1:c", "key2:d"}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("Expected hints %v, got %v", expect, got)
+	}
+
+	h.add("127.0.0.1:13802", []byte("key0:a"), "", nil)
+	h.delivered("127.0.0.1:13802", []byte("key0:e"))
+	if len(h.replicas()) != 0 {
+		t.Errorf("Hint was kept after a newer write was delivered")
+	}
+}
@@ -7,9 +7,12 @@ import (
 	log "kv-store/Logging"
 	msg "kv-store/Messages"
 	consensusEng "kv-store/SystemServices/Consensus"
+	netutil "kv-store/SystemServices/Network"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -18,8 +21,14 @@ const (
 	largeMod  = 7451
 )
 
+// ActionRepair -> a copy of an earlier write sent to a replica that missed it. It is
+// only applied over a value set by an older write, whatever the conflict policy.
+const ActionRepair = "repair"
+
 var logger log.AsyncLog
 
+var startLogger sync.Once // every orchestrator and protocol in the process shares the logger
+
 // Orchestrator -> used to partition shards and assign nodes to shards
 type Orchestrator struct {
 	view               []string
@@ -31,6 +40,7 @@ type Orchestrator struct {
 	vShards            []int       // map of virtual nodes to physical nodes
 	virtualTranslation map[int]int // translation of virtual shards to physical
 	ringEdge           int
+	hints              *hintStore // writes waiting for unreachable replicas
 	consensusEng.ConEngine
 }
 
@@ -42,8 +52,10 @@ func (oracle *Orchestrator) NewOrchestrator(addr string, view []string, replFact
 	oracle.replFactor = replFactor
 	oracle.numShards = int(len(oracle.view) / oracle.replFactor)
 
-	logger = *log.New(nil) // create logger
-	go logger.Start()
+	startLogger.Do(func() {
+		logger = *log.New(nil) // create logger
+		go logger.Start()
+	})
 
 	// pick a prime number to mod our hash by
 	// this defines our ring edge where values circle back to 0
@@ -159,14 +171,15 @@ func (oracle *Orchestrator) NumReplicas() (int, error) {
 }
 
 // GetShardID -> determine which place this node is in the ring when
-// considering nodes only.
+// considering nodes only. Nodes are identified by their canonical host:port address.
 func (oracle *Orchestrator) GetShardID(node string) int {
-	var currAddr string
+	if addr, err := netutil.NormalizeAddr(node); err == nil {
+		node = addr
+	}
+
 	for shardID, shardGroup := range oracle.ShardGroups {
 		for _, currNode := range shardGroup {
-
-			currAddr = strings.Split(currNode, ":")[0]
-			if currAddr == node {
+			if currNode == node {
 				return shardID
 			}
 		}
@@ -179,7 +192,7 @@ func (oracle *Orchestrator) GetShardID(node string) int {
 func (oracle *Orchestrator) PeerReplicas(node string) ([]string, error) {
 	shard := oracle.GetShardID(node)
 
-	if shard >= len(oracle.ShardGroups) {
+	if shard < 0 || shard >= len(oracle.ShardGroups) {
 		return nil, errors.New("shard_id not in range of shard groupds")
 	}
 	return oracle.ShardGroups[shard], nil
@@ -211,13 +224,29 @@ func (oracle *Orchestrator) GetMatch(key string) int {
 	return shard
 }
 
-// KeyOp -> general key operationfunction, find the correct shard then apply given action
-func (oracle *Orchestrator) KeyOp(Msg msg.Msg) bool {
+// KeyOp -> general key operationfunction, find the correct shard then apply given action.
+// Operations carrying an event stream ID have each replica answer delivered to that
+// stream, which completes once the consistency level of the request is met. The
+// replicas have until the deadline of the request to answer.
+func (oracle *Orchestrator) KeyOp(Msg msg.Msg, deadline time.Time) bool {
+	_, local := oracle.Route(Msg, deadline)
+	return local
+}
+
+// Route -> as KeyOp, also returning the message sent to the replicas
+func (oracle *Orchestrator) Route(Msg msg.Msg, deadline time.Time) (msg.Msg, bool) {
 	// find which shard this token belongs to
 	token := strings.Split(Msg.PayloadToStr(), ":")[0]
 	shard := oracle.GetMatch(token)
 	local := false
 
+	// a write is an event of the coordinating node, every replica receives the
+	// clock that includes it along with the writes to the shard it depends on
+	if Msg.Action == "put" {
+		oracle.Increment(oracle.hostAddr)
+		Msg.Deps = oracle.Written(shard)
+	}
+
 	// send each shard node the key update
 	for _, node := range oracle.ShardGroups[shard] {
 
@@ -226,9 +255,34 @@ func (oracle *Orchestrator) KeyOp(Msg msg.Msg) bool {
 			local = true
 		} else {
 			logger.Write("Sending key op to node " + node + " with ID " + Msg.ID)
-			go oracle.Send(node, Msg) // send key-val pair to correct replicas
+			go oracle.forward(node, Msg, deadline) // send key-val pair to correct replicas
 		}
 	}
 	// return whether we need to store this key on this node
-	return local
+	return Msg, local
+}
+
+// forward -> call a replica with the key operation. If the operation belongs to an
+// event stream the reply is delivered to that stream. Writes the replica could not
+// be reached for are kept as hints, which are replayed once it answers again.
+func (oracle *Orchestrator) forward(node string, Msg msg.Msg, deadline time.Time) {
+	reply, err := oracle.CallMsg(node, Msg, deadline)
+	if err != nil {
+		logger.Write("key op " + Msg.Action + " to " + node + " failed: " + err.Error())
+
+		// a replica that answered with an error has rejected the write
+		if reply.Error == "" {
+			oracle.hint(node, Msg)
+		}
+		return
+	}
+
+	if Msg.ID != "" {
+		reply.ID = Msg.ID
+		if err = oracle.Deliver(reply); err != nil {
+			logger.Write(err.Error())
+		}
+	}
+
+	oracle.handedOff(node, Msg)
 }
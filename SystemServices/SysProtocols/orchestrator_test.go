@@ -1,6 +1,12 @@
 package protocols
 
-import "testing"
+import (
+	msg "kv-store/Messages"
+	consensusEng "kv-store/SystemServices/Consensus"
+	netutil "kv-store/SystemServices/Network"
+	"testing"
+	"time"
+)
 
 func TestNewOrchestrator(t *testing.T) {
 	scenarios := []struct {
@@ -48,6 +54,52 @@ func TestGetShardID(t *testing.T) {
 	}
 }
 
+func TestGetShardIDSameHost(t *testing.T) {
+	view := []string{"127.0.0.1:13801", "127.0.0.1:13802", "127.0.0.1:13803", "127.0.0.1:13804"}
+
+	oracle := new(Orchestrator)
+	oracle.NewOrchestrator(view[0], view, 1)
+
+	seen := make(map[int]string)
+	for _, node := range view {
+		shard := oracle.GetShardID(node)
+		if shard < 0 {
+			t.Errorf("Node %v not found in any shard", node)
+		}
+		if other, ok := seen[shard]; ok {
+			t.Errorf("Nodes %v and %v on the same host share shard %d", node, other, shard)
+		}
+		seen[shard] = node
+	}
+
+	if _, err := oracle.PeerReplicas("127.0.0.1:13809"); err == nil {
+		t.Errorf("Expected an error for a node outside the view")
+	}
+}
+
+func TestGetShardIDAddressForms(t *testing.T) {
+	view := []string{"node1:13800", "node2:13800", "[fd00::3]:13800", "[fd00::4]:13800"}
+
+	oracle := new(Orchestrator)
+	oracle.NewOrchestrator(view[0], view, 2)
+
+	scenarios := []struct {
+		addr   string
+		member string
+	}{
+		{addr: "NODE1:13800", member: "node1:13800"},
+		{addr: "[FD00::3]:13800", member: "[fd00::3]:13800"},
+		{addr: "[fd00:0:0:0:0:0:0:4]:13800", member: "[fd00::4]:13800"},
+	}
+
+	for _, s := range scenarios {
+		shard := oracle.GetShardID(s.addr)
+		if shard < 0 || shard != oracle.GetShardID(s.member) {
+			t.Errorf("Expected %v to be found in the shard of %v, got %d", s.addr, s.member, shard)
+		}
+	}
+}
+
 func TestDistributeNodes(t *testing.T) {
 
 }
@@ -67,3 +119,89 @@ func TestGetNodeRingIndex(t *testing.T) {
 func TestUpdateView(t *testing.T) {
 
 }
+
+func TestKeyOp(t *testing.T) {
+	view := []string{"10.0.0.1:13800", "10.0.0.2:13800", "10.0.0.3:13800", "10.0.0.4:13800"}
+	keys := []string{"key0", "key1", "key2", "key3", "key4"}
+
+	mem := netutil.NewMemNetwork()
+	transports := make(map[string]netutil.Transport)
+	for _, node := range view {
+		transports[node] = mem.Join(node, 16)
+	}
+
+	oracle := new(Orchestrator)
+	oracle.NewOrchestrator(view[0], view, 2)
+
+	con := new(consensusEng.ConEngine)
+	con.NewConEngine(view[0], 2, view, transports[view[0]])
+	oracle.AddConsensusEngine(*con)
+
+	for _, key := range keys {
+		shard := oracle.ShardGroups[oracle.GetMatch(key)]
+		local := oracle.KeyOp(msg.Msg{SrcAddr: view[0], Payload: []byte(key + ":val"), Action: "put"}, con.RPCDeadline())
+
+		for _, node := range shard {
+			if node == view[0] {
+				if !local {
+					t.Errorf("Key '%v' belongs to this node but KeyOp did not report it as local", key)
+				}
+				continue
+			}
+
+			got := make(chan msg.Msg)
+			go func(tr netutil.Transport) {
+				m, _, _ := tr.Recv()
+				got <- m
+			}(transports[node])
+
+			select {
+			case m := <-got:
+				if m.PayloadToStr() != key+":val" {
+					t.Errorf("Replica %v received wrong payload. Expected %q, got %q", node, key+":val", m.PayloadToStr())
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Replica %v never received key op for '%v'", node, key)
+			}
+		}
+	}
+}
+
+func TestKeyOpDeadline(t *testing.T) {
+	view := []string{"10.0.0.1:13800", "10.0.0.2:13800"}
+	mem := netutil.NewMemNetwork()
+
+	oracle := new(Orchestrator)
+	oracle.NewOrchestrator(view[0], view, 2)
+	con := new(consensusEng.ConEngine)
+	con.NewConEngine(view[0], 2, view, mem.Join(view[0], 16))
+	oracle.AddConsensusEngine(*con)
+	oracle.UseRPCTimeout(50 * time.Millisecond)
+
+	// the replica answers after the rpc timeout, well within the deadline of the read
+	replica := new(consensusEng.ConEngine)
+	replica.NewConEngine(view[1], 2, view, mem.Join(view[1], 16))
+	go func() {
+		request, _, err := replica.Recv()
+		if err != nil {
+			return
+		}
+		time.Sleep(150 * time.Millisecond)
+		replica.Reply(request, []byte("value0"), nil)
+	}()
+	go func() {
+		reply, _, err := oracle.Recv()
+		if err == nil {
+			oracle.Resolve(reply)
+		}
+	}()
+
+	stream := oracle.NewEventStreamFor(1)
+	deadline := time.Now().Add(time.Second)
+	oracle.KeyOp(msg.Msg{SrcAddr: view[0], Payload: []byte("key0"), ID: stream, Action: "get"}, deadline)
+
+	answers, err := oracle.Collect(stream, deadline)
+	if err != nil || len(answers) != 1 || answers[0].PayloadToStr() != "value0" {
+		t.Errorf("Expected the late answer to reach the read, got %v (%v)", answers, err)
+	}
+}
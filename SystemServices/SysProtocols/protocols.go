@@ -1,15 +1,12 @@
 package protocols
 
 import (
-	"bytes"
 	"fmt"
 	db "kv-store/Database"
 	log "kv-store/Logging"
 	msg "kv-store/Messages"
 	consensus "kv-store/SystemServices/Consensus"
 	"math/rand"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 )
@@ -35,8 +32,10 @@ func (proto *Protocol) NewProtocol(nodeAddr string, shardReplicas []string, DB d
 	proto.shardReplicas = shardReplicas
 	proto.DB = DB
 
-	logger = *log.New(nil) // create logger
-	go logger.Start()
+	startLogger.Do(func() {
+		logger = *log.New(nil) // create logger
+		go logger.Start()
+	})
 }
 
 // Broadcast -> Send message to each node in parrallel
@@ -47,7 +46,7 @@ func (proto *Protocol) Broadcast(view []string, con consensus.ConEngine) {
 	for _, node := range view {
 		thisMsg := msg.Msg{
 			SrcAddr: proto.addr,
-			Payload: strings.NewReader(proto.msg),
+			Payload: []byte(proto.msg),
 			ID:      "",
 			Action:  proto.action,
 		}
@@ -79,9 +78,8 @@ func (proto *Protocol) InitGossipProtocol(con consensus.ConEngine) {
 
 		i := rand.Intn(len(proto.shardReplicas))
 		startNode := proto.shardReplicas[i]
-		ip := strings.Split(startNode, ":")[0]
 
-		if ip == proto.addr {
+		if startNode == proto.addr {
 			logger.Write("Gossip round starting")
 
 			go proto.startGossipRound(con)
@@ -96,10 +94,10 @@ func (proto *Protocol) startGossipRound(con consensus.ConEngine) {
 	copy(proto.notSeen, proto.shardReplicas)
 
 	// update which nodes we still need to reach
-	for i, node := range proto.shardReplicas {
-		ip := strings.Split(node, ":")[0]
-		if ip == proto.addr {
+	for i, node := range proto.notSeen {
+		if node == proto.addr {
 			proto.notSeen = proto.deleteIndex(i)
+			break
 		}
 	}
 
@@ -110,58 +108,98 @@ func (proto *Protocol) startGossipRound(con consensus.ConEngine) {
 	proto.doEvery(interval, proto.sendGossip, con)
 }
 
-// SendGossip -> must put a lock on gossiping so only one node at a time can gossip with us
+// SendGossip -> exchange our database with a random shard replica, the replica
+// answers with its own database which we merge into ours
 func (proto *Protocol) sendGossip(con consensus.ConEngine) {
 
 	// choose a shard replica at random
 	peer := proto.chooseNode()
 
-	// get lock then release when function returns
+	// get lock while we read our database
 	gossiping.Lock()
-	defer gossiping.Unlock()
-
 	p, err := proto.ToByteArray()
+	gossiping.Unlock()
 
 	if err != nil {
 		logger.Write(err.Error())
+		return
 	}
 
-	thisMsg := msg.Msg{
-		SrcAddr: proto.addr,
-		Payload: bytes.NewReader(p),
-		ID:      "",
-		Action:  "gossip",
-	}
+	// compare the reply with what we knew when we sent the gossip
+	local := consensus.VectorClock(con.Clock())
 
 	// send message to peer with vc and db id
 	logger.Write("sending gossip to " + peer)
-	con.SendWithoutEvent(peer, thisMsg)
+	reply, err := con.Call(peer, "gossip", p, con.RPCDeadline())
+	if err != nil {
+		logger.Write("gossip with " + peer + " failed: " + err.Error())
+		return
+	}
+
+	proto.mergeGossip(reply, local, con)
+}
+
+// RecvGossip -> merge the database gossiped to us and answer with our own
+func (proto *Protocol) RecvGossip(Msg msg.Msg, con consensus.ConEngine) ([]byte, error) {
+	logger.Write("gossiping with " + Msg.SrcAddr)
+
+	proto.mergeGossip(Msg, consensus.VectorClock(con.Clock()), con)
+
+	gossiping.Lock()
+	defer gossiping.Unlock()
+
+	return proto.ToByteArray()
 }
 
-// RecvGossip -> must put a lock on gossiping so only one node at a time can gossip with us
-func (proto *Protocol) RecvGossip(Msg msg.Msg, con consensus.ConEngine) {
+// mergeGossip -> must put a lock on gossiping so only one node at a time can gossip with us.
+// When the gossip has seen every event we have its values replace ours. Otherwise we
+// can not tell which values are newer: with last writer wins the later timestamp
+// decides, else we only take the keys we are missing.
+func (proto *Protocol) mergeGossip(Msg msg.Msg, local consensus.VectorClock, con consensus.ConEngine) {
 
 	// get lock then release when function returns
 	gossiping.Lock()
 	defer gossiping.Unlock()
 
-	logger.Write("gossiping with " + Msg.SrcAddr)
+	p, err := proto.ByteArrayToEntries(Msg.Payload)
+	if err != nil {
+		logger.Write(err.Error())
+		return
+	}
 
-	// resolve vcs
-	needToUpdate := con.ValidDeliveryLocal(Msg.SrcAddr, Msg.Context)
-	logger.Write("checking if we need to update our database" + strconv.FormatBool(needToUpdate))
-
-	if needToUpdate {
-		// compare and update
-		payload := new(bytes.Buffer)
-		payload.ReadFrom(Msg.Payload)
-		p, err := proto.ByteArrayToMap(payload.Bytes())
-		if err != nil {
-			logger.Write(err.Error())
+	// writes coordinated here from now on are stamped after the gossiped ones, and
+	// values stamped too far ahead of our clock are not taken
+	for key, entry := range p {
+		if entry.Stamp == "" {
+			continue
 		}
+		if err := con.Observe(entry.Stamp); err != nil {
+			logger.Write("dropping gossiped " + key + ": " + err.Error())
+			delete(p, key)
+		}
+	}
 
-		proto.MergeDB(p)
+	// resolve vcs
+	order := consensus.VectorClock(Msg.Context).Compare(local)
+	logger.Write("gossip from " + Msg.SrcAddr + " is " + order.String() + " our clock")
+
+	// once their values replace ours, all but those stamped before ours, we have
+	// applied every write they had seen
+	if order == consensus.After {
+		proto.MergeDB(p, false)
+		con.Merge(Msg.Context)
+		return
 	}
+
+	if !con.LastWriterWins() {
+		for k := range p {
+			if _, err := proto.Get(k); err == nil {
+				delete(p, k)
+			}
+		}
+	}
+
+	proto.MergeDB(p, con.LastWriterWins())
 }
 
 // chooseNode ->
@@ -213,7 +251,7 @@ func (proto *Protocol) ChainMsg(oracle Orchestrator, con consensus.ConEngine) er
 		// send message to this node
 		thisMsg := msg.Msg{
 			SrcAddr: proto.addr,
-			Payload: strings.NewReader(proto.msg),
+			Payload: []byte(proto.msg),
 			ID:      "",
 			Action:  proto.action,
 		}
@@ -234,7 +272,7 @@ func (proto *Protocol) ChainMsg(oracle Orchestrator, con consensus.ConEngine) er
 		fmt.Println("Sending chain message to next node", addr)
 		thisMsg := msg.Msg{
 			SrcAddr: proto.addr,
-			Payload: strings.NewReader(proto.msg),
+			Payload: []byte(proto.msg),
 			ID:      "",
 			Action:  proto.action,
 		}
@@ -0,0 +1,91 @@
+package protocols
+
+import (
+	db "kv-store/Database"
+	msg "kv-store/Messages"
+	consensus "kv-store/SystemServices/Consensus"
+	"testing"
+)
+
+func TestMergeGossip(t *testing.T) {
+	view := []string{"127.0.0.1:13801", "127.0.0.1:13802"}
+	local := consensus.VectorClock{"127.0.0.1:13801": 1, "127.0.0.1:13802": 1}
+	earlier := consensus.Timestamp{Wall: 1, Node: "127.0.0.1:13801"}.String()
+	theirs := consensus.Timestamp{Wall: 1, Logical: 5, Node: "127.0.0.1:13802"}.String()
+	later := consensus.Timestamp{Wall: 2, Node: "127.0.0.1:13801"}.String()
+
+	scenarios := []struct {
+		context map[string]int
+		policy  string
+		ours    string // timestamp of our write to key0
+		expect  map[string]string
+	}{
+		// the gossip has seen everything we have, its values replace ours
+		{
+			context: map[string]int{"127.0.0.1:13801": 1, "127.0.0.1:13802": 2},
+			expect:  map[string]string{"key0": "theirs", "key1": "theirs"},
+		},
+		// concurrent gossip only fills in the keys we are missing
+		{
+			context: map[string]int{"127.0.0.1:13801": 0, "127.0.0.1:13802": 2},
+			expect:  map[string]string{"key0": "ours", "key1": "theirs"},
+		},
+		// as does gossip we are ahead of
+		{
+			context: map[string]int{"127.0.0.1:13801": 0, "127.0.0.1:13802": 1},
+			expect:  map[string]string{"key0": "ours", "key1": "theirs"},
+		},
+		// with last writer wins the later write is kept whatever the clocks say
+		{
+			context: map[string]int{"127.0.0.1:13801": 0, "127.0.0.1:13802": 2},
+			policy:  consensus.PolicyLWW,
+			ours:    earlier,
+			expect:  map[string]string{"key0": "theirs", "key1": "theirs"},
+		},
+		{
+			context: map[string]int{"127.0.0.1:13801": 0, "127.0.0.1:13802": 1},
+			policy:  consensus.PolicyLWW,
+			ours:    later,
+			expect:  map[string]string{"key0": "ours", "key1": "theirs"},
+		},
+		// a gossip that has seen all our events never replaces a later write
+		{
+			context: map[string]int{"127.0.0.1:13801": 1, "127.0.0.1:13802": 2},
+			policy:  consensus.PolicyLWW,
+			ours:    later,
+			expect:  map[string]string{"key0": "ours", "key1": "theirs"},
+		},
+		{
+			context: map[string]int{"127.0.0.1:13801": 1, "127.0.0.1:13802": 2},
+			ours:    later,
+			expect:  map[string]string{"key0": "ours", "key1": "theirs"},
+		},
+	}
+
+	for i, s := range scenarios {
+		var remote, store db.DB
+		remote.NewDB()
+		remote.PutStamped("key0", "theirs", theirs)
+		remote.PutStamped("key1", "theirs", theirs)
+		payload, _ := remote.ToByteArray()
+
+		store.NewDB()
+		store.PutStamped("key0", "ours", s.ours)
+
+		var con consensus.ConEngine
+		con.NewConEngine(view[0], len(view), view, nil)
+		if s.policy != "" {
+			con.UseConflictPolicy(s.policy)
+		}
+
+		var proto Protocol
+		proto.NewProtocol(view[0], view, store)
+		proto.mergeGossip(msg.Msg{SrcAddr: view[1], Payload: payload, Context: s.context}, local, con)
+
+		for key, value := range s.expect {
+			if got, _ := store.Get(key); string(got) != value {
+				t.Errorf("Scenario %d: expected %v to be %q, got %q", i, key, value, got)
+			}
+		}
+	}
+}
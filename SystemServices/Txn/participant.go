@@ -0,0 +1,316 @@
+package txn
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// record -> our part of a transaction: while pending we hold intents on its keys,
+// along with the values written once it commits and the stamp they are written with.
+// A transaction we were asked about before hearing of it is presumed aborted.
+type record struct {
+	outcome      string
+	presumed     bool
+	coordinator  string
+	participants []string
+	stamp        string
+	keys         []string
+	intents      map[string][]byte
+	since        time.Time
+}
+
+type prepareRequest struct {
+	ID           string
+	Coordinator  string
+	Participants []string
+	Stamp        string
+	Ops          []Op
+}
+
+// vote -> a participant's answer to a prepare with the value it read for each key it
+// evaluated, when it votes no the reason and the key at fault
+type vote struct {
+	Yes    bool
+	Reason string
+	Key    string
+	Reads  map[string]read
+}
+
+// read -> the value a participant held for a key when it evaluated the transaction
+type read struct {
+	Value  []byte
+	Exists bool
+}
+
+func (r read) equal(other read) bool {
+	return r.Exists == other.Exists && bytes.Equal(r.Value, other.Value)
+}
+
+type decideRequest struct {
+	ID      string
+	Outcome string
+}
+
+type statusRequest struct {
+	ID string
+}
+
+// statusReply -> the outcome of a transaction, Presumed when we had not heard of it.
+// A coordinator that lost its decisions answers Presumed as well, so its answer does
+// not settle the transaction.
+type statusReply struct {
+	Outcome  string
+	Presumed bool
+}
+
+// Handle -> answer a message sent by a coordinator or another participant
+func (t *Manager) Handle(action string, payload []byte) ([]byte, error) {
+	switch action {
+	case ActionPrepare:
+		return t.HandlePrepare(payload)
+	case ActionDecide:
+		return t.HandleDecide(payload)
+	case ActionStatus:
+		return t.HandleStatus(payload)
+	}
+	return nil, fmt.Errorf("unknown txn action %q", action)
+}
+
+// HandlePrepare -> evaluate our operations against the values we hold and vote. A
+// yes vote holds an intent on every key until the transaction is decided, a key
+// already held by another transaction is a conflict.
+func (t *Manager) HandlePrepare(payload []byte) ([]byte, error) {
+	var req prepareRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	// a transaction we were asked about before its prepare arrived has been aborted
+	if rec, ok := t.records[req.ID]; ok {
+		if rec.outcome == Aborted {
+			return json.Marshal(vote{Reason: ReasonUnavailable})
+		}
+		return json.Marshal(vote{Yes: true})
+	}
+
+	rec := &record{
+		outcome:      Pending,
+		coordinator:  req.Coordinator,
+		participants: req.Participants,
+		stamp:        req.Stamp,
+		intents:      make(map[string][]byte),
+		since:        t.now(),
+	}
+
+	v := vote{Yes: true}
+	reads := make(map[string]read)
+	for _, op := range req.Ops {
+		if _, held := t.locks[op.Key]; held {
+			v = vote{Reason: ReasonConflict, Key: op.Key}
+			break
+		}
+
+		current, exists := t.load(op.Key)
+		if _, ok := reads[op.Key]; !ok {
+			reads[op.Key] = read{Value: current, Exists: exists}
+		}
+		if next, ok := rec.intents[op.Key]; ok {
+			current, exists = next, true
+		}
+
+		next, write, ok := t.eval(op.Spec, current, exists)
+		if !ok {
+			v = vote{Reason: ReasonCondition, Key: op.Key}
+			break
+		}
+		if write {
+			rec.intents[op.Key] = next
+		}
+	}
+	v.Reads = reads
+
+	if !v.Yes {
+		t.stats.Inc("txn_votes_no")
+		rec.outcome, rec.intents = Aborted, nil
+		t.records[req.ID] = rec
+		return json.Marshal(v)
+	}
+
+	for _, op := range req.Ops {
+		t.locks[op.Key] = req.ID
+		rec.keys = append(rec.keys, op.Key)
+	}
+	t.records[req.ID] = rec
+	t.stats.Inc("txn_votes_yes")
+	return json.Marshal(v)
+}
+
+// HandleDecide -> apply the intents of a committed transaction, or drop those of an
+// aborted one, and release its keys
+func (t *Manager) HandleDecide(payload []byte) ([]byte, error) {
+	var req decideRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	return nil, t.settle(req.ID, req.Outcome)
+}
+
+// HandleStatus -> the outcome of a transaction as far as we know it. A transaction
+// we never heard of can no longer commit without us, it is aborted.
+func (t *Manager) HandleStatus(payload []byte) ([]byte, error) {
+	var req statusRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if d, ok := t.decisions[req.ID]; ok {
+		return json.Marshal(statusReply{Outcome: d.outcome})
+	}
+	if rec, ok := t.records[req.ID]; ok {
+		return json.Marshal(statusReply{Outcome: rec.outcome, Presumed: rec.presumed})
+	}
+
+	t.records[req.ID] = &record{outcome: Aborted, presumed: true, since: t.now()}
+	return json.Marshal(statusReply{Outcome: Aborted, Presumed: true})
+}
+
+// settle -> record the outcome of a transaction we take part in, the caller must hold
+// the lock
+func (t *Manager) settle(id, outcome string) error {
+	rec, ok := t.records[id]
+	if !ok {
+		if outcome == Committed {
+			return fmt.Errorf("transaction %s committed without our vote", id)
+		}
+		t.records[id] = &record{outcome: Aborted, since: t.now()}
+		return nil
+	}
+	if rec.outcome != Pending {
+		return nil
+	}
+
+	if outcome == Committed {
+		for key, value := range rec.intents {
+			if err := t.store(key, value, rec.stamp); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, key := range rec.keys {
+		delete(t.locks, key)
+	}
+	rec.outcome, rec.keys, rec.intents, rec.since = outcome, nil, nil, t.now()
+	return nil
+}
+
+// Resolve -> settle the transactions whose intents have been held for longer than
+// the timeout. The coordinator is asked for the decision and, when it can not be
+// reached or no longer knows it, the other participants. The intents stay held
+// while every participant is prepared and the coordinator is unreachable. Decided
+// transactions are forgotten once they are old enough.
+func (t *Manager) Resolve(deadline time.Time) {
+	type stale struct {
+		id           string
+		coordinator  string
+		participants []string
+	}
+
+	t.m.Lock()
+	now := t.now()
+	var pending []stale
+	for id, rec := range t.records {
+		switch {
+		case rec.outcome == Pending && now.Sub(rec.since) >= t.timeout:
+			pending = append(pending, stale{id: id, coordinator: rec.coordinator, participants: rec.participants})
+		case rec.outcome != Pending && now.Sub(rec.since) >= retention*t.timeout:
+			delete(t.records, id)
+		}
+	}
+	for id, d := range t.decisions {
+		if d.outcome != Pending && now.Sub(d.since) >= retention*t.timeout {
+			delete(t.decisions, id)
+		}
+	}
+	t.m.Unlock()
+
+	for _, s := range pending {
+		outcome := t.ask(s.id, s.coordinator, s.participants, deadline)
+		if outcome == Pending {
+			t.stats.Inc("txn_blocked")
+			continue
+		}
+
+		t.m.Lock()
+		err := t.settle(s.id, outcome)
+		t.m.Unlock()
+		if err != nil {
+			continue
+		}
+		t.stats.Inc("txn_recovered_" + outcome)
+	}
+}
+
+// ask -> the outcome of the transaction according to its coordinator, or to the
+// other participants when the coordinator can not be reached or lost its decision,
+// say after a restart. A participant that committed settles it over one that
+// aborted. When the coordinator lost its decision and every other participant is
+// still prepared, nobody can commit it any more and it is aborted.
+func (t *Manager) ask(id, coordinator string, participants []string, deadline time.Time) string {
+	payload, _ := json.Marshal(statusRequest{ID: id})
+
+	status := func(peer string) (statusReply, bool) {
+		var out []byte
+		var err error
+		if peer == t.id {
+			out, err = t.HandleStatus(payload)
+		} else {
+			out, err = t.call(peer, ActionStatus, payload, deadline)
+		}
+
+		var reply statusReply
+		if err != nil || json.Unmarshal(out, &reply) != nil {
+			return reply, false
+		}
+		return reply, true
+	}
+
+	reply, forgotten := status(coordinator)
+	if forgotten && !reply.Presumed {
+		return reply.Outcome
+	}
+
+	outcome, answered := Pending, true
+	for _, participant := range participants {
+		if participant == t.id || participant == coordinator {
+			continue
+		}
+
+		reply, ok := status(participant)
+		switch {
+		case !ok:
+			answered = false
+		case reply.Outcome == Committed:
+			return Committed
+		case reply.Outcome == Aborted:
+			outcome = Aborted
+		}
+	}
+
+	if outcome == Pending && forgotten && answered {
+		return Aborted
+	}
+	return outcome
+}
@@ -0,0 +1,264 @@
+package txn
+
+import (
+	"encoding/json"
+	stats "kv-store/SystemServices/Stats"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Message actions exchanged between the coordinator and the participants of a
+// transaction
+const (
+	ActionPrepare = "txn_prepare"
+	ActionDecide  = "txn_decide"
+	ActionStatus  = "txn_status"
+)
+
+// DefaultTimeout -> how long a participant holds the intents of a prepared
+// transaction before asking for its decision
+const DefaultTimeout = 5 * time.Second
+
+// DefaultDecideTimeout -> how long the coordinator waits for participants to take
+// the decision, counted from when it is taken rather than from the prepare
+const DefaultDecideTimeout = 2 * time.Second
+
+// Outcomes of a transaction
+const (
+	Pending   = "pending"
+	Committed = "committed"
+	Aborted   = "aborted"
+)
+
+// Reasons a transaction aborted
+const (
+	// ReasonCondition -> a check did not hold, or a value could not be incremented
+	ReasonCondition = "condition"
+
+	// ReasonConflict -> another transaction holds an intent on a key
+	ReasonConflict = "conflict"
+
+	// ReasonUnavailable -> a participant did not vote before the deadline
+	ReasonUnavailable = "unavailable"
+
+	// ReasonDiverged -> the replicas of a key read different values for it
+	ReasonDiverged = "diverged"
+)
+
+// retention -> how many timeouts decided transactions are remembered for, so late
+// messages and participants asking for the decision are answered
+const retention = 10
+
+// Caller -> send an action to a participant and return its reply
+type Caller func(peer, action string, payload []byte, deadline time.Time) ([]byte, error)
+
+// Loader -> read the stored value of a key, returning false when it is missing
+type Loader func(key string) ([]byte, bool)
+
+// Storer -> store the value written by a committed transaction, with the timestamp
+// the coordinator gave the transaction
+type Storer func(key string, value []byte, stamp string) error
+
+// Evaluator -> evaluate an operation against the current value of its key, returning
+// the value to write, whether to write it and false when the transaction must abort
+type Evaluator func(spec []byte, current []byte, exists bool) (next []byte, write bool, ok bool)
+
+// Op -> an operation of a transaction on one key, its Spec is interpreted by the
+// Evaluator of the participants
+type Op struct {
+	Key  string
+	Spec []byte
+}
+
+// Result -> whether the transaction committed, and why it aborted when it did not
+type Result struct {
+	ID        string
+	Committed bool
+	Reason    string
+	Key       string
+}
+
+// Manager -> coordinates the transactions received by this node and takes part in
+// the transactions on the keys it holds
+type Manager struct {
+	m         *sync.Mutex
+	id        string
+	call      Caller
+	load      Loader
+	store     Storer
+	eval      Evaluator
+	stats     *stats.Counters
+	timeout   time.Duration
+	decideFor time.Duration
+	seq       uint64
+	decisions map[string]*decision // transactions we coordinate
+	records   map[string]*record   // transactions we take part in
+	locks     map[string]string    // id of the transaction holding an intent on each key
+	now       func() time.Time
+}
+
+// decision -> the outcome of a transaction we coordinate
+type decision struct {
+	outcome string
+	since   time.Time
+}
+
+// New -> construct the transaction manager of the node id
+func New(id string, call Caller, load Loader, store Storer, eval Evaluator, s *stats.Counters) *Manager {
+	return &Manager{
+		m:         &sync.Mutex{},
+		id:        id,
+		call:      call,
+		load:      load,
+		store:     store,
+		eval:      eval,
+		stats:     s,
+		timeout:   DefaultTimeout,
+		decideFor: DefaultDecideTimeout,
+		decisions: make(map[string]*decision),
+		records:   make(map[string]*record),
+		locks:     make(map[string]string),
+		now:       time.Now,
+	}
+}
+
+// UseTimeout -> set how long intents are held before participants ask for the
+// decision, it should be well above the write deadline of the coordinator
+func (t *Manager) UseTimeout(timeout time.Duration) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.timeout = timeout
+}
+
+// UseDecideTimeout -> set how long the coordinator waits for participants to take
+// the decision of a transaction
+func (t *Manager) UseDecideTimeout(timeout time.Duration) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.decideFor = timeout
+}
+
+// Run -> atomically apply the operations, grouped by the participants holding their
+// keys. Every participant evaluates its operations and holds intents on their keys,
+// the transaction commits only when all of them voted yes before the deadline and
+// the participants holding the same key read the same value for it, so they write
+// the same values. Every participant stores them with the stamp. Participants
+// missing the decision learn it once their intents time out.
+func (t *Manager) Run(ops map[string][]Op, stamp string, deadline time.Time) Result {
+	t.stats.Inc("txn_started")
+
+	var participants []string
+	for participant := range ops {
+		participants = append(participants, participant)
+	}
+	sort.Strings(participants)
+
+	t.m.Lock()
+	t.seq++
+	id := t.id + "-" + strconv.FormatInt(t.now().UnixNano(), 10) + "-" + strconv.FormatUint(t.seq, 10)
+	t.decisions[id] = &decision{outcome: Pending, since: t.now()}
+	t.m.Unlock()
+
+	result := Result{ID: id, Committed: true}
+	reads := make(map[string]read)
+	diverged := ""
+	t.broadcast(participants, ActionPrepare, deadline, func(participant string) interface{} {
+		return prepareRequest{ID: id, Coordinator: t.id, Participants: participants, Stamp: stamp, Ops: ops[participant]}
+	}, func(out []byte, err error) {
+		var v vote
+		if err == nil {
+			err = json.Unmarshal(out, &v)
+		}
+		if err != nil {
+			v = vote{Reason: ReasonUnavailable}
+		}
+		if !v.Yes && (result.Committed || rank[v.Reason] > rank[result.Reason]) {
+			result.Committed, result.Reason, result.Key = false, v.Reason, v.Key
+		}
+
+		for key, r := range v.Reads {
+			first, ok := reads[key]
+			if !ok {
+				reads[key] = r
+			} else if diverged == "" && !first.equal(r) {
+				diverged = key
+			}
+		}
+	})
+
+	// a check or a write evaluated against diverging replicas does not hold for the
+	// key, whatever the replicas voted
+	if diverged != "" {
+		result.Committed, result.Reason, result.Key = false, ReasonDiverged, diverged
+	}
+
+	outcome := Aborted
+	if result.Committed {
+		outcome = Committed
+	}
+	decideBy := t.decide(id, outcome)
+
+	// the decision gets its own deadline, the prepare may have used up the one the
+	// transaction was given. Participants that miss it ask for it once their intents
+	// time out.
+	t.broadcast(participants, ActionDecide, decideBy, func(string) interface{} {
+		return decideRequest{ID: id, Outcome: outcome}
+	}, func([]byte, error) {})
+
+	if result.Committed {
+		t.stats.Inc("txn_committed")
+	} else {
+		t.stats.Inc("txn_aborted")
+		t.stats.Inc("txn_aborted_" + result.Reason)
+	}
+	return result
+}
+
+// rank -> the reason reported when participants vote no for different reasons, the
+// most useful to the client first
+var rank = map[string]int{
+	ReasonUnavailable: 1,
+	ReasonConflict:    2,
+	ReasonCondition:   3,
+}
+
+// decide -> record the outcome of a transaction we coordinate, participants asking
+// for it are answered from now on. Returns the deadline for sending it to them.
+func (t *Manager) decide(id, outcome string) time.Time {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	now := t.now()
+	t.decisions[id] = &decision{outcome: outcome, since: now}
+	return now.Add(t.decideFor)
+}
+
+// broadcast -> send each participant its request, built by request, and hand every
+// reply to answer. Returns once every participant has replied.
+func (t *Manager) broadcast(participants []string, action string, deadline time.Time, request func(participant string) interface{}, answer func(out []byte, err error)) {
+	type reply struct {
+		out []byte
+		err error
+	}
+	replies := make(chan reply, len(participants))
+
+	for _, participant := range participants {
+		payload, _ := json.Marshal(request(participant))
+		go func(participant string) {
+			var r reply
+			if participant == t.id {
+				r.out, r.err = t.Handle(action, payload)
+			} else {
+				r.out, r.err = t.call(participant, action, payload, deadline)
+			}
+			replies <- r
+		}(participant)
+	}
+
+	for range participants {
+		r := <-replies
+		answer(r.out, r.err)
+	}
+}
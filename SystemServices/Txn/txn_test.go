@@ -0,0 +1,346 @@
+package txn
+
+import (
+	"encoding/json"
+	"fmt"
+	stats "kv-store/SystemServices/Stats"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testGroup -> participants calling each other directly, each storing into its own
+// map along with the stamps of the values. Participants may be cut off from the rest
+// of the group.
+type testGroup struct {
+	m       *sync.Mutex
+	members map[string]*Manager
+	stored  map[string]map[string]string
+	stamps  map[string]map[string]string
+	cut     map[string]bool
+	decided []time.Time // deadlines of the decisions sent
+}
+
+func newTestGroup(ids ...string) *testGroup {
+	g := &testGroup{
+		m:       &sync.Mutex{},
+		members: make(map[string]*Manager),
+		stored:  make(map[string]map[string]string),
+		stamps:  make(map[string]map[string]string),
+		cut:     make(map[string]bool),
+	}
+
+	for _, id := range ids {
+		id := id
+		g.stored[id] = make(map[string]string)
+		g.stamps[id] = make(map[string]string)
+
+		load := func(key string) ([]byte, bool) {
+			g.m.Lock()
+			defer g.m.Unlock()
+			val, ok := g.stored[id][key]
+			return []byte(val), ok
+		}
+		store := func(key string, value []byte, stamp string) error {
+			g.m.Lock()
+			defer g.m.Unlock()
+			g.stored[id][key] = string(value)
+			g.stamps[id][key] = stamp
+			return nil
+		}
+
+		g.members[id] = New(id, g.caller(id), load, store, evaluate, stats.New())
+		g.members[id].UseTimeout(time.Second)
+	}
+	return g
+}
+
+func (g *testGroup) caller(from string) Caller {
+	return func(peer, action string, payload []byte, deadline time.Time) ([]byte, error) {
+		g.m.Lock()
+		cut := g.cut[from] || g.cut[peer]
+		t := g.members[peer]
+		g.m.Unlock()
+
+		if cut {
+			return nil, fmt.Errorf("%v can not reach %v", from, peer)
+		}
+		if action == ActionDecide {
+			g.m.Lock()
+			g.decided = append(g.decided, deadline)
+			g.m.Unlock()
+		}
+		return t.Handle(action, payload)
+	}
+}
+
+func (g *testGroup) setCut(id string, cut bool) {
+	g.m.Lock()
+	defer g.m.Unlock()
+	g.cut[id] = cut
+}
+
+func (g *testGroup) value(id, key string) string {
+	g.m.Lock()
+	defer g.m.Unlock()
+	return g.stored[id][key]
+}
+
+func (g *testGroup) stamp(id, key string) string {
+	g.m.Lock()
+	defer g.m.Unlock()
+	return g.stamps[id][key]
+}
+
+// evaluate -> "set:v" writes v, "add:n" adds n to an integer that may not drop below
+// zero and "missing" requires the key to be missing
+func evaluate(spec []byte, current []byte, exists bool) ([]byte, bool, bool) {
+	op := strings.SplitN(string(spec), ":", 2)
+	switch op[0] {
+	case "set":
+		return []byte(op[1]), true, true
+	case "add":
+		n, _ := strconv.Atoi(string(current))
+		delta, _ := strconv.Atoi(op[1])
+		if n+delta < 0 {
+			return nil, false, false
+		}
+		return []byte(strconv.Itoa(n + delta)), true, true
+	}
+	return nil, false, !exists
+}
+
+// ops -> the operations of a transaction on key a, held by n1 and n2, and key b,
+// held by n3 and n4
+func ops(a, b string) map[string][]Op {
+	ops := make(map[string][]Op)
+	if a != "" {
+		ops["n1"] = []Op{{Key: "a", Spec: []byte(a)}}
+		ops["n2"] = []Op{{Key: "a", Spec: []byte(a)}}
+	}
+	if b != "" {
+		ops["n3"] = []Op{{Key: "b", Spec: []byte(b)}}
+		ops["n4"] = []Op{{Key: "b", Spec: []byte(b)}}
+	}
+	return ops
+}
+
+func TestRun(t *testing.T) {
+	g := newTestGroup("n1", "n2", "n3", "n4", "n5")
+
+	scenarios := []struct {
+		a, b      string
+		committed bool
+		reason    string
+		key       string
+		valueA    string
+		valueB    string
+	}{
+		{a: "set:100", b: "set:0", committed: true, valueA: "100", valueB: "0"},
+		{a: "add:-30", b: "add:30", committed: true, valueA: "70", valueB: "30"},
+		// the balance can not drop below zero, neither key is written
+		{a: "add:-100", b: "add:100", reason: ReasonCondition, key: "a", valueA: "70", valueB: "30"},
+		{a: "set:0", b: "missing", reason: ReasonCondition, key: "b", valueA: "70", valueB: "30"},
+	}
+
+	// the coordinator does not hold any of the keys
+	for i, s := range scenarios {
+		stamp := "stamp" + strconv.Itoa(i)
+		result := g.members["n5"].Run(ops(s.a, s.b), stamp, time.Now().Add(time.Second))
+		if result.Committed != s.committed || result.Reason != s.reason || result.Key != s.key {
+			t.Errorf("Scenario %d: expected committed %v (%q %q), got %+v", i, s.committed, s.reason, s.key, result)
+		}
+
+		for _, id := range []string{"n1", "n2"} {
+			if got := g.value(id, "a"); got != s.valueA {
+				t.Errorf("Scenario %d: expected a=%q on %v, got %q", i, s.valueA, id, got)
+			}
+			if got := g.stamp(id, "a"); s.committed && got != stamp {
+				t.Errorf("Scenario %d: expected a stamped %q on %v, got %q", i, stamp, id, got)
+			}
+		}
+		for _, id := range []string{"n3", "n4"} {
+			if got := g.value(id, "b"); got != s.valueB {
+				t.Errorf("Scenario %d: expected b=%q on %v, got %q", i, s.valueB, id, got)
+			}
+		}
+	}
+}
+
+func TestDecideDeadline(t *testing.T) {
+	g := newTestGroup("n1", "n2", "n3", "n4", "n5")
+	g.members["n5"].UseDecideTimeout(time.Minute)
+
+	// the prepare used up the deadline of the transaction, the decision is still sent
+	// with time to spare
+	start := time.Now()
+	if result := g.members["n5"].Run(ops("set:1", "set:1"), "stamp", start.Add(time.Millisecond)); !result.Committed {
+		t.Fatalf("Expected the transaction to commit, got %+v", result)
+	}
+
+	if len(g.decided) != 4 {
+		t.Fatalf("Expected the decision sent to 4 participants, got %d", len(g.decided))
+	}
+	for _, deadline := range g.decided {
+		if deadline.Before(start.Add(time.Minute)) {
+			t.Errorf("Expected the decision deadline a minute out, got %v", deadline.Sub(start))
+		}
+	}
+}
+
+func TestDiverged(t *testing.T) {
+	g := newTestGroup("n1", "n2", "n3", "n4")
+	deadline := time.Now().Add(time.Second)
+
+	// the replicas of a missed a write, adding to it would write different values
+	g.stored["n1"]["a"] = "10"
+	g.stored["n2"]["a"] = "20"
+
+	scenarios := []struct {
+		a, b string
+	}{
+		{a: "add:1", b: "set:1"},
+		// a check holding on both replicas does not hold for the key either
+		{a: "add:0", b: "set:1"},
+	}
+
+	for i, s := range scenarios {
+		result := g.members["n3"].Run(ops(s.a, s.b), "stamp", deadline)
+		if result.Committed || result.Reason != ReasonDiverged || result.Key != "a" {
+			t.Errorf("Scenario %d: expected the replicas of a to diverge, got %+v", i, result)
+		}
+		if g.value("n1", "a") != "10" || g.value("n2", "a") != "20" || g.value("n3", "b") != "" {
+			t.Errorf("Scenario %d: expected nothing written", i)
+		}
+	}
+
+	// once the replicas agree the transaction commits
+	g.stored["n1"]["a"] = "20"
+	if result := g.members["n3"].Run(ops("add:1", "set:1"), "stamp", deadline); !result.Committed {
+		t.Errorf("Expected the transaction to commit, got %+v", result)
+	}
+	for _, id := range []string{"n1", "n2"} {
+		if got := g.value(id, "a"); got != "21" {
+			t.Errorf("Expected a=21 on %v, got %q", id, got)
+		}
+	}
+}
+
+func TestConflict(t *testing.T) {
+	g := newTestGroup("n1", "n2", "n3", "n4")
+	deadline := time.Now().Add(time.Second)
+
+	// another transaction holds an intent on a
+	prepare, _ := json.Marshal(prepareRequest{ID: "other", Coordinator: "n4", Participants: []string{"n1"}, Ops: []Op{{Key: "a", Spec: []byte("set:1")}}})
+	if _, err := g.members["n1"].HandlePrepare(prepare); err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+
+	result := g.members["n3"].Run(ops("set:2", "set:2"), "stamp", deadline)
+	if result.Committed || result.Reason != ReasonConflict || result.Key != "a" {
+		t.Errorf("Expected a conflict on a, got %+v", result)
+	}
+
+	// the intents of the aborted transaction were released, b is free
+	if result := g.members["n3"].Run(ops("", "set:3"), "stamp", deadline); !result.Committed {
+		t.Errorf("Expected b to be released, got %+v", result)
+	}
+
+	decide, _ := json.Marshal(decideRequest{ID: "other", Outcome: Aborted})
+	g.members["n1"].HandleDecide(decide)
+	if result := g.members["n3"].Run(ops("set:4", ""), "stamp", deadline); !result.Committed || g.value("n1", "a") != "4" {
+		t.Errorf("Expected a to be released, got %+v with a=%q", result, g.value("n1", "a"))
+	}
+}
+
+func TestUnavailable(t *testing.T) {
+	g := newTestGroup("n1", "n2", "n3", "n4")
+
+	g.setCut("n4", true)
+	result := g.members["n1"].Run(ops("set:1", "set:1"), "stamp", time.Now().Add(time.Second))
+	if result.Committed || result.Reason != ReasonUnavailable {
+		t.Errorf("Expected the transaction to abort, got %+v", result)
+	}
+	if got := g.value("n1", "a"); got != "" {
+		t.Errorf("Expected a to be left unwritten, got %q", got)
+	}
+
+	g.setCut("n4", false)
+	if result := g.members["n1"].Run(ops("set:2", "set:2"), "stamp", time.Now().Add(time.Second)); !result.Committed {
+		t.Errorf("Expected the intents of the aborted transaction to be released, got %+v", result)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	scenarios := []struct {
+		decided   string // outcome recorded by the coordinator n5, unreachable when empty
+		restarted bool   // n5 is reachable but lost its decision
+		prepared  []string
+		committed []string // participants that received the decision
+		value     string
+		blocked   bool
+	}{
+		{decided: Committed, prepared: []string{"n1", "n3"}, value: "1"},
+		{decided: Aborted, prepared: []string{"n1", "n3"}},
+		// the coordinator is gone, the participants settle it among themselves
+		{prepared: []string{"n1", "n3"}, committed: []string{"n3"}, value: "1"},
+		{prepared: []string{"n1"}},
+		{prepared: []string{"n1", "n3"}, blocked: true},
+		// the coordinator lost its decision, a participant that committed settles it
+		{restarted: true, prepared: []string{"n1", "n3"}, committed: []string{"n3"}, value: "1"},
+		// and when none did nobody can commit it any more
+		{restarted: true, prepared: []string{"n1", "n3"}},
+	}
+
+	for i, s := range scenarios {
+		g := newTestGroup("n1", "n3", "n5")
+		id := "txn" + strconv.Itoa(i)
+		participants := []string{"n1", "n3"}
+
+		for _, p := range s.prepared {
+			prepare, _ := json.Marshal(prepareRequest{ID: id, Coordinator: "n5", Participants: participants, Ops: []Op{{Key: p, Spec: []byte("set:1")}}})
+			g.members[p].HandlePrepare(prepare)
+		}
+		for _, p := range s.committed {
+			decide, _ := json.Marshal(decideRequest{ID: id, Outcome: Committed})
+			g.members[p].HandleDecide(decide)
+		}
+		switch {
+		case s.decided != "":
+			g.members["n5"].decide(id, s.decided)
+		case !s.restarted:
+			g.setCut("n5", true)
+		}
+
+		// nothing is asked before the intents time out
+		n1 := g.members["n1"]
+		n1.Resolve(time.Now().Add(time.Second))
+		if _, held := n1.locks["n1"]; !held {
+			t.Fatalf("Scenario %d: expected the intent to be held until it times out", i)
+		}
+
+		n1.now = func() time.Time { return time.Now().Add(time.Minute) }
+		n1.Resolve(time.Now().Add(time.Second))
+
+		if _, held := n1.locks["n1"]; held != s.blocked {
+			t.Errorf("Scenario %d: expected the intent held %v", i, s.blocked)
+		}
+		if got := g.value("n1", "n1"); got != s.value {
+			t.Errorf("Scenario %d: expected %q written, got %q", i, s.value, got)
+		}
+
+		// a participant asked about a transaction before its prepare arrived votes no
+		if len(s.prepared) == 1 {
+			prepare, _ := json.Marshal(prepareRequest{ID: id, Coordinator: "n5", Participants: participants, Ops: []Op{{Key: "n3", Spec: []byte("set:1")}}})
+			out, _ := g.members["n3"].HandlePrepare(prepare)
+
+			var v vote
+			json.Unmarshal(out, &v)
+			if v.Yes {
+				t.Errorf("Scenario %d: expected a late prepare to be refused", i)
+			}
+		}
+	}
+}
@@ -33,10 +33,16 @@ func main() {
 	// register client http endpoints
 	clientServices.SetupRoutes(basePath, node)
 
-	// start listening to client requests
+	// start listening to client requests, over https when a certificate is provided
 	listenAddr := (":" + strconv.Itoa(node.Port))
 	fmt.Println("Using port:", node.Port)
-	err := http.ListenAndServe(listenAddr, nil)
+
+	var err error
+	if certFile, keyFile := node.ClientCert(); certFile != "" {
+		err = http.ListenAndServeTLS(listenAddr, certFile, keyFile, nil)
+	} else {
+		err = http.ListenAndServe(listenAddr, nil)
+	}
 	errorHandler(err, debug)
 
 }